@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// QEMU guest agent, see services.qemuGuest in base.nix
+
+const agentTimeoutDefault = -1
+
+type agentRequest struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+}
+
+type agentResponse struct {
+	Return json.RawMessage `json:"return"`
+	Error  *struct {
+		Class string `json:"class"`
+		Desc  string `json:"desc"`
+	} `json:"error"`
+}
+
+func agentCommand(l *libvirt.Libvirt, dom libvirt.Domain,
+	execute string, args, result interface{}) (err error) {
+
+	req, err := json.Marshal(agentRequest{Execute: execute, Arguments: args})
+	if err != nil {
+		return
+	}
+
+	out, err := l.QEMUDomainAgentCommand(dom, string(req),
+		agentTimeoutDefault, 0)
+	if err != nil {
+		return
+	}
+	if len(out) == 0 {
+		err = errors.New("empty response from guest agent")
+		return
+	}
+
+	var resp agentResponse
+	err = json.Unmarshal([]byte(out[0]), &resp)
+	if err != nil {
+		return
+	}
+	if resp.Error != nil {
+		err = errors.New(execute + ": " + resp.Error.Desc)
+		return
+	}
+
+	if result != nil {
+		err = json.Unmarshal(resp.Return, result)
+	}
+	return
+}
+
+func guestFileRead(l *libvirt.Libvirt, dom libvirt.Domain,
+	path string) (data []byte, err error) {
+
+	var handle int
+	err = agentCommand(l, dom, "guest-file-open",
+		map[string]string{"path": path, "mode": "r"}, &handle)
+	if err != nil {
+		return
+	}
+	defer agentCommand(l, dom, "guest-file-close",
+		map[string]int{"handle": handle}, nil)
+
+	for {
+		var chunk struct {
+			Count int    `json:"count"`
+			Buf   string `json:"buf-b64"`
+			EOF   bool   `json:"eof"`
+		}
+		err = agentCommand(l, dom, "guest-file-read",
+			map[string]int{"handle": handle, "count": 1 << 20},
+			&chunk)
+		if err != nil {
+			return
+		}
+
+		var b []byte
+		b, err = base64.StdEncoding.DecodeString(chunk.Buf)
+		if err != nil {
+			return
+		}
+		data = append(data, b...)
+
+		if chunk.EOF || chunk.Count == 0 {
+			return
+		}
+	}
+}
+
+type guestExecResult struct {
+	ExitCode int    `json:"exitcode"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+}
+
+// Guest commands that do not exit in time are killed, watchers of the
+// daemon must not hang on a stuck guest
+const guestExecTimeoutDefault = 30 * time.Second
+
+func guestExec(l *libvirt.Libvirt, dom libvirt.Domain, path string,
+	args ...string) (result guestExecResult, err error) {
+
+	return guestExecInput(l, dom, nil, path, args...)
+}
+
+// Input is given to the command on stdin
+func guestExecInput(l *libvirt.Libvirt, dom libvirt.Domain, input []byte,
+	path string, args ...string) (result guestExecResult, err error) {
+
+	return guestExecTimeout(l, dom, guestExecTimeoutDefault, input,
+		path, args...)
+}
+
+func guestExecTimeout(l *libvirt.Libvirt, dom libvirt.Domain,
+	timeout time.Duration, input []byte, path string, args ...string) (
+	result guestExecResult, err error) {
+
+	req := map[string]interface{}{
+		"path":           path,
+		"arg":            args,
+		"capture-output": true,
+	}
+	if input != nil {
+		req["input-data"] = base64.StdEncoding.EncodeToString(input)
+	}
+
+	var pid struct {
+		Pid int `json:"pid"`
+	}
+	err = agentCommand(l, dom, "guest-exec", req, &pid)
+	if err != nil {
+		return
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		var status struct {
+			Exited   bool   `json:"exited"`
+			ExitCode int    `json:"exitcode"`
+			OutData  string `json:"out-data"`
+			ErrData  string `json:"err-data"`
+		}
+		err = agentCommand(l, dom, "guest-exec-status",
+			map[string]int{"pid": pid.Pid}, &status)
+		if err != nil {
+			return
+		}
+
+		if !status.Exited {
+			if time.Now().After(deadline) {
+				killGuestProcess(l, dom, pid.Pid)
+				err = fmt.Errorf("%s timed out after %s", path, timeout)
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		var stdout, stderr []byte
+		stdout, err = base64.StdEncoding.DecodeString(status.OutData)
+		if err != nil {
+			return
+		}
+		stderr, err = base64.StdEncoding.DecodeString(status.ErrData)
+		if err != nil {
+			return
+		}
+
+		result = guestExecResult{status.ExitCode, string(stdout),
+			string(stderr)}
+		return
+	}
+}
+
+// The guest agent has no command to kill processes it started
+func killGuestProcess(l *libvirt.Libvirt, dom libvirt.Domain, pid int) {
+	err := agentCommand(l, dom, "guest-exec", map[string]interface{}{
+		"path": guestBin + "kill",
+		"arg":  []string{"-s", "KILL", strconv.Itoa(pid)},
+	}, nil)
+	if err != nil {
+		log.Println("Can't kill guest process", pid, err)
+	}
+}
+
+func guestAgentReady(l *libvirt.Libvirt, dom libvirt.Domain) bool {
+	return agentCommand(l, dom, "guest-ping", nil, nil) == nil
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// REST API of appvm daemon, every request must have
+// "Authorization: Bearer <token>" header with the token from
+// ~/.config/appvm/api.token. It listens on a unix socket or on loopback,
+// other addresses require TLS, see apiListener.
+//
+//	GET  /api/v1/vms                list application VMs
+//	POST /api/v1/vms/<name>/start   start in background
+//	POST /api/v1/vms/<name>/stop
+//	POST /api/v1/vms/<name>/exec    run command by guest agent
+//	GET  /api/v1/vms/<name>/log     output of the last start and build
+//	GET  /api/v1/vms/<name>/stats   resource usage, see appvm stats
+//	GET  /api/v1/events             lifecycle events (server-sent events)
+//	GET  /api/v1/builds             in-flight builds
+
+type apiVM struct {
+	Name        string `json:"name"`
+	Running     bool   `json:"running"`
+	Description string `json:"description"`
+}
+
+type apiEvent struct {
+	Time   int64  `json:"time"`
+	Name   string `json:"name"`
+	Event  string `json:"event"`
+	Detail int32  `json:"detail"`
+}
+
+var lifecycleEventNames = []string{"defined", "undefined", "started",
+	"suspended", "resumed", "stopped", "shutdown", "pmsuspended",
+	"crashed"}
+
+var (
+	eventPublish     = make(chan apiEvent)
+	eventSubscribe   = make(chan chan apiEvent)
+	eventUnsubscribe = make(chan chan apiEvent)
+)
+
+func eventHub() {
+	subscribers := make(map[chan apiEvent]bool)
+	for {
+		select {
+		case c := <-eventSubscribe:
+			subscribers[c] = true
+		case c := <-eventUnsubscribe:
+			delete(subscribers, c)
+		case e := <-eventPublish:
+			for c := range subscribers {
+				select {
+				case c <- e:
+				default: // slow client
+				}
+			}
+		}
+	}
+}
+
+// Start requests for the application that is already being started
+// are attached to the existing one (same log)
+type startRequest struct {
+	Name  string
+	Reply chan bool // true if no start is in progress
+}
+
+var (
+	startBegin = make(chan startRequest)
+	startEnd   = make(chan string)
+)
+
+func startRegistry() {
+	starting := make(map[string]bool)
+	for {
+		select {
+		case r := <-startBegin:
+			r.Reply <- !starting[r.Name]
+			starting[r.Name] = true
+		case name := <-startEnd:
+			delete(starting, name)
+		}
+	}
+}
+
+func beginStart(name string) bool {
+	reply := make(chan bool)
+	startBegin <- startRequest{name, reply}
+	return <-reply
+}
+
+// Of domains of the user only, see watchLifecycle
+func publishLifecycleEvent(e libvirt.DomainEventLifecycleMsg) {
+	name := "unknown"
+	if int(e.Event) < len(lifecycleEventNames) {
+		name = lifecycleEventNames[e.Event]
+	}
+
+	eventPublish <- apiEvent{
+		Time:   time.Now().Unix(),
+		Name:   e.Dom.Name[6:],
+		Event:  name,
+		Detail: e.Detail,
+	}
+}
+
+func apiTokenPath() string {
+	return configDir + "api.token"
+}
+
+// Empty token file is replaced, empty token would match requests
+// without token
+func apiToken() (token string, err error) {
+	raw, err := ioutil.ReadFile(apiTokenPath())
+	if err == nil {
+		token = strings.TrimSpace(string(raw))
+		if token != "" {
+			return
+		}
+		log.Println(apiTokenPath(), "is empty, generating new token")
+	}
+
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return
+	}
+
+	token = hex.EncodeToString(b)
+	err = ioutil.WriteFile(apiTokenPath(), []byte(token+"\n"), 0600)
+	return
+}
+
+func startLogPath(id string) string {
+	return appvmHomesDir + "." + id + ".start.log"
+}
+
+type api struct {
+	l     *libvirt.Libvirt
+	token string
+}
+
+// Only the header, query strings end up in logs and history
+func (a api) authorized(r *http.Request) bool {
+	h := r.Header.Get("Authorization")
+	return tokenMatches(a.token, strings.TrimPrefix(h, "Bearer "))
+}
+
+func tokenMatches(token, given string) bool {
+	return token != "" &&
+		subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// Error of the API call with its HTTP status, mapped to gRPC codes by
+// grpc.go
+type apiError struct {
+	Code int
+	Err  error
+}
+
+func (e apiError) Error() string {
+	return e.Err.Error()
+}
+
+func apiErr(code int, err error) error {
+	return apiError{code, err}
+}
+
+func errorCode(err error) int {
+	var e apiError
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return http.StatusInternalServerError
+}
+
+func writeResult(w http.ResponseWriter, code int, v interface{}, err error) {
+	if err != nil {
+		writeError(w, errorCode(err), err)
+		return
+	}
+	writeJSON(w, code, v)
+}
+
+// Of lookupOwned errors
+func lookupStatus(err error) int {
+	if libvirt.IsNotFound(err) {
+		return http.StatusNotFound
+	}
+	return http.StatusForbidden
+}
+
+// Calls of the API, served by REST handlers below and by grpc.go
+
+func (a api) listVMs() (vms []apiVM, err error) {
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+
+	running := runningApps(a.l)
+
+	vms = []apiVM{}
+	for _, name := range appNames() {
+		vms = append(vms, apiVM{
+			Name:        name,
+			Running:     running["appvm_"+name],
+			Description: appDescription(name, config.app(name)),
+		})
+	}
+	return
+}
+
+func apiBuilds() []buildInfo {
+	builds := inflightBuilds()
+	if builds == nil {
+		builds = []buildInfo{}
+	}
+	return builds
+}
+
+type startOptions struct {
+	Network string `json:"network"`
+	CLI     bool   `json:"cli"`
+}
+
+func (a api) startVM(name string, opts startOptions) (
+	status map[string]string, err error) {
+
+	if !beginStart(name) {
+		return map[string]string{"status": "attached"}, nil
+	}
+
+	args := []string{"start", name, "--quiet"}
+	if opts.Network != "" {
+		args = append(args, "--network", opts.Network)
+	}
+	if opts.CLI {
+		args = append(args, "--cli")
+	}
+
+	logFile, err := os.Create(startLogPath(name))
+	if err != nil {
+		startEnd <- name
+		return
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		self = os.Args[0]
+	}
+
+	command := exec.Command(self, args...)
+	command.Stdout = logFile
+	command.Stderr = logFile
+	err = command.Start()
+	if err != nil {
+		logFile.Close()
+		startEnd <- name
+		return
+	}
+
+	go func() {
+		command.Wait()
+		logFile.Close()
+		startEnd <- name
+	}()
+
+	return map[string]string{"status": "starting"}, nil
+}
+
+func (a api) stopVM(name string) (status map[string]string, err error) {
+	dom, err := lookupOwned(a.l, "appvm_"+name)
+	if err != nil {
+		return nil, apiErr(lookupStatus(err), err)
+	}
+
+	ioutil.WriteFile(stoppedMarkPath(name), nil, 0600)
+	err = a.l.DomainShutdown(dom)
+	if err != nil {
+		return
+	}
+	return map[string]string{"status": "stopping"}, nil
+}
+
+type execRequest struct {
+	Path string   `json:"path"`
+	Args []string `json:"args"`
+}
+
+func (a api) execVM(name string, req execRequest) (result guestExecResult,
+	err error) {
+
+	if req.Path == "" {
+		err = apiErr(http.StatusBadRequest,
+			errors.New("expected {\"path\": ..., \"args\": [...]}"))
+		return
+	}
+
+	dom, err := lookupOwned(a.l, "appvm_"+name)
+	if err != nil {
+		err = apiErr(lookupStatus(err), err)
+		return
+	}
+
+	result, err = guestExec(a.l, dom, req.Path, req.Args...)
+	if err != nil {
+		err = apiErr(http.StatusBadGateway, err)
+	}
+	return
+}
+
+func vmLog(name string) (text string, err error) {
+	raw, err := ioutil.ReadFile(startLogPath(name))
+	if err != nil {
+		err = apiErr(http.StatusNotFound, err)
+		return
+	}
+
+	// Build output is shared by all clients starting the app
+	if _, ok := inflightBuild(name); ok {
+		build, _ := ioutil.ReadFile(buildOutputPath(name))
+		raw = append(raw, build...)
+	}
+	return string(raw), nil
+}
+
+func vmStats(name string) (rates statsSeries, err error) {
+	samples, err := loadStats(name)
+	if err != nil {
+		err = apiErr(http.StatusNotFound, err)
+		return
+	}
+
+	const n = 60
+	rates = statsRates(samples)
+	rates.CPU = tailValues(rates.CPU, n)
+	rates.Mem = tailValues(rates.Mem, n)
+	rates.Read = tailValues(rates.Read, n)
+	rates.Write = tailValues(rates.Write, n)
+	return
+}
+
+func (a api) vms(w http.ResponseWriter, r *http.Request) {
+	vms, err := a.listVMs()
+	writeResult(w, http.StatusOK, vms, err)
+}
+
+func (a api) start(w http.ResponseWriter, r *http.Request, name string) {
+	var opts startOptions
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&opts)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	status, err := a.startVM(name, opts)
+	writeResult(w, http.StatusAccepted, status, err)
+}
+
+func (a api) stop(w http.ResponseWriter, r *http.Request, name string) {
+	status, err := a.stopVM(name)
+	writeResult(w, http.StatusOK, status, err)
+}
+
+func (a api) exec(w http.ResponseWriter, r *http.Request, name string) {
+	var req execRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest,
+			fmt.Errorf("expected {\"path\": ..., \"args\": [...]}"))
+		return
+	}
+	result, err := a.execVM(name, req)
+	writeResult(w, http.StatusOK, result, err)
+}
+
+func (a api) log(w http.ResponseWriter, r *http.Request, name string) {
+	text, err := vmLog(name)
+	if err != nil {
+		writeError(w, errorCode(err), err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(text))
+}
+
+func (a api) stats(w http.ResponseWriter, r *http.Request, name string) {
+	rates, err := vmStats(name)
+	writeResult(w, http.StatusOK, rates, err)
+}
+
+func (a api) events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError,
+			fmt.Errorf("streaming is not supported"))
+		return
+	}
+
+	c := make(chan apiEvent, 16)
+	eventSubscribe <- c
+	defer func() { eventUnsubscribe <- c }()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher.Flush()
+
+	for {
+		select {
+		case e := <-c:
+			raw, _ := json.Marshal(e)
+			fmt.Fprintf(w, "data: %s\n\n", raw)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (a api) vm(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/vms/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	name, action := parts[0], parts[1]
+
+	err := validateName(name)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	switch {
+	case action == "log" && r.Method == http.MethodGet:
+		a.log(w, r, name)
+	case action == "stats" && r.Method == http.MethodGet:
+		a.stats(w, r, name)
+	case r.Method != http.MethodPost:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	case action == "start":
+		a.start(w, r, name)
+	case action == "stop":
+		a.stop(w, r, name)
+	case action == "exec":
+		a.exec(w, r, name)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a api) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		writeError(w, http.StatusUnauthorized, fmt.Errorf("invalid token"))
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/api/v1/vms":
+		a.vms(w, r)
+	case r.URL.Path == "/api/v1/builds":
+		writeJSON(w, http.StatusOK, apiBuilds())
+	case r.URL.Path == "/api/v1/events":
+		a.events(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/v1/vms/"):
+		a.vm(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// "unix:<path>" is a socket only accessible by the user. A port without
+// host is on 127.0.0.1; other than loopback addresses are refused
+// without TLS certificate and key, the token would be sent in clear.
+func apiListener(listen, cert, key string, protos ...string) (
+	ln net.Listener, err error) {
+
+	if strings.HasPrefix(listen, "unix:") {
+		path := strings.TrimPrefix(listen, "unix:")
+		os.Remove(path)
+		ln, err = net.Listen("unix", path)
+		if err == nil {
+			err = os.Chmod(path, 0600)
+		}
+		return
+	}
+
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	listen = net.JoinHostPort(host, port)
+
+	if cert == "" && key == "" {
+		if !isLocalListen(host) {
+			err = withCategory("usage", errors.New("refusing to serve "+
+				"on non-loopback "+listen+" without TLS, "+
+				"use --tls-cert and --tls-key"))
+			return
+		}
+		return net.Listen("tcp", listen)
+	}
+
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return
+	}
+	return tls.Listen("tcp", listen, &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   protos,
+	})
+}
+
+func serveAPI(l *libvirt.Libvirt, ln net.Listener) {
+	token, err := apiToken()
+	if err != nil {
+		fatal(err)
+	}
+
+	log.Println("Listen on", ln.Addr(), "token is in", apiTokenPath())
+	fatal(http.Serve(ln, api{l, token}))
+}
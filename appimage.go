@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// AppImage is copied out of the user home and shared read-only
+var appimageTemplate = `
+{pkgs, ...}:
+let
+  appRunner = pkgs.writeShellScriptBin "app" ''
+    ARGS_FILE=/home/user/.args
+    ARGS=$(cat $ARGS_FILE)
+    rm $ARGS_FILE
+
+    ${pkgs.appimage-run}/bin/appimage-run /mnt/appimage/%s $ARGS
+    systemctl poweroff
+  '';
+in {
+  imports = [
+    <nixpkgs/nixos/modules/virtualisation/qemu-vm.nix>
+    <nix/base.nix>
+  ];
+
+  systemd.services.mount-appimage = {
+    description = "Mount /mnt/appimage (crutch)";
+    serviceConfig = {
+      ExecStart = "/bin/sh -c 'mkdir -p /mnt/appimage && /run/current-system/sw/bin/mount -t 9p -o trans=virtio,version=9p2000.L,ro appimage /mnt/appimage'";
+      RemainAfterExit = "yes";
+      Type = "oneshot";
+      User = "root";
+    };
+    wantedBy = [ "sysinit.target" ];
+  };
+
+  services.xserver.displayManager.sessionCommands = "${appRunner}/bin/app &";
+}
+`
+
+func appimageDir(name string) string {
+	return appvmHomesDir + ".appimage/" + name
+}
+
+// ./Foo-1.2-x86_64.AppImage -> foo-1.2-x86_64
+func appimageName(path string) string {
+	name := filepath.Base(path)
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	return strings.ToLower(name)
+}
+
+// Copies AppImage and generates expression to run it, returns
+// application name.
+func generateAppImage(path string, force bool) (name string, err error) {
+	name = appimageName(path)
+	err = validateName(name)
+	if err != nil {
+		return
+	}
+
+	dir := appimageDir(name)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return
+	}
+
+	image := dir + "/" + filepath.Base(path)
+	err = copyFile(path, image)
+	if err != nil {
+		return
+	}
+
+	err = os.Chmod(image, 0500)
+	if err != nil {
+		return
+	}
+
+	appNixConfig := fmt.Sprintf(appimageTemplate, filepath.Base(path))
+	_, err = writeGeneratedExpr(name, appNixConfig, force)
+	return
+}
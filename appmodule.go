@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// NixOS module generated from config.json of the application and
+// added to its expression by vm.nix, so settings like proxy don't need
+// changes of the expression. Every part is a list of module
+// attributes.
+
+type appModulePart func(app appConfig) string
+
+var appModuleParts = []appModulePart{
+	profileModule,
+	hostFontsModule,
+	sshAgentModule,
+	gpgAgentModule,
+	hardeningModule,
+	storeModule,
+	proxyModule,
+	spiceServicesModule,
+	guestUserModule,
+	overridesModule,
+}
+
+func nixString(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "${", `\${`)
+	return `"` + r.Replace(s) + `"`
+}
+
+func appModuleDir() string {
+	return configDir + "modules/"
+}
+
+func appModulePath(name string) string {
+	return appModuleDir() + name + ".nix"
+}
+
+// Every part is a separate module, so parts may set the same
+// attributes (e.g. imports)
+func appModule(app appConfig) string {
+	var parts []string
+	for _, part := range appModuleParts {
+		if s := part(app); s != "" {
+			parts = append(parts, "({ config, pkgs, lib, ... }: {\n"+s+"})")
+		}
+	}
+	return "{ ... }:\n{\n  imports = [\n" + strings.Join(parts, "\n") +
+		"\n  ];\n}\n"
+}
+
+func writeAppModule(name string) (err error) {
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+
+	err = os.MkdirAll(appModuleDir(), 0700)
+	if err != nil {
+		return
+	}
+	return ioutil.WriteFile(appModulePath(name),
+		[]byte(appModule(config.app(name))), 0644)
+}
@@ -14,14 +14,11 @@ import (
 	"io/ioutil"
 	"log"
 	"math/rand"
-	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
-	"syscall"
 	"time"
 
 	"github.com/digitalocean/go-libvirt"
@@ -39,35 +36,62 @@ const (
 	networkLibvirt networkModel = iota
 )
 
+// Marks for list output
+func appDescription(name string, app appConfig) string {
+	if app.Type == "image" {
+		name += " (image)"
+	}
+	if isEmulated(app.Arch) {
+		name += " (emulated " + app.Arch + ")"
+	}
+	if app.Protected {
+		name += " (protected)"
+	}
+	return name
+}
+
 func list(l *libvirt.Libvirt) {
 	domains, err := l.Domains()
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
 	}
 
 	fmt.Println("Started VM:")
 	for _, d := range domains {
-		if strings.HasPrefix(d.Name, "appvm") {
-			fmt.Println("\t", d.Name[6:])
+		if strings.HasPrefix(d.Name, "appvm") && isOwned(l, d) {
+			app := config.app(appNameFromDomain(d.Name))
+			desc := appDescription(d.Name[6:], app)
+			if h := healthStatus(d.Name[6:], app); h != "" {
+				desc += " [" + h + "]"
+			}
+			if q := quotaUsage(d.Name[6:], app); q != "" {
+				desc += " [" + q + "]"
+			}
+			fmt.Println("\t", desc)
 		}
 	}
 
 	fmt.Println("\nAvailable VM:")
-	files, err := ioutil.ReadDir(configDir + "/nix")
-	if err != nil {
-		log.Fatal(err)
+	for _, name := range exprNames() {
+		desc := appDescription(name, config.app(name))
+		if m, ok := loadMeta(name); ok && m.Description != "" {
+			desc += " - " + m.Description
+		}
+		if q := quotaUsage(name, config.app(name)); q != "" {
+			desc += " [" + q + "]"
+		}
+		fmt.Println("\t", desc)
 	}
 
-	for _, f := range files {
-		switch f.Name() {
-		case "base.nix":
-			continue
-		case "local.nix":
-			continue
-
+	for name, app := range config.Apps {
+		if app.Type == "image" {
+			fmt.Println("\t", appDescription(name, app))
 		}
-
-		fmt.Println("\t", f.Name()[0:len(f.Name())-4])
 	}
 }
 
@@ -103,63 +127,70 @@ func prepareTemplates(appvmPath string) (err error) {
 	return
 }
 
-func streamStdOutErr(command *cmd.Cmd) {
-	for {
-		select {
-		case line := <-command.Stdout:
-			fmt.Println(line)
-		case line := <-command.Stderr:
-			fmt.Fprintln(os.Stderr, line)
-		}
-	}
+func generateVM(path, name string, verbose bool, arch string) (realpath, reginfo, qcow2 string, err error) {
+	return buildVM(path, name, verbose, arch, "")
 }
 
-func generateVM(path, name string, verbose bool) (realpath, reginfo, qcow2 string, err error) {
-	command := cmd.NewCmdOptions(cmd.Options{Buffered: false, Streaming: true},
-		"nix-build", "<nixpkgs/nixos>", "-A", "config.system.build.vm",
-		"-I", "nixos-config="+path+"/nix/"+name+".nix", "-I", path)
-
-	if verbose {
-		go streamStdOutErr(command)
+// Output is prefixed by label if not empty
+func buildVM(path, name string, verbose bool, arch, label string) (realpath, reginfo, qcow2 string, err error) {
+	err = checkArch(arch)
+	if err != nil {
+		return
 	}
 
-	status := <-command.Start()
-	if status.Error != nil || status.Exit != 0 {
-		log.Println(status.Error, status.Stdout, status.Stderr)
-		if status.Error != nil {
-			err = status.Error
-		} else {
-			s := fmt.Sprintf("ret code: %d, out: %v, err: %v",
-				status.Exit, status.Stdout, status.Stderr)
-			err = errors.New(s)
-		}
+	config, err := loadConfig()
+	if err != nil {
 		return
 	}
 
-	realpath, err = filepath.EvalSymlinks("result/system")
+	err = checkBuildLimits(config.Nix.Limits)
 	if err != nil {
 		return
 	}
 
-	matches, err := filepath.Glob("result/bin/run-*-vm")
-	if err != nil || len(matches) != 1 {
-		return
+	if b, ok := inflightBuild(name); ok {
+		log.Println("Waiting for the build of", name, "started by pid", b.Pid)
+		attachBuild(b, verbose, label)
 	}
 
-	bytes, err := ioutil.ReadFile(matches[0])
-	if err != nil || len(matches) != 1 {
-		return
+	if offlineMode {
+		err = checkOfflineExpr(name)
+		if err != nil {
+			return
+		}
 	}
 
-	match := regexp.MustCompile("regInfo=.*/registration").FindSubmatch(bytes)
-	if len(match) != 1 {
-		err = errors.New("should be one reginfo")
+	phase("evaluating")
+	drv, err := checkExpr(path, name, arch)
+	if err != nil {
 		return
 	}
+	endPhase()
 
-	reginfo = string(match[0])
+	out, _ := run(nixBin("nix-store"), "--query", "--outputs", drv)
+	boot, ok := loadBootInfo(out)
+	if !ok {
+		if offlineMode {
+			err = checkOfflineBuild(drv)
+			if err != nil {
+				return
+			}
+		}
+		out, err = nixBuild(drv, name, verbose, label, config.Nix)
+		if err != nil {
+			err = withCategory("build", err)
+			return
+		}
 
-	syscall.Unlink("result")
+		boot, err = newBootInfo(out)
+		if err != nil {
+			return
+		}
+		saveBootInfo(boot)
+	}
+	realpath, reginfo = boot.System, boot.Reginfo
+	saveBuildRecord(name, realpath)
+	addGCRoot(name, boot.Out)
 
 	qcow2 = os.Getenv("HOME") + "/appvm/." + name + ".fake.qcow2"
 	if _, e := os.Stat(qcow2); os.IsNotExist(e) {
@@ -169,36 +200,103 @@ func generateVM(path, name string, verbose bool) (realpath, reginfo, qcow2 strin
 	return
 }
 
+// Returns output path
+func nixBuild(drv, name string, verbose bool, label string,
+	nix nixConfig) (out string, err error) {
+
+	args := append([]string{drv, "--no-out-link"}, nixBuildOptions(nix)...)
+
+	bin, args := limitedCommand(nix.Limits, nixBin("nix-build"), args...)
+	command := cmd.NewCmdOptions(cmd.Options{Buffered: false, Streaming: true},
+		bin, args...)
+
+	buildLog, err := newBuildLog(name)
+	if err != nil {
+		return
+	}
+
+	statusChan := command.Start()
+	done := streamBuild(command, buildLog, verbose, label)
+	status := <-statusChan
+	<-done
+	buildLog.Close()
+	rotateBuildLogs(name)
+
+	if status.Error != nil || status.Exit != 0 {
+		if status.Error != nil {
+			err = status.Error
+		} else {
+			s := fmt.Sprintf("ret code: %d, see appvm log build %s --last",
+				status.Exit, name)
+			err = errors.New(s)
+		}
+		return
+	}
+
+	out = buildLog.lastStdout
+	return
+}
+
+// VM of another user with the same name is not running for us, see
+// checkForeignDomain
 func isRunning(l *libvirt.Libvirt, name string) bool {
-	_, err := l.DomainLookupByName("appvm_" + name) // yep, there is no libvirt error handling
+	_, err := lookupOwned(l, "appvm_"+name)
 	// VM is destroyed when stop so NO VM means STOPPED
 	return err == nil
 }
 
+// Domain name is taken by a VM of another user
+func checkForeignDomain(l *libvirt.Libvirt, vmName string) (err error) {
+	_, err = lookupOwned(l, vmName)
+	if err != nil && libvirt.IsNotFound(err) {
+		err = nil
+	}
+	return
+}
+
+// Directories exported to the application in addition to the home
+func appShares(name string) (shares []share) {
+	if dir := appimageDir(name); isDirExists(dir) {
+		shares = append(shares, share{dir, "appimage", true})
+	}
+
+	config, err := loadConfig()
+	if err == nil && config.app(name).HostFonts {
+		for _, s := range hostFontShares() {
+			shares = append(shares, s.share)
+		}
+	}
+	return
+}
+
 func generateAppVM(l *libvirt.Libvirt,
 	nixName, vmName, appvmPath, sharedDir string,
-	verbose bool, network networkModel, gui bool) (qcow2 string, err error) {
+	verbose bool, network networkModel, gui bool,
+	app appConfig) (qcow2 string, err error) {
 
-	realpath, reginfo, qcow2, err := generateVM(appvmPath, nixName, verbose)
+	realpath, reginfo, qcow2, err := generateVM(appvmPath, nixName, verbose,
+		app.Arch)
 	if err != nil {
 		return
 	}
 
-	xml := generateXML(vmName, network, gui, realpath, reginfo, qcow2, sharedDir)
-	_, err = l.DomainCreateXML(xml, libvirt.DomainStartValidate)
-	return
-}
+	linkSystem(nixName, realpath)
 
-func stupidProgressBar() {
-	const length = 70
-	for {
-		time.Sleep(time.Second / 4)
-		fmt.Printf("\r%s]\r[", strings.Repeat(" ", length))
-		for i := 0; i <= length-2; i++ {
-			time.Sleep(time.Second / 20)
-			fmt.Printf("+")
-		}
+	phase("creating domain")
+	xml := generateXML(vmName, network, gui, realpath, reginfo, qcow2,
+		sharedDir, appShares(nixName), app)
+	dom, err := l.DomainCreateXML(xml, libvirt.DomainStartValidate)
+	if err != nil {
+		return
 	}
+	err = verifySandbox(l, vmName, app.Sandbox)
+	if err != nil {
+		return
+	}
+	endPhase()
+
+	waitBoot(l, dom)
+	return
 }
 
 func fileExists(filename string) bool {
@@ -209,39 +307,69 @@ func fileExists(filename string) bool {
 	return !info.IsDir()
 }
 
+func isDirExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
 func isAppvmConfigurationExists(appvmPath, name string) bool {
-	return fileExists(appvmPath + "/nix/" + name + ".nix")
+	_, ok := findAppExpr(name)
+	return ok
 }
 
 func start(l *libvirt.Libvirt, name string, verbose bool, network networkModel,
-	gui, stateless bool, args, open string) {
+	gui, stateless bool, args, open string) (vmName, sharedDir string) {
 
 	appvmPath := configDir
 
 	statelessName := fmt.Sprintf("tmp_%d_%s", rand.Int(), name)
 
-	sharedDir := os.Getenv("HOME") + "/appvm/"
+	sharedDir = os.Getenv("HOME") + "/appvm/"
 	if stateless {
 		sharedDir += statelessName
 	} else {
 		sharedDir += name
 	}
 
-	os.MkdirAll(sharedDir, 0700)
+	if stateless {
+		os.MkdirAll(sharedDir, 0700)
+		warnMAC(sharedDir)
+	} else {
+		err := createDataDir(sharedDir)
+		if err != nil {
+			log.Println(err)
+			return "", ""
+		}
+
+		warnMAC(sharedDir)
 
-	vmName := "appvm_"
+		config, err := loadConfig()
+		if q := config.app(name).Quota; err == nil && q != "" {
+			err = applyQuota(name, q)
+			if err != nil {
+				log.Println("Quota of", name, "is not applied:", err)
+			}
+		}
+	}
+
+	vmName = "appvm_"
 	if stateless {
 		vmName += statelessName
 	} else {
 		vmName += name
 	}
 
+	err := checkForeignDomain(l, vmName)
+	if err != nil {
+		fatal(err)
+	}
+
 	if open != "" {
 		filename := sharedDir + "/" + filepath.Base(open)
 		err := copyFile(open, filename)
 		if err != nil {
 			log.Println("Can't copy file")
-			return
+			return "", ""
 		}
 
 		args += "/home/user/" + filepath.Base(open)
@@ -251,87 +379,249 @@ func start(l *libvirt.Libvirt, name string, verbose bool, network networkModel,
 		err := ioutil.WriteFile(sharedDir+"/"+".args", []byte(args), 0700)
 		if err != nil {
 			log.Println("Can't write args")
-			return
+			return "", ""
 		}
 	}
 
-	if !isAppvmConfigurationExists(appvmPath, name) {
-		log.Println("No configuration exists for app, " +
-			"trying to generate")
-		err := generate(name, "", "", false)
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+	app := config.app(name)
+
+	if app.Snapshot && !stateless && !isRunning(l, vmName[6:]) {
+		snapshot, err := dataSnapshot(name)
 		if err != nil {
-			log.Println("Can't auto generate")
-			return
+			log.Println("Can't snapshot data:", err)
+		} else {
+			log.Println("Data snapshot", snapshot)
 		}
 	}
 
-	if !isRunning(l, vmName) {
-		if !verbose {
-			go stupidProgressBar()
+	err = checkGraphics(app)
+	if err != nil {
+		fatal(err)
+	}
+
+	err = checkClipboard(app)
+	if err != nil {
+		fatal(err)
+	}
+
+	err = checkSched(app.Sched)
+	if err != nil {
+		fatal(err)
+	}
+
+	err = checkDNS(app.DNS)
+	if err != nil {
+		fatal(err)
+	}
+
+	err = checkProxy(app.Proxy)
+	if err != nil {
+		fatal(err)
+	}
+
+	err = checkProfile(app.Profile)
+	if err != nil {
+		fatal(err)
+	}
+
+	err = checkGPGAgent(app.GPGAgent)
+	if err != nil {
+		fatal(err)
+	}
+
+	err = checkSecrets(app.Secrets)
+	if err != nil {
+		fatal(err)
+	}
+
+	err = checkHardening(app.Hardening)
+	if err != nil {
+		fatal(err)
+	}
+
+	err = checkSandbox(app.Sandbox)
+	if err != nil {
+		fatal(err)
+	}
+
+	err = checkStoreMode(app)
+	if err != nil {
+		fatal(err)
+	}
+
+	err = checkGuestUser(app.GuestUser)
+	if err != nil {
+		fatal(err)
+	}
+
+	err = checkBalloon(app.Balloon)
+	if err != nil {
+		fatal(err)
+	}
+
+	if !overrides.empty() && isRunning(l, vmName[6:]) {
+		log.Println(name, "is running, --package and --extra-module "+
+			"are not applied")
+	}
+
+	if (app.SSHAgent || app.GPGAgent != "") && vsockDevices(app.Arch) == "" {
+		log.Println("Agent forwarding needs vsock (kvm and vhost_vsock)")
+	}
+
+	if !isRunning(l, vmName[6:]) {
+		network, err = prepareNetwork(l, name, app, network)
+		if err != nil {
+			fatal(err)
 		}
+	}
 
-		qcow2, err := generateAppVM(l, name, vmName, appvmPath, sharedDir,
-			verbose, network, gui)
-		defer os.Remove(qcow2)
+	password := ""
+	if gui && !isRunning(l, vmName[6:]) {
+		password, err = displayPassword(&app)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 	}
 
-	if gui {
-		cmd := exec.Command("virt-viewer", "-c", "qemu:///system", vmName)
-		cmd.Start()
+	if !isRunning(l, vmName[6:]) {
+		err = preStartHook(app, vmName)
+		if err != nil {
+			fatal(err)
+		}
+		log.Println("Resources:", appResources(app))
+		os.Remove(healthPath(vmName[6:]))
 	}
+
+	if app.Type == "image" {
+		if !isRunning(l, vmName[6:]) {
+			err = startImageVM(l, vmName, app, network, gui)
+			if err != nil {
+				fatal(err)
+			}
+		}
+	} else {
+		if app.BaseImage != "" {
+			log.Println("base_image is ignored, " + name +
+				" is not of type image")
+		}
+		if !isAppvmConfigurationExists(appvmPath, name) {
+			log.Println("No configuration exists for app, " +
+				"trying to generate")
+			err := generate(name, "", "", false)
+			if err != nil {
+				log.Println("Can't auto generate:", errNoExpr(name))
+				return "", ""
+			}
+		}
+
+		if !isRunning(l, vmName[6:]) {
+			showPhases = !verbose
+
+			qcow2, err := generateAppVM(l, name, vmName, appvmPath,
+				sharedDir, verbose, network, gui, app)
+			defer os.Remove(qcow2)
+			if err != nil {
+				fatal(err)
+			}
+		}
+	}
+
+	if password != "" {
+		log.Println("Display password:", password)
+	}
+
+	if gui && graphicsType(app) != "none" {
+		startViewer(vmName)
+	}
+	return
 }
 
 func stop(l *libvirt.Libvirt, name string) {
-	dom, err := l.DomainLookupByName("appvm_" + name)
+	dom, err := lookupOwned(l, "appvm_"+name)
 	if err != nil {
 		if libvirt.IsNotFound(err) {
 			log.Println("Appvm not found or already stopped")
 			return
 		} else {
-			log.Fatal(err)
+			fatal(err)
 		}
 	}
+	ioutil.WriteFile(stoppedMarkPath(name), nil, 0600)
 	err = l.DomainShutdown(dom)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 }
 
-func drop(name string) {
-	appDataPath := fmt.Sprintf(os.Getenv("HOME") + "/appvm/" + name)
-	os.RemoveAll(appDataPath)
+// Used memory (KiB) from the balloon statistics, falls back to the
+// file written by VMs started with older appvm (see
+// migrateMemoryUsed)
+func memoryUsed(l *libvirt.Libvirt, d libvirt.Domain) (used uint64, err error) {
+	stats, err := l.DomainMemoryStats(d, uint32(libvirt.DomainMemoryStatNr), 0)
+	if err == nil {
+		var available, usable uint64
+		for _, s := range stats {
+			switch libvirt.DomainMemoryStatTags(s.Tag) {
+			case libvirt.DomainMemoryStatAvailable:
+				available = s.Val
+			case libvirt.DomainMemoryStatUsable:
+				usable = s.Val
+			}
+		}
+		if available != 0 && usable != 0 && usable <= available {
+			return available - usable, nil
+		}
+	}
+
+	name := d.Name[6:]
+	memoryUsedRaw, err := ioutil.ReadFile(os.Getenv("HOME") + "/appvm/" + name + "/.memory_used")
+	if err != nil {
+		return
+	}
+	if len(memoryUsedRaw) == 0 {
+		err = errors.New("Empty .memory_used file for domain " + name)
+		return
+	}
+	memoryUsedMiB, err := strconv.Atoi(string(memoryUsedRaw[0 : len(memoryUsedRaw)-1]))
+	if err != nil {
+		return
+	}
+	used = uint64(memoryUsedMiB) * 1024
+	return
 }
 
 func autoBalloon(l *libvirt.Libvirt, memoryMin, adjustPercent uint64) {
 	domains, err := l.Domains()
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
 	}
 
 	table := tablewriter.NewWriter(os.Stdout)
 	table.SetHeader([]string{"Application VM", "Used memory", "Current memory", "Max memory", "New memory"})
 	for _, d := range domains {
-		if strings.HasPrefix(d.Name, "appvm_") {
+		if strings.HasPrefix(d.Name, "appvm_") && isOwned(l, d) {
 			name := d.Name[6:]
 
-			memoryUsedRaw, err := ioutil.ReadFile(os.Getenv("HOME") + "/appvm/" + name + "/.memory_used")
-			if err != nil {
-				log.Println(err)
+			app := config.app(name)
+			if app.Balloon.Disabled {
+				table.Append([]string{name, "", "", "", "disabled"})
 				continue
 			}
-			if len(memoryUsedRaw) == 0 {
-				log.Println("Empty .memory_used file for domain", name)
-				continue
-			}
-			memoryUsedMiB, err := strconv.Atoi(string(memoryUsedRaw[0 : len(memoryUsedRaw)-1]))
+
+			memoryUsed, err := memoryUsed(l, d)
 			if err != nil {
 				log.Println(err)
 				continue
 			}
-			memoryUsed := memoryUsedMiB * 1024
 
 			_, memoryMax, memoryCurrent, _, _, err := l.DomainGetInfo(d)
 			if err != nil {
@@ -339,15 +629,8 @@ func autoBalloon(l *libvirt.Libvirt, memoryMin, adjustPercent uint64) {
 				continue
 			}
 
-			memoryNew := uint64(float64(memoryUsed) * (1 + float64(adjustPercent)/100))
-
-			if memoryNew > memoryMax {
-				memoryNew = memoryMax - 1
-			}
-
-			if memoryNew < memoryMin {
-				memoryNew = memoryMin
-			}
+			memoryNew := balloonTarget(app, memoryUsed, memoryMax,
+				memoryMin, adjustPercent)
 
 			err = l.DomainSetMemory(d, memoryNew)
 			if err != nil {
@@ -366,7 +649,14 @@ func autoBalloon(l *libvirt.Libvirt, memoryMin, adjustPercent uint64) {
 }
 
 func search(name string) {
-	command := exec.Command("nix", "search", name)
+	for _, app := range exprNames() {
+		if m, _ := loadMeta(app); metaMatches(app, m, name) {
+			fmt.Printf("* %s (appvm, %s): %s\n", app, metaCategory(m),
+				m.Description)
+		}
+	}
+
+	command := exec.Command(nixBin("nix"), "search", name)
 	bytes, err := command.Output()
 	if err != nil {
 		return
@@ -379,28 +669,34 @@ func search(name string) {
 }
 
 func sync() {
-	err := exec.Command("nix-channel", "--update").Run()
+	if offlineMode {
+		fatal(withCategory("denied", fmt.Errorf("sync: %v", errOffline)))
+	}
+
+	err := exec.Command(nixBin("nix-channel"), "--update").Run()
 	if err != nil {
-		log.Fatalln(err)
+		fatal(err)
 	}
 
-	err = exec.Command("nix", "search", "-u").Run()
+	err = exec.Command(nixBin("nix"), "search", "-u").Run()
 	if err != nil {
-		log.Fatalln(err)
+		fatal(err)
 	}
 
+	checkUpstreamDrift()
+
 	log.Println("Done")
 }
 
 func cleanupStatelessVMs(l *libvirt.Libvirt) {
 	domains, err := l.Domains()
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
 	dirs, err := ioutil.ReadDir(appvmHomesDir)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
 	for _, f := range dirs {
@@ -420,11 +716,8 @@ func cleanupStatelessVMs(l *libvirt.Libvirt) {
 	}
 }
 
-func parseNetworkModel(flagOffline bool, flagNetworking string) networkModel {
-	if flagNetworking != "" && flagOffline {
-		log.Fatal("Can't use both --network and --offline switches")
-	}
-	if flagOffline || flagNetworking == "offline" {
+func parseNetworkModel(flagNetworking string) networkModel {
+	if flagNetworking == "offline" {
 		return networkOffline
 	}
 	if flagNetworking == "libvirt" {
@@ -436,7 +729,31 @@ func parseNetworkModel(flagOffline bool, flagNetworking string) networkModel {
 	return networkQemu // qemu is the default network model
 }
 
-var configDir = os.Getenv("HOME") + "/.config/appvm/"
+func networkModelName(network networkModel) string {
+	switch network {
+	case networkOffline:
+		return "offline"
+	case networkLibvirt:
+		return "libvirt"
+	}
+	return "qemu"
+}
+
+func needLibvirt(command string) bool {
+	switch command {
+	case "generate", "import-flatpak", "cache push", "bootstrap-nix",
+		"tune ksm", "stats", "plugins", "web", "which", "cat", "diff", "check", "log build", "build", "builds",
+		"clone", "undrop", "verify", "init", "doctor", "schedule list",
+		"outdated", "update", "catalog", "export-config", "import-config",
+		"wm-rules":
+		return false
+	}
+	return !strings.HasPrefix(command, "handler ") &&
+		!strings.HasPrefix(command, "trust ")
+}
+
+var configDir = xdgConfigDir()
+var libvirtSocket = "/var/run/libvirt/libvirt-sock"
 var appvmHomesDir = os.Getenv("HOME") + "/appvm/"
 
 func main() {
@@ -446,91 +763,804 @@ func main() {
 
 	os.MkdirAll(configDir+"/nix", 0700)
 
-	err := writeBuiltinApps(configDir + "/nix")
+	err := migrate()
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+
+	os.MkdirAll(builtinDir(), 0700)
+	err = writeBuiltinApps(builtinDir())
+	if err != nil {
+		fatal(err)
 	}
 
 	err = ioutil.WriteFile(configDir+"/nix/base.nix", baseNix(), 0644)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+
+	err = writeProfiles()
+	if err != nil {
+		fatal(err)
+	}
+
+	err = ioutil.WriteFile(vmNixPath(), vmNix, 0644)
+	if err != nil {
+		fatal(err)
 	}
 
 	// Copy templates
 	err = prepareTemplates(configDir)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
-	kingpin.Command("list", "List applications")
+	libvirtURI := kingpin.Flag("libvirt-uri", "Libvirt connection URI or socket path").
+		Default(libvirtURIDefault).Envar("APPVM_LIBVIRT_URI").String()
+
+	kingpin.Flag("configs", "Directory with nix expressions (searched first)").
+		StringsVar(&configsFlag)
+	kingpin.Flag("offline", "Build only from local expressions and nix store").
+		Envar("APPVM_OFFLINE").BoolVar(&offlineMode)
+	kingpin.Flag("cores", "nix-build --cores").IntVar(&coresFlag)
+	kingpin.Flag("max-jobs", "nix-build --max-jobs").IntVar(&maxJobsFlag)
+	kingpin.Flag("error-format", "Format of errors: text or json").
+		Default("text").Envar("APPVM_ERROR_FORMAT").
+		EnumVar(&errorFormat, "text", "json")
+
+	listDisk := kingpin.Command("list", "List applications").Flag("disk", "Show disk usage").Bool()
 	autoballonCommand := kingpin.Command("autoballoon", "Automatically adjust/reduce app vm memory")
 	minMemory := autoballonCommand.Flag("min-memory", "Set minimal memory (megabytes)").Default("1024").Uint64()
 	adjustPercent := autoballonCommand.Flag("adj-memory", "Adjust memory amount (percents)").Default("20").Uint64()
 
 	startCommand := kingpin.Command("start", "Start application")
-	startName := startCommand.Arg("name", "Application name").Required().String()
+	startName := nameArg(startCommand.Arg("name", "Application name"))
 	startQuiet := startCommand.Flag("quiet", "Less verbosity").Bool()
 	startArgs := startCommand.Flag("args", "Command line arguments").String()
 	startOpen := startCommand.Flag("open", "Pass file to application").String()
-	startOffline := startCommand.Flag("offline", "Disconnect").Bool()
 	startCli := startCommand.Flag("cli", "Disable graphics mode, enable serial").Bool()
 	startStateless := startCommand.Flag("stateless", "Do not use default state directory").Bool()
 	startNetwork := startCommand.Flag("network", "Used networking model").Enum("offline", "qemu", "libvirt")
-
-	stopName := kingpin.Command("stop", "Stop application").Arg("name", "Application name").Required().String()
-	dropName := kingpin.Command("drop", "Remove application data").Arg("name", "Application name").Required().String()
+	startFromOCI := startCommand.Flag("from-oci", "Run container image, e.g. docker.io/library/gimp").String()
+	startAppImage := startCommand.Flag("appimage", "Run AppImage").ExistingFile()
+	startForce := startCommand.Flag("force", "Replace own expression of the same name by --from-oci or --appimage").Bool()
+	var viewerOpts viewerConfig
+	startCommand.Flag("fullscreen", "Open viewer in fullscreen").BoolVar(&viewerOpts.Fullscreen)
+	startCommand.Flag("kiosk", "Fullscreen viewer without menus").BoolVar(&viewerOpts.Kiosk)
+	startCommand.Flag("zoom", "Viewer zoom (percents)").IntVar(&viewerOpts.Zoom)
+	startCommand.Flag("monitor", "Host monitor for fullscreen viewer").IntVar(&viewerOpts.Monitor)
+	startResetViewer := startCommand.Flag("reset-viewer", "Forget remembered viewer options").Bool()
+	startCamera := startCommand.Flag("camera", "Attach webcam (must be allowed in config)").Bool()
+	startMic := startCommand.Flag("mic", "Attach microphone (must be allowed in config)").Bool()
+	startFIDO := startCommand.Flag("fido", "Attach U2F/FIDO token (must be allowed in config)").Bool()
+	startDry := startCommand.Flag("dry-run", "Show what would be built and started").Bool()
+	startPackages := startCommand.Flag("package", "Add package for this start, e.g. git").Strings()
+	startExtraModules := startCommand.Flag("extra-module", "Add NixOS module for this start").Strings()
+
+	stopName := nameArg(kingpin.Command("stop", "Stop application").Arg("name", "Application name").Required())
+	ipName := nameArg(kingpin.Command("ip", "Show addresses of running VM").Arg("name", "Application name").Required())
+	psName := nameArg(kingpin.Command("ps", "List processes inside of VM").Arg("name", "Application name").Required())
+	killCommand := kingpin.Command("kill", "Send signal to process inside of VM")
+	killName := nameArg(killCommand.Arg("name", "Application name").Required())
+	killTarget := killCommand.Arg("process", "PID or process name").Required().String()
+	killSignal := killCommand.Flag("signal", "Signal").Short('s').Default("TERM").String()
+	renameCommand := kingpin.Command("rename", "Rename application keeping its data")
+	renameFrom := nameArg(renameCommand.Arg("old", "Application name").Required())
+	renameTo := nameArg(renameCommand.Arg("new", "New name").Required())
+	renameRestart := renameCommand.Flag("restart", "Stop running VM and start it under the new name").Bool()
+	cloneCommand := kingpin.Command("clone", "Copy application setup to a new name")
+	cloneFrom := nameArg(cloneCommand.Arg("src", "Application name").Required())
+	cloneTo := nameArg(cloneCommand.Arg("dst", "New name").Required())
+	cloneData := cloneCommand.Flag("data", "Copy data directory too").Bool()
+	attachName := nameArg(kingpin.Command("attach", "Open viewer of running application").Arg("name", "Application name").Required())
+	dropCommand := kingpin.Command("drop", "Move application data to trash")
+	dropName := nameArg(dropCommand.Arg("name", "Application name").Required())
+	dropYes := dropCommand.Flag("yes", "Do not ask for confirmation").Short('y').Bool()
+	undropName := nameArg(kingpin.Command("undrop", "Restore dropped application data").Arg("name", "Application name").Required())
 
 	generateCommand := kingpin.Command("generate", "Generate appvm definition")
-	generateName := generateCommand.Arg("name", "Nix package name").Required().String()
+	generateName := nameArg(generateCommand.Arg("name", "Nix package name").Required())
 	generateBin := generateCommand.Arg("bin", "Binary").Default("").String()
 	generateVMName := generateCommand.Flag("vm", "Use VM Name").Default("").String()
 	generateBuildVM := generateCommand.Flag("build", "Build VM").Bool()
 
+	catalogCommand := kingpin.Command("catalog", "Browse applications by category")
+	catalogCategory := catalogCommand.Flag("category", "Only this category").String()
+	catalogQuery := catalogCommand.Arg("query", "Name, description or category").String()
+
 	searchCommand := kingpin.Command("search", "Search for application")
 	searchName := searchCommand.Arg("name", "Application name").Required().String()
 
 	kingpin.Command("sync", "Synchronize remote repos for applications")
 
+	handlerCommand := kingpin.Command("handler", "Manage host desktop handlers")
+	handlerRegisterCommand := handlerCommand.Command("register", "Open links/files of MIME type in application VM")
+	handlerRegisterName := nameArg(handlerRegisterCommand.Arg("name", "Application name").Required())
+	handlerRegisterMimes := handlerRegisterCommand.Flag("mime", "MIME type (default: http/https links)").Strings()
+	handlerUnregisterName := nameArg(handlerCommand.Command("unregister", "Remove handler").Arg("name", "Application name").Required())
+	handlerCommand.Command("list", "List registered handlers")
+
+	daemonCommand := kingpin.Command("daemon", "Handle requests from application VMs")
+	daemonListen := daemonCommand.Flag("listen",
+		"Serve REST API on address (e.g. 127.0.0.1:8087 or unix:/path)").String()
+	daemonGRPCListen := daemonCommand.Flag("grpc-listen",
+		"Serve gRPC API on address (e.g. 127.0.0.1:8086 or unix:/path)").String()
+	daemonTLSCert := daemonCommand.Flag("tls-cert", "TLS certificate of the API").ExistingFile()
+	daemonTLSKey := daemonCommand.Flag("tls-key", "TLS key of the API").ExistingFile()
+
+	webCommand := kingpin.Command("web", "Web dashboard (requires appvm daemon --listen)")
+	webListen := webCommand.Flag("listen", "Address").Default("127.0.0.1:8088").String()
+	webAPI := webCommand.Flag("api", "Address of appvm daemon API (host:port, https://host:port or unix:/path)").Default("127.0.0.1:8087").String()
+
+	sendCommand := kingpin.Command("send", "Copy file between application VMs")
+	sendFrom := sendCommand.Arg("from", "Source, <name>:<path>").Required().String()
+	sendTo := sendCommand.Arg("to", "Destination application name").Required().String()
+	sendYes := sendCommand.Flag("yes", "Do not ask for confirmation").Bool()
+
+	quarantineCommand := kingpin.Command("quarantine", "Open untrusted file in disposable offline VM")
+	quarantineFile := quarantineCommand.Arg("file", "File to quarantine").Required().ExistingFile()
+	quarantineApp := quarantineCommand.Flag("app", "Application name to open file with").String()
+
+	importFlatpakCommand := kingpin.Command("import-flatpak", "Import application from Flathub")
+	importFlatpakID := importFlatpakCommand.Arg("app-id", "Flatpak application ID").Required().String()
+	importFlatpakForce := importFlatpakCommand.Flag("force", "Replace own expression of the same name").Bool()
+
+	cacheCommand := kingpin.Command("cache", "Binary cache for application VMs")
+	cachePushCommand := cacheCommand.Command("push", "Build application VM and push it to the cache")
+	cachePushName := nameArg(cachePushCommand.Arg("name", "Application name").Required())
+	cachePushQuiet := cachePushCommand.Flag("quiet", "Less verbosity").Bool()
+
+	bootstrapCommand := kingpin.Command("bootstrap-nix", "Install static nix for hosts without nix")
+	bootstrapChannel := bootstrapCommand.Flag("channel", "Nixpkgs channel").Default("https://nixos.org/channels/nixos-unstable").String()
+	bootstrapSha256 := bootstrapCommand.Flag("sha256", "SHA-256 of the static nix build").Required().String()
+
+	gcCommand := kingpin.Command("gc", "Remove stale files to reclaim disk space")
+	gcDryRun := gcCommand.Flag("dry-run", "Only show what would be removed").Bool()
+	gcNix := gcCommand.Flag("nix", "Delete store paths of removed builds too").Bool()
+	gcKeep := gcCommand.Flag("keep", "Previous builds to keep for every application").Default("1").Int()
+
+	pruneCommand := kingpin.Command("prune", "Find and remove leftover domains, data and files")
+	pruneDryRun := pruneCommand.Flag("dry-run", "Only show what would be removed").Bool()
+	pruneYes := pruneCommand.Flag("yes", "Do not ask for confirmation").Short('y').Bool()
+
+	diskCommand := kingpin.Command("disk", "Manage persistent disks")
+	diskCompactName := nameArg(diskCommand.Command("compact", "Reclaim unused space of the stopped VM disk").Arg("name", "Application name").Required())
+	diskResetName := nameArg(diskCommand.Command("reset", "Drop changes made over base image").Arg("name", "Application name").Required())
+
+	dataCommand := kingpin.Command("data", "Manage application data snapshots (btrfs/ZFS)")
+	dataSnapshotName := nameArg(dataCommand.Command("snapshot", "Snapshot application data").Arg("name", "Application name").Required())
+	dataListName := nameArg(dataCommand.Command("list", "List snapshots").Arg("name", "Application name").Required())
+	dataRollbackCommand := dataCommand.Command("rollback", "Rollback application data to snapshot")
+	dataRollbackName := nameArg(dataRollbackCommand.Arg("name", "Application name").Required())
+	dataRollbackSnapshot := nameArg(dataRollbackCommand.Arg("snapshot", "Snapshot name").Required())
+
+	tuneCommand := kingpin.Command("tune", "Tune host for application VMs")
+	tuneKSM := tuneCommand.Command("ksm", "Kernel same-page merging").Arg("state", "on, off or status").Default("status").Enum("on", "off", "status")
+
+	statsCommand := kingpin.Command("stats", "Show resource usage history (collected by daemon)")
+	statsName := nameArg(statsCommand.Arg("name", "Application name").Required())
+	statsWidth := statsCommand.Flag("width", "Number of samples to show").Default("60").Int()
+	statsJSON := statsCommand.Flag("json", "Export samples as JSON").Bool()
+
+	whichName := nameArg(kingpin.Command("which", "Show which nix expression is used for application").Arg("name", "Application name").Required())
+	diffName := nameArg(kingpin.Command("diff", "Compare local expression with the overridden upstream one").Arg("name", "Application name").Required())
+	checkName := nameArg(kingpin.Command("check", "Check nix expression without building").Arg("name", "Application name").Required())
+	trustCommand := kingpin.Command("trust", "Manage trusted expression repos")
+	trustCommand.Command("list", "List repos and trust status")
+	trustAddCommand := trustCommand.Command("add", "Trust repo and add it to config.json")
+	trustAddRepo := trustAddCommand.Arg("repo", "Repo base URL").Required().String()
+	trustAddNote := trustAddCommand.Flag("note", "Reason of the decision").String()
+	trustRevokeURL := trustCommand.Command("revoke", "Revoke repo or pin of expression").Arg("url", "Repo or expression URL").Required().String()
+	trustInspectRepo := trustCommand.Command("inspect", "Show pinned expressions of repo").Arg("repo", "Repo base URL").Required().String()
+	catName := nameArg(kingpin.Command("cat", "Print nix expression used for application").Arg("name", "Application name").Required())
+
+	buildCommand := kingpin.Command("build", "Build application VMs concurrently")
+	buildNames := buildCommand.Arg("names", "Application names").Required().Strings()
+	buildJobs := buildCommand.Flag("jobs", "Number of concurrent builds").Short('j').Int()
+	buildVerbose := buildCommand.Flag("verbose", "Show build output").Bool()
+
+	deviceCommand := kingpin.Command("device", "Manage host devices of running VM")
+	deviceGrantCommand := deviceCommand.Command("grant", "Attach host devices")
+	deviceGrantName := nameArg(deviceGrantCommand.Arg("name", "Application name").Required())
+	deviceGrantKind := deviceGrantCommand.Arg("device", "Device").Required().Enum("camera", "mic", "fido")
+	deviceRevokeCommand := deviceCommand.Command("revoke", "Detach host devices")
+	deviceRevokeName := nameArg(deviceRevokeCommand.Arg("name", "Application name").Required())
+	deviceRevokeKind := deviceRevokeCommand.Arg("device", "Device").Required().Enum("camera", "mic", "fido")
+
+	lssharesName := nameArg(kingpin.Command("lsshares", "List filesystems exported to running VM").Arg("name", "Application name").Required())
+
+	shareCommand := kingpin.Command("share", "Manage shares of running VM")
+	shareAttachCommand := shareCommand.Command("attach", "Export directory until VM is stopped")
+	shareAttachName := nameArg(shareAttachCommand.Arg("name", "Application name").Required())
+	shareAttachDir := shareAttachCommand.Arg("dir", "Host directory").Required().String()
+	shareAttachTag := shareAttachCommand.Flag("tag", "Mount tag, /mnt/<tag> in VM").String()
+	shareAttachRO := shareAttachCommand.Flag("ro", "Read-only").Bool()
+	shareDetachCommand := shareCommand.Command("detach", "Unmount and detach share")
+	shareDetachName := nameArg(shareDetachCommand.Arg("name", "Application name").Required())
+	shareDetachTag := shareDetachCommand.Arg("tag", "Mount tag").Required().String()
+
+	setCommand := kingpin.Command("set", "Change memory and vCPUs, live if VM is running")
+	setName := nameArg(setCommand.Arg("name", "Application name").Required())
+	setMemory := setCommand.Flag("memory", "Memory, e.g. 6G").String()
+	setVCPUs := setCommand.Flag("vcpus", "Number of vCPUs").Int()
+
+	displayCommand := kingpin.Command("display", "Enable or disable guest displays")
+	displayAddName := nameArg(displayCommand.Command("add", "Enable one more display").Arg("name", "Application name").Required())
+	displayRemoveName := nameArg(displayCommand.Command("remove", "Disable the last display").Arg("name", "Application name").Required())
+
+	rpcCommand := kingpin.Command("rpc", "Talk to running VM over vsock")
+	rpcExecCommand := rpcCommand.Command("exec", "Run command in VM")
+	rpcExecName := nameArg(rpcExecCommand.Arg("name", "Application name").Required())
+	rpcExecArgs := rpcExecCommand.Arg("command", "Command and arguments").Required().Strings()
+	rpcPushCommand := rpcCommand.Command("push", "Copy file to VM")
+	rpcPushName := nameArg(rpcPushCommand.Arg("name", "Application name").Required())
+	rpcPushSrc := rpcPushCommand.Arg("src", "Host file").Required().ExistingFile()
+	rpcPushDst := rpcPushCommand.Arg("dst", "Guest path").Required().String()
+	rpcPullCommand := rpcCommand.Command("pull", "Copy file from VM")
+	rpcPullName := nameArg(rpcPullCommand.Arg("name", "Application name").Required())
+	rpcPullSrc := rpcPullCommand.Arg("src", "Guest path").Required().String()
+	rpcPullDst := rpcPullCommand.Arg("dst", "Host file").Required().String()
+	rpcNotifyCommand := rpcCommand.Command("notify", "Show notification in VM")
+	rpcNotifyName := nameArg(rpcNotifyCommand.Arg("name", "Application name").Required())
+	rpcNotifyMessage := rpcNotifyCommand.Arg("message", "Text").Required().String()
+
+	kingpin.Command("builds", "List in-flight builds")
+
+	exportOutput := kingpin.Command("export-config", "Export configuration, trusted repos and own expressions").Flag("output", "File, stdout by default").Short('o').String()
+	importConfigCommand := kingpin.Command("import-config", "Merge exported configuration")
+	importConfigFile := importConfigCommand.Arg("file", "Exported configuration").Required().ExistingFile()
+	importConfigYes := importConfigCommand.Flag("yes", "Do not ask for confirmation").Short('y').Bool()
+	importConfigDryRun := importConfigCommand.Flag("dry-run", "Only show changes").Bool()
+	importConfigSensitive := importConfigCommand.Flag("allow-sensitive", "Allow hooks, schedule, secrets, agents, devices and other host-sensitive settings").Bool()
+
+	kingpin.Command("outdated", "List built applications with available updates")
+	updateCommand := kingpin.Command("update", "Accept updates of expressions and nixpkgs and rebuild")
+	updateNames := updateCommand.Arg("names", "Application names").Strings()
+	updateAll := updateCommand.Flag("all", "Update every outdated application").Bool()
+	updateYes := updateCommand.Flag("yes", "Accept changed repo expressions without asking").Short('y').Bool()
+	updateJobs := updateCommand.Flag("jobs", "Concurrent builds").Short('j').Int()
+	updateVerbose := updateCommand.Flag("verbose", "Show build output").Short('v').Bool()
+
+	scheduleCommand := kingpin.Command("schedule", "Periodic jobs run by appvm daemon")
+	scheduleCommand.Command("list", "List jobs with last and next runs")
+
+	viewerName := kingpin.Command("viewer", "Run viewer and apply on_viewer_exit").Hidden().Arg("vm", "Domain name").Required().String()
+
+	logCommand := kingpin.Command("log", "Show logs")
+	logBuildCommand := logCommand.Command("build", "List build logs")
+	logBuildName := nameArg(logBuildCommand.Arg("name", "Application name").Required())
+	logBuildLast := logBuildCommand.Flag("last", "Print the last build log").Bool()
+
+	verifyCommand := kingpin.Command("verify", "Rebuild application and write attestation")
+	verifyName := nameArg(verifyCommand.Arg("name", "Application name").Required())
+	verifyStore := verifyCommand.Flag("store", "Compare with binary cache or store of another machine").String()
+	verifyAll := verifyCommand.Flag("all", "Rebuild every derivation of the build closure").Bool()
+	verifyOutput := verifyCommand.Flag("output", "Attestation file, stdout by default").Short('o').String()
+
+	infoName := nameArg(kingpin.Command("info", "Show host confinement and data usage of application VM").Arg("name", "Application name").Required())
+
+	statusName := nameArg(kingpin.Command("status", "Show application VM status and last exit reason").Arg("name", "Application name").Required())
+
+	wmRulesCommand := kingpin.Command("wm-rules", "Print sway/i3/Hyprland rules for viewer windows")
+	wmRulesWM := wmRulesCommand.Flag("wm", "Window manager").Default("sway").Enum("sway", "i3", "hyprland")
+	wmRulesNames := wmRulesCommand.Arg("names", "Application names").Strings()
+
+	clipCommand := kingpin.Command("clip", "Copy clipboard between host and application VM")
+	clipPushName := nameArg(clipCommand.Command("push", "Copy host clipboard to VM").Arg("name", "Application name").Required())
+	clipPullName := nameArg(clipCommand.Command("pull", "Copy VM clipboard to host").Arg("name", "Application name").Required())
+
+	screenshotCommand := kingpin.Command("screenshot", "Save screenshot of application VM")
+	screenshotName := nameArg(screenshotCommand.Arg("name", "Application name").Required())
+	screenshotOutput := screenshotCommand.Flag("output", "Image file, <name>-<time>.ppm by default").Short('o').String()
+
+	focusName := nameArg(kingpin.Command("focus", "Focus viewer window, open or start it if there is none").Arg("name", "Application name").Required())
+
+	kingpin.Command("ui", "Terminal UI to manage application VMs")
+
+	doctorFix := kingpin.Command("doctor", "Check host, SELinux and AppArmor setup").Flag("fix", "Apply labels and AppArmor rules").Bool()
+
+	initCommand := kingpin.Command("init", "Check host setup and build a test VM")
+	initYes := initCommand.Flag("yes", "Do not ask for confirmation").Short('y').Bool()
+	initNoBuild := initCommand.Flag("no-build", "Do not build test VM").Bool()
+	initTestApp := initCommand.Flag("test-app", "Application to build").Default("chromium").String()
+
+	kingpin.Command("plugins", "List plugins (appvm-<name> executables in PATH)")
+
+	dispatchPlugin(os.Args)
+
+	command := parseCommandLine()
+
+	// Passed to appvm started by daemon and to plugins
+	os.Setenv("APPVM_LIBVIRT_URI", *libvirtURI)
+	if offlineMode {
+		os.Setenv("APPVM_OFFLINE", "true")
+	}
+	setupProxy()
+
 	var l *libvirt.Libvirt
-	if kingpin.Parse() != "generate" {
-		c, err := net.DialTimeout(
-			"unix",
-			"/var/run/libvirt/libvirt-sock",
-			time.Second,
-		)
+	if needLibvirt(command) && !(command == "start" && *startDry) {
+		c, err := libvirtDial(*libvirtURI)
 		if err != nil {
-			log.Fatal(err)
+			fatal(withCategory("libvirt", fmt.Errorf(
+				"libvirt (%s): %v, is libvirtd running?", *libvirtURI, err)))
 		}
 
 		l = libvirt.New(c)
 		if err := l.Connect(); err != nil {
-			log.Fatal(err)
+			fatal(withCategory("libvirt",
+				fmt.Errorf("libvirt (%s): %v", *libvirtURI, err)))
 		}
 		defer l.Disconnect()
 
 		cleanupStatelessVMs(l)
 	}
 
-	switch kingpin.Parse() {
+	switch command {
 	case "list":
-		list(l)
+		if *listDisk {
+			diskUsage()
+		} else {
+			list(l)
+		}
+	case "catalog":
+		err = catalog(*catalogCategory, *catalogQuery)
+		if err != nil {
+			fatal(err)
+		}
 	case "search":
 		search(*searchName)
 	case "generate":
 		generate(*generateName, *generateBin, *generateVMName,
 			*generateBuildVM)
 	case "start":
-		networkModel := parseNetworkModel(*startOffline, *startNetwork)
-		start(l, *startName,
+		if *startDry && *startFromOCI != "" {
+			*startName = ociName(*startFromOCI)
+		} else if *startDry && *startAppImage != "" {
+			*startName = appimageName(*startAppImage)
+		} else if *startFromOCI != "" {
+			if *startStateless {
+				fatal(withCategory("usage",
+					errors.New("can't use --from-oci with --stateless")))
+			}
+			*startName, err = generateOCI(*startFromOCI, *startForce)
+			if err != nil {
+				fatal(err)
+			}
+		}
+		if !*startDry && *startAppImage != "" {
+			*startName, err = generateAppImage(*startAppImage, *startForce)
+			if err != nil {
+				fatal(err)
+			}
+		}
+		if *startName == "" {
+			fatal(withCategory("usage",
+				errors.New("application name is required")))
+		}
+		config, err := loadConfig()
+		if err != nil {
+			fatal(err)
+		}
+		if *startNetwork == "" {
+			*startNetwork = config.app(*startName).Network
+		}
+		networkModel := parseNetworkModel(*startNetwork)
+		err = setOverrides(*startPackages, *startExtraModules)
+		if err != nil {
+			fatal(withCategory("usage", err))
+		}
+		if *startDry {
+			err = startDryRun(*startName, networkModel, !*startCli,
+				*startStateless)
+			if err != nil {
+				fatal(err)
+			}
+			return
+		}
+		err = saveViewerConfig(*startName, viewerOpts, *startResetViewer)
+		if err != nil {
+			fatal(err)
+		}
+		var devices []string
+		if *startCamera {
+			devices = append(devices, "camera")
+		}
+		if *startMic {
+			devices = append(devices, "mic")
+		}
+		if *startFIDO {
+			devices = append(devices, "fido")
+		}
+		for _, d := range devices {
+			if !deviceAllowed(config.app(*startName), d) {
+				fatal(withCategory("denied", fmt.Errorf(
+					"%s is not allowed for %s, add it to \"devices\" in %s",
+					d, *startName, configPath())))
+			}
+		}
+		vmName, _ := start(l, *startName,
 			!*startQuiet, networkModel, !*startCli, *startStateless,
 			*startArgs, *startOpen)
+		if vmName == "" {
+			fatal(errors.New(*startName + " is not started"))
+		}
+		for _, d := range devices {
+			err = deviceGrant(l, vmName[6:], d)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+		if !*startStateless {
+			args := []string{"start", *startName, "--quiet",
+				"--network", networkModelName(networkModel)}
+			if *startCli {
+				args = append(args, "--cli")
+			}
+			args = append(args, overridesArgs()...)
+			saveStartArgs(vmName[6:], args)
+		}
 	case "stop":
 		stop(l, *stopName)
+	case "ip":
+		err = showIP(l, *ipName)
+		if err != nil {
+			fatal(err)
+		}
+	case "ps":
+		err = guestPs(l, *psName)
+		if err != nil {
+			fatal(err)
+		}
+	case "kill":
+		err = guestKill(l, *killName, *killTarget, *killSignal)
+		if err != nil {
+			fatal(err)
+		}
+	case "rename":
+		err = rename(l, *renameFrom, *renameTo, *renameRestart)
+		if err != nil {
+			fatal(err)
+		}
+	case "clone":
+		err = clone(*cloneFrom, *cloneTo, *cloneData)
+		if err != nil {
+			fatal(err)
+		}
+	case "attach":
+		err = attach(l, *attachName)
+		if err != nil {
+			fatal(err)
+		}
 	case "drop":
-		drop(*dropName)
+		err = drop(l, *dropName, *dropYes)
+		if err != nil {
+			fatal(err)
+		}
+	case "undrop":
+		err = undrop(*undropName)
+		if err != nil {
+			fatal(err)
+		}
 	case "autoballoon":
 		autoBalloon(l, *minMemory*1024, *adjustPercent)
 	case "sync":
 		sync()
+	case "handler register":
+		err = handlerRegister(*handlerRegisterName, *handlerRegisterMimes)
+		if err != nil {
+			fatal(err)
+		}
+	case "handler unregister":
+		err = handlerUnregister(*handlerUnregisterName)
+		if err != nil {
+			fatal(err)
+		}
+	case "handler list":
+		handlerList()
+	case "daemon":
+		daemon(l, *daemonListen, *daemonGRPCListen, *daemonTLSCert,
+			*daemonTLSKey)
+	case "web":
+		web(*webListen, *webAPI)
+	case "send":
+		src, path, err := parseVMPath(*sendFrom)
+		if err != nil {
+			fatal(err)
+		}
+		err = send(l, src, path, *sendTo, *sendYes)
+		if err != nil {
+			fatal(err)
+		}
+	case "quarantine":
+		err = quarantine(l, *quarantineFile, *quarantineApp)
+		if err != nil {
+			fatal(err)
+		}
+	case "import-flatpak":
+		err = importFlatpak(*importFlatpakID, *importFlatpakForce)
+		if err != nil {
+			fatal(err)
+		}
+	case "cache push":
+		err = cachePush(*cachePushName, !*cachePushQuiet)
+		if err != nil {
+			fatal(err)
+		}
+	case "bootstrap-nix":
+		err = bootstrapNix(*bootstrapChannel, *bootstrapSha256)
+		if err != nil {
+			fatal(err)
+		}
+	case "disk reset":
+		err = diskReset(l, *diskResetName)
+		if err != nil {
+			fatal(err)
+		}
+	case "disk compact":
+		err = diskCompact(l, *diskCompactName)
+		if err != nil {
+			fatal(err)
+		}
+	case "data snapshot":
+		snapshot, err := dataSnapshot(*dataSnapshotName)
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Println(snapshot)
+	case "data list":
+		snapshots, err := dataSnapshots(*dataListName)
+		if err != nil {
+			fatal(err)
+		}
+		for _, s := range snapshots {
+			fmt.Println("\t", s)
+		}
+	case "data rollback":
+		if isRunning(l, *dataRollbackName) {
+			fatal(errors.New(*dataRollbackName + " is running, stop it first"))
+		}
+		err = dataRollback(*dataRollbackName, *dataRollbackSnapshot)
+		if err != nil {
+			fatal(err)
+		}
+	case "tune ksm":
+		err = tuneKSMState(*tuneKSM)
+		if err != nil {
+			fatal(err)
+		}
+	case "stats":
+		err = stats(*statsName, *statsWidth, *statsJSON)
+		if err != nil {
+			fatal(err)
+		}
+	case "which":
+		err = which(*whichName)
+		if err != nil {
+			fatal(err)
+		}
+	case "trust list":
+		err = trustList()
+		if err != nil {
+			fatal(err)
+		}
+	case "trust add":
+		err = trustAdd(*trustAddRepo, *trustAddNote)
+		if err != nil {
+			fatal(err)
+		}
+	case "trust revoke":
+		err = trustRevoke(*trustRevokeURL)
+		if err != nil {
+			fatal(err)
+		}
+	case "trust inspect":
+		err = trustInspect(*trustInspectRepo)
+		if err != nil {
+			fatal(err)
+		}
+	case "diff":
+		err = diffExpr(*diffName)
+		if err != nil {
+			fatal(err)
+		}
+	case "check":
+		config, err := loadConfig()
+		if err != nil {
+			fatal(err)
+		}
+		drv, err := checkExpr(configDir, *checkName, config.app(*checkName).Arch)
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Println(drv)
+	case "cat":
+		err = catExpr(*catName)
+		if err != nil {
+			fatal(err)
+		}
+	case "build":
+		err = checkBuildNames(*buildNames)
+		if err != nil {
+			fatal(err)
+		}
+		err = buildApps(*buildNames, *buildJobs, *buildVerbose)
+		if err != nil {
+			fatal(err)
+		}
+	case "rpc exec":
+		code, err := rpcExec(l, *rpcExecName, *rpcExecArgs)
+		if err != nil {
+			fatal(err)
+		}
+		os.Exit(code)
+	case "rpc push":
+		err = rpcPush(l, *rpcPushName, *rpcPushSrc, *rpcPushDst)
+		if err != nil {
+			fatal(err)
+		}
+	case "rpc pull":
+		err = rpcPull(l, *rpcPullName, *rpcPullSrc, *rpcPullDst)
+		if err != nil {
+			fatal(err)
+		}
+	case "rpc notify":
+		err = rpcNotify(l, *rpcNotifyName, *rpcNotifyMessage)
+		if err != nil {
+			fatal(err)
+		}
+	case "viewer":
+		err = superviseViewer(l, *viewerName)
+		if err != nil {
+			fatal(err)
+		}
+	case "device grant":
+		err = deviceGrant(l, *deviceGrantName, *deviceGrantKind)
+		if err != nil {
+			fatal(err)
+		}
+	case "device revoke":
+		err = deviceRevoke(l, *deviceRevokeName, *deviceRevokeKind)
+		if err != nil {
+			fatal(err)
+		}
+	case "set":
+		err = setResources(l, *setName, *setMemory, *setVCPUs)
+		if err != nil {
+			fatal(err)
+		}
+	case "display add":
+		err = displayChange(l, *displayAddName, true)
+		if err != nil {
+			fatal(err)
+		}
+	case "display remove":
+		err = displayChange(l, *displayRemoveName, false)
+		if err != nil {
+			fatal(err)
+		}
+	case "wm-rules":
+		err = checkBuildNames(*wmRulesNames)
+		if err != nil {
+			fatal(err)
+		}
+		err = wmRules(*wmRulesWM, *wmRulesNames)
+		if err != nil {
+			fatal(err)
+		}
+	case "clip push":
+		err = clip(l, *clipPushName, true)
+		if err != nil {
+			fatal(err)
+		}
+	case "clip pull":
+		err = clip(l, *clipPullName, false)
+		if err != nil {
+			fatal(err)
+		}
+	case "screenshot":
+		err = screenshot(l, *screenshotName, *screenshotOutput)
+		if err != nil {
+			fatal(err)
+		}
+	case "focus":
+		err = focus(l, *focusName)
+		if err != nil {
+			fatal(err)
+		}
+	case "export-config":
+		err = exportConfig(*exportOutput)
+		if err != nil {
+			fatal(err)
+		}
+	case "import-config":
+		err = importConfig(*importConfigFile, *importConfigYes,
+			*importConfigDryRun, *importConfigSensitive)
+		if err != nil {
+			fatal(err)
+		}
+	case "outdated":
+		err = outdated()
+		if err != nil {
+			fatal(err)
+		}
+	case "update":
+		err = checkBuildNames(*updateNames)
+		if err != nil {
+			fatal(err)
+		}
+		err = update(*updateNames, *updateAll, *updateYes, *updateJobs,
+			*updateVerbose)
+		if err != nil {
+			fatal(err)
+		}
+	case "schedule list":
+		err = listSchedule()
+		if err != nil {
+			fatal(err)
+		}
+	case "builds":
+		listBuilds()
+	case "log build":
+		err = logBuild(*logBuildName, *logBuildLast)
+		if err != nil {
+			fatal(err)
+		}
+	case "status":
+		status(l, *statusName)
+	case "verify":
+		err = verify(*verifyName, *verifyStore, *verifyAll, *verifyOutput)
+		if err != nil {
+			fatal(err)
+		}
+	case "lsshares":
+		err = lsshares(l, *lssharesName)
+		if err != nil {
+			fatal(err)
+		}
+	case "share attach":
+		err = shareAttach(l, *shareAttachName, *shareAttachDir,
+			*shareAttachTag, *shareAttachRO)
+		if err != nil {
+			fatal(err)
+		}
+	case "share detach":
+		err = shareDetach(l, *shareDetachName, *shareDetachTag)
+		if err != nil {
+			fatal(err)
+		}
+	case "doctor":
+		err = doctor(*libvirtURI, *doctorFix)
+		if err != nil {
+			fatal(err)
+		}
+	case "init":
+		err = setup(*libvirtURI, *initYes, !*initNoBuild, *initTestApp)
+		if err != nil {
+			fatal(err)
+		}
+	case "ui":
+		err = ui(l)
+		if err != nil {
+			fatal(err)
+		}
+	case "info":
+		err = info(l, *infoName)
+		if err != nil {
+			fatal(err)
+		}
+	case "plugins":
+		for _, p := range plugins() {
+			fmt.Println("\t", p)
+		}
+	case "gc":
+		err = gc(l, *gcDryRun, *gcNix, *gcKeep)
+		if err != nil {
+			fatal(err)
+		}
+	case "prune":
+		err = prune(l, *pruneDryRun, *pruneYes)
+		if err != nil {
+			fatal(err)
+		}
 	}
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"runtime"
+)
+
+// Guests of other architectures are emulated by qemu TCG, nix-build
+// needs either binfmt emulation or remote builder for them.
+
+var hostArch = map[string]string{
+	"amd64":   "x86_64",
+	"arm64":   "aarch64",
+	"riscv64": "riscv64",
+}[runtime.GOARCH]
+
+func guestArch(arch string) string {
+	if arch == "" {
+		return hostArch
+	}
+	return arch
+}
+
+func isEmulated(arch string) bool {
+	return guestArch(arch) != hostArch
+}
+
+func checkArch(arch string) (err error) {
+	switch guestArch(arch) {
+	case "x86_64", "aarch64", "riscv64":
+		return
+	}
+	return errors.New("unsupported architecture " + arch)
+}
+
+// Part of <os> and <features>
+func archXML(arch string) (osType, features string) {
+	switch guestArch(arch) {
+	case "aarch64":
+		osType = "<type arch='aarch64' machine='virt'>hvm</type>"
+	case "riscv64":
+		osType = "<type arch='riscv64' machine='virt'>hvm</type>"
+	default:
+		osType = "<type arch='x86_64'>hvm</type>"
+		features = "<acpi></acpi>"
+	}
+	return
+}
+
+func domainType(arch string) string {
+	if isEmulated(arch) {
+		return "qemu"
+	}
+	return "kvm"
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Per-application policy of appvm autoballoon. Floor and ceiling are
+// in MiB and override --min-memory and the memory set by appvm set,
+// adjust_percent overrides --adj-memory. Disabled VMs are left as is.
+
+type balloonConfig struct {
+	Disabled bool `json:"disabled,omitempty"`
+	// MiB
+	Min uint64 `json:"min,omitempty"`
+	Max uint64 `json:"max,omitempty"`
+	// Headroom above used memory
+	AdjustPercent *uint64 `json:"adjust_percent,omitempty"`
+}
+
+func checkBalloon(b balloonConfig) error {
+	if b.Min != 0 && b.Max != 0 && b.Min > b.Max {
+		return fmt.Errorf("balloon min %d MiB is above max %d MiB",
+			b.Min, b.Max)
+	}
+	return nil
+}
+
+// New memory in KiB for the VM using memoryUsed KiB of memoryMax KiB,
+// defaults are the autoballoon flags (memoryMin is in KiB)
+func balloonTarget(app appConfig, memoryUsed, memoryMax, memoryMin,
+	adjustPercent uint64) (memoryNew uint64) {
+
+	b := app.Balloon
+	if b.AdjustPercent != nil {
+		adjustPercent = *b.AdjustPercent
+	}
+	if b.Min != 0 {
+		memoryMin = b.Min * 1024
+	}
+
+	ceiling := memoryMax - 1
+	// Limit set by appvm set
+	if m := app.Memory * 1024; m != 0 && m < ceiling {
+		ceiling = m
+	}
+	if m := b.Max * 1024; m != 0 && m < ceiling {
+		ceiling = m
+	}
+
+	memoryNew = uint64(float64(memoryUsed) * (1 + float64(adjustPercent)/100))
+	if memoryNew > ceiling {
+		memoryNew = ceiling
+	}
+	if memoryNew < memoryMin {
+		memoryNew = memoryMin
+	}
+	if memoryNew > memoryMax {
+		memoryNew = memoryMax
+	}
+	return
+}
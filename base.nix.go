@@ -2,13 +2,97 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"os/user"
 )
 
 var base_nix = `
 {pkgs, ...}:
-{
+let
+  xdgOpen = pkgs.writeShellScriptBin "xdg-open" ''
+    target="$1"
+    if [ -e "$target" ]; then
+      target=$(${pkgs.coreutils}/bin/realpath "$target")
+    fi
+    echo "$target" > /dev/virtio-ports/org.appvm.open
+  '';
+  appvmSend = pkgs.writeShellScriptBin "appvm-send" ''
+    if [ $# -ne 2 ]; then
+      echo "Usage: appvm-send FILE APPVM" >&2
+      exit 1
+    fi
+    echo "$2 $(${pkgs.coreutils}/bin/realpath "$1")" > /dev/virtio-ports/org.appvm.send
+  '';
+  # RPC from the host over vsock, see vsock.go
+  appvmRPC = pkgs.writeScript "appvm-rpc" ''
+    #!${pkgs.python3}/bin/python3
+    import base64, json, os, socket, struct, subprocess
+
+    def recv_exact(conn, n):
+        buf = b""
+        while len(buf) < n:
+            chunk = conn.recv(n - len(buf))
+            if not chunk:
+                raise EOFError()
+            buf += chunk
+        return buf
+
+    def b64(data):
+        return base64.b64encode(data).decode()
+
+    def handle(req):
+        method = req.get("method")
+        if method == "exec":
+            p = subprocess.run(req["args"], capture_output=True)
+            return {"stdout": b64(p.stdout), "stderr": b64(p.stderr),
+                    "exitcode": p.returncode}
+        if method == "put":
+            with open(req["path"], "wb") as f:
+                f.write(base64.b64decode(req.get("data", "")))
+            return {}
+        if method == "get":
+            with open(req["path"], "rb") as f:
+                return {"data": b64(f.read())}
+        if method == "power":
+            state = json.loads(base64.b64decode(req["data"]))
+            run = os.environ.get("XDG_RUNTIME_DIR", "/tmp") + "/appvm"
+            os.makedirs(run, exist_ok=True)
+            with open(run + "/power.json", "w") as f:
+                json.dump(state, f)
+            if state.get("low"):
+                subprocess.run(["${pkgs.libnotify}/bin/notify-send",
+                                "-u", "critical", "appvm",
+                                "Host battery is low"])
+            return {}
+        if method == "notify":
+            subprocess.run(["${pkgs.libnotify}/bin/notify-send",
+                            "appvm", req["message"]])
+            return {}
+        return {"error": "unknown method " + str(method)}
+
+    def serve(conn):
+        with conn:
+            while True:
+                try:
+                    size, = struct.unpack(">I", recv_exact(conn, 4))
+                    req = json.loads(recv_exact(conn, size))
+                except EOFError:
+                    return
+                try:
+                    resp = handle(req)
+                except Exception as e:
+                    resp = {"error": str(e)}
+                raw = json.dumps(resp).encode()
+                conn.sendall(struct.pack(">I", len(raw)) + raw)
+
+    s = socket.socket(socket.AF_VSOCK, socket.SOCK_STREAM)
+    s.bind((socket.VMADDR_CID_ANY, 5000))
+    s.listen()
+    os.chdir(os.path.expanduser("~"))
+    while True:
+        conn, _ = s.accept()
+        serve(conn)
+  '';
+in {
   imports = [
     <nix/local.nix>
   ];
@@ -28,6 +112,24 @@ var base_nix = `
 
   services.spice-vdagentd.enable = true;
 
+  services.qemuGuest.enable = true;
+  services.fstrim.enable = true;
+
+  # Addresses from RA (SLAAC) and DHCPv6 if appvm networking has IPv6
+  networking.enableIPv6 = true;
+
+  # Requests are handled on the host by appvm daemon
+  # xrandr is used by appvm display add/remove, xclip by appvm clip
+  environment.systemPackages = [ (pkgs.hiPrio xdgOpen) appvmSend pkgs.xorg.xrandr pkgs.xclip ];
+  services.udev.extraRules = ''
+    SUBSYSTEM=="virtio-ports", ATTR{name}=="org.appvm.open", OWNER="user"
+    SUBSYSTEM=="virtio-ports", ATTR{name}=="org.appvm.send", OWNER="user"
+    # FIDO tokens attached by appvm device grant
+    KERNEL=="hidraw*", SUBSYSTEM=="hidraw", OWNER="user"
+    # vCPUs hotplugged by appvm set
+    SUBSYSTEM=="cpu", ACTION=="add", TEST=="online", ATTR{online}=="0", ATTR{online}="1"
+  '';
+
   users.extraUsers.user = {
     uid = %s;
     isNormalUser = true;
@@ -71,41 +173,35 @@ startup = do
     wantedBy = [ "sysinit.target" ];
   };
 
-  systemd.user.services."xrandr" = {
-    serviceConfig = {
-      StartLimitBurst = 100;
-    };
-    script = "${pkgs.xorg.xrandr}/bin/xrandr --output Virtual-1 --mode $(${pkgs.xorg.xrandr}/bin/xrandr | grep '   ' | head -n 2 | tail -n 1 | ${pkgs.gawk}/bin/awk '{ print $1 }')";
+  # DoH resolver of per-app DNS policy, started by appvm daemon
+  systemd.services.appvm-doh = {
+    description = "DNS over HTTPS proxy";
+    script = "exec ${pkgs.dnsproxy}/bin/dnsproxy -l 127.0.0.1 -p 53 -u $(cat /run/appvm/doh)";
   };
 
-  systemd.user.timers."xrandr" = {
-    description = "Auto update resolution crutch";
-    timerConfig = {
-      OnBootSec = "1s";
-      OnUnitInactiveSec = "1s";
-      Unit = "xrandr.service";
-      AccuracySec = "1us";
+  systemd.user.services."appvm-rpc" = {
+    description = "appvm RPC over vsock";
+    environment.DISPLAY = ":0";
+    serviceConfig = {
+      ExecStart = "${appvmRPC}";
+      Restart = "always";
     };
-    wantedBy = ["timers.target"];
+    wantedBy = [ "default.target" ];
   };
 
-  systemd.services."autoballoon" = {
+  systemd.user.services."xrandr" = {
     serviceConfig = {
       StartLimitBurst = 100;
     };
-    script = ''
-      ${pkgs.procps}/bin/free -m | grep Mem | \
-        ${pkgs.gawk}/bin/awk '{print $2 "-" $4}' | \
-        ${pkgs.bc}/bin/bc > /home/user/.memory_used
-    '';
+    script = "${pkgs.xorg.xrandr}/bin/xrandr --output Virtual-1 --mode $(${pkgs.xorg.xrandr}/bin/xrandr | grep '   ' | head -n 2 | tail -n 1 | ${pkgs.gawk}/bin/awk '{ print $1 }')";
   };
 
-  systemd.timers."autoballoon" = {
+  systemd.user.timers."xrandr" = {
     description = "Auto update resolution crutch";
     timerConfig = {
       OnBootSec = "1s";
       OnUnitInactiveSec = "1s";
-      Unit = "autoballoon.service";
+      Unit = "xrandr.service";
       AccuracySec = "1us";
     };
     wantedBy = ["timers.target"];
@@ -116,7 +212,7 @@ startup = do
 func baseNix() []byte {
 	u, err := user.Current()
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 	return []byte(fmt.Sprintf(base_nix, u.Uid))
 }
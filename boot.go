@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Boot parameters are cached per generation (output path of the VM
+// derivation), so starting already built VM doesn't run nix-build.
+
+// Supported version of appvm.json, see vm.nix.go
+const bootSchema = 1
+
+type vmMetadata struct {
+	Schema   int    `json:"schema"`
+	Toplevel string `json:"toplevel"`
+	Kernel   string `json:"kernel"`
+	Initrd   string `json:"initrd"`
+	RegInfo  string `json:"regInfo"`
+	// Verity-protected store image, see store.go
+	Store string `json:"store,omitempty"`
+}
+
+type bootInfo struct {
+	Out     string `json:"out"`
+	System  string `json:"system"`
+	Kernel  string `json:"kernel"`
+	Initrd  string `json:"initrd"`
+	Reginfo string `json:"reginfo"`
+	Store   string `json:"store,omitempty"`
+}
+
+func bootCacheDir() string {
+	return appvmHomesDir + ".boot/"
+}
+
+func bootCachePath(out string) string {
+	return bootCacheDir() + filepath.Base(out) + ".json"
+}
+
+func newBootInfo(out string) (b bootInfo, err error) {
+	raw, err := ioutil.ReadFile(out + "/appvm.json")
+	if err != nil {
+		return
+	}
+
+	var m vmMetadata
+	err = json.Unmarshal(raw, &m)
+	if err != nil {
+		return
+	}
+
+	if m.Schema > bootSchema {
+		err = fmt.Errorf("%s/appvm.json has schema %d, only %d is "+
+			"supported, update appvm", out, m.Schema, bootSchema)
+		return
+	}
+
+	b = bootInfo{
+		Out:     out,
+		System:  m.Toplevel,
+		Kernel:  m.Kernel,
+		Initrd:  m.Initrd,
+		Reginfo: "regInfo=" + m.RegInfo,
+		Store:   m.Store,
+	}
+	return
+}
+
+// Cache is valid only while the generation is in the store
+func loadBootInfo(out string) (b bootInfo, ok bool) {
+	if out == "" {
+		return
+	}
+
+	raw, err := ioutil.ReadFile(bootCachePath(out))
+	if err != nil {
+		return
+	}
+
+	if json.Unmarshal(raw, &b) != nil || b.Out != out {
+		return
+	}
+
+	ok = fileExists(b.Kernel) && fileExists(b.Initrd)
+	return
+}
+
+func saveBootInfo(b bootInfo) {
+	os.MkdirAll(bootCacheDir(), 0700)
+	raw, _ := json.Marshal(b)
+	ioutil.WriteFile(bootCachePath(b.Out), raw, 0600)
+}
+
+// Boot parameters of the system path
+func systemBootInfo(system string) (b bootInfo, ok bool) {
+	files, _ := filepath.Glob(bootCacheDir() + "*.json")
+	for _, f := range files {
+		raw, err := ioutil.ReadFile(f)
+		if err == nil && json.Unmarshal(raw, &b) == nil &&
+			b.System == system {
+			return b, true
+		}
+	}
+	return bootInfo{}, false
+}
+
+// Entries for generations removed by nix-collect-garbage
+func staleBootInfo() (stale []string) {
+	files, _ := filepath.Glob(bootCacheDir() + "*.json")
+	for _, f := range files {
+		var b bootInfo
+		raw, err := ioutil.ReadFile(f)
+		if err == nil && json.Unmarshal(raw, &b) == nil &&
+			fileExists(b.Kernel) {
+			continue
+		}
+		stale = append(stale, f)
+	}
+	return
+}
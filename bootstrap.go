@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Static nix for hosts without nix installation, it uses /nix/store
+// directly, so only /nix owned by the user is required. The build is
+// checked against the sha256 given by the user, the one shown on the
+// Hydra build page.
+
+// Nix system of the host architecture
+var nixSystems = map[string]string{
+	"amd64": "x86_64-linux",
+	"arm64": "aarch64-linux",
+}
+
+func nixStaticURL(system string) string {
+	return "https://hydra.nixos.org/job/nix/maintenance-2.18/buildStatic." +
+		system + "/latest/download-by-type/file/binary-dist"
+}
+
+var nixStaticDir = os.Getenv("HOME") + "/.local/share/appvm/bin/"
+
+var nixStaticTools = []string{"nix-build", "nix-channel", "nix-instantiate",
+	"nix-store", "nix-env", "nix-collect-garbage"}
+
+// Returns tool from PATH or from the bootstrapped static nix
+func nixBin(name string) string {
+	if _, err := exec.LookPath(name); err == nil {
+		return name
+	}
+	if fileExists(nixStaticDir + name) {
+		return nixStaticDir + name
+	}
+	return name
+}
+
+func download(url, to string) (err error) {
+	resp, err := httpGet(url)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	f, err := os.OpenFile(to, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return
+	}
+
+	_, err = io.Copy(f, resp.Body)
+	if err != nil {
+		f.Close()
+		return
+	}
+	return f.Close()
+}
+
+// Downloads to the file only if the content has the checksum, the file
+// is executable only after that
+func downloadChecked(url, sum, to string) (err error) {
+	resp, err := httpGet(url)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	f, err := ioutil.TempFile(filepath.Dir(to), ".download-")
+	if err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, hash), resp.Body)
+	if err != nil {
+		f.Close()
+		return
+	}
+	err = f.Close()
+	if err != nil {
+		return
+	}
+
+	if got := hex.EncodeToString(hash.Sum(nil)); got != sum {
+		return fmt.Errorf("%s: sha256 is %s, expected %s", url, got, sum)
+	}
+
+	err = os.Chmod(f.Name(), 0755)
+	if err != nil {
+		return
+	}
+	return os.Rename(f.Name(), to)
+}
+
+func bootstrapNix(channel, sum string) (err error) {
+	if _, err = exec.LookPath("nix-build"); err == nil {
+		log.Println("Nix is already installed")
+		return
+	}
+
+	system, ok := nixSystems[runtime.GOARCH]
+	if !ok {
+		return errors.New("no static nix for " + runtime.GOARCH)
+	}
+	sum = strings.ToLower(sum)
+	if len(sum) != sha256.Size*2 {
+		return withCategory("usage", errors.New("--sha256 of the "+
+			system+" static nix build is required"))
+	}
+
+	f, err := ioutil.TempFile("/nix", ".appvm-")
+	if err != nil {
+		err = errors.New("/nix is not writable, create it with: " +
+			"sudo install -d -o $USER /nix")
+		return
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	err = os.MkdirAll(nixStaticDir, 0755)
+	if err != nil {
+		return
+	}
+
+	url := nixStaticURL(system)
+	log.Println("Download", url)
+	err = downloadChecked(url, sum, nixStaticDir+"nix")
+	if err != nil {
+		return
+	}
+
+	// Static nix is multi-call binary
+	for _, tool := range nixStaticTools {
+		os.Remove(nixStaticDir + tool)
+		err = os.Symlink("nix", nixStaticDir+tool)
+		if err != nil {
+			return
+		}
+	}
+
+	err = exec.Command(nixBin("nix-channel"), "--add", channel,
+		"nixpkgs").Run()
+	if err != nil {
+		return
+	}
+
+	command := exec.Command(nixBin("nix-channel"), "--update")
+	command.Stdout = os.Stdout
+	command.Stderr = os.Stderr
+	err = command.Run()
+	if err != nil {
+		return
+	}
+
+	log.Println("Nix is installed to", nixStaticDir)
+	return
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Closures of several application VMs are evaluated and built
+// concurrently, at most jobs at once.
+
+const buildJobsDefault = 2
+
+type buildResult struct {
+	Name     string
+	Err      error
+	Duration time.Duration
+}
+
+func buildApps(names []string, jobs int, verbose bool) (err error) {
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+
+	if jobs <= 0 {
+		jobs = config.Nix.BuildJobs
+	}
+	if jobs <= 0 {
+		jobs = buildJobsDefault
+	}
+
+	slots := make(chan bool, jobs)
+	results := make(chan buildResult)
+
+	for _, name := range names {
+		go func(name string) {
+			slots <- true
+			defer func() { <-slots }()
+
+			fmt.Printf("[%s] building\n", name)
+			start := time.Now()
+			realpath, _, _, err := buildVM(configDir, name, verbose,
+				config.app(name).Arch, name)
+			if err == nil {
+				linkSystem(name, realpath)
+			}
+			results <- buildResult{name, err, time.Since(start)}
+		}(name)
+	}
+
+	failed := 0
+	for range names {
+		r := <-results
+		if r.Err != nil {
+			fmt.Printf("[%s] failed: %v\n", r.Name, r.Err)
+			failed++
+			continue
+		}
+		fmt.Printf("[%s] done in %s\n", r.Name, r.Duration.Round(time.Second))
+	}
+
+	if failed != 0 {
+		err = fmt.Errorf("%d of %d builds failed", failed, len(names))
+	}
+	return
+}
+
+func checkBuildNames(names []string) error {
+	for _, name := range names {
+		if err := validateName(name); err != nil {
+			return err
+		}
+		if _, ok := findAppExpr(name); !ok {
+			return errNoExpr(name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Evaluation and builds of large VMs may take all memory of the host.
+// nix-instantiate and nix-build are run in a transient systemd scope of
+// the user with MemoryMax/CPUQuota; with nix-daemon the builders run in
+// the daemon, so they are limited only by --cores and --max-jobs.
+
+type buildLimits struct {
+	// systemd resource control values, e.g. "4G" and "200%"
+	MemoryMax string `json:"memory_max,omitempty"`
+	CPUQuota  string `json:"cpu_quota,omitempty"`
+	// nix --cores and --max-jobs, nix.conf values by default
+	Cores   int `json:"cores,omitempty"`
+	MaxJobs int `json:"max_jobs,omitempty"`
+}
+
+// Set by --cores and --max-jobs, override config.json
+var coresFlag, maxJobsFlag int
+
+func nixLimitOptions(c buildLimits) (args []string) {
+	if coresFlag != 0 {
+		c.Cores = coresFlag
+	}
+	if maxJobsFlag != 0 {
+		c.MaxJobs = maxJobsFlag
+	}
+	if c.Cores != 0 {
+		args = append(args, "--cores", strconv.Itoa(c.Cores))
+	}
+	if c.MaxJobs != 0 {
+		args = append(args, "--max-jobs", strconv.Itoa(c.MaxJobs))
+	}
+	return
+}
+
+var scopeWarned bool
+
+// Command line of the nix tool, in a scope if limits are set
+func limitedCommand(c buildLimits, name string, args ...string) (string,
+	[]string) {
+
+	if c.MemoryMax == "" && c.CPUQuota == "" {
+		return name, args
+	}
+
+	systemdRun, err := exec.LookPath("systemd-run")
+	if err != nil {
+		if !scopeWarned {
+			log.Println("systemd-run is not found, build limits " +
+				"are not applied")
+			scopeWarned = true
+		}
+		return name, args
+	}
+
+	scope := []string{"--user", "--scope", "--quiet", "--collect"}
+	if c.MemoryMax != "" {
+		scope = append(scope, "-p", "MemoryMax="+c.MemoryMax,
+			"-p", "MemorySwapMax=0")
+	}
+	if c.CPUQuota != "" {
+		scope = append(scope, "-p", "CPUQuota="+c.CPUQuota)
+	}
+	scope = append(scope, "--", name)
+	return systemdRun, append(scope, args...)
+}
+
+func checkBuildLimits(c buildLimits) error {
+	if c.Cores < 0 || c.MaxJobs < 0 {
+		return fmt.Errorf("invalid build limits: cores %d, max_jobs %d",
+			c.Cores, c.MaxJobs)
+	}
+	if c.MemoryMax != "" && !strings.HasSuffix(c.MemoryMax, "%") {
+		if _, err := parseSize(c.MemoryMax); err != nil {
+			return fmt.Errorf("build memory_max: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/go-cmd/cmd"
+)
+
+// Output of every nix-build is stored compressed in
+// ~/appvm/.logs/<name>/<timestamp>.log.gz, last buildLogsKeep are kept.
+// While build is in progress output is written uncompressed to
+// ~/appvm/.builds/<name>.log, see builds.go.
+
+const buildLogsKeep = 10
+
+func buildLogDir(name string) string {
+	return appvmHomesDir + ".logs/" + name + "/"
+}
+
+func buildLogs(name string) (logs []string) {
+	logs, _ = filepath.Glob(buildLogDir(name) + "*.log.gz")
+	sort.Strings(logs)
+	return
+}
+
+func rotateBuildLogs(name string) {
+	logs := buildLogs(name)
+	for len(logs) > buildLogsKeep {
+		os.Remove(logs[0])
+		logs = logs[1:]
+	}
+}
+
+type buildLog struct {
+	name string
+	path string
+	f    *os.File
+	// nix-build prints output path last
+	lastStdout string
+}
+
+func newBuildLog(name string) (b *buildLog, err error) {
+	err = os.MkdirAll(buildLogDir(name), 0700)
+	if err != nil {
+		return
+	}
+
+	err = markBuild(name)
+	if err != nil {
+		return
+	}
+
+	b = &buildLog{name: name, path: buildLogDir(name) +
+		time.Now().Format("20060102-150405") + ".log.gz"}
+	b.f, err = os.Create(buildOutputPath(name))
+	return
+}
+
+func compressFile(from, to string) (err error) {
+	src, err := os.Open(from)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+
+	dst, err := os.Create(to)
+	if err != nil {
+		return
+	}
+	defer dst.Close()
+
+	gz := gzip.NewWriter(dst)
+	_, err = io.Copy(gz, src)
+	if err != nil {
+		return
+	}
+	return gz.Close()
+}
+
+func (b *buildLog) Close() {
+	b.f.Close()
+	compressFile(buildOutputPath(b.name), b.path)
+	unmarkBuild(b.name)
+}
+
+// Drains output of the command to the log (and to the terminal if
+// verbose, prefixed by label), done is closed when command has finished
+func streamBuild(command *cmd.Cmd, b *buildLog, verbose bool,
+	label string) (done chan bool) {
+
+	if label != "" {
+		label = "[" + label + "] "
+	}
+
+	var progress buildProgress
+	done = make(chan bool)
+	go func() {
+		defer close(done)
+		stdout, stderr := command.Stdout, command.Stderr
+		for stdout != nil || stderr != nil {
+			select {
+			case line, ok := <-stdout:
+				if !ok {
+					stdout = nil
+					continue
+				}
+				fmt.Fprintln(b.f, line)
+				b.lastStdout = line
+				if verbose {
+					fmt.Println(label + line)
+				}
+			case line, ok := <-stderr:
+				if !ok {
+					stderr = nil
+					continue
+				}
+				fmt.Fprintln(b.f, line)
+				if verbose {
+					fmt.Fprintln(os.Stderr, label+line)
+				} else {
+					progress.line(line)
+				}
+			}
+		}
+	}()
+	return
+}
+
+func printBuildLog(path string) (err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(os.Stdout, gz)
+	return
+}
+
+func logBuild(name string, last bool) (err error) {
+	logs := buildLogs(name)
+	if len(logs) == 0 {
+		return fmt.Errorf("no build logs for %s", name)
+	}
+
+	if last {
+		return printBuildLog(logs[len(logs)-1])
+	}
+
+	for _, l := range logs {
+		info, err := os.Stat(l)
+		if err != nil {
+			continue
+		}
+		fmt.Println("\t", l, humanSize(info.Size()))
+	}
+	return
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// In-flight builds are marked by ~/appvm/.builds/<name>.json, so a
+// concurrent start of the same application (from daemon or another
+// terminal) waits for the running build and follows its output
+// instead of building again.
+
+type buildInfo struct {
+	Name    string `json:"name"`
+	Pid     int    `json:"pid"`
+	Started int64  `json:"started"`
+}
+
+func buildsDir() string {
+	return appvmHomesDir + ".builds/"
+}
+
+func buildMarkerPath(name string) string {
+	return buildsDir() + name + ".json"
+}
+
+func buildOutputPath(name string) string {
+	return buildsDir() + name + ".log"
+}
+
+func markBuild(name string) (err error) {
+	err = os.MkdirAll(buildsDir(), 0700)
+	if err != nil {
+		return
+	}
+
+	raw, _ := json.Marshal(buildInfo{name, os.Getpid(), time.Now().Unix()})
+	return ioutil.WriteFile(buildMarkerPath(name), raw, 0600)
+}
+
+func unmarkBuild(name string) {
+	os.Remove(buildMarkerPath(name))
+	os.Remove(buildOutputPath(name))
+}
+
+func processAlive(pid int) bool {
+	return syscall.Kill(pid, 0) == nil
+}
+
+func inflightBuild(name string) (b buildInfo, ok bool) {
+	raw, err := ioutil.ReadFile(buildMarkerPath(name))
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(raw, &b)
+	if err != nil || b.Pid == os.Getpid() {
+		return
+	}
+
+	if !processAlive(b.Pid) {
+		unmarkBuild(name) // killed appvm
+		return
+	}
+	ok = true
+	return
+}
+
+func inflightBuilds() (builds []buildInfo) {
+	markers, _ := filepath.Glob(buildsDir() + "*.json")
+	for _, m := range markers {
+		name := strings.TrimSuffix(filepath.Base(m), ".json")
+		if b, ok := inflightBuild(name); ok {
+			builds = append(builds, b)
+		}
+	}
+	return
+}
+
+// Follows output of the build until it is finished
+func attachBuild(b buildInfo, verbose bool, label string) {
+	if label != "" {
+		label = "[" + label + "] "
+	}
+
+	f, err := os.Open(buildOutputPath(b.Name))
+	if err == nil {
+		defer f.Close()
+	}
+
+	var reader *bufio.Reader
+	if f != nil {
+		reader = bufio.NewReader(f)
+	}
+
+	for {
+		for reader != nil {
+			line, err := reader.ReadString('\n')
+			if verbose && line != "" {
+				fmt.Print(label + line)
+			}
+			if err != nil {
+				break
+			}
+		}
+
+		if !processAlive(b.Pid) {
+			return
+		}
+		time.Sleep(time.Second / 4)
+	}
+}
+
+func listBuilds() {
+	for _, b := range inflightBuilds() {
+		fmt.Printf("\t %s (pid %d, %s)\n", b.Name, b.Pid,
+			time.Since(time.Unix(b.Started, 0)).Round(time.Second))
+	}
+}
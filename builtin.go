@@ -9,6 +9,8 @@ import (
 type app struct {
 	Name string
 	Nix  []byte
+	// Metadata, see registry.go
+	Meta []byte
 }
 
 var builtin_chromium_nix = app{
@@ -42,6 +44,13 @@ in {
 
   services.xserver.displayManager.sessionCommands = "${appRunner}/bin/app &";
 }
+`),
+	Meta: []byte(`{
+  "description": "Web browser with uBlock Origin",
+  "category": "Network",
+  "icon": "chromium",
+  "homepage": "https://www.chromium.org"
+}
 `),
 }
 
@@ -49,7 +58,11 @@ func writeBuiltinApps(path string) (err error) {
 	for _, f := range []app{
 		builtin_chromium_nix,
 	} {
-		err = ioutil.WriteFile(configDir+"/nix/"+f.Name+".nix", f.Nix, 0644)
+		err = ioutil.WriteFile(path+"/"+f.Name+".nix", f.Nix, 0644)
+		if err != nil {
+			return
+		}
+		err = ioutil.WriteFile(path+"/"+f.Name+".json", f.Meta, 0644)
 		if err != nil {
 			return
 		}
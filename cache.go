@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+func nixBuildOptions(c nixConfig) (args []string) {
+	if len(c.Substituters) != 0 {
+		args = append(args, "--option", "extra-substituters",
+			strings.Join(c.Substituters, " "))
+	}
+	if len(c.TrustedPublicKeys) != 0 {
+		args = append(args, "--option", "extra-trusted-public-keys",
+			strings.Join(c.TrustedPublicKeys, " "))
+	}
+	if len(c.Builders) != 0 {
+		args = append(args, "--option", "builders",
+			strings.Join(c.Builders, "; "))
+	}
+	args = append(args, nixLimitOptions(c.Limits)...)
+	return append(args, offlineOptions()...)
+}
+
+// regInfo=/nix/store/...-closure-info/registration -> store path
+func reginfoStorePath(reginfo string) string {
+	return filepath.Dir(strings.TrimPrefix(reginfo, "regInfo="))
+}
+
+func cachePush(name string, verbose bool) (err error) {
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+
+	if config.Nix.Cache == "" {
+		err = errors.New("no cache is set in " + configPath())
+		return
+	}
+
+	realpath, reginfo, qcow2, err := generateVM(configDir, name, verbose,
+		config.app(name).Arch)
+	defer os.Remove(qcow2)
+	if err != nil {
+		return
+	}
+
+	paths := []string{realpath, reginfoStorePath(reginfo)}
+
+	var command *exec.Cmd
+	if strings.HasPrefix(config.Nix.Cache, "cachix:") {
+		cache := strings.TrimPrefix(config.Nix.Cache, "cachix:")
+		command = exec.Command("cachix",
+			append([]string{"push", cache}, paths...)...)
+	} else {
+		command = exec.Command(nixBin("nix"),
+			append([]string{"copy", "--to", config.Nix.Cache},
+				paths...)...)
+	}
+	command.Stdout = os.Stdout
+	command.Stderr = os.Stderr
+
+	log.Println("Push", name, "to", config.Nix.Cache)
+	return command.Run()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Syntax of the expression and evaluation of the VM derivation are
+// checked before nix-build, so errors are shown in seconds instead of
+// after the part of the build. Evaluation is done in restricted mode,
+// i.e. only paths from -I and NIX_PATH are accessible.
+
+func nixConfigPath(path, name string) string {
+	if e, ok := findAppExpr(name); ok {
+		return e.Path
+	}
+	return path + "/nix/" + name + ".nix"
+}
+
+// Last lines of nix output without the command line
+func nixError(err error) error {
+	lines := strings.Split(strings.TrimSpace(err.Error()), "\n")
+	if len(lines) > 10 {
+		lines = lines[len(lines)-10:]
+	}
+	return errors.New(strings.Join(lines, "\n"))
+}
+
+// Returns path to the derivation of the VM
+func checkExpr(path, name, arch string) (drv string, err error) {
+	nixConfig := nixConfigPath(path, name)
+	if !fileExists(nixConfig) {
+		err = errNoExpr(name)
+		return
+	}
+
+	_, err = exec.LookPath(nixBin("nix-instantiate"))
+	if err != nil {
+		return
+	}
+
+	_, err = run(nixBin("nix-instantiate"), "--parse", nixConfig)
+	if err != nil {
+		err = fmt.Errorf("syntax error in %s:\n%v", nixConfig, nixError(err))
+		return
+	}
+
+	err = writeAppModule(name)
+	if err != nil {
+		return
+	}
+
+	args := []string{vmNixPath(),
+		"-I", "nixos-config=" + nixConfig,
+		"-I", "appvm-app=" + appModulePath(name), "-I", path,
+		"--option", "restrict-eval", "true"}
+	if isEmulated(arch) {
+		args = append(args, "--argstr", "system", guestArch(arch)+"-linux")
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+	params := config.app(name).Params
+	err = checkParams(params)
+	if err != nil {
+		return
+	}
+	extra, err := paramArgs(params)
+	if err != nil {
+		return
+	}
+	args = append(args, extra...)
+	args = append(args, overridesSearchPath()...)
+
+	bin, args := limitedCommand(config.Nix.Limits,
+		nixBin("nix-instantiate"), args...)
+	drv, err = run(bin, args...)
+	if err != nil {
+		err = fmt.Errorf("evaluation of %s failed:\n%v", nixConfig,
+			nixError(err))
+		return
+	}
+
+	// Warnings are printed before the path
+	lines := strings.Split(drv, "\n")
+	drv = lines[len(lines)-1]
+	return
+}
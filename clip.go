@@ -0,0 +1,536 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// Clipboard of the viewer is shared by SPICE (vdagent) unless mode is
+// "manual" or "proxy". Both disable SPICE clipboard sharing. With
+// "manual" the clipboard only crosses the boundary by appvm clip push
+// (host to VM) and appvm clip pull (VM to host), like Ctrl-Shift-C/V in
+// Qubes. With "proxy" appvm daemon copies changes of the VM to the host,
+// and of the host only to the VM whose viewer is focused (see focus.go
+// for window managers). Content copied from another VM is given only
+// after the user confirms it. The guest side is xclip over the guest
+// agent, the host side wl-clipboard on Wayland or xclip on X11.
+//
+// Transfers of appvm clip and of the proxy are limited by max_size and
+// types; SPICE sharing can not be limited.
+
+const (
+	clipboardTick      = time.Second
+	clipboardSizeLimit = "1M"
+)
+
+type clipboardConfig struct {
+	// "spice" (default), "manual" or "proxy"
+	Mode string `json:"mode,omitempty"`
+	// Transfer size limit, e.g. "64K", 1M by default
+	MaxSize string `json:"max_size,omitempty"`
+	// Allowed MIME types in order of preference, "image/*" matches
+	// any image; text/plain only by default
+	Types []string `json:"types,omitempty"`
+}
+
+func clipboardMode(app appConfig) string {
+	if app.Clipboard.Mode == "" {
+		return "spice"
+	}
+	return app.Clipboard.Mode
+}
+
+func clipboardMaxSize(c clipboardConfig) (int64, error) {
+	if c.MaxSize == "" {
+		return parseSize(clipboardSizeLimit)
+	}
+	return parseSize(c.MaxSize)
+}
+
+func clipboardTypes(c clipboardConfig) []string {
+	if len(c.Types) == 0 {
+		return []string{"text/plain"}
+	}
+	return c.Types
+}
+
+func checkClipboard(app appConfig) (err error) {
+	switch clipboardMode(app) {
+	case "spice", "manual", "proxy":
+	default:
+		return errors.New("unknown clipboard mode " + app.Clipboard.Mode)
+	}
+	_, err = clipboardMaxSize(app.Clipboard)
+	if err != nil {
+		return fmt.Errorf("clipboard max_size: %v", err)
+	}
+	for _, t := range app.Clipboard.Types {
+		if !strings.Contains(t, "/") {
+			return errors.New("clipboard type must be MIME type, not " + t)
+		}
+	}
+	return
+}
+
+// Inside of <graphics type='spice'>
+func spiceClipboardXML(app appConfig) string {
+	if clipboardMode(app) != "spice" {
+		return "<clipboard copypaste='no'/>"
+	}
+	return ""
+}
+
+// X11 text targets are text/plain
+func isTextTarget(target string) bool {
+	switch target {
+	case "UTF8_STRING", "STRING", "TEXT", "COMPOUND_TEXT":
+		return true
+	}
+	return target == "text/plain" || strings.HasPrefix(target, "text/plain;")
+}
+
+func typeMatches(allowed, target string) bool {
+	switch {
+	case allowed == "text/plain":
+		return isTextTarget(target)
+	case strings.HasSuffix(allowed, "/*"):
+		return strings.HasPrefix(target, strings.TrimSuffix(allowed, "*"))
+	}
+	return allowed == target ||
+		strings.HasPrefix(target, allowed+";")
+}
+
+// Target to transfer from those offered by the clipboard owner
+func clipboardTarget(c clipboardConfig, targets []string) (string, bool) {
+	for _, allowed := range clipboardTypes(c) {
+		for _, target := range targets {
+			if typeMatches(allowed, target) {
+				return target, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Text is written without type, both xclip and wl-copy offer the usual
+// text targets then
+func clipboardWriteType(target string) string {
+	if isTextTarget(target) {
+		return ""
+	}
+	return target
+}
+
+func targetLines(s string) (list []string) {
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			list = append(list, line)
+		}
+	}
+	return
+}
+
+func hostClipboardCommand(args ...string) (command *exec.Cmd, err error) {
+	wayland := os.Getenv("WAYLAND_DISPLAY") != ""
+	if !wayland && os.Getenv("DISPLAY") == "" {
+		err = errors.New("no host display for the clipboard")
+		return
+	}
+
+	// args: "targets", "read" <type> or "write" [type]
+	switch {
+	case wayland && args[0] == "targets":
+		command = exec.Command("wl-paste", "--list-types")
+	case wayland && args[0] == "read":
+		command = exec.Command("wl-paste", "--no-newline", "--type", args[1])
+	case wayland && len(args) > 1:
+		command = exec.Command("wl-copy", "--type", args[1])
+	case wayland:
+		command = exec.Command("wl-copy")
+	case args[0] == "targets":
+		command = exec.Command("xclip", "-selection", "clipboard", "-o",
+			"-t", "TARGETS")
+	case args[0] == "read":
+		command = exec.Command("xclip", "-selection", "clipboard", "-o",
+			"-t", args[1])
+	case len(args) > 1:
+		command = exec.Command("xclip", "-selection", "clipboard", "-i",
+			"-t", args[1])
+	default:
+		command = exec.Command("xclip", "-selection", "clipboard", "-i")
+	}
+	return
+}
+
+// Empty without owner of the clipboard
+func hostClipboardTargets() (targets []string, err error) {
+	command, err := hostClipboardCommand("targets")
+	if err != nil {
+		return
+	}
+	out, _ := command.Output()
+	return targetLines(string(out)), nil
+}
+
+// At most max+1 bytes are read
+func hostClipboardRead(target string, max int64) (data []byte, err error) {
+	command, err := hostClipboardCommand("read", target)
+	if err != nil {
+		return
+	}
+	stdout, err := command.StdoutPipe()
+	if err != nil {
+		return
+	}
+	err = command.Start()
+	if err != nil {
+		return
+	}
+	data, err = ioutil.ReadAll(io.LimitReader(stdout, max+1))
+	if int64(len(data)) > max {
+		command.Process.Kill()
+	}
+	command.Wait()
+	return
+}
+
+func hostClipboardWrite(target string, data []byte) (err error) {
+	args := []string{"write"}
+	if t := clipboardWriteType(target); t != "" {
+		args = append(args, t)
+	}
+	command, err := hostClipboardCommand(args...)
+	if err != nil {
+		return
+	}
+	command.Stdin = strings.NewReader(string(data))
+	err = command.Run()
+	if err != nil {
+		err = fmt.Errorf("%s: %v", command.Path, err)
+	}
+	return
+}
+
+// Arguments are given to xclip, after the script in $@. xclip -i stays
+// in background to serve the selection, its output is not captured so
+// that guest-exec does not wait for it.
+func guestXclip(l *libvirt.Libvirt, dom libvirt.Domain, input []byte,
+	pipe string, args ...string) (out []byte, err error) {
+
+	script := "DISPLAY=:0 XAUTHORITY=/home/user/.Xauthority " +
+		"/run/current-system/sw/bin/xclip -selection clipboard \"$@\""
+	if input != nil {
+		script += " >/dev/null 2>&1"
+	}
+	script += pipe
+
+	result, err := guestExecInput(l, dom, input, "/bin/sh",
+		append([]string{"-c", script, "sh"}, args...)...)
+	if err != nil {
+		return
+	}
+	if result.ExitCode != 0 {
+		err = errors.New("xclip: " + strings.TrimSpace(result.Stderr))
+		return
+	}
+	return []byte(result.Stdout), nil
+}
+
+func guestClipboardTargets(l *libvirt.Libvirt, dom libvirt.Domain) (
+	targets []string, err error) {
+
+	out, err := guestXclip(l, dom, nil, "", "-o", "-t", "TARGETS")
+	if err != nil {
+		// No owner of the clipboard
+		return nil, nil
+	}
+	return targetLines(string(out)), nil
+}
+
+// At most max+1 bytes are read
+func guestClipboardRead(l *libvirt.Libvirt, dom libvirt.Domain,
+	target string, max int64) ([]byte, error) {
+
+	head := fmt.Sprintf(" | /run/current-system/sw/bin/head -c %d", max+1)
+	return guestXclip(l, dom, nil, head, "-o", "-t", target)
+}
+
+func guestClipboardWrite(l *libvirt.Libvirt, dom libvirt.Domain,
+	target string, data []byte) (err error) {
+
+	args := []string{"-i"}
+	if t := clipboardWriteType(target); t != "" {
+		args = append(args, "-t", t)
+	}
+	_, err = guestXclip(l, dom, data, "", args...)
+	return
+}
+
+type clipboardContent struct {
+	Target string
+	Data   []byte
+}
+
+func (c clipboardContent) hash() [sha256.Size]byte {
+	return sha256.Sum256(append([]byte(c.Target+"\n"), c.Data...))
+}
+
+// Empty without owner of the clipboard, error if there is nothing
+// allowed by the policy
+func readClipboard(c clipboardConfig, targets []string,
+	read func(target string, max int64) ([]byte, error)) (
+	content clipboardContent, err error) {
+
+	if len(targets) == 0 {
+		return
+	}
+	target, ok := clipboardTarget(c, targets)
+	if !ok {
+		err = fmt.Errorf("no allowed type in clipboard (%s), allowed: %s",
+			strings.Join(targets, ", "),
+			strings.Join(clipboardTypes(c), ", "))
+		return
+	}
+
+	max, err := clipboardMaxSize(c)
+	if err != nil {
+		return
+	}
+	data, err := read(target, max)
+	if err != nil {
+		return
+	}
+	if int64(len(data)) > max {
+		err = fmt.Errorf("%s in clipboard is larger than max_size %s",
+			target, humanMaxSize(c))
+		return
+	}
+	return clipboardContent{target, data}, nil
+}
+
+func humanMaxSize(c clipboardConfig) string {
+	if c.MaxSize == "" {
+		return clipboardSizeLimit
+	}
+	return c.MaxSize
+}
+
+func readHostClipboard(c clipboardConfig) (content clipboardContent,
+	err error) {
+
+	targets, err := hostClipboardTargets()
+	if err != nil {
+		return
+	}
+	content, err = readClipboard(c, targets, hostClipboardRead)
+	if err != nil {
+		err = errors.New("host: " + err.Error())
+	}
+	return
+}
+
+func readGuestClipboard(l *libvirt.Libvirt, dom libvirt.Domain,
+	c clipboardConfig) (content clipboardContent, err error) {
+
+	targets, err := guestClipboardTargets(l, dom)
+	if err != nil {
+		return
+	}
+	content, err = readClipboard(c, targets,
+		func(target string, max int64) ([]byte, error) {
+			return guestClipboardRead(l, dom, target, max)
+		})
+	if err != nil {
+		err = errors.New(appNameFromDomain(dom.Name) + ": " + err.Error())
+	}
+	return
+}
+
+func clip(l *libvirt.Libvirt, name string, push bool) (err error) {
+	dom, err := runningDomain(l, name)
+	if err != nil {
+		return
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+	c := config.app(name).Clipboard
+
+	if push {
+		content, err := readHostClipboard(c)
+		if err != nil {
+			return err
+		}
+		if content.Target == "" {
+			return errors.New("host clipboard is empty")
+		}
+		err = guestClipboardWrite(l, dom, content.Target, content.Data)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Copied %d bytes of %s to %s\n", len(content.Data),
+			content.Target, name)
+		return nil
+	}
+
+	content, err := readGuestClipboard(l, dom, c)
+	if err != nil {
+		return
+	}
+	if content.Target == "" {
+		return errors.New("clipboard of " + name + " is empty")
+	}
+	err = hostClipboardWrite(content.Target, content.Data)
+	if err != nil {
+		return
+	}
+	fmt.Printf("Copied %d bytes of %s from %s\n", len(content.Data),
+		content.Target, name)
+	return
+}
+
+// Last content seen on both sides, so that copied content is not
+// copied back and rejected content is logged once
+type clipboardState struct {
+	Host, Guest [sha256.Size]byte
+	Rejected    string
+}
+
+func (s *clipboardState) reject(domain string, err error) {
+	if err.Error() != s.Rejected {
+		log.Printf("clipboard of %s: %v, not copied", domain, err)
+		s.Rejected = err.Error()
+	}
+}
+
+// VM the host clipboard content was copied from, content of one VM
+// goes to another one only if the user confirms it
+type clipboardOrigin struct {
+	Hash   [sha256.Size]byte
+	Domain string
+	// Answers by content and destination
+	Allowed map[string]bool
+}
+
+func (o *clipboardOrigin) allowed(h [sha256.Size]byte, domain string) bool {
+	if h != o.Hash || o.Domain == "" || o.Domain == domain {
+		return true
+	}
+	key := fmt.Sprintf("%x %s", h, domain)
+	allowed, asked := o.Allowed[key]
+	if !asked {
+		allowed = confirm(fmt.Sprintf("Copy clipboard of %s to %s?",
+			appNameFromDomain(o.Domain), appNameFromDomain(domain)))
+		o.Allowed[key] = allowed
+	}
+	return allowed
+}
+
+// Guest to host, then host to guest if the viewer of the VM is focused
+func proxyClipboard(l *libvirt.Libvirt, dom libvirt.Domain,
+	c clipboardConfig, s *clipboardState, focused bool,
+	origin *clipboardOrigin) {
+
+	content, err := readGuestClipboard(l, dom, c)
+	if err != nil {
+		s.reject(dom.Name, err)
+	} else if h := content.hash(); content.Target != "" && h != s.Guest {
+		s.Guest = h
+		if h != s.Host && hostClipboardWrite(content.Target,
+			content.Data) == nil {
+
+			s.Host, s.Rejected = h, ""
+			origin.Hash, origin.Domain = h, dom.Name
+			origin.Allowed = make(map[string]bool)
+		}
+	}
+
+	if !focused {
+		return
+	}
+
+	content, err = readHostClipboard(c)
+	if err != nil {
+		s.reject(dom.Name, err)
+	} else if h := content.hash(); content.Target != "" && h != s.Host {
+		if !origin.allowed(h, dom.Name) {
+			return
+		}
+		s.Host = h
+		if h != s.Guest && guestClipboardWrite(l, dom, content.Target,
+			content.Data) == nil {
+
+			s.Guest, s.Rejected = h, ""
+		}
+	}
+}
+
+// Class of the focused window, empty without supported window manager
+func focusedClass() string {
+	wm, err := windowManager()
+	if err != nil {
+		return ""
+	}
+	class, _ := wm.Focused()
+	return class
+}
+
+func watchClipboard(l *libvirt.Libvirt) {
+	states := make(map[string]*clipboardState)
+	origin := &clipboardOrigin{}
+
+	for ; ; time.Sleep(clipboardTick) {
+		domains, err := l.Domains()
+		if err != nil {
+			continue
+		}
+
+		config, err := loadConfig()
+		if err != nil {
+			continue
+		}
+
+		focused := focusedClass()
+
+		running := make(map[string]bool)
+		for _, d := range domains {
+			if !strings.HasPrefix(d.Name, "appvm_") || !isOwned(l, d) {
+				continue
+			}
+
+			name := appNameFromDomain(d.Name)
+			app := config.app(name)
+			if clipboardMode(app) != "proxy" || !guestAgentReady(l, d) {
+				continue
+			}
+			running[d.Name] = true
+
+			s, ok := states[d.Name]
+			if !ok {
+				s = &clipboardState{}
+				states[d.Name] = s
+			}
+			proxyClipboard(l, d, app.Clipboard, s,
+				focused != "" && focused == viewerClass(name, app.Viewer),
+				origin)
+		}
+
+		for name := range states {
+			if !running[name] {
+				delete(states, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+)
+
+// appvm clone copies expression (to ~/.config/appvm/nix) and config of
+// the application, and data if asked. Expression is copied as is, so
+// the clone has the same derivation and starts without rebuild.
+
+func clone(from, to string, data bool) (err error) {
+	if !appExists(from) {
+		return errors.New("no application " + from)
+	}
+	if appExists(to) {
+		return errors.New(to + " already exists")
+	}
+
+	if e, ok := findAppExpr(from); ok {
+		os.MkdirAll(configDir+"nix", 0700)
+		err = copyFile(e.Path, configDir+"nix/"+to+".nix")
+		if err != nil {
+			return
+		}
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+	if app, ok := config.Apps[from]; ok {
+		config.setApp(to, app)
+		err = saveConfig(config)
+		if err != nil {
+			return
+		}
+	}
+
+	if system, err := os.Readlink(systemLink(from)); err == nil {
+		linkSystem(to, system)
+	}
+	if out, err := os.Readlink(gcRootPath(from)); err == nil {
+		addGCRoot(to, out)
+	}
+
+	if data && isDirExists(appvmHomesDir+from) {
+		err = createDataDir(appvmHomesDir + to)
+		if err != nil {
+			return
+		}
+		_, err = run("cp", "-a", "--reflink=auto",
+			appvmHomesDir+from+"/.", appvmHomesDir+to)
+		if err != nil {
+			return
+		}
+	}
+
+	log.Println("Cloned", from, "to", to)
+	return
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+func compactImage(image, backing string) (err error) {
+	if _, err = exec.LookPath("virt-sparsify"); err == nil {
+		command := exec.Command("virt-sparsify", "--in-place", image)
+		command.Stdout = os.Stdout
+		command.Stderr = os.Stderr
+		return command.Run()
+	}
+
+	if !strings.HasSuffix(image, ".qcow2") {
+		err = errors.New("only qcow2 can be compacted without virt-sparsify")
+		return
+	}
+
+	args := []string{"convert", "-p", "-O", "qcow2"}
+	if backing != "" {
+		args = append(args, "-B", backing, "-F", imageFormat(backing))
+	}
+
+	tmp := image + ".compact"
+	command := exec.Command("qemu-img", append(args, image, tmp)...)
+	command.Stdout = os.Stdout
+	command.Stderr = os.Stderr
+	err = command.Run()
+	if err != nil {
+		os.Remove(tmp)
+		return
+	}
+
+	return os.Rename(tmp, image)
+}
+
+// Overlay is recreated on the next start
+func diskReset(l *libvirt.Libvirt, name string) (err error) {
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+
+	if config.app(name).BaseImage == "" {
+		err = errors.New(name + " has no overlay over base image")
+		return
+	}
+
+	if isRunning(l, name) {
+		err = errors.New(name + " is running, stop it first")
+		return
+	}
+
+	return os.Remove(overlayPath(name))
+}
+
+func diskCompact(l *libvirt.Libvirt, name string) (err error) {
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+
+	app := config.app(name)
+	if app.Type != "image" {
+		err = errors.New(name + " has no persistent disk")
+		return
+	}
+
+	if isRunning(l, name) {
+		err = errors.New(name + " is running, stop it first")
+		return
+	}
+
+	image := appDisk(name, app)
+
+	before, _, err := imageSize(image)
+	if err != nil {
+		return
+	}
+
+	err = compactImage(image, app.BaseImage)
+	if err != nil {
+		return
+	}
+
+	after, _, err := imageSize(image)
+	if err != nil {
+		return
+	}
+
+	log.Println("Reclaimed", humanSize(before-after))
+	return
+}
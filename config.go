@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+type hooksConfig struct {
+	// Shell commands, see runHook
+	PreStart string `json:"pre_start,omitempty"`
+	PostStop string `json:"post_stop,omitempty"`
+	// Do not start VM if pre-start hook fails
+	Fatal bool `json:"fatal,omitempty"`
+}
+
+// Options of virt-viewer
+type viewerConfig struct {
+	Fullscreen bool `json:"fullscreen,omitempty"`
+	// Fullscreen without menus, viewer quits on disconnect
+	Kiosk bool `json:"kiosk,omitempty"`
+	// Percents
+	Zoom int `json:"zoom,omitempty"`
+	// Host monitor (starting from 1) for fullscreen mode
+	Monitor int `json:"monitor,omitempty"`
+	// Window class and title, appvm-<name> and "<name> (appvm)" by
+	// default, see wmclass.go
+	Class string `json:"class,omitempty"`
+	Title string `json:"title,omitempty"`
+	// Workspace for appvm wm-rules
+	Workspace string `json:"workspace,omitempty"`
+}
+
+// Per-application settings
+type appConfig struct {
+	// "nix" (default) or "image" for VM booted from existing disk image
+	Type string `json:"type,omitempty"`
+	// Disk image for "image" type, qcow2 or raw
+	Image string `json:"image,omitempty"`
+	// Shared read-only image for "image" type, changes are written
+	// to the per-app overlay
+	BaseImage string `json:"base_image,omitempty"`
+	// Disk bus for "image" type: "virtio" (default, guest needs
+	// drivers), "sata" or "ide"
+	DiskBus string `json:"disk_bus,omitempty"`
+
+	// Policy for files/links opened inside of the VM:
+	// "deny" (default), "host" or name of another application VM
+	Open string `json:"open,omitempty"`
+	// Guest architecture: x86_64, aarch64 or riscv64, emulated if
+	// differs from the host one
+	Arch string `json:"arch,omitempty"`
+	// Snapshot data directory before every start (btrfs/ZFS)
+	Snapshot bool `json:"snapshot,omitempty"`
+	// Exclude memory from the kernel same-page merging
+	NoSharePages bool `json:"no_share_pages,omitempty"`
+	// Restart policy applied by appvm daemon: "never" (default),
+	// "on-failure" or "always"
+	Restart string `json:"restart,omitempty"`
+	// Checked by appvm daemon, see health.go
+	Health healthConfig `json:"health,omitempty"`
+	// Post-stop hooks are run by appvm daemon
+	Hooks hooksConfig `json:"hooks,omitempty"`
+	// Resolvers and blocklist, see dns.go
+	DNS dnsConfig `json:"dns,omitempty"`
+	// NixOS profile on top of base.nix: "minimal", "desktop",
+	// "devbox", "media" or own one, see profiles.go
+	Profile string `json:"profile,omitempty"`
+	// Fonts and themes of the host instead of fonts in the closure,
+	// see hostfonts.go
+	HostFonts bool `json:"host_fonts,omitempty"`
+	// SSH agent of the host in the guest, see sshagent.go
+	SSHAgent bool `json:"ssh_agent,omitempty"`
+	// Split GPG: "allow" or "confirm", see gpgagent.go
+	GPGAgent string `json:"gpg_agent,omitempty"`
+	// File name in /run/appvm/secrets -> reference, see secrets.go
+	Secrets map[string]string `json:"secrets,omitempty"`
+	// Guest kernel hardening, see hardening.go
+	Hardening hardeningConfig `json:"hardening,omitempty"`
+	// Confinement of qemu on the host, see sandbox.go
+	Sandbox sandboxConfig `json:"sandbox,omitempty"`
+	// Guest store: "host", "image" or "verity", see store.go
+	Store string `json:"store,omitempty"`
+	// The same as "store": "verity"
+	Verity bool `json:"verity,omitempty"`
+	// Guest uid/gid and ownership of data, see guestuser.go
+	GuestUser guestUserConfig `json:"guest_user,omitempty"`
+	// Files from ~/Outbox of the VM to the host, see outbox.go
+	Outbox outboxConfig `json:"outbox,omitempty"`
+	// Periodic jobs run by appvm daemon, see schedule.go
+	Schedule []scheduledJob `json:"schedule,omitempty"`
+	// Size limit of the data directory, e.g. "10G", see quota.go
+	Quota string `json:"quota,omitempty"`
+	// Outbound HTTP(S) proxy, see proxy.go
+	Proxy proxyConfig `json:"proxy,omitempty"`
+	// Provides network to other VMs, see gateway.go
+	Gateway bool `json:"gateway,omitempty"`
+	// Gateway VM used instead of the host network
+	NetVM string `json:"netvm,omitempty"`
+	// Networking model used if not set on the command line
+	Network string `json:"network,omitempty"`
+	// Action when the viewer window is closed: "keep" (default),
+	// "pause" or "shutdown"
+	OnViewerExit string `json:"on_viewer_exit,omitempty"`
+	// Host devices allowed for the application: "camera", "mic",
+	// "fido"
+	Devices []string `json:"devices,omitempty"`
+	// Redirect smartcard of the viewer host by SPICE
+	Smartcard bool `json:"smartcard,omitempty"`
+	// SPICE folder sharing from the viewer
+	Webdav bool `json:"webdav,omitempty"`
+	// USB redirection of printers from the viewer, guest has CUPS
+	Printing bool `json:"printing,omitempty"`
+	// Sized from the host if not set, see resources.go
+	VCPUs  int    `json:"vcpus,omitempty"`
+	Memory uint64 `json:"memory,omitempty"` // MiB
+	// Policy of appvm autoballoon, see balloon.go
+	Balloon balloonConfig `json:"balloon,omitempty"`
+	// Host CPU and I/O scheduling, see sched.go
+	Sched schedConfig `json:"sched,omitempty"`
+	// "pause" to pause VM while host is on battery
+	OnBattery string `json:"on_battery,omitempty"`
+	// Number of guest displays (heads), 1 by default
+	Displays int `json:"displays,omitempty"`
+	// Display protocol, see graphics.go
+	Graphics graphicsConfig `json:"graphics,omitempty"`
+	// Clipboard sharing with the host, see clip.go
+	Clipboard clipboardConfig `json:"clipboard,omitempty"`
+	// No screenshots of the VM, see screenshot.go
+	Protected bool `json:"protected,omitempty"`
+	// Remembered from appvm start --fullscreen/--kiosk/...
+	Viewer viewerConfig `json:"viewer,omitempty"`
+	// Use expression of another application, e.g. with other params
+	Expr string `json:"expr,omitempty"`
+	// Arguments of the expression, see params.go
+	Params map[string]interface{} `json:"params,omitempty"`
+	// Appended to the kernel command line, e.g. "quiet mitigations=off"
+	KernelParams string `json:"kernel_params,omitempty"`
+}
+
+// Scanner for files copied out of application VMs
+type scanConfig struct {
+	// Command and arguments, path to file is appended, non-zero
+	// exit code means that file must not be imported
+	Command []string `json:"command,omitempty"`
+	// Move rejected files to quarantine instead of removing
+	Quarantine bool `json:"quarantine,omitempty"`
+}
+
+// Passed to every nix-build
+type nixConfig struct {
+	Substituters      []string `json:"substituters,omitempty"`
+	TrustedPublicKeys []string `json:"trusted_public_keys,omitempty"`
+	// Remote builders in nix.conf format, e.g.
+	// "ssh://builder aarch64-linux"
+	Builders []string `json:"builders,omitempty"`
+	// Binary cache for appvm cache push: nix store URI or
+	// cachix:<name>
+	Cache string `json:"cache,omitempty"`
+	// Number of VMs built concurrently by appvm build
+	BuildJobs int `json:"build_jobs,omitempty"`
+	// Resources of evaluation and builds, see buildlimits.go
+	Limits buildLimits `json:"limits,omitempty"`
+}
+
+type appvmConfig struct {
+	// Schema version of config and state files, see migrate.go
+	Version int                  `json:"version,omitempty"`
+	Nix     nixConfig            `json:"nix,omitempty"`
+	Scan    scanConfig           `json:"scan,omitempty"`
+	Apps    map[string]appConfig `json:"apps,omitempty"`
+	// IPv6 for qemu and libvirt networking, see ipv6.go
+	IPv6 bool `json:"ipv6,omitempty"`
+	// Base URLs of remote expression repos, see configLayers
+	Repos []string `json:"repos,omitempty"`
+	// Default guest store of applications, see store.go
+	Store string `json:"store,omitempty"`
+	// Proxy and mirrors for downloads, see fetch.go
+	Fetch fetchConfig `json:"fetch,omitempty"`
+}
+
+func configPath() string {
+	return configDir + "/config.json"
+}
+
+func loadConfig() (c appvmConfig, err error) {
+	raw, err := ioutil.ReadFile(configPath())
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(raw, &c)
+	if err != nil {
+		err = fmt.Errorf("%s: %v", configPath(), err)
+	}
+	return
+}
+
+func saveConfig(c appvmConfig) (err error) {
+	raw, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return
+	}
+
+	return ioutil.WriteFile(configPath(), append(raw, '\n'), 0600)
+}
+
+func (c *appvmConfig) setApp(name string, app appConfig) {
+	if c.Apps == nil {
+		c.Apps = make(map[string]appConfig)
+	}
+	c.Apps[name] = app
+}
+
+// Defaults from metadata of the expression, see registry.go
+func (c appvmConfig) app(name string) appConfig {
+	if app, ok := c.Apps[name]; ok {
+		return app
+	}
+	return defaultAppConfig(name)
+}
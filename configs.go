@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Nix expressions of applications are searched in order:
+//
+//  1. directories from --configs
+//  2. directories from APPVM_CONFIGS (separated by colon)
+//  3. ~/.config/appvm/nix (own and generated expressions)
+//  4. builtin expressions
+//  5. repos from config.json, <repo>/<name>.nix is downloaded once to
+//     the cache of the repo and checked against its pin on every use
+//
+// Expressions may import <nix/base.nix> and <nix/local.nix> from
+// ~/.config/appvm/nix in any layer.
+
+// Set by --configs
+var configsFlag []string
+
+type configLayer struct {
+	Name string
+	Dir  string
+	URL  string // remote repo
+}
+
+type appExpr struct {
+	Name  string
+	Layer configLayer
+	Path  string
+	URL   string
+}
+
+func builtinDir() string {
+	return configDir + "builtin/"
+}
+
+func remoteDir() string {
+	return configDir + "remote/"
+}
+
+// Every repo has its own cache, so a file of one repo is never taken
+// for a file of another one
+func repoCacheDir(repo string) string {
+	return fmt.Sprintf("%s%x/", remoteDir(), sha256.Sum256([]byte(repo)))
+}
+
+// Cache path of the file URL of a repo
+func cachedPath(url string) string {
+	i := strings.LastIndex(url, "/")
+	return repoCacheDir(url[:i]) + url[i+1:]
+}
+
+func configLayers() (layers []configLayer) {
+	for _, dir := range configsFlag {
+		layers = append(layers, configLayer{Name: "--configs", Dir: dir})
+	}
+
+	for _, dir := range filepath.SplitList(os.Getenv("APPVM_CONFIGS")) {
+		if dir != "" {
+			layers = append(layers, configLayer{Name: "APPVM_CONFIGS", Dir: dir})
+		}
+	}
+
+	layers = append(layers,
+		configLayer{Name: "user", Dir: configDir + "nix"},
+		configLayer{Name: "builtin", Dir: builtinDir()})
+
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+	for _, repo := range config.Repos {
+		repo = strings.TrimSuffix(repo, "/")
+		layers = append(layers, configLayer{Name: "repo",
+			Dir: repoCacheDir(repo), URL: repo})
+	}
+	return
+}
+
+func (layer configLayer) expr(name string) (e appExpr, ok bool) {
+	e = appExpr{Name: name, Layer: layer,
+		Path: filepath.Join(layer.Dir, name+".nix")}
+
+	if layer.URL == "" {
+		ok = fileExists(e.Path)
+		return
+	}
+
+	e.URL = layer.URL + "/" + name + ".nix"
+	if !isTrustedRepo(layer.URL) {
+		return
+	}
+	if fileExists(e.Path) {
+		// Cached before it was pinned or changed since
+		if err := checkPinned(layer.URL, e.URL, e.Path); err != nil {
+			log.Println(err)
+			os.Remove(e.Path)
+			os.Remove(metaPath(e))
+		}
+	}
+	if !fileExists(e.Path) {
+		if offlineMode {
+			return
+		}
+		os.MkdirAll(layer.Dir, 0700)
+		err := fetchExpr(e)
+		if err != nil {
+			// Not every repo has the application
+			if !isNotFound(err) {
+				log.Println(err)
+			}
+			return
+		}
+		fetchMeta(e)
+	}
+	ok = true
+	return
+}
+
+// All expressions for the application, first one is used
+func findAppExprs(name string) (exprs []appExpr) {
+	config, _ := loadConfig()
+	if expr := config.Apps[name].Expr; expr != "" {
+		name = expr
+	}
+
+	if name == "base" || name == "local" {
+		return
+	}
+
+	for _, layer := range configLayers() {
+		if e, ok := layer.expr(name); ok {
+			exprs = append(exprs, e)
+		}
+	}
+	return
+}
+
+func findAppExpr(name string) (e appExpr, ok bool) {
+	exprs := findAppExprs(name)
+	if len(exprs) == 0 {
+		return
+	}
+	return exprs[0], true
+}
+
+// Names of applications in local layers
+func exprNames() (names []string) {
+	seen := make(map[string]bool)
+	for _, layer := range configLayers() {
+		if layer.URL != "" {
+			continue
+		}
+
+		files, _ := filepath.Glob(filepath.Join(layer.Dir, "*.nix"))
+		for _, f := range files {
+			name := strings.TrimSuffix(filepath.Base(f), ".nix")
+			if name == "base" || name == "local" || seen[name] {
+				continue
+			}
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	config, _ := loadConfig()
+	for name, app := range config.Apps {
+		if app.Expr != "" && !seen[name] && seen[app.Expr] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return
+}
+
+func (e appExpr) hash() (sum string, err error) {
+	raw, err := ioutil.ReadFile(e.Path)
+	if err != nil {
+		return
+	}
+	sum = fmt.Sprintf("%x", sha256.Sum256(raw))
+	return
+}
+
+func which(name string) (err error) {
+	exprs := findAppExprs(name)
+	if len(exprs) == 0 {
+		return errNoExpr(name)
+	}
+
+	for i, e := range exprs {
+		mark := ""
+		if i != 0 {
+			mark = " (shadowed)"
+		}
+		fmt.Printf("%-14s %s%s\n", e.Layer.Name, e.Path, mark)
+		if e.URL != "" {
+			fmt.Printf("%-14s %s\n", "", e.URL)
+		}
+
+		sum, err := e.hash()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%-14s sha256:%s\n", "", sum)
+	}
+	return
+}
+
+func catExpr(name string) (err error) {
+	e, ok := findAppExpr(name)
+	if !ok {
+		return errNoExpr(name)
+	}
+
+	raw, err := ioutil.ReadFile(e.Path)
+	if err != nil {
+		return
+	}
+
+	fmt.Printf("# %s (%s)\n", e.Path, e.Layer.Name)
+	_, err = os.Stdout.Write(raw)
+	return
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// Line-based virtio-serial channels from the guest to appvm daemon
+type guestChannel struct {
+	Name   string
+	Handle func(l *libvirt.Libvirt, vmName, line string)
+}
+
+var guestChannels = []guestChannel{
+	{guestOpenChannel, guestOpen},
+	{guestSendChannel, guestSend},
+}
+
+func guestChannelSocket(vmName, channel string) string {
+	return appvmHomesDir + "." + vmName + "." + channel + ".sock"
+}
+
+// Domain name from the file name of guestChannelSocket, the channel is
+// matched as names and channels may both contain dots
+func socketVMName(base string) (vmName string, ok bool) {
+	for _, c := range guestChannels {
+		suffix := "." + c.Name + ".sock"
+		if strings.HasPrefix(base, ".") && strings.HasSuffix(base, suffix) {
+			return strings.TrimSuffix(base[1:], suffix), true
+		}
+	}
+	return
+}
+
+func guestChannelsXML(vmName string) (xml string) {
+	for _, c := range guestChannels {
+		xml += fmt.Sprintf(guestChannelTmpl,
+			xmlEscape(guestChannelSocket(vmName, c.Name)), c.Name)
+	}
+	return
+}
+
+func handleGuestChannel(l *libvirt.Libvirt, vmName string,
+	c guestChannel, conn net.Conn) {
+
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		c.Handle(l, vmName, line)
+	}
+}
+
+func daemon(l *libvirt.Libvirt, listen, grpcListen, cert, key string) {
+	var ln, grpcLn net.Listener
+	var err error
+	if listen != "" {
+		ln, err = apiListener(listen, cert, key)
+		if err != nil {
+			fatal(err)
+		}
+	}
+	if grpcListen != "" {
+		grpcLn, err = apiListener(grpcListen, cert, key, "h2")
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	done := make(chan string)
+	watched := make(map[string]bool)
+	var statsTime time.Time
+
+	go eventHub()
+	go watchLifecycle(l)
+	go watchPower(l)
+	go watchHealth(l)
+	go watchDNS(l)
+	go watchSecrets(l)
+	go watchOutbox()
+	go watchClipboard(l)
+	if config, err := loadConfig(); err == nil {
+		checkSchedule(config)
+	}
+	go watchSchedule()
+	go serveAgent(l, sshAgent)
+	go serveAgent(l, gpgAgent)
+
+	if ln != nil || grpcLn != nil {
+		go startRegistry()
+	}
+	if ln != nil {
+		go serveAPI(l, ln)
+	}
+	if grpcLn != nil {
+		go serveGRPC(l, grpcLn)
+	}
+
+	for {
+		if time.Since(statsTime) >= statsInterval {
+			collectStats(l)
+			statsTime = time.Now()
+		}
+
+		domains, err := l.Domains()
+		if err != nil {
+			fatal(err)
+		}
+
+		for _, d := range domains {
+			if !strings.HasPrefix(d.Name, "appvm_") || !isOwned(l, d) {
+				continue
+			}
+
+			for _, c := range guestChannels {
+				socket := guestChannelSocket(d.Name, c.Name)
+				if watched[socket] {
+					continue
+				}
+
+				conn, err := net.Dial("unix", socket)
+				if err != nil {
+					continue
+				}
+
+				watched[socket] = true
+				go func(vmName string, c guestChannel) {
+					handleGuestChannel(l, vmName, c, conn)
+					done <- socket
+				}(d.Name, c)
+			}
+		}
+
+		timeout := time.After(time.Second)
+	wait:
+		for {
+			select {
+			case socket := <-done:
+				delete(watched, socket)
+			case <-timeout:
+				break wait
+			}
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// Host webcams, microphones and FIDO tokens are passed to VM as USB
+// devices, only if listed in "devices" of the application. Devices are
+// attached to the running VM and can be revoked at any time. Built-in
+// microphones that are not USB devices are not supported.
+
+var deviceFinders = map[string]func() []usbDevice{
+	"camera": func() []usbDevice { return findUSBDevices("0e") }, // video
+	"mic":    func() []usbDevice { return findUSBDevices("01") }, // audio
+	"fido":   findFIDODevices,
+}
+
+type usbDevice struct {
+	Vendor  string
+	Product string
+	Bus     string
+	Device  string
+	Name    string
+}
+
+func sysfsValue(path string) string {
+	raw, _ := ioutil.ReadFile(path)
+	return strings.TrimSpace(string(raw))
+}
+
+func findUSBDevices(class string) (devices []usbDevice) {
+	seen := make(map[string]bool)
+
+	interfaces, _ := filepath.Glob("/sys/bus/usb/devices/*:*")
+	for _, iface := range interfaces {
+		if sysfsValue(iface+"/bInterfaceClass") != class {
+			continue
+		}
+
+		dev, _ := filepath.EvalSymlinks(filepath.Join(iface, ".."))
+		if seen[dev] {
+			continue
+		}
+		seen[dev] = true
+
+		devices = append(devices, usbDeviceFromSysfs(dev))
+	}
+	return
+}
+
+func usbDeviceFromSysfs(dev string) usbDevice {
+	return usbDevice{
+		Vendor:  sysfsValue(dev + "/idVendor"),
+		Product: sysfsValue(dev + "/idProduct"),
+		Bus:     sysfsValue(dev + "/busnum"),
+		Device:  sysfsValue(dev + "/devnum"),
+		Name:    sysfsValue(dev + "/product"),
+	}
+}
+
+// FIDO HID usage page 0xF1D0 in the report descriptor
+var fidoUsagePage = []byte{0x06, 0xd0, 0xf1}
+
+func findFIDODevices() (devices []usbDevice) {
+	seen := make(map[string]bool)
+
+	hidraws, _ := filepath.Glob("/sys/class/hidraw/*")
+	for _, h := range hidraws {
+		desc, err := ioutil.ReadFile(h + "/device/report_descriptor")
+		if err != nil || !bytes.Contains(desc, fidoUsagePage) {
+			continue
+		}
+
+		// hidraw -> hid device -> usb interface -> usb device
+		iface, err := filepath.EvalSymlinks(h + "/device/..")
+		if err != nil {
+			continue
+		}
+		dev := filepath.Dir(iface)
+		if seen[dev] || !fileExists(dev+"/idVendor") {
+			continue
+		}
+		seen[dev] = true
+
+		devices = append(devices, usbDeviceFromSysfs(dev))
+	}
+	return
+}
+
+func (d usbDevice) xml() string {
+	return fmt.Sprintf(`
+<hostdev mode='subsystem' type='usb' managed='yes'>
+  <source>
+    <vendor id='0x%s'/>
+    <product id='0x%s'/>
+    <address bus='%s' device='%s'/>
+  </source>
+</hostdev>`, xmlEscape(d.Vendor), xmlEscape(d.Product),
+		xmlEscape(d.Bus), xmlEscape(d.Device))
+}
+
+func deviceAllowed(app appConfig, kind string) bool {
+	for _, d := range app.Devices {
+		if d == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func appDomain(l *libvirt.Libvirt, name string) (dom libvirt.Domain, err error) {
+	return lookupOwned(l, "appvm_"+name)
+}
+
+func deviceGrant(l *libvirt.Libvirt, name, kind string) (err error) {
+	find, ok := deviceFinders[kind]
+	if !ok {
+		return errors.New("unknown device " + kind)
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+	if !deviceAllowed(config.app(appNameFromDomain("appvm_"+name)), kind) {
+		return withCategory("denied", fmt.Errorf("%s is not allowed "+
+			"for %s, add it to \"devices\" in %s", kind, name,
+			configPath()))
+	}
+
+	dom, err := appDomain(l, name)
+	if err != nil {
+		return
+	}
+
+	devices := find()
+	if len(devices) == 0 {
+		return errors.New("no USB " + kind + " found")
+	}
+
+	for _, d := range devices {
+		err = l.DomainAttachDeviceFlags(dom, d.xml(),
+			uint32(libvirt.DomainDeviceModifyLive))
+		if err != nil {
+			return
+		}
+		fmt.Println("Attached", d.Name, "to", name)
+	}
+	return
+}
+
+func deviceRevoke(l *libvirt.Libvirt, name, kind string) (err error) {
+	find, ok := deviceFinders[kind]
+	if !ok {
+		return errors.New("unknown device " + kind)
+	}
+
+	dom, err := appDomain(l, name)
+	if err != nil {
+		return
+	}
+
+	desc, err := l.DomainGetXMLDesc(dom, 0)
+	if err != nil {
+		return
+	}
+
+	for _, d := range find() {
+		if !strings.Contains(desc, "<vendor id='0x"+d.Vendor+"'/>") ||
+			!strings.Contains(desc, "<product id='0x"+d.Product+"'/>") {
+			continue
+		}
+
+		err = l.DomainDetachDeviceFlags(dom, d.xml(),
+			uint32(libvirt.DomainDeviceModifyLive))
+		if err != nil {
+			return
+		}
+		fmt.Println("Detached", d.Name, "from", name)
+	}
+	return
+}
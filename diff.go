@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+)
+
+// Local override is the first expression found for the application,
+// upstream is the next one (builtin or from the repo).
+
+func upstreamHashesPath() string {
+	return configDir + "upstream.json"
+}
+
+func overriddenExpr(name string) (local, upstream appExpr, err error) {
+	exprs := findAppExprs(name)
+	if len(exprs) < 2 {
+		err = errors.New("no upstream expression is overridden for " + name)
+		return
+	}
+	return exprs[0], exprs[1], nil
+}
+
+func diffExpr(name string) (err error) {
+	local, upstream, err := overriddenExpr(name)
+	if err != nil {
+		return
+	}
+
+	if upstream.URL != "" && offlineMode {
+		// Last downloaded copy, if any
+		if !fileExists(upstream.Path) {
+			return errOffline
+		}
+	} else if upstream.URL != "" {
+		err = fetchExpr(upstream)
+		if err != nil {
+			return
+		}
+	}
+
+	command := exec.Command("diff", "-u",
+		"--label", upstream.Layer.Name+"/"+name+".nix",
+		"--label", local.Layer.Name+"/"+name+".nix",
+		upstream.Path, local.Path)
+	command.Stdout = os.Stdout
+	command.Stderr = os.Stderr
+	err = command.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		err = nil // files differ
+	}
+	return
+}
+
+// Refreshes expressions from repos and warns if upstream of the
+// overridden expression has changed since the previous check.
+func checkUpstreamDrift() {
+	hashes := make(map[string]string)
+	raw, err := ioutil.ReadFile(upstreamHashesPath())
+	if err == nil {
+		json.Unmarshal(raw, &hashes)
+	}
+
+	for _, name := range exprNames() {
+		_, upstream, err := overriddenExpr(name)
+		if err != nil {
+			continue
+		}
+
+		if upstream.URL != "" {
+			err = fetchExpr(upstream)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+		}
+
+		sum, err := upstream.hash()
+		if err != nil {
+			continue
+		}
+
+		if prev, ok := hashes[name]; ok && prev != sum {
+			log.Println("Upstream expression of", name, "has changed, "+
+				"see appvm diff", name)
+		}
+		hashes[name] = sum
+	}
+
+	raw, _ = json.Marshal(hashes)
+	ioutil.WriteFile(upstreamHashesPath(), raw, 0644)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// Guest displays are created at start (number of heads of the video
+// device), appvm display add/remove enables or disables them at runtime
+// in the guest X session by xrandr over the guest agent. Every display
+// is shown in its own virt-viewer window (View -> Displays).
+
+const displaysMax = 4
+
+func displays(app appConfig) int {
+	switch {
+	case app.Displays <= 0:
+		return 1
+	case app.Displays > displaysMax:
+		return displaysMax
+	}
+	return app.Displays
+}
+
+type xrandrOutput struct {
+	Name    string
+	Enabled bool
+}
+
+func guestXrandr(l *libvirt.Libvirt, dom libvirt.Domain,
+	args ...string) (out string, err error) {
+
+	script := "DISPLAY=:0 XAUTHORITY=/home/user/.Xauthority " +
+		"/run/current-system/sw/bin/xrandr " + strings.Join(args, " ")
+	result, err := guestExec(l, dom, "/bin/sh", "-c", script)
+	if err != nil {
+		return
+	}
+	if result.ExitCode != 0 {
+		err = errors.New("xrandr: " + strings.TrimSpace(result.Stderr))
+		return
+	}
+	return result.Stdout, nil
+}
+
+// Lines like "Virtual-2 connected 1024x768+1024+0 ..."
+func xrandrOutputs(query string) (outputs []xrandrOutput) {
+	for _, line := range strings.Split(query, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || (fields[1] != "connected" &&
+			fields[1] != "disconnected") {
+			continue
+		}
+
+		enabled := false
+		for _, f := range fields[2:] {
+			if strings.Contains(f, "x") && strings.Contains(f, "+") {
+				enabled = true
+			}
+		}
+		outputs = append(outputs, xrandrOutput{fields[0], enabled})
+	}
+	return
+}
+
+func displayChange(l *libvirt.Libvirt, name string, add bool) (err error) {
+	dom, err := lookupOwned(l, "appvm_"+name)
+	if err != nil {
+		return
+	}
+
+	query, err := guestXrandr(l, dom, "--query")
+	if err != nil {
+		return
+	}
+	outputs := xrandrOutputs(query)
+
+	if add {
+		last := ""
+		for _, o := range outputs {
+			if o.Enabled {
+				last = o.Name
+				continue
+			}
+			position := []string{"--right-of", last}
+			if last == "" {
+				position = []string{"--pos", "0x0"}
+			}
+			_, err = guestXrandr(l, dom, append([]string{"--output",
+				o.Name, "--auto"}, position...)...)
+			if err == nil {
+				fmt.Println("Enabled", o.Name)
+			}
+			return
+		}
+		return fmt.Errorf("all %d displays are enabled, set \"displays\" "+
+			"in %s and restart %s", len(outputs), configPath(), name)
+	}
+
+	for i := len(outputs) - 1; i > 0; i-- {
+		if outputs[i].Enabled {
+			_, err = guestXrandr(l, dom, "--output", outputs[i].Name, "--off")
+			if err == nil {
+				fmt.Println("Disabled", outputs[i].Name)
+			}
+			return
+		}
+	}
+	return errors.New("only the primary display is enabled")
+}
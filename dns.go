@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// Per-app resolvers are pushed into the guest by appvm daemon through
+// the guest agent: resolv.conf is set by resolvconf -x (exclusive, so
+// DHCP servers are ignored), DoH endpoint is served on 127.0.0.1 by
+// dnsproxy (see appvm-doh in base.nix), blocked domains are resolved
+// to 0.0.0.0 by /etc/hosts. On the host the nwfilter of the VM (see
+// proxy.go) drops DNS to anything but the servers, so root in the guest
+// can't use other resolvers; with DoH all of port 53 is dropped.
+
+const dnsTick = 5 * time.Second
+
+type dnsConfig struct {
+	Servers []string `json:"servers,omitempty"`
+	// e.g. https://dns.quad9.net/dns-query
+	DoH string `json:"doh,omitempty"`
+	// Path or URL of hosts-style or one domain per line list
+	Blocklist string `json:"blocklist,omitempty"`
+}
+
+var dnsFilterTmpl = `
+<filter name='%s' chain='root'>
+%s  <rule action='drop' direction='out' priority='900'>
+    <udp dstportstart='53'/>
+  </rule>
+  <rule action='drop' direction='out' priority='900'>
+    <tcp dstportstart='53'/>
+  </rule>
+  <rule action='drop' direction='out' priority='900'>
+    <udp-ipv6 dstportstart='53'/>
+  </rule>
+  <rule action='drop' direction='out' priority='900'>
+    <tcp-ipv6 dstportstart='53'/>
+  </rule>
+</filter>
+`
+
+func resolverRules(servers []string) (rules string, err error) {
+	for _, ip := range servers {
+		if net.ParseIP(ip) == nil {
+			err = errors.New("dns server must be an address, not " + ip)
+			return
+		}
+		rules += egressRule("udp", ip, "53") + egressRule("tcp", ip, "53")
+	}
+	return
+}
+
+// DoH is served in the guest, so no resolver is allowed with it
+func dnsFilterXML(name string, app appConfig) (xml string, err error) {
+	rules := ""
+	if app.DNS.DoH == "" {
+		rules, err = resolverRules(app.DNS.Servers)
+		if err != nil {
+			return
+		}
+	}
+	xml = fmt.Sprintf(dnsFilterTmpl, xmlEscape(egressFilterName(name)),
+		rules)
+	return
+}
+
+func (c dnsConfig) empty() bool {
+	return len(c.Servers) == 0 && c.DoH == "" && c.Blocklist == ""
+}
+
+func readBlocklist(source string) (raw []byte, err error) {
+	if !strings.HasPrefix(source, "http://") &&
+		!strings.HasPrefix(source, "https://") {
+		return ioutil.ReadFile(source)
+	}
+
+	resp, err := httpGet(source)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Accepts "0.0.0.0 domain", "127.0.0.1 domain" and "domain" lines
+func blocklistHosts(raw []byte) (hosts []byte) {
+	var b bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.SplitN(scanner.Text(), "#", 2)[0])
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		domain := fields[len(fields)-1]
+		if domain == "localhost" || strings.Contains(domain, "/") {
+			continue
+		}
+		b.WriteString("0.0.0.0 " + domain + "\n")
+	}
+	return b.Bytes()
+}
+
+func guestRoot(l *libvirt.Libvirt, dom libvirt.Domain, input []byte,
+	script string) (err error) {
+
+	result, err := guestExecInput(l, dom, input, "/bin/sh", "-c",
+		"PATH=/run/current-system/sw/bin; "+script)
+	if err != nil {
+		return
+	}
+	if result.ExitCode != 0 {
+		err = errors.New(strings.TrimSpace(result.Stderr))
+	}
+	return
+}
+
+func applyDNS(l *libvirt.Libvirt, dom libvirt.Domain, c dnsConfig) (err error) {
+	servers := c.Servers
+	if c.DoH != "" {
+		err = guestRoot(l, dom, []byte(c.DoH),
+			"mkdir -p /run/appvm && cat > /run/appvm/doh && "+
+				"systemctl restart appvm-doh")
+		if err != nil {
+			return
+		}
+		servers = []string{"127.0.0.1"}
+	}
+
+	if len(servers) != 0 {
+		resolv := ""
+		for _, s := range servers {
+			resolv += "nameserver " + s + "\n"
+		}
+		err = guestRoot(l, dom, []byte(resolv),
+			"resolvconf -x -a appvm")
+		if err != nil {
+			return
+		}
+	}
+
+	if c.Blocklist != "" {
+		raw, err := readBlocklist(c.Blocklist)
+		if err != nil {
+			return err
+		}
+		// /etc/hosts is a link to the store, original is kept to
+		// apply again
+		err = guestRoot(l, dom, blocklistHosts(raw),
+			"if [ -L /etc/hosts ]; then "+
+				"cp \"$(readlink -f /etc/hosts)\" /etc/hosts.orig; fi && "+
+				"cp --remove-destination /etc/hosts.orig /etc/hosts && "+
+				"cat >> /etc/hosts")
+		if err != nil {
+			return err
+		}
+	}
+	return
+}
+
+func watchDNS(l *libvirt.Libvirt) {
+	applied := make(map[string]bool)
+
+	for ; ; time.Sleep(dnsTick) {
+		domains, err := l.Domains()
+		if err != nil {
+			continue
+		}
+
+		config, err := loadConfig()
+		if err != nil {
+			continue
+		}
+
+		running := make(map[string]bool)
+		for _, d := range domains {
+			if !strings.HasPrefix(d.Name, "appvm_") || !isOwned(l, d) {
+				continue
+			}
+			running[d.Name] = true
+
+			c := config.app(appNameFromDomain(d.Name)).DNS
+			if applied[d.Name] || c.empty() {
+				continue
+			}
+
+			// Guest agent is not available until boot
+			err = applyDNS(l, d, c)
+			if err == nil {
+				log.Println("DNS policy applied to", d.Name)
+				applied[d.Name] = true
+			}
+		}
+
+		for name := range applied {
+			if !running[name] {
+				delete(applied, name)
+			}
+		}
+	}
+}
+
+func checkDNS(c dnsConfig) (err error) {
+	if c.DoH != "" && !strings.HasPrefix(c.DoH, "https://") {
+		return errors.New("DoH endpoint must be https:// URL")
+	}
+	if _, err = resolverRules(c.Servers); err != nil {
+		return
+	}
+	if c.Blocklist != "" && !strings.Contains(c.Blocklist, "://") {
+		_, err = os.Stat(c.Blocklist)
+	}
+	return
+}
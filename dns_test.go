@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBlocklistHosts(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"ads.example.com\n", "0.0.0.0 ads.example.com\n"},
+		{"0.0.0.0 ads.example.com\n127.0.0.1 t.example.org",
+			"0.0.0.0 ads.example.com\n0.0.0.0 t.example.org\n"},
+		{"# comment\n\n  \nads.example.com # inline\n",
+			"0.0.0.0 ads.example.com\n"},
+		{"127.0.0.1 localhost\n::1 localhost\n", ""},
+		{"https://example.com/list\n", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := string(blocklistHosts([]byte(tt.in))); got != tt.want {
+			t.Errorf("blocklistHosts(%q) = %q, want %q", tt.in, got,
+				tt.want)
+		}
+	}
+}
+
+func TestDNSFilterXML(t *testing.T) {
+	tests := []struct {
+		dns     dnsConfig
+		allowed []string
+		valid   bool
+	}{
+		{dnsConfig{Servers: []string{"9.9.9.9"}},
+			[]string{"<udp dstipaddr='9.9.9.9' dstportstart='53'/>",
+				"<tcp dstipaddr='9.9.9.9' dstportstart='53'/>"}, true},
+		{dnsConfig{Servers: []string{"2620:fe::fe"}},
+			[]string{"<udp-ipv6 dstipaddr='2620:fe::fe' dstportstart='53'/>",
+				"<tcp-ipv6 dstipaddr='2620:fe::fe' dstportstart='53'/>"},
+			true},
+		{dnsConfig{Servers: []string{"9.9.9.9"},
+			DoH: "https://dns.quad9.net/dns-query"}, nil, true},
+		{dnsConfig{Servers: []string{"dns.quad9.net"}}, nil, false},
+	}
+
+	for _, tt := range tests {
+		xml, err := dnsFilterXML("test", appConfig{DNS: tt.dns})
+		if !tt.valid {
+			if err == nil {
+				t.Errorf("%+v: accepted, want error", tt.dns)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: %v", tt.dns, err)
+			continue
+		}
+
+		if !strings.Contains(xml, "<filter name='appvm-egress-test'") {
+			t.Errorf("%+v: no filter name in %s", tt.dns, xml)
+		}
+		if got := strings.Count(xml, "action='accept'"); got !=
+			len(tt.allowed) {
+
+			t.Errorf("%+v: %d accept rules, want %d", tt.dns, got,
+				len(tt.allowed))
+		}
+		for _, rule := range tt.allowed {
+			if !strings.Contains(xml, rule) {
+				t.Errorf("%+v: no %s in %s", tt.dns, rule, xml)
+			}
+		}
+		if strings.Count(xml, "action='drop'") != 4 {
+			t.Errorf("%+v: port 53 is not dropped in %s", tt.dns, xml)
+		}
+	}
+}
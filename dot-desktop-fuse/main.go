@@ -64,7 +64,7 @@ func (r *ddf) OnAdd(ctx context.Context) {
 var _ = (fs.NodeOnAdder)((*ddf)(nil))
 
 func setupSigintHandler(server *fuse.Server) {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
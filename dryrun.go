@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// appvm start --dry-run: shows what would be done without building
+// and starting VM. Expression is still evaluated by nix-instantiate.
+
+func startDryRun(name string, network networkModel, gui, stateless bool) (err error) {
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+	app := config.app(name)
+
+	id := name
+	if stateless {
+		id = "tmp_<random>_" + name
+	}
+	vmName := "appvm_" + id
+	sharedDir := appvmHomesDir + id
+
+	fmt.Println("Domain:   ", vmName)
+	if app.NetVM != "" {
+		network = networkLibvirt
+		fmt.Println("Network:   via", app.NetVM)
+	} else {
+		fmt.Println("Network:  ", networkModelName(network))
+	}
+	if gui {
+		fmt.Println("Graphics: ", graphicsType(app), "on", graphicsListen(app))
+	} else {
+		fmt.Println("Graphics:  off")
+	}
+	fmt.Println("Resources:", appResources(app))
+	fmt.Println("Store:    ", storeMode(app))
+	fmt.Println("Home:     ", sharedDir)
+	for _, s := range appShares(name) {
+		fmt.Println("Share:    ", s.Source, "as", s.Tag)
+	}
+	if app.Arch != "" {
+		fmt.Println("Arch:     ", app.Arch)
+	}
+	if app.Restart != "" {
+		fmt.Println("Restart:  ", app.Restart)
+	}
+	if app.Hooks.PreStart != "" {
+		fmt.Println("Pre-start:", app.Hooks.PreStart)
+	}
+	if app.Hooks.PostStop != "" {
+		fmt.Println("Post-stop:", app.Hooks.PostStop)
+	}
+	if app.Snapshot && !stateless {
+		fmt.Println("Data snapshot before start")
+	}
+
+	if app.Type == "image" {
+		fmt.Println("Image:    ", appDisk(id, app))
+		xml, err := generateImageXML(vmName, app, network, gui)
+		if err != nil {
+			return err
+		}
+		fmt.Println(xml)
+		return nil
+	}
+
+	e, ok := findAppExpr(name)
+	if !ok {
+		fmt.Println("No expression, would be generated by appvm generate", name)
+		return
+	}
+	fmt.Printf("Expression: %s (%s)\n", e.Path, e.Layer.Name)
+
+	err = checkArch(app.Arch)
+	if err != nil {
+		return
+	}
+
+	drv, err := checkExpr(configDir, name, app.Arch)
+	if err != nil {
+		return
+	}
+	fmt.Println("Derivation:", drv)
+
+	out, err := run(nixBin("nix-store"), "--query", "--outputs", drv)
+	if err != nil {
+		return
+	}
+
+	realpath, reginfo := "<system>", "<reginfo>"
+	if b, e := newBootInfo(out); e == nil {
+		realpath, reginfo = b.System, b.Reginfo
+		fmt.Println("Cached:    ", out)
+	} else {
+		plan, err := run(nixBin("nix-store"), append([]string{
+			"--realise", "--dry-run", drv},
+			nixBuildOptions(config.Nix)...)...)
+		if err != nil {
+			return err
+		}
+		fmt.Println(strings.TrimSpace(plan))
+	}
+
+	qcow2 := appvmHomesDir + "." + name + ".fake.qcow2"
+	fmt.Println(generateXML(vmName, network, gui, realpath, reginfo, qcow2,
+		sharedDir, appShares(name), app))
+	return
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// Built system is linked to be able to find closure without rebuild
+func systemLink(name string) string {
+	return appvmHomesDir + "." + name + ".system"
+}
+
+func linkSystem(name, realpath string) {
+	os.Remove(systemLink(name))
+	err := os.Symlink(realpath, systemLink(name))
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func closureSize(name string) (size int64, ok bool) {
+	system, err := os.Readlink(systemLink(name))
+	if err != nil {
+		return
+	}
+
+	out, err := exec.Command(nixBin("nix"), "path-info", "-S",
+		system).Output()
+	if err != nil {
+		return
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		return
+	}
+
+	size, err = strconv.ParseInt(fields[1], 10, 64)
+	ok = err == nil
+	return
+}
+
+func imageSize(path string) (actual, virtual int64, err error) {
+	out, err := exec.Command("qemu-img", "info", "--output=json",
+		path).Output()
+	if err != nil {
+		return
+	}
+
+	var info struct {
+		ActualSize  int64 `json:"actual-size"`
+		VirtualSize int64 `json:"virtual-size"`
+	}
+	err = json.Unmarshal(out, &info)
+	return info.ActualSize, info.VirtualSize, err
+}
+
+func appNames() (names []string) {
+	names = exprNames()
+
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+
+	for name, app := range config.Apps {
+		if app.Type == "image" {
+			names = append(names, name)
+		}
+	}
+	return
+}
+
+func diskUsage() {
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Application VM", "Shared directory",
+		"Disk (allocated/virtual)", "Closure"})
+
+	for _, name := range appNames() {
+		shared := "-"
+		if isDirExists(appvmHomesDir + name) {
+			shared = humanSize(pathSize(appvmHomesDir + name))
+		}
+
+		disk := "-"
+		if app := config.app(name); app.Type == "image" {
+			actual, virtual, err := imageSize(appDisk(name, app))
+			if err == nil {
+				disk = humanSize(actual) + " / " +
+					humanSize(virtual)
+			}
+		}
+
+		closure := "-"
+		if size, ok := closureSize(name); ok {
+			closure = humanSize(size)
+		}
+
+		table.Append([]string{name, shared, disk, closure})
+	}
+	table.Render()
+
+	fmt.Println("Closures are shared between VMs, so total is less than the sum")
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+// Exit codes are stable, wrappers may rely on them. With
+// --error-format json the error is printed to stderr as
+// {"error": "...", "category": "...", "exit_code": N}.
+
+const (
+	exitError    = 1
+	exitUsage    = 2
+	exitBuild    = 3
+	exitLibvirt  = 4
+	exitNotFound = 5
+	exitDenied   = 6
+	exitTimeout  = 7
+)
+
+var exitCodes = map[string]int{
+	"error":     exitError,
+	"usage":     exitUsage,
+	"build":     exitBuild,
+	"libvirt":   exitLibvirt,
+	"not_found": exitNotFound,
+	"denied":    exitDenied,
+	"timeout":   exitTimeout,
+}
+
+// Set by --error-format (APPVM_ERROR_FORMAT): "text" or "json"
+var errorFormat = "text"
+
+type categoryError struct {
+	Category string
+	Err      error
+}
+
+func (e categoryError) Error() string {
+	return e.Err.Error()
+}
+
+func (e categoryError) Unwrap() error {
+	return e.Err
+}
+
+func withCategory(category string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return categoryError{category, err}
+}
+
+func errorCategory(err error) string {
+	var c categoryError
+	if errors.As(err, &c) {
+		return c.Category
+	}
+
+	var netErr net.Error
+	switch {
+	case libvirt.IsNotFound(err), os.IsNotExist(err):
+		return "not_found"
+	case os.IsPermission(err):
+		return "denied"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+	return "error"
+}
+
+// Flags are not set if the command line can't be parsed
+func errorFormatArg(args []string) string {
+	for i, arg := range args {
+		if arg == "--error-format" && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(arg, "--error-format=") {
+			return strings.TrimPrefix(arg, "--error-format=")
+		}
+	}
+	if format := os.Getenv("APPVM_ERROR_FORMAT"); format != "" {
+		return format
+	}
+	return errorFormat
+}
+
+func fatal(err error) {
+	abortPhase()
+	category := errorCategory(err)
+	code := exitCodes[category]
+
+	if errorFormat == "json" {
+		raw, _ := json.Marshal(map[string]interface{}{
+			"error":     err.Error(),
+			"category":  category,
+			"exit_code": code,
+		})
+		fmt.Fprintln(os.Stderr, string(raw))
+	} else if category == "usage" {
+		kingpin.Errorf("%s", err)
+	} else {
+		log.Println(err)
+	}
+	os.Exit(code)
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// appvm export-config writes config.json, trusted repos with pins and
+// own expressions, profiles and metadata from ~/.config/appvm/nix to a
+// single JSON file; data directories, build state and the API token are
+// not exported. appvm import-config merges it: settings and applications
+// of the file replace local ones with the same name, repos and pins are
+// added.
+
+const exportFormat = 1
+
+type configExport struct {
+	Format int             `json:"appvm_config_export"`
+	Config json.RawMessage `json:"config"`
+	Trust  trustStore      `json:"trust"`
+	// Path relative to ~/.config/appvm -> content
+	Files map[string]string `json:"files,omitempty"`
+}
+
+// Rewritten on every run
+func generatedFile(rel string) bool {
+	if rel == "nix/base.nix" {
+		return true
+	}
+	for name := range builtinProfiles {
+		if rel == "nix/profiles/"+name+".nix" {
+			return true
+		}
+	}
+	return false
+}
+
+// Files under nix/ exported as text
+func exportedFiles() (files map[string]string, err error) {
+	files = make(map[string]string)
+	root := configDir + "nix"
+	err = filepath.Walk(root, func(path string, info os.FileInfo,
+		err error) error {
+
+		if err != nil || info.IsDir() {
+			return err
+		}
+		ext := filepath.Ext(path)
+		if ext != ".nix" && ext != ".json" {
+			return nil
+		}
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if !utf8.Valid(raw) {
+			return nil
+		}
+		rel, _ := filepath.Rel(configDir, path)
+		if !generatedFile(rel) {
+			files[rel] = string(raw)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return
+}
+
+func exportConfig(output string) (err error) {
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+	config.Version = 0
+
+	e := configExport{Format: exportFormat}
+	e.Config, err = json.Marshal(config)
+	if err != nil {
+		return
+	}
+	e.Trust, err = loadTrust()
+	if err != nil {
+		return
+	}
+	e.Files, err = exportedFiles()
+	if err != nil {
+		return
+	}
+
+	raw, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return
+	}
+	raw = append(raw, '\n')
+
+	if output == "" || output == "-" {
+		_, err = os.Stdout.Write(raw)
+		return
+	}
+	return ioutil.WriteFile(output, raw, 0600)
+}
+
+func loadExport(path string) (e configExport, err error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(raw, &e)
+	if err != nil {
+		err = fmt.Errorf("%s: %v", path, err)
+		return
+	}
+	if e.Format != exportFormat {
+		err = fmt.Errorf("%s is not an appvm config export "+
+			"(format %d)", path, e.Format)
+	}
+	return
+}
+
+// Settings that run commands on the host or give host files, devices
+// and agents to the guest
+var sensitiveSettings = map[string]bool{
+	"scan": true, "nix": true, "store": true, "fetch": true,
+}
+
+var sensitiveAppSettings = map[string]bool{
+	"hooks": true, "schedule": true, "secrets": true, "ssh_agent": true,
+	"gpg_agent": true, "devices": true, "outbox": true, "smartcard": true,
+	"webdav": true, "printing": true, "sandbox": true, "graphics": true,
+	"command": true,
+}
+
+// Changed fields of the application, "name.field: old -> new"
+func appDiff(name string, old, app appConfig) (changes,
+	sensitive []string) {
+
+	var a, b map[string]json.RawMessage
+	raw, _ := json.Marshal(old)
+	json.Unmarshal(raw, &a)
+	raw, _ = json.Marshal(app)
+	json.Unmarshal(raw, &b)
+
+	fields := make(map[string]bool)
+	for key := range a {
+		fields[key] = true
+	}
+	for key := range b {
+		fields[key] = true
+	}
+	var keys []string
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if string(a[key]) == string(b[key]) {
+			continue
+		}
+		from, to := string(a[key]), string(b[key])
+		if from == "" {
+			from = "(none)"
+		}
+		if to == "" {
+			to = "(none)"
+		}
+		changes = append(changes, fmt.Sprintf("  %s.%s: %s -> %s",
+			name, key, from, to))
+		if sensitiveAppSettings[key] && to != "(none)" {
+			sensitive = append(sensitive, name+"."+key)
+		}
+	}
+	return
+}
+
+// Top level settings are replaced, apps are replaced by name and repos
+// are added. Sensitive are changed settings that need --allow-sensitive.
+func mergeConfig(local appvmConfig, imported json.RawMessage) (
+	merged appvmConfig, changes, sensitive []string, err error) {
+
+	var settings map[string]json.RawMessage
+	err = json.Unmarshal(imported, &settings)
+	if err != nil {
+		return
+	}
+
+	var in appvmConfig
+	err = json.Unmarshal(imported, &in)
+	if err != nil {
+		return
+	}
+
+	// Settings that are not in the file are kept
+	raw, err := json.Marshal(local)
+	if err != nil {
+		return
+	}
+	var current map[string]json.RawMessage
+	json.Unmarshal(raw, &current)
+	var keys []string
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := settings[key]
+		switch key {
+		case "apps", "repos", "version":
+			continue
+		}
+		if string(current[key]) != string(value) {
+			changes = append(changes, "setting "+key+": "+
+				string(value))
+			if sensitiveSettings[key] {
+				sensitive = append(sensitive, key)
+			}
+		}
+		current[key] = value
+	}
+	raw, _ = json.Marshal(current)
+	err = json.Unmarshal(raw, &merged)
+	if err != nil {
+		return
+	}
+	merged.Version = local.Version
+
+	var names []string
+	for name := range in.Apps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		app := in.Apps[name]
+		err = validateName(name)
+		if err != nil {
+			return
+		}
+		old, ok := merged.Apps[name]
+		diff, s := appDiff(name, old, app)
+		if len(diff) == 0 {
+			continue
+		}
+		if !ok {
+			changes = append(changes, "add application "+name)
+		} else {
+			changes = append(changes, "change settings of "+name)
+		}
+		changes = append(changes, diff...)
+		sensitive = append(sensitive, s...)
+		merged.setApp(name, app)
+	}
+
+	repos := make(map[string]bool)
+	for _, repo := range merged.Repos {
+		repos[strings.TrimSuffix(repo, "/")] = true
+	}
+	for _, repo := range in.Repos {
+		if !repos[strings.TrimSuffix(repo, "/")] {
+			changes = append(changes, "add repo "+repo)
+			merged.Repos = append(merged.Repos, repo)
+		}
+	}
+	return
+}
+
+// Stale are URLs of pins that are changed, their cached copies do not
+// match anymore
+func mergeTrust(local, in trustStore) (changes, stale []string) {
+	for repo, r := range in.Repos {
+		if _, ok := local.Repos[repo]; !ok {
+			changes = append(changes, "trust "+repo)
+			local.Repos[repo] = r
+		}
+	}
+	for url, pin := range in.Pins {
+		old, ok := local.Pins[url]
+		if ok && old.SHA256 == pin.SHA256 {
+			continue
+		}
+		if ok {
+			changes = append(changes, "replace pin of "+url)
+		} else {
+			changes = append(changes, "pin "+url)
+		}
+		local.Pins[url] = pin
+		stale = append(stale, url)
+	}
+	return
+}
+
+// Paths must stay in ~/.config/appvm/nix
+func importedPath(rel string) (path string, err error) {
+	clean := filepath.Clean(rel)
+	if filepath.IsAbs(clean) || !strings.HasPrefix(clean, "nix/") {
+		err = errors.New("refusing to write " + rel + " outside of nix/")
+		return
+	}
+	return configDir + clean, nil
+}
+
+func importConfig(path string, yes, dryRun, allowSensitive bool) (
+	err error) {
+
+	e, err := loadExport(path)
+	if err != nil {
+		return
+	}
+
+	local, err := loadConfig()
+	if err != nil {
+		return
+	}
+	merged, changes, sensitive, err := mergeConfig(local, e.Config)
+	if err != nil {
+		return
+	}
+
+	trust, err := loadTrust()
+	if err != nil {
+		return
+	}
+
+	var rels []string
+	for rel := range e.Files {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+
+	var writes []string
+	for _, rel := range rels {
+		target, err := importedPath(rel)
+		if err != nil {
+			return err
+		}
+		raw, err := ioutil.ReadFile(target)
+		switch {
+		case os.IsNotExist(err):
+			changes = append(changes, "add "+rel)
+		case err != nil:
+			return err
+		case string(raw) != e.Files[rel]:
+			changes = append(changes, "overwrite "+rel)
+		default:
+			continue
+		}
+		writes = append(writes, rel)
+	}
+
+	trustChanges, stale := mergeTrust(trust, e.Trust)
+	changes = append(changes, trustChanges...)
+
+	if len(changes) == 0 {
+		fmt.Println("Nothing to import")
+		return
+	}
+	for _, c := range changes {
+		fmt.Println("\t" + c)
+	}
+	if len(sensitive) != 0 {
+		fmt.Println("Host-sensitive settings:", strings.Join(sensitive, ", "))
+	}
+	if dryRun {
+		return
+	}
+	if len(sensitive) != 0 && !allowSensitive {
+		return withCategory("denied", errors.New("the file changes "+
+			"host-sensitive settings, review them and use "+
+			"--allow-sensitive"))
+	}
+	if !yes && !confirm(fmt.Sprintf("Apply %d changes?", len(changes))) {
+		return withCategory("denied", errors.New("import is cancelled"))
+	}
+
+	for _, rel := range writes {
+		target, _ := importedPath(rel)
+		os.MkdirAll(filepath.Dir(target), 0700)
+		err = ioutil.WriteFile(target, []byte(e.Files[rel]), 0644)
+		if err != nil {
+			return
+		}
+	}
+
+	for _, url := range stale {
+		os.Remove(cachedPath(url))
+	}
+	err = saveTrust(trust)
+	if err != nil {
+		return
+	}
+	return saveConfig(merged)
+}
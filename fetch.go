@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Proxy and mirrors for downloads: "fetch.proxy" is exported as
+// http(s)_proxy unless already set in the environment, so it is used by
+// appvm itself and by builtins fetchers of nix-instantiate/nix-build.
+// Fixed-output derivations are built by nix-daemon, which reads proxy
+// from its own environment. Mirrors replace URL prefixes of files
+// downloaded by appvm (repos, blocklists, static nix).
+
+type fetchConfig struct {
+	// e.g. http://proxy.corp:3128
+	Proxy   string   `json:"proxy,omitempty"`
+	NoProxy []string `json:"no_proxy,omitempty"`
+	// URL prefix -> replacement, e.g.
+	// "https://raw.githubusercontent.com/": "https://git.corp/raw/"
+	Mirrors map[string]string `json:"mirrors,omitempty"`
+	// Seconds to connect and to receive response headers
+	Timeout int `json:"timeout,omitempty"`
+	// Retries of failed downloads, 3 by default
+	Retries int `json:"retries,omitempty"`
+}
+
+func setenvDefault(key, value string) {
+	if os.Getenv(key) == "" {
+		os.Setenv(key, value)
+	}
+}
+
+// Must be called before the first request, net/http reads the
+// environment once
+func setupProxy() {
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+
+	c := config.Fetch
+	if c.Proxy != "" {
+		for _, key := range []string{"http_proxy", "https_proxy",
+			"HTTP_PROXY", "HTTPS_PROXY"} {
+			setenvDefault(key, c.Proxy)
+		}
+	}
+	if len(c.NoProxy) != 0 {
+		noProxy := strings.Join(c.NoProxy, ",")
+		setenvDefault("no_proxy", noProxy)
+		setenvDefault("NO_PROXY", noProxy)
+	}
+}
+
+// The longest matching prefix wins
+func mirrorURL(url string) string {
+	config, err := loadConfig()
+	if err != nil {
+		return url
+	}
+
+	from := ""
+	for prefix := range config.Fetch.Mirrors {
+		if strings.HasPrefix(url, prefix) && len(prefix) > len(from) {
+			from = prefix
+		}
+	}
+	if from == "" {
+		return url
+	}
+	return config.Fetch.Mirrors[from] + strings.TrimPrefix(url, from)
+}
+
+const (
+	fetchTimeoutDefault = 30 // seconds
+	fetchRetriesDefault = 3
+)
+
+type fetchError struct {
+	URL      string
+	Status   int // 0 if no response
+	Err      error
+	Attempts int
+}
+
+func (e *fetchError) Error() string {
+	s := "fetch " + e.URL + ": " + e.Err.Error()
+	if e.Attempts > 1 {
+		s += fmt.Sprintf(" (%d attempts)", e.Attempts)
+	}
+	return s
+}
+
+func isNotFound(err error) bool {
+	var fe *fetchError
+	return errors.As(err, &fe) && fe.Status == http.StatusNotFound
+}
+
+// Client errors except of rate limiting are not retried
+func retryable(status int) bool {
+	return status == 0 || status == http.StatusTooManyRequests ||
+		status >= 500
+}
+
+// Timeout is applied to connect and to the response headers, body is
+// not limited as static nix is large
+func fetchClient(c fetchConfig) *http.Client {
+	timeout := time.Duration(c.Timeout) * time.Second
+	if c.Timeout <= 0 {
+		timeout = fetchTimeoutDefault * time.Second
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: timeout}).DialContext
+	transport.TLSHandshakeTimeout = timeout
+	transport.ResponseHeaderTimeout = timeout
+	return &http.Client{Transport: transport}
+}
+
+// GET with retries and exponential backoff (1s, 2s, 4s, ...), caller
+// closes the body
+func httpGet(url string) (resp *http.Response, err error) {
+	fe := &fetchError{URL: url}
+	if offlineMode {
+		fe.Err = errOffline
+		return nil, fe
+	}
+
+	config, _ := loadConfig()
+	retries := config.Fetch.Retries
+	if retries <= 0 {
+		retries = fetchRetriesDefault
+	}
+	client := fetchClient(config.Fetch)
+
+	target := mirrorURL(url)
+	if target != url {
+		fe.URL = url + " (mirror " + target + ")"
+	}
+
+	for backoff := time.Second; ; backoff *= 2 {
+		fe.Attempts++
+		resp, err = client.Get(target)
+		if err == nil && resp.StatusCode == http.StatusOK {
+			return
+		}
+
+		if err == nil {
+			resp.Body.Close()
+			fe.Status, fe.Err = resp.StatusCode, errors.New(resp.Status)
+		} else {
+			fe.Status, fe.Err = 0, err
+		}
+
+		if !retryable(fe.Status) || fe.Attempts > retries {
+			return nil, fe
+		}
+		time.Sleep(backoff)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Application is installed by the host to the shared directory, so
+// the VM itself does not need network to run it. Only the metadata of
+// the installed application (runtime and permissions) is used, modules
+// of the build manifest are not translated to nix.
+var flatpakTemplate = `
+# Imported from Flathub %s
+#   runtime: %s
+#   permissions not mapped to appvm:
+%s
+{pkgs, ...}:
+let
+  appRunner = pkgs.writeShellScriptBin "app" ''
+    ARGS_FILE=/home/user/.args
+    ARGS=$(cat $ARGS_FILE)
+    rm $ARGS_FILE
+
+    ${pkgs.flatpak}/bin/flatpak run --user %s $ARGS
+    systemctl poweroff
+  '';
+in {
+  imports = [
+    <nixpkgs/nixos/modules/virtualisation/qemu-vm.nix>
+    <nix/base.nix>
+  ];
+
+  services.flatpak.enable = true;
+  xdg.portal.enable = true;
+  xdg.portal.extraPortals = [ pkgs.xdg-desktop-portal-gtk ];
+
+  services.xserver.displayManager.sessionCommands = "${appRunner}/bin/app &";
+}
+`
+
+const flathubRepo = "https://flathub.org/repo/flathub.flatpakrepo"
+
+type flatpakMetadata struct {
+	Runtime string
+	Shared  []string
+	// Host files and devices, the VM has only the shared directory
+	// and devices of appvm start, so these are not granted
+	Filesystems []string
+	Devices     []string
+	Other       []string
+}
+
+// Parses [Application] and [Context] of flatpak metadata
+func parseFlatpakMetadata(raw string) (m flatpakMetadata) {
+	section := ""
+	for _, line := range strings.Split(raw, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			section = line
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, values := kv[0], strings.Split(strings.Trim(kv[1], ";"), ";")
+
+		switch {
+		case section == "[Application]" && key == "runtime":
+			m.Runtime = kv[1]
+		case section == "[Context]" && key == "shared":
+			m.Shared = values
+		case section == "[Context]" && key == "filesystems":
+			m.Filesystems = values
+		case section == "[Context]" && key == "devices":
+			m.Devices = values
+		case section == "[Context]":
+			for _, v := range values {
+				m.Other = append(m.Other, key+"="+v)
+			}
+		}
+	}
+	return
+}
+
+func (m flatpakMetadata) hasNetwork() bool {
+	for _, s := range m.Shared {
+		if s == "network" {
+			return true
+		}
+	}
+	return false
+}
+
+// org.gimp.GIMP -> gimp
+func flatpakName(appID string) string {
+	parts := strings.Split(appID, ".")
+	return strings.ToLower(parts[len(parts)-1])
+}
+
+func flatpak(sharedDir string, args ...string) *exec.Cmd {
+	command := exec.Command("flatpak", append([]string{"--user"}, args...)...)
+	command.Env = append(os.Environ(),
+		"FLATPAK_USER_DIR="+sharedDir+"/.local/share/flatpak")
+	return command
+}
+
+func importFlatpak(appID string, force bool) (err error) {
+	name := flatpakName(appID)
+	err = validateName(name)
+	if err != nil {
+		return
+	}
+
+	sharedDir := appvmHomesDir + name
+	err = os.MkdirAll(sharedDir, 0700)
+	if err != nil {
+		return
+	}
+
+	out, err := flatpak(sharedDir, "remote-add", "--if-not-exists",
+		"flathub", flathubRepo).CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("flatpak remote-add: %v: %s", err, out)
+		return
+	}
+
+	out, err = flatpak(sharedDir, "remote-info", "--show-metadata",
+		"flathub", appID).Output()
+	if err != nil {
+		err = fmt.Errorf("flatpak remote-info %s: %v", appID, err)
+		return
+	}
+	metadata := parseFlatpakMetadata(string(out))
+
+	log.Println("Install", appID, "to", sharedDir)
+	install := flatpak(sharedDir, "install", "--noninteractive",
+		"flathub", appID)
+	install.Stdout = os.Stdout
+	install.Stderr = os.Stderr
+	err = install.Run()
+	if err != nil {
+		return
+	}
+
+	var ignored []string
+	for _, f := range metadata.Filesystems {
+		ignored = append(ignored, "filesystems="+f)
+	}
+	for _, d := range metadata.Devices {
+		ignored = append(ignored, "devices="+d)
+	}
+	for _, i := range ignored {
+		log.Println("Permission", i, "is not granted, "+
+			"the VM sees only", sharedDir)
+	}
+
+	var other string
+	for _, o := range append(ignored, metadata.Other...) {
+		other += "#     " + o + "\n"
+	}
+
+	appNixConfig := fmt.Sprintf(flatpakTemplate, appID, metadata.Runtime,
+		other, appID)
+	appFilename, err := writeGeneratedExpr(name, appNixConfig, force)
+	if err != nil {
+		return
+	}
+	log.Println("Configuration file is saved to", appFilename)
+
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+
+	app := config.app(name)
+	if !metadata.hasNetwork() {
+		app.Network = "offline"
+	}
+	config.setApp(name, app)
+
+	err = saveConfig(config)
+	if err != nil {
+		return
+	}
+
+	log.Println("Use appvm start", name)
+	return
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// appvm focus finds the viewer window by its class (see wmclass.go)
+// through the IPC of the window manager and focuses it. If there is no
+// window the viewer is opened for the running VM, otherwise the VM is
+// started. Backends are tried in order, the first available one is
+// used.
+
+type windowBackend interface {
+	Name() string
+	Available() bool
+	// False if there is no such window
+	Focus(class string) (bool, error)
+	// Class of the focused window, empty if there is none
+	Focused() (string, error)
+}
+
+var windowBackends = []windowBackend{
+	// Xwayland viewers have class instead of app_id
+	i3IPC{"sway", "SWAYSOCK", []string{"app_id", "class"}},
+	i3IPC{"i3", "I3SOCK", []string{"class"}},
+}
+
+// sway and i3 share the protocol: "i3-ipc", payload length and message
+// type (native byte order, little endian on supported hosts), payload
+type i3IPC struct {
+	name string
+	env  string
+	// Window attributes matched against the class
+	attrs []string
+}
+
+const (
+	i3RunCommand = 0
+	i3GetTree    = 4
+)
+
+func (b i3IPC) Name() string {
+	return b.name
+}
+
+func (b i3IPC) socket() string {
+	if path := os.Getenv(b.env); path != "" {
+		return path
+	}
+	if b.name == "i3" && os.Getenv("DISPLAY") != "" {
+		out, err := exec.Command("i3", "--get-socketpath").Output()
+		if err == nil {
+			return strings.TrimSpace(string(out))
+		}
+	}
+	return ""
+}
+
+func (b i3IPC) Available() bool {
+	return b.socket() != ""
+}
+
+func (b i3IPC) message(typ uint32, payload string) (raw []byte, err error) {
+	conn, err := net.Dial("unix", b.socket())
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	header := make([]byte, 14)
+	copy(header, "i3-ipc")
+	binary.LittleEndian.PutUint32(header[6:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[10:], typ)
+	_, err = conn.Write(append(header, payload...))
+	if err != nil {
+		return
+	}
+
+	_, err = io.ReadFull(conn, header)
+	if err != nil {
+		return
+	}
+	if string(header[:6]) != "i3-ipc" {
+		err = errors.New(b.name + ": invalid IPC reply")
+		return
+	}
+	raw = make([]byte, binary.LittleEndian.Uint32(header[6:]))
+	_, err = io.ReadFull(conn, raw)
+	return
+}
+
+func (b i3IPC) Focus(class string) (found bool, err error) {
+	var commands []string
+	for _, attr := range b.attrs {
+		commands = append(commands,
+			fmt.Sprintf("[%s=\"^%s$\"] focus", attr, class))
+	}
+
+	raw, err := b.message(i3RunCommand, strings.Join(commands, "; "))
+	if err != nil {
+		return
+	}
+
+	var results []struct {
+		Success bool `json:"success"`
+	}
+	err = json.Unmarshal(raw, &results)
+	if err != nil {
+		return
+	}
+	for _, r := range results {
+		if r.Success {
+			found = true
+		}
+	}
+	return
+}
+
+type i3Node struct {
+	Focused          bool   `json:"focused"`
+	AppID            string `json:"app_id"`
+	WindowProperties struct {
+		Class string `json:"class"`
+	} `json:"window_properties"`
+	Nodes         []i3Node `json:"nodes"`
+	FloatingNodes []i3Node `json:"floating_nodes"`
+}
+
+func (n i3Node) focused() (class string, ok bool) {
+	if n.Focused {
+		if n.AppID != "" {
+			return n.AppID, true
+		}
+		return n.WindowProperties.Class, true
+	}
+	for _, c := range append(n.Nodes, n.FloatingNodes...) {
+		if class, ok = c.focused(); ok {
+			return
+		}
+	}
+	return
+}
+
+func (b i3IPC) Focused() (class string, err error) {
+	raw, err := b.message(i3GetTree, "")
+	if err != nil {
+		return
+	}
+	var tree i3Node
+	err = json.Unmarshal(raw, &tree)
+	if err != nil {
+		return
+	}
+	class, _ = tree.focused()
+	return
+}
+
+func windowManager() (windowBackend, error) {
+	for _, b := range windowBackends {
+		if b.Available() {
+			return b, nil
+		}
+	}
+	var names []string
+	for _, b := range windowBackends {
+		names = append(names, b.Name())
+	}
+	return nil, errors.New("no supported window manager found (" +
+		strings.Join(names, ", ") + ")")
+}
+
+func focus(l *libvirt.Libvirt, name string) (err error) {
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+	class := viewerClass(name, config.app(name).Viewer)
+
+	wm, err := windowManager()
+	if err != nil {
+		return
+	}
+	found, err := wm.Focus(class)
+	if err != nil {
+		return fmt.Errorf("%s: %v", wm.Name(), err)
+	}
+	if found {
+		return
+	}
+
+	if isRunning(l, name) {
+		return attach(l, name)
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		self = os.Args[0]
+	}
+	command := exec.Command(self, "start", name, "--quiet")
+	command.Stdout = os.Stdout
+	command.Stderr = os.Stderr
+	return command.Run()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// Gateway VM ("gateway": true, e.g. VPN, Tor or firewall) gets the
+// second NIC on its own isolated libvirt network, VMs with "netvm"
+// have the only NIC on that network instead of the host NAT. Gateway
+// provides DHCP and routing itself, gateways can be chained.
+
+func gatewayNetwork(gateway string) string {
+	return "appvm-gw-" + gateway
+}
+
+// No <ip> and <forward>, so host is not connected to the network
+var gatewayNetworkTmpl = `
+<network>
+  <name>%s</name>
+</network>
+`
+
+func ensureGatewayNetwork(l *libvirt.Libvirt, gateway string) (err error) {
+	name := gatewayNetwork(gateway)
+	if net, err := l.NetworkLookupByName(name); err == nil {
+		if active, _ := l.NetworkIsActive(net); active == 1 {
+			return nil
+		}
+		return l.NetworkCreate(net)
+	}
+
+	_, err = l.NetworkCreateXML(fmt.Sprintf(gatewayNetworkTmpl,
+		xmlEscape(name)))
+	return
+}
+
+var gatewayNetDevicesTmpl = `
+    <interface type='network'>
+      <source network='%s'/>
+      <model type='virtio'/>%s
+    </interface>
+`
+
+func gatewayNetDevices(gateway, filter string) string {
+	return fmt.Sprintf(gatewayNetDevicesTmpl,
+		xmlEscape(gatewayNetwork(gateway)), filter)
+}
+
+// Network devices for NIC on the libvirt network
+func libvirtNetDevices(name string, app appConfig) string {
+	if app.NetVM != "" {
+		return gatewayNetDevices(app.NetVM, netFilterRef(name, app))
+	}
+	return fmt.Sprintf(netDevices, xmlEscape(hostNetwork()),
+		netFilterRef(name, app))
+}
+
+// Internal network of the gateway, empty for other VMs
+func gatewayDevices(name string, app appConfig) string {
+	if !app.Gateway {
+		return ""
+	}
+	return gatewayNetDevices(name, "")
+}
+
+// Gateway is started without viewer if it is not running
+func startGateway(l *libvirt.Libvirt, gateway string) (err error) {
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+	if !config.app(gateway).Gateway {
+		return errors.New(gateway + " is not a gateway")
+	}
+
+	if isRunning(l, gateway) {
+		return
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		self = os.Args[0]
+	}
+
+	log.Println("Start gateway", gateway)
+	command := exec.Command(self, "start", gateway, "--cli")
+	command.Stdout = os.Stdout
+	command.Stderr = os.Stderr
+	return command.Run()
+}
+
+func prepareNetwork(l *libvirt.Libvirt, name string, app appConfig,
+	network networkModel) (networkModel, error) {
+
+	network, err := prepareEgress(l, name, app, network)
+	if err != nil {
+		return network, err
+	}
+
+	if app.Gateway {
+		err = ensureGatewayNetwork(l, name)
+		if err != nil {
+			return network, err
+		}
+	}
+
+	if app.NetVM == "" {
+		if network == networkLibvirt && ipv6Enabled() {
+			return network, ensureAppvmNetwork(l)
+		}
+		return network, nil
+	}
+	if app.NetVM == name {
+		return network, errors.New(name + " can't be its own netvm")
+	}
+
+	err = startGateway(l, app.NetVM)
+	if err != nil {
+		return network, err
+	}
+	return networkLibvirt, ensureGatewayNetwork(l, app.NetVM)
+}
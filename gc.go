@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+func pathSize(path string) (size int64) {
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return
+}
+
+func humanSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div),
+		"KMGTPE"[exp])
+}
+
+func runningApps(l *libvirt.Libvirt) (apps map[string]bool) {
+	apps = make(map[string]bool)
+
+	domains, err := l.Domains()
+	if err != nil {
+		fatal(err)
+	}
+
+	for _, d := range domains {
+		if strings.HasPrefix(d.Name, "appvm_") && isOwned(l, d) {
+			apps[d.Name] = true
+			apps[appNameFromDomain(d.Name)] = true
+		}
+	}
+	return
+}
+
+const importStaleAge = time.Hour
+
+// Files in ~/appvm left by crashed or killed appvm
+func staleFiles(l *libvirt.Libvirt) (stale []string) {
+	running := runningApps(l)
+
+	qcow2s, _ := filepath.Glob(appvmHomesDir + ".*.fake.qcow2")
+	for _, f := range qcow2s {
+		name := strings.TrimSuffix(filepath.Base(f)[1:], ".fake.qcow2")
+		if !running[name] {
+			stale = append(stale, f)
+		}
+	}
+
+	overlays, _ := filepath.Glob(appvmHomesDir + ".tmp_*.overlay.qcow2")
+	for _, f := range overlays {
+		id := strings.TrimSuffix(filepath.Base(f)[1:], ".overlay.qcow2")
+		if !running["appvm_"+id] {
+			stale = append(stale, f)
+		}
+	}
+
+	sockets, _ := filepath.Glob(appvmHomesDir + ".appvm_*.sock")
+	for _, f := range sockets {
+		vmName, ok := socketVMName(filepath.Base(f))
+		if ok && !running[vmName] {
+			stale = append(stale, f)
+		}
+	}
+
+	// Not of an import in progress
+	imports, _ := filepath.Glob(appvmHomesDir + ".import-*")
+	for _, f := range imports {
+		info, err := os.Stat(f)
+		if err == nil && time.Since(info.ModTime()) > importStaleAge {
+			stale = append(stale, f)
+		}
+	}
+
+	stale = append(stale, staleBootInfo()...)
+	stale = append(stale, expiredTrash()...)
+
+	// nix-build is run in the current directory
+	if target, err := os.Readlink("result"); err == nil &&
+		strings.HasSuffix(target, "-nixos-vm") {
+		stale = append(stale, "result")
+	}
+	return
+}
+
+// Store paths of the closures that are not alive anymore, so only what
+// appvm built is collected and not the rest of the store
+func deadPaths(closures []string) (dead []string, err error) {
+	if len(closures) == 0 {
+		return
+	}
+	args := append([]string{"--query", "--requisites"}, closures...)
+	out, err := run(nixBin("nix-store"), args...)
+	if err != nil {
+		return
+	}
+	ours := make(map[string]bool)
+	for _, path := range strings.Fields(out) {
+		ours[path] = true
+	}
+
+	out, err = run(nixBin("nix-store"), "--gc", "--print-dead")
+	if err != nil {
+		return
+	}
+	for _, path := range strings.Fields(out) {
+		if ours[path] {
+			dead = append(dead, path)
+		}
+	}
+	return
+}
+
+func gc(l *libvirt.Libvirt, dryRun, nix bool, keep int) (err error) {
+	// Negative keep would slice beyond the generations
+	if keep < 0 {
+		err = withCategory("usage", errors.New("--keep must not be negative"))
+		return
+	}
+
+	var reclaimed int64
+
+	for _, f := range staleFiles(l) {
+		size := pathSize(f)
+		fmt.Println("\t", f, humanSize(size))
+		if dryRun {
+			continue
+		}
+
+		err = os.RemoveAll(f)
+		if err != nil {
+			return
+		}
+		reclaimed += size
+	}
+
+	var closures []string
+	for _, g := range oldGenerations(keep) {
+		fmt.Println("\t", g.Root, g.Out)
+		if dryRun {
+			continue
+		}
+
+		err = os.Remove(g.Root)
+		if err != nil {
+			return
+		}
+		closures = append(closures, g.Out)
+	}
+
+	if nix && !dryRun {
+		var dead []string
+		dead, err = deadPaths(closures)
+		if err != nil {
+			return
+		}
+		if len(dead) != 0 {
+			args := append([]string{"--delete"}, dead...)
+			command := exec.Command(nixBin("nix-store"), args...)
+			command.Stdout = os.Stdout
+			command.Stderr = os.Stderr
+			err = command.Run()
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	if dryRun {
+		return
+	}
+
+	fmt.Println("Reclaimed", humanSize(reclaimed), "in", appvmHomesDir)
+	return
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Output of the last build of every application is an indirect nix GC
+// root ~/appvm/.<name>.gcroot, so nix-collect-garbage keeps closures of
+// installed applications. Outputs of previous builds are kept as
+// numbered roots in ~/appvm/.<name>.generations until appvm gc removes
+// them beyond --keep. Roots are moved with the data by rename and drop;
+// a moved link is not a root anymore for nix, so roots are registered
+// again after rename and undrop.
+
+func gcRootPath(name string) string {
+	return appvmHomesDir + "." + name + ".gcroot"
+}
+
+func generationsDir(name string) string {
+	return appvmHomesDir + "." + name + ".generations"
+}
+
+type generation struct {
+	N    int
+	Root string
+	Out  string
+}
+
+// Previous builds of the application, oldest first
+func generations(name string) (gens []generation) {
+	files, err := ioutil.ReadDir(generationsDir(name))
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		n, err := strconv.Atoi(f.Name())
+		if err != nil {
+			continue
+		}
+		root := filepath.Join(generationsDir(name), f.Name())
+		out, err := os.Readlink(root)
+		if err != nil {
+			continue
+		}
+		gens = append(gens, generation{n, root, out})
+	}
+	sort.Slice(gens, func(i, j int) bool { return gens[i].N < gens[j].N })
+	return
+}
+
+func registerRoot(root, out string) (err error) {
+	_, err = run(nixBin("nix-store"), "--realise", out,
+		"--add-root", root, "--indirect")
+	return
+}
+
+// Keeps the output replaced by a new build as the next generation. The
+// output is not realised again if it is already collected.
+func keepGeneration(name, out string) {
+	_, err := run(nixBin("nix-store"), "--check-validity", out)
+	if err != nil {
+		return
+	}
+
+	n := 1
+	if gens := generations(name); len(gens) != 0 {
+		n = gens[len(gens)-1].N + 1
+	}
+	err = os.MkdirAll(generationsDir(name), 0700)
+	if err == nil {
+		err = registerRoot(filepath.Join(generationsDir(name),
+			strconv.Itoa(n)), out)
+	}
+	if err != nil {
+		log.Println("Can't keep previous build:", err)
+	}
+}
+
+func addGCRoot(name, out string) {
+	if old, err := os.Readlink(gcRootPath(name)); err == nil && old != out {
+		keepGeneration(name, old)
+	}
+
+	err := registerRoot(gcRootPath(name), out)
+	if err != nil {
+		log.Println("Can't register GC root:", err)
+	}
+}
+
+// After the links are moved to the name
+func reregisterGCRoot(name string) {
+	out, err := os.Readlink(gcRootPath(name))
+	if err == nil {
+		addGCRoot(name, out)
+	}
+
+	for _, g := range generations(name) {
+		err = registerRoot(g.Root, g.Out)
+		if err != nil {
+			log.Println("Can't register GC root:", err)
+		}
+	}
+}
+
+// Generations of every application beyond the newest keep
+func oldGenerations(keep int) (old []generation) {
+	dirs, _ := filepath.Glob(appvmHomesDir + ".*.generations")
+	for _, dir := range dirs {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(dir),
+			"."), ".generations")
+		gens := generations(name)
+		if len(gens) > keep {
+			old = append(old, gens[:len(gens)-keep]...)
+		}
+	}
+	return
+}
+
+// Roots of applications that do not exist anymore
+func orphanGCRoots() (orphans []orphan) {
+	roots, _ := filepath.Glob(appvmHomesDir + ".*.gcroot")
+	gens, _ := filepath.Glob(appvmHomesDir + ".*.generations")
+	for _, root := range append(roots, gens...) {
+		root := root
+		name := strings.TrimPrefix(filepath.Base(root), ".")
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+		if appExists(name) {
+			continue
+		}
+		orphans = append(orphans, orphan{"gc root", root,
+			func() error { return os.RemoveAll(root) }})
+	}
+	return
+}
@@ -32,12 +32,38 @@ in {
 }
 `
 
+// Expressions written by --from-oci, --appimage and import-flatpak start
+// with the marker, files without it are own expressions of the user and
+// are not replaced unless forced
+const generatedMarker = "# Generated by appvm"
+
+func writeGeneratedExpr(name, expr string, force bool) (path string,
+	err error) {
+
+	path = configDir + "nix/" + name + ".nix"
+	raw, err := ioutil.ReadFile(path)
+	if err == nil && !force &&
+		!strings.HasPrefix(string(raw), generatedMarker) {
+
+		err = withCategory("usage", fmt.Errorf("%s is not generated by "+
+			"appvm, use --force to replace it", path))
+		return
+	}
+
+	err = os.MkdirAll(configDir+"nix", 0700)
+	if err != nil {
+		return
+	}
+	err = ioutil.WriteFile(path, []byte(generatedMarker+"\n"+expr), 0600)
+	return
+}
+
 func isPackageExists(channel, name string) bool {
-	return nil == exec.Command("nix-build", "<"+channel+">", "-A", name).Run()
+	return nil == exec.Command(nixBin("nix-build"), "<"+channel+">", "-A", name).Run()
 }
 
 func nixPath(name string) (path string, err error) {
-	command := exec.Command("nix", "path-info", name)
+	command := exec.Command(nixBin("nix"), "path-info", name)
 	bytes, err := command.Output()
 	if err != nil {
 		return
@@ -47,7 +73,7 @@ func nixPath(name string) (path string, err error) {
 }
 
 func guessChannel() (channel string, err error) {
-	command := exec.Command("nix-channel", "--list")
+	command := exec.Command(nixBin("nix-channel"), "--list")
 	bytes, err := command.Output()
 	if err != nil {
 		return
@@ -190,10 +216,18 @@ func generate(pkg, bin, vmname string, build bool) (err error) {
 	log.Println("Configuration file is saved to", appFilename)
 
 	if build {
+		var config appvmConfig
+		config, err = loadConfig()
+		if err != nil {
+			return
+		}
+
 		if vmname != "" {
-			_, _, _, err = generateVM(configDir, vmname, true)
+			_, _, _, err = generateVM(configDir, vmname, true,
+				config.app(vmname).Arch)
 		} else {
-			_, _, _, err = generateVM(configDir, name, true)
+			_, _, _, err = generateVM(configDir, name, true,
+				config.app(name).Arch)
 		}
 
 		if err != nil {
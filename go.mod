@@ -10,5 +10,8 @@ require (
 	github.com/hanwen/go-fuse/v2 v2.1.0
 	github.com/jollheef/go-system v0.0.0-20160710075518-6ed6b1d2b8db
 	github.com/olekukonko/tablewriter v0.0.5
+	golang.org/x/sys v0.0.0-20210510120138-977fb7262007
+	google.golang.org/grpc v1.40.0
+	google.golang.org/protobuf v1.27.1
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
 )
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Split GPG: "gpg_agent": "allow" or "confirm" forwards the restricted
+// (extra) socket of gpg-agent of the host, smartcards are used by
+// scdaemon of the host. With "confirm" every use is asked on the host
+// and is valid for gpgConfirmFor. Guest keeps only public keys.
+
+const (
+	gpgAgentPort  = 5002
+	gpgConfirmFor = 5 * time.Minute
+)
+
+func gpgExtraSocket() string {
+	out, err := exec.Command("gpgconf", "--list-dirs",
+		"agent-extra-socket").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+var gpgAgent = forwardedAgent{
+	Name:   "gpg-agent",
+	Port:   gpgAgentPort,
+	Socket: gpgExtraSocket,
+	Policy: func(name string, app appConfig) (bool, bool) {
+		return app.GPGAgent == "allow" || app.GPGAgent == "confirm",
+			app.GPGAgent == "confirm"
+	},
+	ConfirmFor: gpgConfirmFor,
+	approved:   make(map[string]time.Time),
+}
+
+func gpgAgentModule(app appConfig) string {
+	if app.GPGAgent != "allow" && app.GPGAgent != "confirm" {
+		return ""
+	}
+	return fmt.Sprintf(gpgAgentModuleTmpl, gpgAgentPort)
+}
+
+var gpgAgentModuleTmpl = `  systemd.user.services.appvm-gpg-agent = {
+    description = "gpg-agent of the host over vsock";
+    serviceConfig = {
+      ExecStartPre = "${pkgs.coreutils}/bin/mkdir -m 700 -p %%t/gnupg";
+      ExecStart = "${pkgs.socat}/bin/socat UNIX-LISTEN:%%t/gnupg/S.gpg-agent,fork,unlink-early VSOCK-CONNECT:2:%d";
+      Restart = "always";
+    };
+    wantedBy = [ "default.target" ];
+  };
+  environment.systemPackages = [ pkgs.gnupg ];
+  programs.gnupg.agent.enable = lib.mkForce false;
+`
+
+func checkGPGAgent(policy string) (err error) {
+	switch policy {
+	case "", "allow", "confirm":
+		return
+	}
+	return fmt.Errorf("gpg_agent must be allow or confirm, not %s", policy)
+}
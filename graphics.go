@@ -0,0 +1,330 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// Display protocol of the VM: "spice" (default), "vnc",
+// "egl-headless" (GL rendered on the host, shown over VNC) or "none".
+// Smartcard, folder sharing and USB redirection need SPICE.
+//
+// Display listening on a non-local address gets a one-time password
+// on every start unless password is set, virt-viewer obtains it from
+// libvirt.
+
+type graphicsConfig struct {
+	Type string `json:"type,omitempty"`
+	// Listen address, 127.0.0.1 by default
+	Listen string `json:"listen,omitempty"`
+	// Password required by the display server
+	Password string `json:"password,omitempty"`
+	// SPICE over TLS only, needs spice_tls in /etc/libvirt/qemu.conf
+	// (vnc_tls for VNC)
+	TLS bool `json:"tls,omitempty"`
+	// CA certificate given to remote-viewer
+	CA string `json:"ca,omitempty"`
+}
+
+func graphicsType(app appConfig) string {
+	if app.Graphics.Type == "" {
+		return "spice"
+	}
+	return app.Graphics.Type
+}
+
+func checkGraphics(app appConfig) (err error) {
+	switch graphicsType(app) {
+	case "spice", "vnc", "egl-headless", "none":
+		return
+	}
+	return errors.New("unknown graphics type " + app.Graphics.Type)
+}
+
+func graphicsListen(app appConfig) string {
+	if app.Graphics.Listen == "" {
+		return "127.0.0.1"
+	}
+	return app.Graphics.Listen
+}
+
+func isLocalListen(addr string) bool {
+	if addr == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(addr)
+	return ip != nil && ip.IsLoopback()
+}
+
+const passwordChars = "abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// VNC uses only 8 first characters of password
+func oneTimePassword() (password string, err error) {
+	b := make([]byte, 8)
+	_, err = rand.Read(b)
+	if err != nil {
+		return
+	}
+	for _, c := range b {
+		password += string(passwordChars[int(c)%len(passwordChars)])
+	}
+	return
+}
+
+// Sets one-time password for display on non-local address, returns
+// it if generated
+func displayPassword(app *appConfig) (password string, err error) {
+	if graphicsType(*app) == "none" || app.Graphics.Password != "" ||
+		isLocalListen(graphicsListen(*app)) {
+		return
+	}
+
+	password, err = oneTimePassword()
+	if err != nil {
+		return
+	}
+	app.Graphics.Password = password
+	return
+}
+
+func graphicsAttrs(app appConfig) (attrs string) {
+	attrs = "autoport='yes'"
+	if app.Graphics.Password != "" {
+		attrs += " passwd='" + xmlEscape(app.Graphics.Password) + "'"
+	}
+	if app.Graphics.TLS && graphicsType(app) == "spice" {
+		attrs += " defaultMode='secure'"
+	}
+	return
+}
+
+// Graphics, video and SPICE-only devices, virtio is for machines
+// without QXL
+func guiXML(app appConfig, virtio bool) (devices string) {
+	listen := xmlEscape(graphicsListen(app))
+	heads := displays(app)
+
+	switch graphicsType(app) {
+	case "none":
+		return "<video><model type='none'/></video>"
+	case "vnc":
+		devices = fmt.Sprintf(vncGraphics, graphicsAttrs(app), listen)
+	case "egl-headless":
+		devices = eglGraphics + fmt.Sprintf(vncGraphics,
+			graphicsAttrs(app), listen) + fmt.Sprintf(videoVirtioGL, heads)
+		if virtio {
+			devices += usbInput
+		}
+		return
+	default:
+		devices = fmt.Sprintf(spiceGraphics, graphicsAttrs(app), listen,
+			spiceClipboardXML(app))
+		if app.Smartcard {
+			devices += smartcardDevices
+		}
+		if app.Webdav {
+			devices += webdavDevices
+		}
+		if app.Printing {
+			devices += usbRedirDevices
+		}
+	}
+
+	if virtio {
+		return devices + fmt.Sprintf(videoVirtio, heads) + usbInput
+	}
+	return devices + fmt.Sprintf(videoQXL, heads)
+}
+
+var spiceGraphics = `
+    <!-- Graphical console -->
+    <graphics type='spice' %s>
+      <listen type='address' address='%s'/>
+      <image compression='off'/>
+      %s
+    </graphics>
+    <!-- Guest additionals support -->
+    <channel type='spicevmc'>
+      <target type='virtio' name='com.redhat.spice.0'/>
+    </channel>
+`
+
+var vncGraphics = `
+    <graphics type='vnc' %s>
+      <listen type='address' address='%s'/>
+    </graphics>
+`
+
+var eglGraphics = `
+    <graphics type='egl-headless'/>
+`
+
+var videoQXL = `
+    <video>
+      <model type='qxl' ram='524288' vram='524288' vgamem='262144' heads='%d' primary='yes'/>
+      <address type='pci' domain='0x0000' bus='0x00' slot='0x02' function='0x0'/>
+    </video>
+`
+
+// There is no QXL on virt machines
+var videoVirtio = `
+    <video>
+      <model type='virtio' heads='%d' primary='yes'/>
+    </video>
+`
+
+var videoVirtioGL = `
+    <video>
+      <model type='virtio' heads='%d' primary='yes'>
+        <acceleration accel3d='yes'/>
+      </model>
+    </video>
+`
+
+var usbInput = `
+    <input type='tablet' bus='usb'/>
+    <input type='keyboard' bus='usb'/>
+`
+
+var (
+	graphicsRe      = regexp.MustCompile(`<graphics type='(spice|vnc)'[^>]*>`)
+	graphicsAttrsRe = regexp.MustCompile(`(\w+)='([^']*)'`)
+)
+
+// Attributes of the display of running VM, passwd is included
+func domainGraphics(l *libvirt.Libvirt, vmName string) (
+	attrs map[string]string, err error) {
+
+	dom, err := lookupOwned(l, vmName)
+	if err != nil {
+		return
+	}
+
+	xml, err := l.DomainGetXMLDesc(dom, libvirt.DomainXMLSecure)
+	if err != nil {
+		return
+	}
+
+	tag := graphicsRe.FindString(xml)
+	if tag == "" {
+		err = errors.New("no display for " + vmName)
+		return
+	}
+
+	attrs = make(map[string]string)
+	for _, m := range graphicsAttrsRe.FindAllStringSubmatch(tag, -1) {
+		attrs[m[1]] = m[2]
+	}
+	return
+}
+
+// Connection file of remote-viewer, the SPICE password is not passed in
+// arguments that other users can see. The viewer deletes the file after
+// reading it.
+func writeVVFile(host string, g map[string]string) (path string, err error) {
+	vv := "[virt-viewer]\ntype=spice\nhost=" + host + "\nport=" + g["port"] +
+		"\ndelete-this-file=1\n"
+	if g["tlsPort"] != "" {
+		vv += "tls-port=" + g["tlsPort"] + "\n"
+	}
+	if g["passwd"] != "" {
+		vv += "password=" + g["passwd"] + "\n"
+	}
+
+	f, err := ioutil.TempFile("", "appvm-*.vv")
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	path = f.Name()
+	_, err = f.WriteString(vv)
+	if err != nil {
+		os.Remove(path)
+	}
+	return
+}
+
+// Guest services of SPICE redirection, only for the enabled ones
+func spiceServicesModule(app appConfig) (module string) {
+	if app.Smartcard {
+		module += "  services.pcscd.enable = true;\n"
+	}
+	if app.Webdav {
+		module += "  services.spice-webdavd.enable = true;\n"
+	}
+	if app.Printing {
+		module += "  services.printing = {\n" +
+			"    enable = true;\n" +
+			"    startWhenNeeded = true;\n" +
+			"  };\n"
+	}
+	return
+}
+
+// Client for the display of running VM: virt-viewer if installed,
+// otherwise remote-viewer for SPICE or vncviewer for VNC. The connection
+// file of remote-viewer, if any, is to be removed after the viewer exits.
+func viewerCommand(l *libvirt.Libvirt, vmName string, app appConfig) (
+	command *exec.Cmd, vvFile string, err error) {
+
+	if graphicsType(app) == "none" {
+		err = errors.New("no display, graphics type is none")
+		return
+	}
+
+	window := viewerWindowArgs(appNameFromDomain(vmName), app.Viewer)
+
+	if _, e := exec.LookPath("virt-viewer"); e == nil {
+		args := append(viewerArgs(app.Viewer), window...)
+		command = exec.Command("virt-viewer", append(args,
+			"-c", viewerURI(), vmName)...)
+		return
+	}
+
+	g, err := domainGraphics(l, vmName)
+	if err != nil {
+		return
+	}
+
+	host := graphicsListen(app)
+	if host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+
+	switch g["type"] {
+	case "spice":
+		args := append(viewerArgs(app.Viewer), window...)
+		if app.Graphics.CA != "" {
+			args = append(args, "--spice-ca-file="+app.Graphics.CA)
+		}
+		vvFile, err = writeVVFile(host, g)
+		if err != nil {
+			return
+		}
+		command = exec.Command("remote-viewer", append(args, vvFile)...)
+	case "vnc":
+		if g["passwd"] != "" {
+			fmt.Println("Display password:", g["passwd"])
+		}
+		command = exec.Command("vncviewer", host+"::"+g["port"])
+	}
+
+	_, err = exec.LookPath(command.Path)
+	if err != nil {
+		if vvFile != "" {
+			os.Remove(vvFile)
+			vvFile = ""
+		}
+		err = errors.New("no viewer found, install virt-viewer")
+	}
+	return
+}
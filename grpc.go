@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	grpcstatus "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// gRPC API of appvm daemon (appvm daemon --grpc-listen), service
+// appvm.v1.AppVM from appvm.proto. Messages are google.protobuf.Struct
+// with the same fields as the JSON of the REST API, and every method
+// calls the same function as the REST handler (api.go). The token is in
+// "authorization: Bearer <token>" metadata.
+
+const grpcService = "appvm.v1.AppVM"
+
+type grpcMethod struct {
+	Name string
+	// Takes the name field
+	Named bool
+	Call  func(a api, name string, fields []byte) (interface{}, error)
+}
+
+var grpcMethods = []grpcMethod{
+	{"ListVMs", false, func(a api, _ string, _ []byte) (interface{}, error) {
+		return a.listVMs()
+	}},
+	{"ListBuilds", false, func(a api, _ string, _ []byte) (interface{},
+		error) {
+
+		return apiBuilds(), nil
+	}},
+	{"Start", true, func(a api, name string, fields []byte) (interface{},
+		error) {
+
+		var opts startOptions
+		err := json.Unmarshal(fields, &opts)
+		if err != nil {
+			return nil, apiErr(http.StatusBadRequest, err)
+		}
+		return a.startVM(name, opts)
+	}},
+	{"Stop", true, func(a api, name string, _ []byte) (interface{}, error) {
+		return a.stopVM(name)
+	}},
+	{"Exec", true, func(a api, name string, fields []byte) (interface{},
+		error) {
+
+		var req execRequest
+		err := json.Unmarshal(fields, &req)
+		if err != nil {
+			return nil, apiErr(http.StatusBadRequest, err)
+		}
+		return a.execVM(name, req)
+	}},
+	{"Log", true, func(a api, name string, _ []byte) (interface{}, error) {
+		text, err := vmLog(name)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{"text": text}, nil
+	}},
+	{"Stats", true, func(a api, name string, _ []byte) (interface{}, error) {
+		return vmStats(name)
+	}},
+}
+
+var httpCodes = map[int]codes.Code{
+	http.StatusBadRequest:          codes.InvalidArgument,
+	http.StatusUnauthorized:        codes.Unauthenticated,
+	http.StatusForbidden:           codes.PermissionDenied,
+	http.StatusNotFound:            codes.NotFound,
+	http.StatusMethodNotAllowed:    codes.Unimplemented,
+	http.StatusConflict:            codes.AlreadyExists,
+	http.StatusBadGateway:          codes.Unavailable,
+	http.StatusInternalServerError: codes.Internal,
+}
+
+func grpcToken(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, h := range md.Get("authorization") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	return ""
+}
+
+func grpcError(err error) error {
+	code, ok := httpCodes[errorCode(err)]
+	if !ok {
+		code = codes.Unknown
+	}
+	return grpcstatus.Error(code, err.Error())
+}
+
+// Result as Struct, through its JSON: objects as is, arrays in "items"
+func grpcResult(result interface{}) (*structpb.Struct, error) {
+	raw, err := json.Marshal(result)
+	if err != nil {
+		return nil, grpcstatus.Error(codes.Internal, err.Error())
+	}
+
+	var v interface{}
+	err = json.Unmarshal(raw, &v)
+	if err != nil {
+		return nil, grpcstatus.Error(codes.Internal, err.Error())
+	}
+	if m, ok := v.(map[string]interface{}); ok {
+		return structpb.NewStruct(m)
+	}
+	return structpb.NewStruct(map[string]interface{}{"items": v})
+}
+
+func (a api) grpcCall(ctx context.Context, m grpcMethod,
+	in *structpb.Struct) (*structpb.Struct, error) {
+
+	if !tokenMatches(a.token, grpcToken(ctx)) {
+		return nil, grpcstatus.Error(codes.Unauthenticated, "invalid token")
+	}
+
+	fields := in.AsMap()
+	var name string
+	if m.Named {
+		name, _ = fields["name"].(string)
+		if err := validateName(name); err != nil {
+			return nil, grpcstatus.Error(codes.InvalidArgument, err.Error())
+		}
+		delete(fields, "name")
+	}
+
+	raw, err := json.Marshal(fields)
+	if err != nil {
+		return nil, grpcstatus.Error(codes.InvalidArgument, err.Error())
+	}
+
+	result, err := m.Call(a, name, raw)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return grpcResult(result)
+}
+
+func (a api) grpcEvents(stream grpc.ServerStream) (err error) {
+	if !tokenMatches(a.token, grpcToken(stream.Context())) {
+		return grpcstatus.Error(codes.Unauthenticated, "invalid token")
+	}
+	err = stream.RecvMsg(new(structpb.Struct))
+	if err != nil {
+		return
+	}
+
+	c := make(chan apiEvent, 16)
+	eventSubscribe <- c
+	defer func() { eventUnsubscribe <- c }()
+
+	for {
+		select {
+		case e := <-c:
+			msg, err := structpb.NewStruct(map[string]interface{}{
+				"time": float64(e.Time), "name": e.Name,
+				"event": e.Event, "detail": float64(e.Detail)})
+			if err != nil {
+				return err
+			}
+			err = stream.SendMsg(msg)
+			if err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func unaryHandler(m grpcMethod) func(interface{}, context.Context,
+	func(interface{}) error, grpc.UnaryServerInterceptor) (interface{},
+	error) {
+
+	return func(srv interface{}, ctx context.Context,
+		dec func(interface{}) error,
+		interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+
+		in := new(structpb.Struct)
+		err := dec(in)
+		if err != nil {
+			return nil, err
+		}
+		call := func(ctx context.Context, req interface{}) (interface{},
+			error) {
+
+			return srv.(api).grpcCall(ctx, m, req.(*structpb.Struct))
+		}
+		if interceptor == nil {
+			return call(ctx, in)
+		}
+		return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: srv,
+			FullMethod: "/" + grpcService + "/" + m.Name}, call)
+	}
+}
+
+func grpcServiceDesc() *grpc.ServiceDesc {
+	desc := &grpc.ServiceDesc{
+		ServiceName: grpcService,
+		HandlerType: (*interface{})(nil),
+		Streams: []grpc.StreamDesc{{
+			StreamName: "Events",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				return srv.(api).grpcEvents(stream)
+			},
+			ServerStreams: true,
+		}},
+		Metadata: "appvm.proto",
+	}
+	for _, m := range grpcMethods {
+		desc.Methods = append(desc.Methods, grpc.MethodDesc{
+			MethodName: m.Name, Handler: unaryHandler(m)})
+	}
+	return desc
+}
+
+func serveGRPC(l *libvirt.Libvirt, ln net.Listener) {
+	token, err := apiToken()
+	if err != nil {
+		fatal(err)
+	}
+
+	server := grpc.NewServer()
+	server.RegisterService(grpcServiceDesc(), api{l, token})
+
+	log.Println("gRPC on", ln.Addr(), "token is in", apiTokenPath())
+	fatal(server.Serve(ln))
+}
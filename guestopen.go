@@ -0,0 +1,114 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// Guest sends one url or absolute path per line to the virtio-serial
+// port, see xdg-open shim in base.nix.
+const guestOpenChannel = "org.appvm.open"
+
+// appvm_tmp_123_chromium -> chromium
+func appNameFromDomain(vmName string) string {
+	name := strings.TrimPrefix(vmName, "appvm_")
+	if strings.HasPrefix(name, "tmp_") {
+		parts := strings.SplitN(name, "_", 3)
+		if len(parts) == 3 {
+			name = parts[2]
+		}
+	}
+	return name
+}
+
+// Host path of rel in the home directory of the VM with symlinks
+// resolved. The guest controls symlinks and may point them anywhere, so
+// the result must stay in the home directory.
+func resolveInHome(name, rel string) (hostPath string, ok bool) {
+	home, err := filepath.EvalSymlinks(appvmHomesDir + name)
+	if err != nil {
+		return
+	}
+	hostPath, err = filepath.EvalSymlinks(home + "/" + rel)
+	if err != nil || !strings.HasPrefix(hostPath, home+"/") {
+		return "", false
+	}
+	return hostPath, true
+}
+
+// Translates path inside of the VM to the path on the host, only
+// home directory of the VM is available on the host.
+func guestPathToHost(vmName, path string) (hostPath string, ok bool) {
+	path = filepath.Clean(path)
+	if !strings.HasPrefix(path, "/home/user/") {
+		return
+	}
+
+	hostPath, ok = resolveInHome(strings.TrimPrefix(vmName, "appvm_"),
+		strings.TrimPrefix(path, "/home/user/"))
+	ok = ok && fileExists(hostPath)
+	return
+}
+
+func isURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && u.Scheme != "" && u.Scheme != "file"
+}
+
+func guestOpen(l *libvirt.Libvirt, vmName, target string) {
+	name := appNameFromDomain(vmName)
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	policy := config.app(name).Open
+	if policy == "" || policy == "deny" {
+		log.Println("Deny", name, "to open", target)
+		return
+	}
+
+	var args []string
+	if isURL(target) {
+		args = []string{target}
+	} else {
+		path := strings.TrimPrefix(target, "file://")
+		hostPath, ok := guestPathToHost(vmName, path)
+		if !ok {
+			log.Println("Deny", name, "to open", target,
+				"(not in the shared directory)")
+			return
+		}
+		args = []string{hostPath}
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		self = os.Args[0]
+	}
+
+	var command *exec.Cmd
+	if policy == "host" {
+		command = exec.Command("xdg-open", args[0])
+	} else if isURL(args[0]) {
+		command = exec.Command(self, "start", policy, "--args", args[0])
+	} else {
+		command = exec.Command(self, "start", policy, "--open", args[0])
+	}
+
+	log.Println("Open", target, "from", name, "in", policy)
+	err = command.Start()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	go command.Wait()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Guest user and ownership of files in the data directory. With
+// "mapped" access (default) qemu keeps guest owners in xattrs and files
+// on the host are owned by the qemu user; with "passthrough" guest
+// owners are used on the host as is (qemu must run as root or by
+// qemu:///session), so guest uid/gid must be the same as of the host
+// user or be mapped by the idmapped mount in the guest.
+
+type guestUserConfig struct {
+	// Host user uid and "users" group by default
+	UID int `json:"uid,omitempty"`
+	GID int `json:"gid,omitempty"`
+	// libvirt accessmode of the data directory: "mapped",
+	// "passthrough" or "squash"
+	Access string `json:"access,omitempty"`
+	// Map owner of the data directory to the guest user by idmapped
+	// mount, plain mount is used if the guest kernel can't do it
+	Idmap bool `json:"idmap,omitempty"`
+}
+
+func guestUID(c guestUserConfig) int {
+	if c.UID != 0 {
+		return c.UID
+	}
+	return os.Getuid()
+}
+
+// "users" group of normal users in NixOS by default
+func guestGID(c guestUserConfig) int {
+	if c.GID != 0 {
+		return c.GID
+	}
+	return 100
+}
+
+func shareAccess(c guestUserConfig) string {
+	if c.Access == "" {
+		return "mapped"
+	}
+	return c.Access
+}
+
+func checkGuestUser(c guestUserConfig) error {
+	switch shareAccess(c) {
+	case "mapped", "passthrough", "squash":
+	default:
+		return fmt.Errorf("guest_user access must be mapped, "+
+			"passthrough or squash, not %s", c.Access)
+	}
+	if c.UID < 0 || c.GID < 0 {
+		return fmt.Errorf("invalid guest uid/gid %d/%d", c.UID, c.GID)
+	}
+	return nil
+}
+
+// Mounted to /run/appvm/home first, ids of its owner are mapped to
+// the guest user. %% is escaped twice, for Sprintf and for systemd.
+var idmapMountTmpl = `/bin/sh -c 'PATH=/run/current-system/sw/bin; ` +
+	`mkdir -p /run/appvm/home && ` +
+	`mount -t 9p -o trans=virtio,version=9p2000.L home /run/appvm/home && ` +
+	`mount --bind -o X-mount.idmap="u:$(stat -c %%%%u /run/appvm/home):%d:1 ` +
+	`g:$(stat -c %%%%g /run/appvm/home):%d:1" /run/appvm/home /home/user || ` +
+	`mount --bind /run/appvm/home /home/user'`
+
+func guestUserModule(app appConfig) (module string) {
+	c := app.GuestUser
+	if c.UID != 0 {
+		module += fmt.Sprintf("  users.users.user.uid = lib.mkForce %d;\n",
+			c.UID)
+	}
+	if c.GID != 0 {
+		module += fmt.Sprintf("  users.groups.user.gid = %d;\n", c.GID) +
+			"  users.users.user.group = lib.mkForce \"user\";\n"
+	}
+	if c.Idmap {
+		module += "  systemd.services.mount-home-user.serviceConfig." +
+			"ExecStart = lib.mkForce " + nixString(fmt.Sprintf(
+			idmapMountTmpl, guestUID(c), guestGID(c))) + ";\n"
+	}
+	return
+}
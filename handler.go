@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var desktopHandlerTmpl = `[Desktop Entry]
+Type=Application
+Name=%s (appvm)
+Comment=%s
+Exec=%s start %s %s
+MimeType=%s;
+NoDisplay=true
+Terminal=false
+`
+
+// Icon and categories from metadata of the application
+func desktopMetaLines(name string) (lines string) {
+	m, ok := loadMeta(name)
+	if !ok {
+		return
+	}
+	if m.Icon != "" {
+		lines += "Icon=" + m.Icon + "\n"
+	}
+	if m.Category != "" {
+		lines += "Categories=" + m.Category + ";\n"
+	}
+	return
+}
+
+func desktopComment(name string) string {
+	if m, ok := loadMeta(name); ok && m.Description != "" {
+		return m.Description + " in " + name + " application VM"
+	}
+	return "Open in " + name + " application VM"
+}
+
+var desktopEntriesDir = os.Getenv("HOME") + "/.local/share/applications/"
+
+func handlerDesktopFile(name string) string {
+	return desktopEntriesDir + "appvm-" + name + ".desktop"
+}
+
+// URLs are passed as is, but files should be copied to the shared
+// directory first, so use --open for them.
+func handlerForwardArgs(mimes []string) string {
+	for _, mime := range mimes {
+		if !strings.HasPrefix(mime, "x-scheme-handler/") {
+			return "--open %f"
+		}
+	}
+	return "--args %u"
+}
+
+func appvmExecutable() string {
+	path, err := os.Executable()
+	if err != nil {
+		return "appvm"
+	}
+	if strings.ContainsAny(path, " \t\"'\\") {
+		return `"` + strings.ReplaceAll(path, `"`, `\"`) + `"`
+	}
+	return path
+}
+
+func handlerRegister(name string, mimes []string) (err error) {
+	if len(mimes) == 0 {
+		mimes = []string{"x-scheme-handler/http",
+			"x-scheme-handler/https"}
+	}
+
+	os.MkdirAll(desktopEntriesDir, 0755)
+
+	entry := fmt.Sprintf(desktopHandlerTmpl, name, desktopComment(name),
+		appvmExecutable(), name, handlerForwardArgs(mimes),
+		strings.Join(mimes, ";")) + desktopMetaLines(name)
+
+	path := handlerDesktopFile(name)
+	err = ioutil.WriteFile(path, []byte(entry), 0644)
+	if err != nil {
+		return
+	}
+
+	for _, mime := range mimes {
+		err = exec.Command("xdg-mime", "default",
+			filepath.Base(path), mime).Run()
+		if err != nil {
+			err = fmt.Errorf("xdg-mime default %s: %v", mime, err)
+			return
+		}
+		log.Println("Use", name, "as default handler for", mime)
+	}
+
+	exec.Command("update-desktop-database", desktopEntriesDir).Run()
+	return
+}
+
+func handlerUnregister(name string) (err error) {
+	err = os.Remove(handlerDesktopFile(name))
+	if os.IsNotExist(err) {
+		log.Println("No handler registered for", name)
+		return nil
+	}
+	if err != nil {
+		return
+	}
+
+	exec.Command("update-desktop-database", desktopEntriesDir).Run()
+	return
+}
+
+func handlerList() {
+	files, err := filepath.Glob(desktopEntriesDir + "appvm-*.desktop")
+	if err != nil {
+		fatal(err)
+	}
+
+	for _, f := range files {
+		raw, err := ioutil.ReadFile(f)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		name := strings.TrimSuffix(filepath.Base(f), ".desktop")[6:]
+		for _, line := range strings.Split(string(raw), "\n") {
+			if strings.HasPrefix(line, "MimeType=") {
+				mimes := strings.Trim(line[9:], ";")
+				fmt.Println("\t", name, strings.Split(mimes, ";"))
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Guest hardening knobs for high-risk VMs, added to the generated
+// module. The hardened profile of nixpkgs uses scudo allocator and
+// disables some kernel features, so not every application works.
+
+type hardeningConfig struct {
+	// <nixpkgs/nixos/modules/profiles/hardened.nix>
+	Profile bool `json:"profile,omitempty"`
+	// Kernel lockdown: "integrity" or "confidentiality"
+	Lockdown string `json:"lockdown,omitempty"`
+	// No module loading after boot
+	NoModules bool `json:"no_modules,omitempty"`
+	// No writable overlay over /nix/store
+	ReadOnlyStore bool `json:"readonly_store,omitempty"`
+}
+
+func checkHardening(h hardeningConfig) (err error) {
+	switch h.Lockdown {
+	case "", "integrity", "confidentiality":
+		return
+	}
+	return fmt.Errorf("lockdown must be integrity or confidentiality, not %s",
+		h.Lockdown)
+}
+
+func hardeningModule(app appConfig) string {
+	h := app.Hardening
+	var lines []string
+	if h.Profile {
+		lines = append(lines,
+			"  imports = [ <nixpkgs/nixos/modules/profiles/hardened.nix> ];")
+	}
+	if h.Lockdown != "" {
+		lines = append(lines, "  boot.kernelParams = [ "+
+			nixString("lockdown="+h.Lockdown)+" ];")
+	}
+	if h.NoModules {
+		lines = append(lines, "  security.lockKernelModules = lib.mkForce true;")
+	}
+	if h.ReadOnlyStore {
+		lines = append(lines,
+			"  virtualisation.writableStore = lib.mkForce false;")
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// Health command of the application is run by appvm daemon inside of
+// the VM through the guest agent. VM is "starting" until the first
+// successful check, after retries failed checks in a row it is
+// "unhealthy" and is destroyed if restart policy is set, which counts
+// as a failure for "on-failure".
+
+const (
+	healthTick            = 5 * time.Second
+	healthIntervalDefault = 30 // seconds
+	healthRetriesDefault  = 3
+	healthGraceDefault    = 60 // seconds
+	healthTimeoutDefault  = 10 // seconds
+)
+
+type healthConfig struct {
+	// Command and arguments, absolute path, zero exit code is healthy
+	Command []string `json:"command,omitempty"`
+	// Seconds between checks
+	Interval int `json:"interval,omitempty"`
+	// Failed checks in a row to become unhealthy
+	Retries int `json:"retries,omitempty"`
+	// Seconds after start when failures are not counted
+	Grace int `json:"grace,omitempty"`
+	// Seconds until the command is killed and the check failed
+	Timeout int `json:"timeout,omitempty"`
+}
+
+type healthState struct {
+	Status   string `json:"status"` // starting, healthy or unhealthy
+	Failures int    `json:"failures"`
+	Checked  int64  `json:"checked"`
+	Output   string `json:"output,omitempty"`
+	// Destroyed by the daemon because of failures
+	Killed bool `json:"killed,omitempty"`
+}
+
+func healthPath(id string) string {
+	return appvmHomesDir + "." + id + ".health"
+}
+
+func loadHealth(id string) (h healthState, err error) {
+	raw, err := ioutil.ReadFile(healthPath(id))
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(raw, &h)
+	return
+}
+
+func saveHealth(id string, h healthState) {
+	raw, _ := json.Marshal(h)
+	ioutil.WriteFile(healthPath(id), raw, 0600)
+}
+
+func healthSeconds(value, def int) time.Duration {
+	if value == 0 {
+		value = def
+	}
+	return time.Duration(value) * time.Second
+}
+
+func checkHealth(l *libvirt.Libvirt, d libvirt.Domain, hc healthConfig,
+	started time.Time) (h healthState) {
+
+	id := d.Name[6:]
+	h, err := loadHealth(id)
+	if err != nil || h.Checked < started.Unix() {
+		h = healthState{Status: "starting"}
+	}
+	h.Checked = time.Now().Unix()
+
+	result, err := guestExecTimeout(l, d,
+		healthSeconds(hc.Timeout, healthTimeoutDefault), nil,
+		hc.Command[0], hc.Command[1:]...)
+	if err == nil && result.ExitCode == 0 {
+		h.Status, h.Failures, h.Output = "healthy", 0, ""
+		saveHealth(id, h)
+		return
+	}
+
+	if err != nil {
+		h.Output = err.Error()
+	} else {
+		h.Output = strings.TrimSpace(result.Stdout + result.Stderr)
+	}
+
+	retries := hc.Retries
+	if retries == 0 {
+		retries = healthRetriesDefault
+	}
+	if time.Since(started) > healthSeconds(hc.Grace, healthGraceDefault) ||
+		h.Status == "healthy" {
+		h.Failures++
+	}
+	if h.Failures >= retries {
+		h.Status = "unhealthy"
+	}
+	saveHealth(id, h)
+	return
+}
+
+func watchHealth(l *libvirt.Libvirt) {
+	started := make(map[string]time.Time)
+	checked := make(map[string]time.Time)
+
+	for ; ; time.Sleep(healthTick) {
+		config, err := loadConfig()
+		if err != nil {
+			continue
+		}
+
+		domains, err := l.Domains()
+		if err != nil {
+			continue
+		}
+
+		running := make(map[string]bool)
+		for _, d := range domains {
+			if !strings.HasPrefix(d.Name, "appvm_") || !isOwned(l, d) {
+				continue
+			}
+			running[d.Name] = true
+			if _, ok := started[d.Name]; !ok {
+				started[d.Name] = time.Now()
+			}
+
+			app := config.app(appNameFromDomain(d.Name))
+			if len(app.Health.Command) == 0 || time.Since(checked[d.Name]) <
+				healthSeconds(app.Health.Interval, healthIntervalDefault) {
+				continue
+			}
+			checked[d.Name] = time.Now()
+
+			h := checkHealth(l, d, app.Health, started[d.Name])
+			if h.Status != "unhealthy" || app.Restart == "" ||
+				app.Restart == "never" {
+				continue
+			}
+
+			log.Println(d.Name, "is unhealthy:", h.Output)
+			h.Killed = true
+			saveHealth(d.Name[6:], h)
+			l.DomainDestroy(d)
+		}
+
+		for name := range started {
+			if !running[name] {
+				delete(started, name)
+				delete(checked, name)
+			}
+		}
+	}
+}
+
+// For list and status, empty if there is no health command
+func healthStatus(id string, app appConfig) string {
+	if len(app.Health.Command) == 0 {
+		return ""
+	}
+	h, err := loadHealth(id)
+	if err != nil {
+		return "starting"
+	}
+	return h.Status
+}
+
+// Destroyed because of health check, see handleStop
+func takeUnhealthy(id string) bool {
+	h, err := loadHealth(id)
+	if err != nil || !h.Killed {
+		return false
+	}
+	os.Remove(healthPath(id))
+	return true
+}
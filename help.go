@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+// Examples are shown by appvm help <command> after the usage, typos in
+// commands and application names get the closest known one suggested.
+// Help is not translated.
+
+var appHelp = `Nix-based application VMs.
+
+Every application runs in its own virtual machine built from a nix
+expression, data is kept in ~/appvm/<name>. See appvm help <command>
+for examples.`
+
+var commandExamples = map[string][]string{
+	"list": {
+		"appvm list",
+		"appvm list --disk",
+	},
+	"start": {
+		"appvm start chromium",
+		"appvm start chromium --args https://nixos.org",
+		"appvm start chromium --stateless --network qemu",
+		"appvm start --from-oci docker.io/library/gimp",
+		"appvm start chromium --dry-run",
+		"appvm start editor --package git --extra-module ./dev.nix",
+	},
+	"stop": {
+		"appvm stop chromium",
+	},
+	"wm-rules": {
+		"appvm wm-rules >> ~/.config/sway/config",
+		"appvm wm-rules --wm i3 chromium",
+		"appvm wm-rules --wm hyprland >> ~/.config/hypr/hyprland.conf",
+	},
+	"focus": {
+		"appvm focus chromium",
+	},
+	"screenshot": {
+		"appvm screenshot chromium -o chromium.ppm",
+	},
+	"clip push": {
+		"appvm clip push chromium",
+	},
+	"clip pull": {
+		"appvm clip pull chromium",
+	},
+	"export-config": {
+		"appvm export-config -o team.json",
+	},
+	"import-config": {
+		"appvm import-config team.json --dry-run",
+	},
+	"outdated": {
+		"appvm outdated",
+	},
+	"update": {
+		"appvm update chromium",
+		"appvm update --all -j 4",
+	},
+	"schedule list": {
+		"appvm schedule list",
+	},
+	"set": {
+		"appvm set chromium --memory 6G --vcpus 2",
+	},
+	"search": {
+		"appvm search gimp",
+	},
+	"catalog": {
+		"appvm catalog",
+		"appvm catalog --category Office",
+	},
+	"generate": {
+		"appvm generate gimp",
+		"appvm generate libreoffice soffice --vm office --build",
+	},
+	"send": {
+		"appvm send chromium:Downloads/report.pdf office",
+	},
+	"quarantine": {
+		"appvm quarantine ~/Downloads/invoice.pdf --app office",
+	},
+	"build": {
+		"appvm build chromium office -j 2",
+	},
+	"which": {
+		"appvm which chromium",
+	},
+	"trust add": {
+		"appvm trust add https://example.org/appvm --note 'own repo'",
+	},
+	"share attach": {
+		"appvm share attach chromium ~/Pictures --tag pictures --ro",
+	},
+	"data rollback": {
+		"appvm data list chromium",
+		"appvm data rollback chromium appvm-20240101-100000",
+	},
+	"rpc exec": {
+		"appvm rpc exec chromium -- ls -l /home/user",
+	},
+	"verify": {
+		"appvm verify chromium --store ssh://builder -o chromium.json",
+	},
+	"daemon": {
+		"appvm daemon --listen 127.0.0.1:8087",
+		"appvm daemon --grpc-listen unix:$XDG_RUNTIME_DIR/appvm-grpc.sock",
+	},
+}
+
+// Examples are selected by the template itself, kingpin does not allow
+// to extend the template functions
+func usageTemplate() string {
+	var commands []string
+	for command := range commandExamples {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+
+	tmpl := kingpin.DefaultUsageTemplate +
+		"{{if .Context.SelectedCommand}}"
+	for _, command := range commands {
+		tmpl += fmt.Sprintf("{{if eq .Context.SelectedCommand.FullCommand %q}}"+
+			"Examples:\n", command)
+		for _, example := range commandExamples[command] {
+			tmpl += "  " + example + "\n"
+		}
+		tmpl += "\n{{end}}"
+	}
+	return tmpl + "{{end}}"
+}
+
+// Edit distance where swapped neighbour letters are one edit
+func editDistance(a, b string) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+func min(values ...int) (m int) {
+	m = values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return
+}
+
+// Closest candidate within a third of the word length (ones starting
+// with the word are preferred), or one starting with the word
+func suggest(word string, candidates []string) (best string) {
+	bestDistance := len(word)/3 + 1
+	for _, c := range candidates {
+		d := editDistance(word, c)
+		if d == 0 {
+			return ""
+		}
+		if d < bestDistance || d == bestDistance && best != "" &&
+			strings.HasPrefix(c, word) && !strings.HasPrefix(best, word) {
+			best, bestDistance = c, d
+		}
+	}
+	if best != "" {
+		return
+	}
+	for _, c := range candidates {
+		if len(word) > 1 && strings.HasPrefix(c, word) {
+			return c
+		}
+	}
+	return
+}
+
+func didYouMean(s string) string {
+	if s == "" {
+		return ""
+	}
+	return fmt.Sprintf(", did you mean '%s'?", s)
+}
+
+func errNoExpr(name string) error {
+	names := exprNames()
+	config, err := loadConfig()
+	if err == nil {
+		for app := range config.Apps {
+			names = append(names, app)
+		}
+	}
+	return withCategory("not_found", errors.New("no expression for "+
+		name+didYouMean(suggest(name, names))))
+}
+
+// Subcommands of the already typed command, only leaves are flattened
+func subcommands(parent string) (names []string) {
+	prefix := ""
+	if parent != "" {
+		prefix = parent + " "
+	}
+
+	seen := make(map[string]bool)
+	for _, c := range kingpin.CommandLine.Model().FlattenedCommands() {
+		if c.Hidden || !strings.HasPrefix(c.FullCommand, prefix) {
+			continue
+		}
+		name := strings.Fields(c.FullCommand[len(prefix):])[0]
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	if parent == "" {
+		names = append(names, plugins()...)
+	}
+	return
+}
+
+// Like kingpin.Parse, but suggests command for the typo
+func parseCommandLine() string {
+	kingpin.CommandLine.Help = appHelp
+	kingpin.UsageTemplate(usageTemplate())
+
+	command, err := kingpin.CommandLine.Parse(os.Args[1:])
+	if err == nil {
+		return command
+	}
+
+	errorFormat = errorFormatArg(os.Args[1:])
+
+	var token string
+	_, scanErr := fmt.Sscanf(err.Error(), "expected command but got %q",
+		&token)
+	if scanErr != nil {
+		fatal(withCategory("usage", fmt.Errorf("%s, try --help", err)))
+	}
+
+	var parent []string
+	for _, arg := range os.Args[1:] {
+		if arg == token {
+			break
+		}
+		// Skips values of flags
+		for _, c := range subcommands(strings.Join(parent, " ")) {
+			if c == arg {
+				parent = append(parent, arg)
+				break
+			}
+		}
+	}
+	s := suggest(token, subcommands(strings.Join(parent, " ")))
+	if s != "" {
+		s = strings.Join(append(parent, s), " ")
+	}
+	fatal(withCategory("usage", fmt.Errorf("%s%s", err, didYouMean(s))))
+	return ""
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+)
+
+// Hook is a shell command, application name and state are passed in
+// environment:
+//
+//	APPVM_NAME   application name
+//	APPVM_VM     libvirt domain name
+//	APPVM_DIR    shared directory
+//	APPVM_STATE  pre-start or post-stop
+//	APPVM_REASON exit reason (post-stop only)
+func runHook(hook, state, vmName, reason string) (err error) {
+	if hook == "" {
+		return
+	}
+
+	command := exec.Command("/bin/sh", "-c", hook)
+	command.Env = append(os.Environ(),
+		"APPVM_NAME="+appNameFromDomain(vmName),
+		"APPVM_VM="+vmName,
+		"APPVM_DIR="+appvmHomesDir+vmName[6:],
+		"APPVM_STATE="+state,
+		"APPVM_REASON="+reason)
+	command.Stdout = os.Stdout
+	command.Stderr = os.Stderr
+
+	err = command.Run()
+	if err != nil {
+		err = fmt.Errorf("%s hook: %v", state, err)
+	}
+	return
+}
+
+func preStartHook(app appConfig, vmName string) (err error) {
+	err = runHook(app.Hooks.PreStart, "pre-start", vmName, "")
+	if err != nil && !app.Hooks.Fatal {
+		log.Println("Warning:", err)
+		err = nil
+	}
+	return
+}
+
+func postStopHook(app appConfig, vmName, reason string) {
+	err := runHook(app.Hooks.PostStop, "post-stop", vmName, reason)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// With "host_fonts": true font, icon and theme directories of the host
+// are exported read-only, mounted to /run/host/share<N>/<kind> in the
+// guest and added to fontconfig and XDG_DATA_DIRS, so fonts are not
+// built into the closure. Links to /nix/store are resolved in the guest.
+
+var hostFontDirs = []struct {
+	Kind string
+	Dirs []string
+}{
+	{"fonts", []string{"/usr/share/fonts", "/usr/local/share/fonts",
+		"/run/current-system/sw/share/X11/fonts",
+		"~/.local/share/fonts", "~/.fonts"}},
+	{"icons", []string{"/usr/share/icons",
+		"/run/current-system/sw/share/icons", "~/.local/share/icons"}},
+	{"themes", []string{"/usr/share/themes",
+		"/run/current-system/sw/share/themes", "~/.themes"}},
+}
+
+type hostFontShare struct {
+	share
+	Kind  string
+	Guest string // mount point
+}
+
+func hostFontShares() (shares []hostFontShare) {
+	seen := make(map[string]bool)
+	for _, kind := range hostFontDirs {
+		for _, dir := range kind.Dirs {
+			dir = strings.Replace(dir, "~", os.Getenv("HOME"), 1)
+			real, err := filepath.EvalSymlinks(dir)
+			if err != nil || seen[real] || !isDirExists(real) {
+				continue
+			}
+			seen[real] = true
+
+			n := len(shares)
+			shares = append(shares, hostFontShare{
+				share: share{Source: real,
+					Tag: fmt.Sprintf("hostshare%d", n), ReadOnly: true},
+				Kind:  kind.Kind,
+				Guest: fmt.Sprintf("/run/host/share%d/%s", n, kind.Kind),
+			})
+		}
+	}
+	return
+}
+
+func hostFontsModule(app appConfig) (module string) {
+	if !app.HostFonts {
+		return
+	}
+
+	var mounts, dataDirs []string
+	fontconfig := ""
+	for _, s := range hostFontShares() {
+		mounts = append(mounts, fmt.Sprintf("mkdir -p %[2]s && "+
+			"/run/current-system/sw/bin/mount -t 9p "+
+			"-o trans=virtio,version=9p2000.L,ro %[1]s %[2]s",
+			s.Tag, s.Guest))
+		dataDirs = append(dataDirs, nixString(filepath.Dir(s.Guest)))
+		if s.Kind == "fonts" {
+			fontconfig += "      <dir>" + s.Guest + "</dir>\n"
+		}
+	}
+	if len(mounts) == 0 {
+		return
+	}
+
+	return `  systemd.services.mount-host-fonts = {
+    description = "Mount fonts and themes of the host (crutch)";
+    serviceConfig = {
+      ExecStart = "/bin/sh -c '` + strings.Join(mounts, "; ") + `'";
+      RemainAfterExit = "yes";
+      Type = "oneshot";
+      User = "root";
+    };
+    wantedBy = [ "sysinit.target" ];
+  };
+  fonts.enableDefaultPackages = lib.mkDefault false;
+  fonts.fontconfig.localConf = ''
+    <?xml version="1.0"?>
+    <!DOCTYPE fontconfig SYSTEM "urn:fontconfig:fonts.dtd">
+    <fontconfig>
+` + fontconfig + `    </fontconfig>
+  '';
+  environment.sessionVariables.XDG_DATA_DIRS = [ ` +
+		strings.Join(dataDirs, " ") + ` ];
+`
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// VMs booted from user-supplied disk image (e.g. Windows) instead of
+// NixOS build. Changes are written to the image, or to the per-app
+// overlay if the base image is shared between several VMs.
+
+func overlayPath(id string) string {
+	return appvmHomesDir + "." + id + ".overlay.qcow2"
+}
+
+func imageFormat(path string) string {
+	if strings.HasSuffix(path, ".qcow2") {
+		return "qcow2"
+	}
+	return "raw"
+}
+
+// Disk used by VM, id is application name or name of stateless VM
+func appDisk(id string, app appConfig) string {
+	if app.BaseImage != "" {
+		return overlayPath(id)
+	}
+	return app.Image
+}
+
+func createOverlay(id string, app appConfig) (err error) {
+	if !fileExists(app.BaseImage) {
+		err = errors.New("base image " + app.BaseImage + " does not exist")
+		return
+	}
+
+	if fileExists(overlayPath(id)) {
+		return
+	}
+
+	_, err = run("qemu-img", "create", "-f", "qcow2",
+		"-b", app.BaseImage, "-F", imageFormat(app.BaseImage),
+		overlayPath(id))
+	return
+}
+
+func imageDiskTarget(bus string) (dev string, err error) {
+	switch bus {
+	case "", "virtio":
+		return "vda", nil
+	case "sata":
+		return "sda", nil
+	case "ide":
+		return "hda", nil
+	}
+	err = errors.New("unknown disk bus " + bus)
+	return
+}
+
+func generateImageXML(vmName string, app appConfig, network networkModel,
+	gui bool) (xml string, err error) {
+
+	image := appDisk(vmName[6:], app)
+	if image == "" {
+		err = errors.New("no image is set for " + vmName)
+		return
+	}
+
+	if !fileExists(image) {
+		err = errors.New("image " + image + " does not exist")
+		return
+	}
+
+	bus := app.DiskBus
+	if bus == "" {
+		bus = "virtio"
+	}
+
+	dev, err := imageDiskTarget(bus)
+	if err != nil {
+		return
+	}
+
+	devices := ""
+	if gui {
+		app.Webdav = false // no spice-webdavd in the image
+		devices = guiXML(app, false)
+	}
+
+	switch network {
+	case networkQemu:
+		devices += fmt.Sprintf(imageUserNetDevices, userNetIPv6())
+	case networkLibvirt:
+		devices += libvirtNetDevices(appNameFromDomain(vmName), app)
+	}
+	devices += gatewayDevices(appNameFromDomain(vmName), app)
+
+	r := appResources(app)
+
+	xml = fmt.Sprintf(imageXMLTmpl, xmlEscape(vmName), ownerMetadata(),
+		r.Memory, r.CurrentMemory, memoryBacking(app), r.VCPUs,
+		r.VCPUsMax, schedXML(app.Sched, r.VCPUsMax)+sandboxXML(strings.TrimPrefix(vmName, "appvm_"), app.Sandbox), imageFormat(image), xmlEscape(image),
+		dev, bus, devices)
+	return
+}
+
+func startImageVM(l *libvirt.Libvirt, vmName string, app appConfig,
+	network networkModel, gui bool) (err error) {
+
+	if app.BaseImage != "" {
+		err = createOverlay(vmName[6:], app)
+		if err != nil {
+			return
+		}
+	}
+
+	xml, err := generateImageXML(vmName, app, network, gui)
+	if err != nil {
+		return
+	}
+
+	_, err = l.DomainCreateXML(xml, libvirt.DomainStartValidate)
+	if err != nil {
+		return
+	}
+	return verifySandbox(l, vmName, app.Sandbox)
+}
+
+// e1000 works without additional drivers
+var imageUserNetDevices = `
+    <interface type='user'>
+      <model type='e1000'/>
+      %s
+    </interface>
+`
+
+var imageXMLTmpl = `
+<domain type='kvm'>
+  <name>%s</name>%s
+  <memory unit='MiB'>%d</memory>
+  <currentMemory unit='MiB'>%d</currentMemory>
+  %s
+  <vcpu current='%d'>%d</vcpu>
+  %s
+  <os>
+    <type arch='x86_64'>hvm</type>
+    <boot dev='hd'/>
+  </os>
+  <features>
+    <acpi></acpi>
+    <apic></apic>
+  </features>
+  <cpu mode='host-passthrough'/>
+  <clock offset='utc'/>
+  <on_poweroff>destroy</on_poweroff>
+  <on_reboot>restart</on_reboot>
+  <on_crash>destroy</on_crash>
+  <devices>
+    <disk type='file' device='disk'>
+      <driver name='qemu' type='%s' cache='writeback' discard='unmap' detect_zeroes='unmap'/>
+      <source file='%s'/>
+      <target dev='%s' bus='%s'/>
+    </disk>
+    <!-- Free pages are returned to the host -->
+    <memballoon model='virtio' autodeflate='on' freePageReporting='on'>
+      <stats period='5'/>
+    </memballoon>
+    <input type='tablet' bus='usb'/>
+    %s
+  </devices>
+</domain>
+`
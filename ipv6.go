@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/olekukonko/tablewriter"
+)
+
+// With "ipv6": true in config.json qemu user networking gets the ULA
+// prefix and libvirt networking uses own "appvm" network with NAT for
+// both families instead of "default". Guest configures addresses by
+// RA (SLAAC) and DHCPv6.
+
+const (
+	appvmNetwork   = "appvm"
+	ipv6UserPrefix = "fd61:7070:766d:1::"
+	ipv6NATPrefix  = "fd61:7070:766d:2::"
+)
+
+func ipv6Enabled() bool {
+	config, err := loadConfig()
+	return err == nil && config.IPv6
+}
+
+var appvmNetworkXML = `
+<network>
+  <name>` + appvmNetwork + `</name>
+  <forward mode='nat'>
+    <nat ipv6='yes'/>
+  </forward>
+  <ip address='192.168.123.1' netmask='255.255.255.0'>
+    <dhcp>
+      <range start='192.168.123.10' end='192.168.123.250'/>
+    </dhcp>
+  </ip>
+  <ip family='ipv6' address='` + ipv6NATPrefix + `1' prefix='64'>
+    <dhcp>
+      <range start='` + ipv6NATPrefix + `10' end='` + ipv6NATPrefix + `ff'/>
+    </dhcp>
+  </ip>
+</network>
+`
+
+func ensureAppvmNetwork(l *libvirt.Libvirt) (err error) {
+	if net, err := l.NetworkLookupByName(appvmNetwork); err == nil {
+		if active, _ := l.NetworkIsActive(net); active == 1 {
+			return nil
+		}
+		return l.NetworkCreate(net)
+	}
+	_, err = l.NetworkCreateXML(appvmNetworkXML)
+	return
+}
+
+// Network for NIC of VMs with libvirt networking
+func hostNetwork() string {
+	if ipv6Enabled() {
+		return appvmNetwork
+	}
+	return "default"
+}
+
+// -netdev of qemu user networking
+func userNetdev() string {
+	if ipv6Enabled() {
+		return "user,id=net0,ipv6=on,ipv6-prefix=" + ipv6UserPrefix +
+			",ipv6-prefixlen=64"
+	}
+	return "user,id=net0"
+}
+
+// For <interface type='user'> of image VMs
+func userNetIPv6() string {
+	if ipv6Enabled() {
+		return "<ip family='ipv6' address='" + ipv6UserPrefix + "' prefix='64'/>"
+	}
+	return ""
+}
+
+func addrFamily(t int32) string {
+	if t == 1 {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+// Addresses reported by the guest agent
+func showIP(l *libvirt.Libvirt, name string) (err error) {
+	dom, err := runningDomain(l, name)
+	if err != nil {
+		return
+	}
+
+	ifaces, err := l.DomainInterfaceAddresses(dom,
+		uint32(libvirt.DomainInterfaceAddressesSrcAgent), 0)
+	if err != nil {
+		return
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Interface", "Family", "Address"})
+	for _, iface := range ifaces {
+		if iface.Name == "lo" {
+			continue
+		}
+		for _, a := range iface.Addrs {
+			if strings.HasPrefix(a.Addr, "fe80:") {
+				continue
+			}
+			table.Append([]string{iface.Name, addrFamily(a.Type),
+				fmt.Sprintf("%s/%d", a.Addr, a.Prefix)})
+		}
+	}
+	table.Render()
+	return
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const ksmPath = "/sys/kernel/mm/ksm/"
+
+// Memory of sensitive VMs may be excluded from merging, because of
+// side channels
+func memoryBacking(app appConfig) string {
+	if app.NoSharePages {
+		return "<memoryBacking><nosharepages/></memoryBacking>"
+	}
+	return ""
+}
+
+func ksmValue(name string) (value int64, err error) {
+	raw, err := ioutil.ReadFile(ksmPath + name)
+	if err != nil {
+		return
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(raw)), 10, 64)
+}
+
+func ksmStatus() (err error) {
+	run, err := ksmValue("run")
+	if err != nil {
+		return
+	}
+
+	shared, err := ksmValue("pages_shared")
+	if err != nil {
+		return
+	}
+
+	sharing, err := ksmValue("pages_sharing")
+	if err != nil {
+		return
+	}
+
+	state := "off"
+	if run == 1 {
+		state = "on"
+	}
+
+	pageSize := int64(os.Getpagesize())
+	fmt.Println("KSM:", state)
+	fmt.Println("Pages shared:", shared)
+	fmt.Println("Pages sharing:", sharing)
+	fmt.Println("Memory saved:", humanSize(sharing*pageSize))
+	return
+}
+
+func tuneKSMState(state string) (err error) {
+	value := ""
+	switch state {
+	case "status":
+		return ksmStatus()
+	case "on":
+		value = "1"
+	case "off":
+		value = "0"
+	}
+
+	err = ioutil.WriteFile(ksmPath+"run", []byte(value), 0644)
+	if os.IsPermission(err) {
+		err = errors.New("permission denied, run as root " +
+			"or set hardware.ksm.enable on NixOS")
+	}
+	return
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Supported forms of --libvirt-uri:
+//
+//	qemu:///system                     system socket (default)
+//	qemu:///session                    session socket of the current user
+//	qemu+unix:///system?socket=<path>  custom socket
+//	/run/libvirt/libvirt-sock-ro       path to socket
+//	qemu+tcp://<host>[:port]/system    libvirtd listening on TCP
+
+const libvirtURIDefault = "qemu:///system"
+
+const libvirtTCPPort = "16509"
+
+// Plugins are dispatched before flags are parsed
+func libvirtURIEnv() string {
+	if uri := os.Getenv("APPVM_LIBVIRT_URI"); uri != "" {
+		return uri
+	}
+	return libvirtURIDefault
+}
+
+func libvirtAddr(uri string) (network, address string, err error) {
+	if strings.HasPrefix(uri, "/") {
+		return "unix", uri, nil
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return
+	}
+
+	if socket := u.Query().Get("socket"); socket != "" {
+		return "unix", socket, nil
+	}
+
+	switch u.Scheme {
+	case "qemu", "qemu+unix":
+		if u.Host != "" {
+			err = errors.New("remote host requires qemu+tcp:// in " + uri)
+			return
+		}
+		switch u.Path {
+		case "/system":
+			return "unix", libvirtSocket, nil
+		case "/session":
+			runtime := os.Getenv("XDG_RUNTIME_DIR")
+			if runtime == "" {
+				runtime = os.Getenv("HOME") + "/.cache"
+			}
+			return "unix", runtime + "/libvirt/libvirt-sock", nil
+		}
+	case "qemu+tcp":
+		address = u.Host
+		if u.Port() == "" {
+			address = net.JoinHostPort(u.Hostname(), libvirtTCPPort)
+		}
+		return "tcp", address, nil
+	case "unix":
+		return "unix", u.Path, nil
+	}
+
+	err = errors.New("unsupported libvirt URI " + uri)
+	return
+}
+
+func libvirtDial(uri string) (conn net.Conn, err error) {
+	network, address, err := libvirtAddr(uri)
+	if err != nil {
+		return
+	}
+	return net.DialTimeout(network, address, time.Second)
+}
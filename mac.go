@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Mandatory access control of qemu on the host. SELinux: libvirt does
+// not relabel 9p shares, so every application gets static MCS
+// categories (mcsLevel) for its qemu and the same ones for its data
+// directory, on start. qemu of one VM can't access data of another.
+// AppArmor: virt-aa-helper adds the shares and disks of the domain to
+// its own profile, only the nix store (read-only, the same for all)
+// is added to the local libvirt-qemu abstraction by appvm doctor --fix
+// (needs root).
+
+const selinuxShareType = "svirt_image_t"
+
+const apparmorLocal = "/etc/apparmor.d/local/abstractions/libvirt-qemu"
+
+var apparmorSnippet = `# appvm
+/nix/store/** r,
+/nix/store/**.so* mr,
+`
+
+// Added by older appvm, gives qemu of every VM data of all of them
+const apparmorSharedRule = "@{HOME}/appvm/** rwk,\n"
+
+func selinuxEnabled() bool {
+	return fileExists("/sys/fs/selinux/enforce")
+}
+
+func selinuxEnforcing() bool {
+	raw, err := ioutil.ReadFile("/sys/fs/selinux/enforce")
+	return err == nil && strings.TrimSpace(string(raw)) == "1"
+}
+
+func apparmorEnabled() bool {
+	raw, err := ioutil.ReadFile("/sys/module/apparmor/parameters/enabled")
+	return err == nil && strings.TrimSpace(string(raw)) == "Y" &&
+		isDirExists("/etc/apparmor.d/libvirt")
+}
+
+// Static MCS categories of the application (or stateless VM), the same
+// on every start. Two names with the same pair share the label.
+func mcsLevel(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	a := int(binary.BigEndian.Uint16(sum[0:])) % 1024
+	b := int(binary.BigEndian.Uint16(sum[2:])) % 1023
+	if b >= a {
+		b++
+	} else {
+		a, b = b, a
+	}
+	return fmt.Sprintf("s0:c%d,c%d", a, b)
+}
+
+// Label of qemu of the application
+func selinuxProcessLabel(name string) string {
+	return "system_u:system_r:svirt_t:" + mcsLevel(name)
+}
+
+// Type and level of the SELinux context, e.g. user_home_t and s0
+func selinuxLabel(path string) (typ, level string) {
+	buf := make([]byte, 256)
+	n, err := unix.Lgetxattr(path, "security.selinux", buf)
+	if err != nil {
+		return
+	}
+	fields := strings.Split(strings.TrimRight(string(buf[:n]), "\x00"), ":")
+	if len(fields) < 4 {
+		return
+	}
+	return fields[2], strings.Join(fields[3:], ":")
+}
+
+// Data directory of the application is its basename
+func checkShareLabel(dir string) error {
+	typ, level := selinuxLabel(dir)
+	if typ != selinuxShareType || level != mcsLevel(filepath.Base(dir)) {
+		return fmt.Errorf("label is %s:%s, not %s:%s", typ, level,
+			selinuxShareType, mcsLevel(filepath.Base(dir)))
+	}
+	return nil
+}
+
+// Labels data directory for qemu, does nothing without SELinux
+func labelShare(dir string) (err error) {
+	if !selinuxEnabled() || checkShareLabel(dir) == nil {
+		return
+	}
+	out, err := exec.Command("chcon", "-R", "-t", selinuxShareType,
+		"-l", mcsLevel(filepath.Base(dir)), dir).CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("chcon %s: %v: %s", dir, err,
+			strings.TrimSpace(string(out)))
+	}
+	return
+}
+
+func apparmorSnippetInstalled() bool {
+	raw, err := ioutil.ReadFile(apparmorLocal)
+	return err == nil && strings.Contains(string(raw), apparmorSnippet) &&
+		!strings.Contains(string(raw), apparmorSharedRule)
+}
+
+// Also drops the rule for all of ~/appvm
+func installApparmorSnippet() (err error) {
+	raw, err := ioutil.ReadFile(apparmorLocal)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	local := strings.Replace(string(raw), apparmorSharedRule, "", -1)
+	if !strings.Contains(local, apparmorSnippet) {
+		local += apparmorSnippet
+	}
+	return ioutil.WriteFile(apparmorLocal, []byte(local), 0644)
+}
+
+// qemu of qemu:///system runs as another user, which needs search
+// permission on every directory up to ~/appvm
+func checkSearchable(path string) (err error) {
+	for dir := filepath.Clean(path); dir != "/"; dir = filepath.Dir(dir) {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if info.Mode()&0001 == 0 {
+			return fmt.Errorf("%s is not searchable by others "+
+				"(chmod o+x), qemu of qemu:///system can't reach %s",
+				dir, path)
+		}
+	}
+	return
+}
+
+func doctor(uri string, fix bool) (err error) {
+	ok := setupCheck("nix", func() error {
+		_, err := exec.LookPath(nixBin("nix-build"))
+		return err
+	}())
+	ok = setupCheck("KVM", checkKVM()) && ok
+	ok = setupCheck("libvirt "+uri, checkLibvirt(uri)) && ok
+
+	// Not a failure, qemu may run as the user (user in qemu.conf)
+	if strings.HasPrefix(uri, "qemu:///system") {
+		if err := checkSearchable(appvmHomesDir); err != nil {
+			fmt.Printf("[WARN] %v, unless qemu runs as the current "+
+				"user\n", err)
+		}
+	}
+
+	if selinuxEnabled() {
+		mode := "permissive"
+		if selinuxEnforcing() {
+			mode = "enforcing"
+		}
+		fmt.Println("SELinux is", mode)
+
+		dirs, _ := ioutil.ReadDir(appvmHomesDir)
+		for _, f := range dirs {
+			if !f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+				continue
+			}
+			dir := appvmHomesDir + f.Name()
+			labelErr := checkShareLabel(dir)
+			if labelErr != nil && fix {
+				labelErr = labelShare(dir)
+			}
+			ok = setupCheck("SELinux label of "+dir, labelErr) && ok
+		}
+	}
+
+	if apparmorEnabled() {
+		fmt.Println("AppArmor is enabled")
+		var snippetErr error
+		if !apparmorSnippetInstalled() {
+			snippetErr = errors.New("no appvm rules or rule for all " +
+				"of ~/appvm in " + apparmorLocal)
+			if fix {
+				snippetErr = installApparmorSnippet()
+				if os.IsPermission(snippetErr) {
+					snippetErr = errors.New("run appvm doctor --fix as root")
+				}
+			}
+		}
+		ok = setupCheck("AppArmor rules", snippetErr) && ok
+	}
+
+	if !ok {
+		return errors.New("problems found, see failed checks")
+	}
+	return
+}
+
+func warnMAC(dir string) {
+	err := labelShare(dir)
+	if err != nil {
+		log.Println("SELinux:", err, "(see appvm doctor)")
+	}
+	if apparmorEnabled() && !apparmorSnippetInstalled() {
+		log.Println("AppArmor rules for appvm are not installed, " +
+			"see appvm doctor")
+	}
+}
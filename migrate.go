@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// On-disk formats are versioned by "version" of config.json. Every
+// migration upgrades config and state files from the previous version,
+// pending ones are run on start of appvm and reported. Migrations must
+// be idempotent, daemon and commands may run them at the same time.
+// Changes of on-disk formats must be done by a new migration.
+
+type migration struct {
+	Description string
+	// Returns what is changed, nothing for fresh installations
+	Migrate func() (changes []string, err error)
+}
+
+// Version N is the result of migrations[N-1]
+var migrations = []migration{
+	{"builtin expressions moved out of the user directory",
+		migrateBuiltinExprs},
+	{"memory usage is read from balloon statistics",
+		migrateMemoryUsed},
+}
+
+func schemaVersion() int {
+	return len(migrations)
+}
+
+// Old versions wrote builtin expressions to ~/.config/appvm/nix, which
+// is searched before builtin ones now. Unchanged copies are removed,
+// modified ones are kept as user expressions.
+func migrateBuiltinExprs() (changes []string, err error) {
+	for _, f := range []app{builtin_chromium_nix} {
+		path := configDir + "nix/" + f.Name + ".nix"
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if !bytes.Equal(raw, f.Nix) {
+			changes = append(changes, path+" is modified, "+
+				"kept as user expression")
+			continue
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, "removed "+path)
+	}
+	return
+}
+
+// .memory_used was written into the data directory by the guest of old
+// appvm, values left after the rebuild are outdated. Running VMs with
+// old closures write it again, see memoryUsed.
+func migrateMemoryUsed() (changes []string, err error) {
+	files, _ := filepath.Glob(appvmHomesDir + "*/.memory_used")
+	for _, path := range files {
+		err = os.Remove(path)
+		if err != nil {
+			return
+		}
+		changes = append(changes, "removed "+path)
+	}
+	return
+}
+
+func migrate() (err error) {
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+
+	if config.Version > schemaVersion() {
+		return fmt.Errorf("config.json has version %d, newer than %d "+
+			"supported by this appvm", config.Version, schemaVersion())
+	}
+	if config.Version == schemaVersion() {
+		return
+	}
+
+	for v := config.Version; v < schemaVersion(); v++ {
+		m := migrations[v]
+		changes, err := m.Migrate()
+		if err != nil {
+			return fmt.Errorf("migration to version %d (%s): %v",
+				v+1, m.Description, err)
+		}
+		for _, change := range changes {
+			log.Printf("Migration to version %d (%s): %s", v+1,
+				m.Description, change)
+		}
+
+		// Migrations may change config.json too
+		config, err = loadConfig()
+		if err != nil {
+			return err
+		}
+		config.Version = v + 1
+		err = saveConfig(config)
+		if err != nil {
+			return err
+		}
+	}
+	return
+}
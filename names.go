@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"regexp"
+
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+// Application names are used in file paths, domain names and XML
+
+const nameMaxLen = 64
+
+var nameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.+-]*$`)
+
+func validateName(name string) error {
+	if len(name) > nameMaxLen {
+		return fmt.Errorf("name %q is longer than %d characters",
+			name, nameMaxLen)
+	}
+	if !nameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid name %q, only letters, digits and "+
+			"_.+- are allowed", name)
+	}
+	return nil
+}
+
+type nameValue string
+
+func (n *nameValue) Set(s string) error {
+	err := validateName(s)
+	if err == nil {
+		*n = nameValue(s)
+	}
+	return err
+}
+
+func (n *nameValue) String() string {
+	return string(*n)
+}
+
+func nameArg(a *kingpin.ArgClause) *string {
+	s := new(string)
+	a.SetValue((*nameValue)(s))
+	return s
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+func TestNameArg(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"chromium", true},
+		{"foo.bar", true},
+		{"a_b+c-1", true},
+		{strings.Repeat("a", 64), true},
+		{strings.Repeat("a", 65), false},
+		{"", false},
+		{"with space", false},
+		{"a/b", false},
+		{"/abs", false},
+		{"..", false},
+		{"../x", false},
+		{".hidden", false},
+		{"-flag", false},
+		{"a<b", false},
+		{"a&b", false},
+		{`a"b`, false},
+	}
+
+	for _, tt := range tests {
+		app := kingpin.New("test", "")
+		app.Terminate(nil)
+		got := nameArg(app.Arg("name", "").Required())
+
+		_, err := app.Parse([]string{"--", tt.name})
+		if tt.valid && (err != nil || *got != tt.name) {
+			t.Errorf("%q: got %q, %v, want valid", tt.name, *got, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%q: accepted, want error", tt.name)
+		}
+	}
+}
+
+func TestXMLEscape(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"chromium", "chromium"},
+		{"with space", "with space"},
+		{"a/b/../c", "a/b/../c"},
+		{`<&"`, "&lt;&amp;&#34;"},
+		{"'", "&#39;"},
+		{"</domain><x>", "&lt;/domain&gt;&lt;x&gt;"},
+	}
+
+	for _, tt := range tests {
+		if got := xmlEscape(tt.in); got != tt.want {
+			t.Errorf("xmlEscape(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
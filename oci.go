@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Image is copied to the shared directory by the host, so the VM does
+// not need network to run it.
+var ociTemplate = `
+{pkgs, ...}:
+let
+  appRunner = pkgs.writeShellScriptBin "app" ''
+    ARGS_FILE=/home/user/.args
+    ARGS=$(cat $ARGS_FILE)
+    rm $ARGS_FILE
+
+    ${pkgs.xorg.xhost}/bin/xhost +local:
+    ${pkgs.podman}/bin/podman run --rm --net=host -e DISPLAY \
+      -v /tmp/.X11-unix:/tmp/.X11-unix -v /home/user:/home/user \
+      oci-archive:/home/user/%s $ARGS
+    systemctl poweroff
+  '';
+in {
+  imports = [
+    <nixpkgs/nixos/modules/virtualisation/qemu-vm.nix>
+    <nix/base.nix>
+  ];
+
+  virtualisation.podman.enable = true;
+
+  services.xserver.displayManager.sessionCommands = "${appRunner}/bin/app &";
+}
+`
+
+const ociArchive = ".oci-image.tar"
+
+// docker.io/library/gimp:2.10 -> gimp
+func ociName(ref string) string {
+	name := ref
+	if i := strings.LastIndex(name, "/"); i != -1 {
+		name = name[i+1:]
+	}
+	if i := strings.IndexAny(name, ":@"); i != -1 {
+		name = name[:i]
+	}
+	return strings.ToLower(name)
+}
+
+// Pulls image to the shared directory and generates expression to run
+// it, returns application name.
+func generateOCI(ref string, force bool) (name string, err error) {
+	name = ociName(ref)
+	err = validateName(name)
+	if err != nil {
+		err = fmt.Errorf("invalid image reference %s: %v", ref, err)
+		return
+	}
+
+	sharedDir := appvmHomesDir + name
+	err = os.MkdirAll(sharedDir, 0700)
+	if err != nil {
+		return
+	}
+
+	archive := sharedDir + "/" + ociArchive
+	if !fileExists(archive) {
+		log.Println("Pull", ref)
+		var out []byte
+		out, err = exec.Command("skopeo", "copy", "docker://"+ref,
+			"oci-archive:"+archive).CombinedOutput()
+		if err != nil {
+			err = fmt.Errorf("skopeo: %v: %s", err, out)
+			return
+		}
+	}
+
+	appNixConfig := fmt.Sprintf(ociTemplate, ociArchive)
+	_, err = writeGeneratedExpr(name, appNixConfig, force)
+	return
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// appvm --offline uses only local expressions and the nix store: remote
+// expressions are not downloaded, builds that need substitutes or
+// fixed-output derivations (fetchurl and friends) fail before nix-build
+// is started. Evaluation is restricted anyway, see checkExpr.
+
+// Set by --offline (APPVM_OFFLINE)
+var offlineMode bool
+
+func checkOfflineExpr(name string) (err error) {
+	e, ok := findAppExpr(name)
+	if ok && e.URL != "" {
+		err = fmt.Errorf("expression of %s is fetched from %s, "+
+			"not available offline", name, e.URL)
+	}
+	return
+}
+
+func isFixedOutput(drv string) bool {
+	raw, err := ioutil.ReadFile(drv)
+	if err != nil {
+		return false
+	}
+	s := string(raw)
+	return strings.Contains(s, `("outputHash","`) &&
+		!strings.Contains(s, `("outputHash","")`)
+}
+
+// Parses "these N paths will be fetched" and "these N derivations will
+// be built" sections of nix-store --realise --dry-run
+func checkOfflineBuild(drv string) (err error) {
+	plan, err := run(nixBin("nix-store"), "--realise", "--dry-run", drv)
+	if err != nil {
+		return
+	}
+
+	var fetched, downloads []string
+	section := ""
+	for _, line := range strings.Split(plan, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.Contains(line, "will be fetched"):
+			section = "fetch"
+		case strings.Contains(line, "will be built"):
+			section = "build"
+		case strings.HasPrefix(trimmed, "/nix/store/"):
+			if section == "fetch" {
+				fetched = append(fetched, trimmed)
+			} else if section == "build" && isFixedOutput(trimmed) {
+				downloads = append(downloads, trimmed)
+			}
+		}
+	}
+
+	if len(fetched) != 0 {
+		return fmt.Errorf("offline: %d paths must be fetched from "+
+			"binary caches, e.g. %s", len(fetched), fetched[0])
+	}
+	if len(downloads) != 0 {
+		return fmt.Errorf("offline: %d sources must be downloaded, e.g. %s",
+			len(downloads), downloads[0])
+	}
+	return
+}
+
+func offlineOptions() []string {
+	if offlineMode {
+		return []string{"--option", "substitute", "false"}
+	}
+	return nil
+}
+
+var errOffline = withCategory("denied",
+	errors.New("not available in offline mode"))
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// One-way channel from the guest: files closed after writing or moved
+// to ~/Outbox of the VM are copied (scanned, see importFile) by appvm
+// daemon to the host destination. Outbox is a part of the shared home,
+// inotify sees writes of qemu on the host.
+
+type outboxConfig struct {
+	// Host directory, e.g. ~/Downloads/chromium
+	Dest string `json:"dest,omitempty"`
+	// Remove files from the outbox after copying
+	Move bool `json:"move,omitempty"`
+}
+
+const outboxPollTimeout = 5000 // ms
+
+func outboxDir(name string) string {
+	return appvmHomesDir + name + "/Outbox"
+}
+
+func outboxDest(c outboxConfig) string {
+	if strings.HasPrefix(c.Dest, "~/") {
+		return os.Getenv("HOME") + c.Dest[1:]
+	}
+	return c.Dest
+}
+
+// name, name (1), name (2), ...
+func freePath(dir, name string) string {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	path := filepath.Join(dir, name)
+	for i := 1; fileExists(path); i++ {
+		path = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+	}
+	return path
+}
+
+// Outbox is written by the guest: symlinks are not followed and FIFOs
+// or devices are not opened for reading, so only files of the VM are
+// copied and the copy does not block
+func openRegular(path string) (f *os.File, err error) {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_NOFOLLOW|
+		unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return
+	}
+	f = os.NewFile(uintptr(fd), path)
+
+	info, err := f.Stat()
+	if err == nil && !info.Mode().IsRegular() {
+		err = errors.New(path + " is not a regular file")
+	}
+	if err != nil {
+		f.Close()
+		f = nil
+	}
+	return
+}
+
+// The same as importFile, but without reading the file to memory
+func importPath(from, to string) (err error) {
+	source, err := openRegular(from)
+	if err != nil {
+		return
+	}
+	defer source.Close()
+
+	tmp, err := ioutil.TempFile(appvmHomesDir, ".import-")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, source)
+	if err != nil {
+		tmp.Close()
+		return
+	}
+	err = tmp.Close()
+	if err != nil {
+		return
+	}
+
+	err = scanFile(tmp.Name(), filepath.Base(to))
+	if err != nil {
+		return
+	}
+	return moveFile(tmp.Name(), to)
+}
+
+func syncOutboxFile(name, file string, c outboxConfig) {
+	from := filepath.Join(outboxDir(name), file)
+	if strings.HasPrefix(file, ".") {
+		return
+	}
+	// Neither the outbox nor the file may be a symlink
+	dir, err := os.Lstat(outboxDir(name))
+	if err != nil || !dir.IsDir() {
+		return
+	}
+	info, err := os.Lstat(from)
+	if err != nil || !info.Mode().IsRegular() {
+		return
+	}
+
+	dest := outboxDest(c)
+	err = os.MkdirAll(dest, 0700)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	to := freePath(dest, file)
+	err = importPath(from, to)
+	if err != nil {
+		log.Println("Outbox of", name+":", err)
+		return
+	}
+	log.Println("Outbox of", name+":", file, "->", to)
+
+	if c.Move {
+		os.Remove(from)
+	}
+}
+
+func watchOutbox() {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		log.Println("outbox:", err)
+		return
+	}
+
+	apps := make(map[int32]string) // watch descriptor -> application
+	watched := make(map[string]bool)
+	buf := make([]byte, 64*1024)
+
+	for {
+		config, err := loadConfig()
+		if err == nil {
+			for name, app := range config.Apps {
+				if app.Outbox.Dest == "" || watched[name] ||
+					!isDirExists(appvmHomesDir+name) {
+					continue
+				}
+				os.MkdirAll(outboxDir(name), 0700)
+				wd, err := unix.InotifyAddWatch(fd, outboxDir(name),
+					unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO)
+				if err != nil {
+					log.Println("outbox:", err)
+					continue
+				}
+				apps[int32(wd)] = name
+				watched[name] = true
+			}
+		}
+
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, outboxPollTimeout)
+		if err != nil || n == 0 {
+			continue
+		}
+
+		size, err := unix.Read(fd, buf)
+		if err != nil {
+			continue
+		}
+		for offset := 0; offset+unix.SizeofInotifyEvent <= size; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			raw := buf[offset+unix.SizeofInotifyEvent : offset+
+				unix.SizeofInotifyEvent+int(event.Len)]
+			offset += unix.SizeofInotifyEvent + int(event.Len)
+
+			name, ok := apps[event.Wd]
+			if !ok {
+				continue
+			}
+			// Outbox is removed, e.g. by appvm drop
+			if event.Mask&unix.IN_IGNORED != 0 {
+				delete(apps, event.Wd)
+				delete(watched, name)
+				continue
+			}
+			file := strings.TrimRight(string(raw), "\x00")
+			syncOutboxFile(name, file, config.app(name).Outbox)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// Every build records the hash of the expression and the nixpkgs
+// revision it was built from. appvm outdated compares them with the
+// local expression, with the repo expression (against its pin in
+// trust.json) and with the revision of the nixpkgs channel upstream.
+// appvm update accepts changed repo expressions, updates the channel
+// and rebuilds.
+
+type buildRecord struct {
+	Expression string    `json:"expression"`
+	ExprSHA256 string    `json:"expression_sha256"`
+	Nixpkgs    string    `json:"nixpkgs,omitempty"`
+	Output     string    `json:"output"`
+	Time       time.Time `json:"time"`
+}
+
+type appUpdate struct {
+	Name string
+	// "expression", "repo" or "nixpkgs"
+	Kind    string
+	Current string
+	Latest  string
+	Changes string
+	expr    appExpr
+	// Upstream repo expression that was compared
+	latest []byte
+}
+
+func buildRecordPath(name string) string {
+	return configDir + "built/" + name + ".json"
+}
+
+func loadBuildRecord(name string) (r buildRecord, err error) {
+	raw, err := ioutil.ReadFile(buildRecordPath(name))
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(raw, &r)
+	return
+}
+
+// Revision of <nixpkgs>, empty if nixpkgs is not from a channel or git
+func nixpkgsRevision() string {
+	out, err := exec.Command(nixBin("nix-instantiate"), "--eval", "--json",
+		"-E", `(import <nixpkgs/lib>).trivial.revisionWithDefault ""`).Output()
+	if err != nil {
+		return ""
+	}
+	var rev string
+	json.Unmarshal(out, &rev)
+	return rev
+}
+
+func saveBuildRecord(name, output string) {
+	r := buildRecord{Output: output, Time: time.Now(),
+		Nixpkgs: nixpkgsRevision()}
+	if e, ok := findAppExpr(name); ok {
+		r.Expression = e.Path
+		r.ExprSHA256, _ = e.hash()
+	}
+
+	raw, _ := json.MarshalIndent(r, "", "  ")
+	os.MkdirAll(configDir+"built", 0700)
+	err := ioutil.WriteFile(buildRecordPath(name), raw, 0600)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// URL of the channel used as <nixpkgs>
+func nixpkgsChannel() (url string, err error) {
+	out, err := run(nixBin("nix-channel"), "--list")
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if fields[0] == "nixpkgs" {
+			return fields[1], nil
+		}
+		if url == "" && strings.Contains(fields[1], "nixos.org/channels") {
+			url = fields[1]
+		}
+	}
+	if url == "" {
+		err = errors.New("no nixpkgs channel")
+	}
+	return
+}
+
+func channelRevision(url string) (rev string, err error) {
+	resp, err := httpGet(strings.TrimSuffix(url, "/") + "/git-revision")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	raw, err := ioutil.ReadAll(resp.Body)
+	rev = strings.TrimSpace(string(raw))
+	return
+}
+
+func shortRev(rev string) string {
+	if len(rev) > 12 {
+		return rev[:12]
+	}
+	return rev
+}
+
+// "+N -M lines" from diff -u, empty if files are equal
+func diffSummary(from, to string) string {
+	out, _ := exec.Command("diff", "-u", from, to).Output()
+	added, removed := 0, 0
+	for _, line := range strings.Split(string(out), "\n") {
+		switch {
+		case strings.HasPrefix(line, "+++"), strings.HasPrefix(line, "---"):
+		case strings.HasPrefix(line, "+"):
+			added++
+		case strings.HasPrefix(line, "-"):
+			removed++
+		}
+	}
+	if added == 0 && removed == 0 {
+		return ""
+	}
+	return fmt.Sprintf("+%d -%d lines", added, removed)
+}
+
+// Compares upstream copy of the repo expression with the pinned one
+func repoUpdate(name string, e appExpr) (u appUpdate, ok bool, err error) {
+	t, err := loadTrust()
+	if err != nil {
+		return
+	}
+	pin, pinned := t.Pins[e.URL]
+	if !pinned {
+		return
+	}
+
+	latest := e.Path + ".latest"
+	defer os.Remove(latest)
+	err = download(e.URL, latest)
+	if err != nil {
+		return
+	}
+	sum := fileSHA256(latest)
+	if sum == pin.SHA256 {
+		return
+	}
+	raw, err := ioutil.ReadFile(latest)
+	if err != nil {
+		return
+	}
+
+	u = appUpdate{Name: name, Kind: "repo", expr: e, latest: raw,
+		Current: "sha256:" + shortRev(pin.SHA256),
+		Latest:  "sha256:" + shortRev(sum),
+		Changes: diffSummary(e.Path, latest)}
+	return u, true, nil
+}
+
+func outdatedApps() (updates []appUpdate, err error) {
+	if offlineMode {
+		err = fmt.Errorf("outdated: %v", errOffline)
+		return
+	}
+
+	channel, err := nixpkgsChannel()
+	latestRev := ""
+	if err == nil {
+		latestRev, err = channelRevision(channel)
+	}
+	if err != nil {
+		log.Println("nixpkgs:", err)
+		err = nil
+	}
+
+	records, _ := filepath.Glob(configDir + "built/*.json")
+	for _, path := range records {
+		name := strings.TrimSuffix(filepath.Base(path), ".json")
+		r, err := loadBuildRecord(name)
+		if err != nil {
+			continue
+		}
+
+		e, ok := findAppExpr(name)
+		if !ok {
+			continue
+		}
+
+		if e.URL != "" {
+			u, ok, err := repoUpdate(name, e)
+			if err != nil {
+				log.Println(name+":", err)
+			} else if ok {
+				updates = append(updates, u)
+			}
+		}
+
+		if sum, _ := e.hash(); sum != r.ExprSHA256 {
+			updates = append(updates, appUpdate{Name: name,
+				Kind:    "expression",
+				Current: "sha256:" + shortRev(r.ExprSHA256),
+				Latest:  "sha256:" + shortRev(sum),
+				Changes: "changed since the build " +
+					r.Time.Format("2006-01-02"),
+				expr: e})
+		}
+
+		if latestRev != "" && r.Nixpkgs != "" && r.Nixpkgs != latestRev {
+			updates = append(updates, appUpdate{Name: name,
+				Kind:    "nixpkgs",
+				Current: shortRev(r.Nixpkgs),
+				Latest:  shortRev(latestRev),
+				Changes: "https://github.com/NixOS/nixpkgs/compare/" +
+					shortRev(r.Nixpkgs) + "..." + shortRev(latestRev)})
+		}
+	}
+	return
+}
+
+func outdated() (err error) {
+	updates, err := outdatedApps()
+	if err != nil {
+		return
+	}
+	if len(updates) == 0 {
+		fmt.Println("All built applications are up to date")
+		return
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Application", "Source", "Built", "Available",
+		"Changes"})
+	for _, u := range updates {
+		table.Append([]string{u.Name, u.Kind, u.Current, u.Latest,
+			u.Changes})
+	}
+	table.Render()
+	return
+}
+
+// The reviewed copy is pinned, it is not downloaded again
+func acceptRepoUpdate(u appUpdate) (err error) {
+	t, err := loadTrust()
+	if err != nil {
+		return
+	}
+	tmp := u.expr.Path + ".part"
+	defer os.Remove(tmp)
+	err = ioutil.WriteFile(tmp, u.latest, 0600)
+	if err != nil {
+		return
+	}
+	t.Pins[u.expr.URL] = pinnedExpr{SHA256: fileSHA256(tmp),
+		Pinned: time.Now()}
+	err = saveTrust(t)
+	if err != nil {
+		return
+	}
+	return os.Rename(tmp, u.expr.Path)
+}
+
+// Updates listed applications if they are outdated, or every outdated
+// one with all. Every changed repo expression is accepted only after
+// confirmation, unless yes.
+func update(names []string, all, yes bool, jobs int, verbose bool) (
+	err error) {
+
+	if !all && len(names) == 0 {
+		return withCategory("usage",
+			errors.New("no applications, use --all to update every one"))
+	}
+
+	updates, err := outdatedApps()
+	if err != nil {
+		return
+	}
+
+	selected := make(map[string]bool)
+	for _, name := range names {
+		selected[name] = true
+	}
+
+	var rebuild []string
+	seen := make(map[string]bool)
+	accepted := make(map[string]bool)
+	channelUpdated := false
+	for _, u := range updates {
+		if !all && !selected[u.Name] {
+			continue
+		}
+
+		switch u.Kind {
+		case "repo":
+			ok, asked := accepted[u.expr.URL]
+			if !asked {
+				ok = yes || confirm(fmt.Sprintf("[%s] accept %s %s "+
+					"(%s, see appvm diff %s)?", u.Name, u.expr.URL,
+					u.Latest, u.Changes, u.Name))
+				if ok {
+					err = acceptRepoUpdate(u)
+					if err != nil {
+						return
+					}
+				}
+				accepted[u.expr.URL] = ok
+			}
+			if !ok {
+				fmt.Printf("[%s] skipped\n", u.Name)
+				continue
+			}
+		case "nixpkgs":
+			if !channelUpdated {
+				fmt.Println("Updating nixpkgs channel to", u.Latest)
+				err = exec.Command(nixBin("nix-channel"), "--update").Run()
+				if err != nil {
+					return fmt.Errorf("nix-channel --update: %v", err)
+				}
+				channelUpdated = true
+			}
+		}
+
+		if !seen[u.Name] {
+			seen[u.Name] = true
+			rebuild = append(rebuild, u.Name)
+		}
+	}
+
+	if len(rebuild) == 0 {
+		fmt.Println("Nothing to update")
+		return
+	}
+	return buildApps(rebuild, jobs, verbose)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// appvm start --package and --extra-module add packages and NixOS
+// modules to the application for this start only. They are put into
+// the generated module of the application (see appmodule.go), extra
+// modules are passed by -I appvm-extra-<N>=<path> as evaluation is
+// restricted to the search path.
+
+type startOverrides struct {
+	// Attribute paths in pkgs, e.g. python3Packages.requests
+	Packages []string
+	// Absolute paths
+	Modules []string
+}
+
+// Set by appvm start
+var overrides startOverrides
+
+var packageRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_'-]*` +
+	`(\.[a-zA-Z_][a-zA-Z0-9_'-]*)*$`)
+
+func setOverrides(packages, modules []string) (err error) {
+	for _, p := range packages {
+		if !packageRegexp.MatchString(p) {
+			return fmt.Errorf("invalid package %q", p)
+		}
+	}
+
+	overrides.Packages = packages
+	overrides.Modules = nil
+	for _, m := range modules {
+		path, err := filepath.Abs(m)
+		if err != nil {
+			return err
+		}
+		if !fileExists(path) {
+			return fmt.Errorf("no such module %s", m)
+		}
+		overrides.Modules = append(overrides.Modules, path)
+	}
+	return
+}
+
+func (o startOverrides) empty() bool {
+	return len(o.Packages) == 0 && len(o.Modules) == 0
+}
+
+func overridesSearchPath() (args []string) {
+	for i, m := range overrides.Modules {
+		args = append(args, "-I", fmt.Sprintf("appvm-extra-%d=%s", i, m))
+	}
+	return
+}
+
+func overridesModule(app appConfig) (module string) {
+	if len(overrides.Packages) != 0 {
+		var packages []string
+		for _, p := range overrides.Packages {
+			packages = append(packages, "    (lib.getAttrFromPath "+
+				"(lib.splitString \".\" "+nixString(p)+") pkgs)\n")
+		}
+		module += "  environment.systemPackages = [\n" +
+			strings.Join(packages, "") + "  ];\n"
+	}
+
+	if len(overrides.Modules) != 0 {
+		module += "  imports = ["
+		for i := range overrides.Modules {
+			module += fmt.Sprintf(" <appvm-extra-%d>", i)
+		}
+		module += " ];\n"
+	}
+	return
+}
+
+// Saved with arguments of appvm start, so restarts get the same VM
+func overridesArgs() (args []string) {
+	for _, p := range overrides.Packages {
+		args = append(args, "--package", p)
+	}
+	for _, m := range overrides.Modules {
+		args = append(args, "--extra-module", m)
+	}
+	return
+}
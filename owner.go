@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// With the system libvirt connection domains of all users are visible,
+// so appvm stores uid of the user that started VM in domain metadata
+// and refuses to manage domains of other users. The uid is also the
+// first 8 hex digits of the domain UUID, polkit can not read metadata,
+// but the polkit rule from README matches the UUID against the uid of
+// the caller, so libvirtd enforces ownership for other clients too.
+
+const appvmNamespace = "https://code.dumpstack.io/tools/appvm"
+
+// <uid>-xxxx-4xxx-yxxx-xxxxxxxxxxxx, the rest as random UUID
+func ownerUUID(uid int) string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	b[2] = b[2]&0x0f | 0x40
+	b[4] = b[4]&0x3f | 0x80
+	h := hex.EncodeToString(b)
+	return fmt.Sprintf("%08x-%s-%s-%s-%s", uint32(uid),
+		h[0:4], h[4:8], h[8:12], h[12:24])
+}
+
+func ownerMetadata() string {
+	return fmt.Sprintf(`
+  <uuid>%s</uuid>
+  <metadata>
+    <appvm:owner xmlns:appvm='%s' uid='%d'/>
+  </metadata>`, ownerUUID(os.Getuid()), appvmNamespace, os.Getuid())
+}
+
+func domainOwner(l *libvirt.Libvirt, dom libvirt.Domain) (uid int, err error) {
+	raw, err := l.DomainGetMetadata(dom, int32(libvirt.DomainMetadataElement),
+		libvirt.OptString{appvmNamespace}, libvirt.DomainAffectLive)
+	if err != nil {
+		return
+	}
+
+	var owner struct {
+		UID string `xml:"uid,attr"`
+	}
+	err = xml.Unmarshal([]byte(raw), &owner)
+	if err != nil {
+		return
+	}
+
+	uid, err = strconv.Atoi(owner.UID)
+	return
+}
+
+func checkOwner(l *libvirt.Libvirt, dom libvirt.Domain) (err error) {
+	if os.Getuid() == 0 {
+		return
+	}
+
+	uid, err := domainOwner(l, dom)
+	if err != nil || uid != os.Getuid() {
+		err = withCategory("denied",
+			errors.New(dom.Name+" is not owned by current user"))
+	}
+	return
+}
+
+func isOwned(l *libvirt.Libvirt, dom libvirt.Domain) bool {
+	return checkOwner(l, dom) == nil
+}
+
+// As isOwned, for domains of lifecycle events. Transient domains are
+// gone after they stop, so then the uid is taken from the UUID.
+func eventOwned(l *libvirt.Libvirt, dom libvirt.Domain) bool {
+	if isOwned(l, dom) {
+		return true
+	}
+	if _, err := l.DomainLookupByUUID(dom.UUID); err == nil {
+		return false
+	}
+	return binary.BigEndian.Uint32(dom.UUID[:4]) == uint32(os.Getuid())
+}
+
+// As DomainLookupByName with the libvirt name of the VM ("appvm_<name>"),
+// but domains of other users are refused. Every lookup by name goes
+// through it, names are unique per user only.
+func lookupOwned(l *libvirt.Libvirt, vmName string) (dom libvirt.Domain,
+	err error) {
+
+	dom, err = l.DomainLookupByName(vmName)
+	if err != nil {
+		return
+	}
+	err = checkOwner(l, dom)
+	return
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// Parameters of the expression from "params" of the application are
+// passed to vm.nix by --argstr (strings) or --arg (other JSON values)
+// and to the expression as the params module argument, e.g.
+//
+//	{ pkgs, params, ... }: {
+//	  environment.systemPackages = map (p: pkgs.${p}) params.packages;
+//	}
+
+var paramRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_'-]*$`)
+
+func checkParams(params map[string]interface{}) error {
+	for name := range params {
+		if !paramRegexp.MatchString(name) || name == "system" {
+			return fmt.Errorf("invalid parameter name %q", name)
+		}
+	}
+	return nil
+}
+
+// Arguments of nix-instantiate, sorted to get the same command line
+func paramArgs(params map[string]interface{}) (args []string, err error) {
+	var names []string
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if s, ok := params[name].(string); ok {
+			args = append(args, "--argstr", name, s)
+			continue
+		}
+		raw, err := json.Marshal(params[name])
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "--arg", name,
+			"builtins.fromJSON "+nixString(string(raw)))
+	}
+	return
+}
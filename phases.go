@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// Without --verbose appvm start shows coarse phases with timing
+// instead of nix output. Counts of paths and derivations come from the
+// plan nix-build prints first; progress is updated in place on a
+// terminal and only finished phases are printed otherwise.
+
+const bootWaitTimeout = time.Minute
+
+// Set by appvm start --quiet
+var showPhases bool
+
+var currentPhase struct {
+	Name  string
+	Start time.Time
+}
+
+var (
+	planBuildRegexp = regexp.MustCompile(`^these (\d+) derivations will be built`)
+	planFetchRegexp = regexp.MustCompile(`^these (\d+) paths will be fetched`)
+)
+
+func phase(name string) {
+	if !showPhases {
+		return
+	}
+	endPhase()
+	currentPhase.Name, currentPhase.Start = name, time.Now()
+	if isTerminal(os.Stdout) {
+		fmt.Print(name + "...")
+	}
+}
+
+func phaseProgress(status string) {
+	if showPhases && currentPhase.Name != "" && isTerminal(os.Stdout) {
+		fmt.Printf("\r\033[K%s... %s", currentPhase.Name, status)
+	}
+}
+
+func endPhase() {
+	if !showPhases || currentPhase.Name == "" {
+		return
+	}
+	took := time.Since(currentPhase.Start).Round(100 * time.Millisecond)
+	if isTerminal(os.Stdout) {
+		fmt.Print("\r\033[K")
+	}
+	fmt.Printf("%s (%s)\n", currentPhase.Name, took)
+	currentPhase.Name = ""
+}
+
+// Error is printed on its own line
+func abortPhase() {
+	if showPhases && currentPhase.Name != "" && isTerminal(os.Stdout) {
+		fmt.Println()
+	}
+	currentPhase.Name = ""
+}
+
+// Follows nix-build output
+type buildProgress struct {
+	Fetch, Fetched int
+	Build, Built   int
+}
+
+func (p *buildProgress) line(line string) {
+	switch {
+	case line == "this derivation will be built:":
+		p.Build = 1
+	case strings.HasPrefix(line, "this path will be fetched"):
+		p.Fetch = 1
+	case planBuildRegexp.MatchString(line):
+		p.Build, _ = strconv.Atoi(planBuildRegexp.FindStringSubmatch(line)[1])
+	case planFetchRegexp.MatchString(line):
+		p.Fetch, _ = strconv.Atoi(planFetchRegexp.FindStringSubmatch(line)[1])
+	case strings.HasPrefix(line, "copying path "):
+		if p.Fetched == 0 {
+			phase(fmt.Sprintf("fetching %d paths", p.Fetch))
+		}
+		p.Fetched++
+		phaseProgress(fmt.Sprintf("%d/%d", p.Fetched, p.Fetch))
+	case strings.HasPrefix(line, "building '"):
+		if p.Built == 0 {
+			phase(fmt.Sprintf("building %d derivations", p.Build))
+		}
+		p.Built++
+		phaseProgress(fmt.Sprintf("%d/%d", p.Built, p.Build))
+	}
+}
+
+func waitBoot(l *libvirt.Libvirt, dom libvirt.Domain) {
+	if !showPhases {
+		return
+	}
+	phase("waiting for boot")
+	for start := time.Now(); time.Since(start) < bootWaitTimeout; time.Sleep(time.Second) {
+		if guestAgentReady(l, dom) {
+			break
+		}
+	}
+	endPhase()
+}
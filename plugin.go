@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+// Unknown subcommands are dispatched to appvm-<name> executables
+// from PATH (like git does), settings are passed in environment.
+
+const pluginPrefix = "appvm-"
+
+// Plugins connect to the same libvirt by APPVM_LIBVIRT_URI
+func pluginEnv() []string {
+	return append(os.Environ(),
+		"APPVM_CONFIG_DIR="+configDir,
+		"APPVM_HOMES_DIR="+appvmHomesDir,
+		"APPVM_LIBVIRT_URI="+libvirtURIEnv())
+}
+
+// Does not return if plugin is found
+func dispatchPlugin(args []string) {
+	if len(args) < 2 || strings.HasPrefix(args[1], "-") {
+		return
+	}
+
+	if kingpin.CommandLine.GetCommand(args[1]) != nil {
+		return
+	}
+
+	path, err := exec.LookPath(pluginPrefix + args[1])
+	if err != nil {
+		return
+	}
+
+	err = syscall.Exec(path, append([]string{path}, args[2:]...), pluginEnv())
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+func plugins() (names []string) {
+	seen := make(map[string]bool)
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		matches, _ := filepath.Glob(filepath.Join(dir, pluginPrefix+"*"))
+		for _, m := range matches {
+			info, err := os.Stat(m)
+			if err != nil || info.IsDir() || info.Mode()&0111 == 0 {
+				continue
+			}
+
+			name := strings.TrimPrefix(filepath.Base(m), pluginPrefix)
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return
+}
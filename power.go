@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// Host power state is forwarded to running VMs by appvm daemon over
+// vsock RPC, guest stores it to $XDG_RUNTIME_DIR/appvm/power.json and
+// shows notification on low battery. VMs with "on_battery": "pause"
+// are paused while host is on battery and resumed on AC.
+
+const (
+	powerInterval = 10 * time.Second
+	powerLow      = 10 // percent
+)
+
+type powerState struct {
+	OnBattery bool `json:"on_battery"`
+	// Percent, -1 if there is no battery
+	Capacity int  `json:"capacity"`
+	Low      bool `json:"low"`
+}
+
+func hostPowerState() (state powerState) {
+	state.Capacity = -1
+
+	supplies, _ := filepath.Glob("/sys/class/power_supply/*")
+	mains, online := false, false
+	for _, dir := range supplies {
+		switch sysfsValue(dir + "/type") {
+		case "Mains":
+			mains = true
+			if sysfsValue(dir+"/online") == "1" {
+				online = true
+			}
+		case "Battery":
+			n, err := strconv.Atoi(sysfsValue(dir + "/capacity"))
+			if err == nil && (state.Capacity < 0 || n < state.Capacity) {
+				state.Capacity = n
+			}
+		}
+	}
+
+	state.OnBattery = mains && !online && state.Capacity >= 0
+	state.Low = state.OnBattery && state.Capacity <= powerLow
+	return
+}
+
+func forwardPowerState(l *libvirt.Libvirt, vmName string,
+	state powerState) (err error) {
+
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return
+	}
+	_, err = rpcCall(l, vmName[6:], rpcRequest{Method: "power", Data: raw})
+	return
+}
+
+// Pauses or resumes VMs according to on_battery policy, paused keeps
+// VMs paused by the policy
+func applyPowerPolicy(l *libvirt.Libvirt, d libvirt.Domain, state powerState,
+	paused map[string]bool) {
+
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+	if config.app(appNameFromDomain(d.Name)).OnBattery != "pause" {
+		return
+	}
+
+	if state.OnBattery && !paused[d.Name] {
+		err = l.DomainSuspend(d)
+		if err == nil {
+			log.Println("On battery, pause", d.Name)
+			paused[d.Name] = true
+		}
+	} else if !state.OnBattery && paused[d.Name] {
+		delete(paused, d.Name)
+		err = l.DomainResume(d)
+		if err == nil {
+			log.Println("On AC, resume", d.Name)
+		}
+	}
+}
+
+func watchPower(l *libvirt.Libvirt) {
+	var last powerState
+	forwarded := make(map[string]bool)
+	paused := make(map[string]bool)
+
+	for ; ; time.Sleep(powerInterval) {
+		state := hostPowerState()
+		changed := state != last
+		last = state
+
+		domains, err := l.Domains()
+		if err != nil {
+			continue
+		}
+
+		running := make(map[string]bool)
+		for _, d := range domains {
+			if !strings.HasPrefix(d.Name, "appvm_") || !isOwned(l, d) {
+				continue
+			}
+			running[d.Name] = true
+
+			applyPowerPolicy(l, d, state, paused)
+
+			// Newly started VMs receive current state
+			if changed || !forwarded[d.Name] {
+				err = forwardPowerState(l, d.Name, state)
+				forwarded[d.Name] = err == nil
+			}
+		}
+
+		for name := range forwarded {
+			if !running[name] {
+				delete(forwarded, name)
+				delete(paused, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Profiles are NixOS modules selected by "profile" in config.json on
+// top of base.nix. Builtin ones are rewritten on every run like
+// base.nix, own profiles may be added to ~/.config/appvm/nix/profiles/
+// under other names. The order of layers is base.nix, profile,
+// local.nix, expression of the application and config.json settings;
+// profiles override base.nix with priority 90 and set everything else
+// by mkDefault, so local.nix and expressions win without mkForce.
+
+var builtinProfiles = map[string]string{
+	"minimal": `
+# Console only, use with "graphics": { "type": "none" } or --cli
+{ lib, ... }:
+{
+  services.xserver.enable = lib.mkOverride 90 false;
+  services.spice-vdagentd.enable = lib.mkOverride 90 false;
+  documentation.enable = lib.mkDefault false;
+  fonts.fontconfig.enable = lib.mkDefault false;
+}
+`,
+	"desktop": `
+# Fonts and consistent GTK theme
+{ lib, pkgs, ... }:
+{
+  fonts.packages = with pkgs; [
+    dejavu_fonts
+    liberation_ttf
+    noto-fonts
+    noto-fonts-emoji
+  ];
+  fonts.fontconfig.defaultFonts.monospace = lib.mkDefault [ "DejaVu Sans Mono" ];
+  environment.systemPackages = with pkgs; [
+    adwaita-icon-theme
+    gnome-themes-extra
+  ];
+  environment.etc."xdg/gtk-3.0/settings.ini".text = lib.mkDefault ''
+    [Settings]
+    gtk-theme-name=Adwaita
+    gtk-icon-theme-name=Adwaita
+    gtk-font-name=DejaVu Sans 10
+  '';
+}
+`,
+	"devbox": `
+# Development tools, ssh-agent of the session unless "ssh_agent" is set
+{ lib, pkgs, ... }:
+{
+  environment.systemPackages = with pkgs; [
+    direnv
+    gcc
+    git
+    gnumake
+    openssh
+    tmux
+    vim
+  ];
+  programs.ssh.startAgent = lib.mkDefault true;
+  documentation.dev.enable = lib.mkDefault true;
+}
+`,
+	"media": `
+# Audio through SPICE (sound device is added by appvm) and players
+{ lib, pkgs, ... }:
+{
+  security.rtkit.enable = lib.mkDefault true;
+  services.pipewire = {
+    enable = lib.mkDefault true;
+    pulse.enable = lib.mkDefault true;
+  };
+  environment.systemPackages = with pkgs; [
+    ffmpeg
+    mpv
+    pavucontrol
+  ];
+}
+`,
+}
+
+func profilesDir() string {
+	return configDir + "nix/profiles/"
+}
+
+func writeProfiles() (err error) {
+	err = os.MkdirAll(profilesDir(), 0700)
+	if err != nil {
+		return
+	}
+	for name, profile := range builtinProfiles {
+		err = ioutil.WriteFile(profilesDir()+name+".nix",
+			[]byte(profile), 0644)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func checkProfile(profile string) (err error) {
+	if profile == "" || fileExists(profilesDir()+profile+".nix") {
+		return
+	}
+	return errors.New("no profile " + profile + ", available: " +
+		strings.Join(profileNames(), ", "))
+}
+
+func profileNames() (names []string) {
+	files, _ := ioutil.ReadDir(profilesDir())
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".nix") {
+			names = append(names, strings.TrimSuffix(f.Name(), ".nix"))
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+func profileModule(app appConfig) string {
+	if app.Profile == "" {
+		return ""
+	}
+	return "  imports = [ <nix/profiles/" + app.Profile + ".nix> ];\n"
+}
+
+var soundDevices = `
+    <sound model='ich9'/>
+`
+
+func profileDevices(app appConfig) string {
+	if app.Profile == "media" {
+		return soundDevices
+	}
+	return ""
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// Outbound proxy of the application: proxy variables are set for the
+// whole guest (networking.proxy). If enforced, the VM is on the libvirt
+// network and the nwfilter of its interface on the host drops direct
+// egress except of the proxy itself, DNS to the resolvers and DHCP, so
+// root in the guest can't bypass it. libvirt network: host is the
+// address of the network (192.168.122.1 for "default").
+
+type proxyConfig struct {
+	// e.g. http://10.0.2.2:3128
+	URL     string   `json:"url,omitempty"`
+	NoProxy []string `json:"no_proxy,omitempty"`
+	// Reject connections that bypass the proxy
+	Enforce bool `json:"enforce,omitempty"`
+}
+
+func proxyHostPort(p proxyConfig) (host, port string, err error) {
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return
+	}
+	if u.Host == "" {
+		err = errors.New("no host in proxy URL " + p.URL)
+		return
+	}
+
+	host, port = u.Hostname(), u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return
+}
+
+func checkProxy(p proxyConfig) (err error) {
+	if p.URL == "" {
+		return
+	}
+	_, _, err = proxyHostPort(p)
+	return
+}
+
+// Traffic of the VM allowed by the filter: DHCP, DNS to the resolvers,
+// the proxy and replies; DHCP requests are broadcast only and do not
+// leave the network
+var egressFilterTmpl = `
+<filter name='%s' chain='root'>
+  <rule action='accept' direction='out' priority='100'>
+    <udp srcportstart='68' dstportstart='67' dstipaddr='255.255.255.255'/>
+  </rule>
+  <rule action='accept' direction='in' priority='100'>
+    <udp srcportstart='67' dstportstart='68'/>
+  </rule>
+%s  <rule action='drop' direction='inout' priority='900'>
+    <all/>
+  </rule>
+  <rule action='drop' direction='inout' priority='900'>
+    <all-ipv6/>
+  </rule>
+</filter>
+`
+
+var egressRuleTmpl = `  <rule action='accept' direction='out' priority='500'>
+    <%s dstipaddr='%s' dstportstart='%s'/>
+  </rule>
+`
+
+func egressFilterName(name string) string {
+	return "appvm-egress-" + name
+}
+
+// Host side filter of the VM: enforced proxy, or DNS policy
+func egressFiltered(app appConfig) bool {
+	return app.Proxy.URL != "" && app.Proxy.Enforce ||
+		len(app.DNS.Servers) != 0 || app.DNS.DoH != ""
+}
+
+func egressRule(proto, ip, port string) string {
+	if net.ParseIP(ip).To4() == nil {
+		proto += "-ipv6"
+	}
+	return fmt.Sprintf(egressRuleTmpl, proto, xmlEscape(ip), port)
+}
+
+// Addresses of the host name, resolved on the host
+func lookupAddrs(host string) (addrs []string, err error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	ips, err := net.LookupIP(host)
+	for _, ip := range ips {
+		addrs = append(addrs, ip.String())
+	}
+	return
+}
+
+// router is the address of the host on the network, empty for the
+// network of a gateway VM
+func egressFilterXML(name string, app appConfig, router string) (
+	xml string, err error) {
+
+	if app.Proxy.URL == "" || !app.Proxy.Enforce {
+		return dnsFilterXML(name, app)
+	}
+
+	host, port, err := proxyHostPort(app.Proxy)
+	if err != nil {
+		return
+	}
+	proxies, err := lookupAddrs(host)
+	if err != nil {
+		return
+	}
+
+	resolvers := app.DNS.Servers
+	if len(resolvers) == 0 && router != "" {
+		resolvers = []string{router}
+	}
+	if len(resolvers) == 0 {
+		err = errors.New("proxy.enforce with netvm needs dns.servers")
+		return
+	}
+
+	rules := ""
+	if router != "" {
+		rules += egressRule("udp", router, "67")
+	}
+	dns, err := resolverRules(resolvers)
+	if err != nil {
+		return
+	}
+	rules += dns
+	for _, ip := range proxies {
+		rules += egressRule("tcp", ip, port)
+	}
+	xml = fmt.Sprintf(egressFilterTmpl, xmlEscape(egressFilterName(name)),
+		rules)
+	return
+}
+
+var networkAddrRe = regexp.MustCompile(`<ip [^>]*address='([^']+)'`)
+
+// IPv4 address of the host on the libvirt network, if any
+func networkAddress(l *libvirt.Libvirt, network string) string {
+	n, err := l.NetworkLookupByName(network)
+	if err != nil {
+		return ""
+	}
+	xml, err := l.NetworkGetXMLDesc(n, 0)
+	if err != nil {
+		return ""
+	}
+	for _, m := range networkAddrRe.FindAllStringSubmatch(xml, -1) {
+		if net.ParseIP(m[1]).To4() != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+// Defines the filter of the VM interface (see netFilterRef)
+func defineEgressFilter(l *libvirt.Libvirt, name string, app appConfig) (
+	err error) {
+
+	router := ""
+	if app.NetVM == "" {
+		router = networkAddress(l, hostNetwork())
+	}
+	xml, err := egressFilterXML(name, app, router)
+	if err != nil {
+		return
+	}
+	_, err = l.NwfilterDefineXML(xml)
+	return
+}
+
+// qemu networking can't be filtered on the host, so enforced proxy
+// and DNS policy need the libvirt network
+func prepareEgress(l *libvirt.Libvirt, name string, app appConfig,
+	network networkModel) (networkModel, error) {
+
+	if !egressFiltered(app) || network == networkOffline {
+		return network, nil
+	}
+	if network == networkQemu {
+		log.Println("Egress filter of", name, "uses libvirt networking")
+		network = networkLibvirt
+	}
+	return network, defineEgressFilter(l, name, app)
+}
+
+// Inside of <interface>
+func netFilterRef(name string, app appConfig) string {
+	if !egressFiltered(app) {
+		return ""
+	}
+	return "\n      <filterref filter='" +
+		xmlEscape(egressFilterName(name)) + "'/>"
+}
+
+func proxyModule(app appConfig) (module string) {
+	p := app.Proxy
+	if p.URL == "" {
+		return
+	}
+
+	noProxy := append([]string{"127.0.0.1", "localhost"}, p.NoProxy...)
+	module = "  networking.proxy.default = " + nixString(p.URL) + ";\n" +
+		"  networking.proxy.noProxy = " +
+		nixString(strings.Join(noProxy, ",")) + ";\n"
+	return
+}
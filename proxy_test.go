@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEgressRule(t *testing.T) {
+	tests := []struct {
+		proto, ip, port, want string
+	}{
+		{"tcp", "10.0.2.2", "3128",
+			"<tcp dstipaddr='10.0.2.2' dstportstart='3128'/>"},
+		{"udp", "192.168.122.1", "67",
+			"<udp dstipaddr='192.168.122.1' dstportstart='67'/>"},
+		{"tcp", "fd00::1", "3128",
+			"<tcp-ipv6 dstipaddr='fd00::1' dstportstart='3128'/>"},
+	}
+
+	for _, tt := range tests {
+		got := egressRule(tt.proto, tt.ip, tt.port)
+		if !strings.Contains(got, tt.want) ||
+			!strings.Contains(got, "action='accept' direction='out'") {
+
+			t.Errorf("egressRule(%q, %q, %q) = %q, want %q", tt.proto,
+				tt.ip, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestEgressFilterXML(t *testing.T) {
+	tests := []struct {
+		app     appConfig
+		router  string
+		allowed []string
+		valid   bool
+	}{
+		// libvirt network, the host resolves and leases addresses
+		{appConfig{Proxy: proxyConfig{URL: "http://10.0.2.2:3128",
+			Enforce: true}}, "192.168.122.1", []string{
+			"<udp dstipaddr='192.168.122.1' dstportstart='67'/>",
+			"<udp dstipaddr='192.168.122.1' dstportstart='53'/>",
+			"<tcp dstipaddr='192.168.122.1' dstportstart='53'/>",
+			"<tcp dstipaddr='10.0.2.2' dstportstart='3128'/>"}, true},
+		// Default port of the scheme, own resolver
+		{appConfig{Proxy: proxyConfig{URL: "https://10.0.0.1",
+			Enforce: true}, DNS: dnsConfig{Servers: []string{"9.9.9.9"}}},
+			"192.168.122.1", []string{
+				"<udp dstipaddr='192.168.122.1' dstportstart='67'/>",
+				"<udp dstipaddr='9.9.9.9' dstportstart='53'/>",
+				"<tcp dstipaddr='9.9.9.9' dstportstart='53'/>",
+				"<tcp dstipaddr='10.0.0.1' dstportstart='443'/>"}, true},
+		// Network of a gateway VM has no router to resolve with
+		{appConfig{Proxy: proxyConfig{URL: "http://10.0.2.2:3128",
+			Enforce: true}}, "", nil, false},
+		{appConfig{Proxy: proxyConfig{URL: "http://10.0.2.2:3128",
+			Enforce: true}, DNS: dnsConfig{Servers: []string{"9.9.9.9"}}},
+			"", []string{
+				"<udp dstipaddr='9.9.9.9' dstportstart='53'/>",
+				"<tcp dstipaddr='9.9.9.9' dstportstart='53'/>",
+				"<tcp dstipaddr='10.0.2.2' dstportstart='3128'/>"}, true},
+		{appConfig{Proxy: proxyConfig{URL: "10.0.2.2:3128",
+			Enforce: true}}, "192.168.122.1", nil, false},
+	}
+
+	for _, tt := range tests {
+		xml, err := egressFilterXML("test", tt.app, tt.router)
+		if !tt.valid {
+			if err == nil {
+				t.Errorf("%+v: accepted, want error", tt.app.Proxy)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: %v", tt.app.Proxy, err)
+			continue
+		}
+
+		// DHCP broadcast is in the template, accepted rules are given
+		if got := strings.Count(xml, "action='accept' direction='out' "+
+			"priority='500'"); got != len(tt.allowed) {
+
+			t.Errorf("%+v: %d accept rules, want %d in %s", tt.app.Proxy,
+				got, len(tt.allowed), xml)
+		}
+		for _, rule := range tt.allowed {
+			if !strings.Contains(xml, rule) {
+				t.Errorf("%+v: no %s in %s", tt.app.Proxy, rule, xml)
+			}
+		}
+		if !strings.Contains(xml, "<all/>") ||
+			!strings.Contains(xml, "<all-ipv6/>") {
+
+			t.Errorf("%+v: the rest is not dropped in %s", tt.app.Proxy,
+				xml)
+		}
+	}
+}
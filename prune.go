@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// appvm prune finds what is left after crashes and manual changes:
+// domains of applications without expression and config, data
+// directories without expression, stale files (see staleFiles),
+// viewers of stopped VMs and GC roots of removed applications.
+
+// Orphans without Remove are only reported
+type orphan struct {
+	Kind   string
+	Name   string
+	Remove func() error
+}
+
+func orphanDomains(l *libvirt.Libvirt) (orphans []orphan) {
+	domains, err := l.Domains()
+	if err != nil {
+		fatal(err)
+	}
+
+	for _, d := range domains {
+		d := d
+		if !strings.HasPrefix(d.Name, "appvm_") || !isOwned(l, d) ||
+			appExists(appNameFromDomain(d.Name)) {
+			continue
+		}
+		// Running VM may be still in use, it is left for the user
+		if state, _, err := l.DomainGetState(d, 0); err == nil &&
+			libvirt.DomainState(state) != libvirt.DomainShutoff {
+
+			orphans = append(orphans, orphan{"domain",
+				d.Name + " (running, stop it to prune)", nil})
+			continue
+		}
+		orphans = append(orphans, orphan{"domain", d.Name, func() error {
+			return l.DomainUndefine(d)
+		}})
+	}
+	return
+}
+
+func orphanDataDirs(l *libvirt.Libvirt) (orphans []orphan) {
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+
+	dirs, _ := ioutil.ReadDir(appvmHomesDir)
+	for _, f := range dirs {
+		name := f.Name()
+		if !f.IsDir() || strings.HasPrefix(name, ".") ||
+			strings.HasPrefix(name, "tmp_") ||
+			config.app(name).Type == "image" {
+			continue
+		}
+		if _, ok := findAppExpr(name); ok {
+			continue
+		}
+		orphans = append(orphans, orphan{"data", appvmHomesDir + name,
+			func() error { return drop(l, name, true) }})
+	}
+	return
+}
+
+// appvm viewer and virt-viewer processes of VMs that are not running
+func orphanViewers(l *libvirt.Libvirt) (orphans []orphan) {
+	running := runningApps(l)
+
+	procs, _ := filepath.Glob("/proc/[0-9]*/cmdline")
+	for _, p := range procs {
+		raw, err := ioutil.ReadFile(p)
+		if err != nil || len(raw) == 0 {
+			continue
+		}
+		args := strings.Split(strings.TrimRight(string(raw), "\x00"), "\x00")
+
+		viewer := filepath.Base(args[0]) == "virt-viewer" ||
+			len(args) == 3 && args[1] == "viewer"
+		vmName := args[len(args)-1]
+		if !viewer || !strings.HasPrefix(vmName, "appvm_") ||
+			running[vmName] {
+			continue
+		}
+
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(p)))
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		orphans = append(orphans, orphan{"viewer",
+			fmt.Sprintf("%d %s", pid, strings.Join(args, " ")),
+			func() error { return syscall.Kill(pid, syscall.SIGTERM) }})
+	}
+	return
+}
+
+func orphans(l *libvirt.Libvirt) (all []orphan) {
+	all = append(all, orphanDomains(l)...)
+	all = append(all, orphanDataDirs(l)...)
+	for _, f := range staleFiles(l) {
+		f := f
+		all = append(all, orphan{"file", f,
+			func() error { return os.RemoveAll(f) }})
+	}
+	all = append(all, orphanViewers(l)...)
+	all = append(all, orphanGCRoots()...)
+	return
+}
+
+func prune(l *libvirt.Libvirt, dryRun, yes bool) (err error) {
+	found := orphans(l)
+	if len(found) == 0 {
+		fmt.Println("Nothing to prune")
+		return
+	}
+
+	removable := 0
+	for _, o := range found {
+		fmt.Printf("\t%-7s %s\n", o.Kind, o.Name)
+		if o.Remove != nil {
+			removable++
+		}
+	}
+
+	if dryRun || removable == 0 {
+		return
+	}
+	if !yes && !confirm(fmt.Sprintf("Remove %d items?", removable)) {
+		return
+	}
+
+	for _, o := range found {
+		if o.Remove == nil {
+			continue
+		}
+		err = o.Remove()
+		if err != nil {
+			log.Println("Can't remove", o.Name, err)
+		}
+	}
+	return nil
+}
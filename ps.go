@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/olekukonko/tablewriter"
+)
+
+// Processes inside of the VM, listed and signalled through the guest
+// agent.
+
+const guestBin = "/run/current-system/sw/bin/"
+
+func runningDomain(l *libvirt.Libvirt, name string) (dom libvirt.Domain,
+	err error) {
+
+	dom, err = lookupOwned(l, "appvm_"+name)
+	if err != nil && libvirt.IsNotFound(err) {
+		err = errors.New(name + " is not running")
+	}
+	return
+}
+
+func guestPs(l *libvirt.Libvirt, name string) (err error) {
+	dom, err := runningDomain(l, name)
+	if err != nil {
+		return
+	}
+
+	result, err := guestExec(l, dom, guestBin+"ps", "-eo",
+		"pid,user,pcpu,pmem,rss,comm", "--sort=-pcpu", "--no-headers")
+	if err != nil {
+		return
+	}
+	if result.ExitCode != 0 {
+		return errors.New("ps: " + strings.TrimSpace(result.Stderr))
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"PID", "User", "CPU %", "Memory %", "RSS", "Command"})
+	for _, line := range strings.Split(result.Stdout, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 6 {
+			continue
+		}
+
+		rss := fields[4]
+		if kib, err := strconv.ParseInt(rss, 10, 64); err == nil {
+			rss = humanSize(kib * 1024)
+		}
+		table.Append([]string{fields[0], fields[1], fields[2], fields[3],
+			rss, strings.Join(fields[5:], " ")})
+	}
+	table.Render()
+	return
+}
+
+// Target is PID or exact process name
+func guestKill(l *libvirt.Libvirt, name, target, signal string) (err error) {
+	dom, err := runningDomain(l, name)
+	if err != nil {
+		return
+	}
+
+	var result guestExecResult
+	if _, e := strconv.Atoi(target); e == nil {
+		result, err = guestExec(l, dom, guestBin+"kill", "-s", signal, target)
+	} else {
+		result, err = guestExec(l, dom, guestBin+"pkill",
+			"--signal", signal, "-x", target)
+	}
+	if err != nil {
+		return
+	}
+	if result.ExitCode != 0 {
+		err = errors.New("no process " + target)
+		if msg := strings.TrimSpace(result.Stderr); msg != "" {
+			err = errors.New(msg)
+		}
+	}
+	return
+}
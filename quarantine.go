@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+var quarantineDir = appvmHomesDir + ".quarantine/"
+
+var quarantineViewers = map[string]string{
+	".pdf":  "evince",
+	".djvu": "evince",
+	".epub": "evince",
+	".doc":  "libreoffice",
+	".docx": "libreoffice",
+	".odt":  "libreoffice",
+	".xls":  "libreoffice",
+	".xlsx": "libreoffice",
+	".ods":  "libreoffice",
+	".ppt":  "libreoffice",
+	".pptx": "libreoffice",
+	".odp":  "libreoffice",
+	".png":  "feh",
+	".jpg":  "feh",
+	".jpeg": "feh",
+	".gif":  "feh",
+	".svg":  "feh",
+}
+
+func quarantineViewer(file string) (viewer string, err error) {
+	ext := strings.ToLower(filepath.Ext(file))
+	viewer, ok := quarantineViewers[ext]
+	if !ok {
+		err = errors.New("no viewer known for " + ext + ", use --app")
+	}
+	return
+}
+
+func dirFiles(dir string) (names map[string]bool) {
+	names = make(map[string]bool)
+	files, _ := ioutil.ReadDir(dir)
+	for _, f := range filterDotfiles(files) {
+		if !f.IsDir() {
+			names[f.Name()] = true
+		}
+	}
+	return
+}
+
+// Moves file out of home to the quarantine directory, opens it in the
+// disposable offline VM and, after VM is stopped, offers to export
+// files created inside of the VM (e.g. printed to PDF) back to the
+// directory of original file.
+func quarantine(l *libvirt.Libvirt, file, viewer string) (err error) {
+	file, err = filepath.Abs(file)
+	if err != nil {
+		return
+	}
+
+	if viewer == "" {
+		viewer, err = quarantineViewer(file)
+		if err != nil {
+			return
+		}
+	}
+
+	err = os.MkdirAll(quarantineDir, 0700)
+	if err != nil {
+		return
+	}
+
+	quarantined := quarantineDir + filepath.Base(file)
+	err = os.Rename(file, quarantined)
+	if err != nil {
+		return
+	}
+	log.Println("Moved", file, "to", quarantined)
+
+	vmName, sharedDir := start(l, viewer, true, networkOffline, true,
+		true, "", quarantined)
+	if vmName == "" {
+		err = errors.New("can't start " + viewer)
+		return
+	}
+
+	before := dirFiles(sharedDir)
+
+	log.Println("Waiting for", viewer, "to be closed")
+	for isRunning(l, strings.TrimPrefix(vmName, "appvm_")) {
+		time.Sleep(time.Second)
+	}
+
+	for name := range dirFiles(sharedDir) {
+		if before[name] {
+			continue
+		}
+
+		to := filepath.Join(filepath.Dir(file), name)
+		if fileExists(to) {
+			to = filepath.Join(filepath.Dir(file), "sanitized-"+name)
+		}
+
+		if !confirm("Export " + name + " to " + to + "?") {
+			continue
+		}
+
+		var data []byte
+		data, err = ioutil.ReadFile(filepath.Join(sharedDir, name))
+		if err != nil {
+			return
+		}
+
+		err = importFile(data, to)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		log.Println("Exported", to)
+	}
+
+	os.RemoveAll(sharedDir)
+	return
+}
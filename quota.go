@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Size limit of the data directory: btrfs qgroup of the subvolume,
+// quota of the ZFS dataset or XFS project quota. Writes beyond the
+// limit fail with EDQUOT in the guest. Limits usually need root, so
+// failure to apply is reported, but does not prevent start.
+
+const xfsMagic = 0x58465342
+
+// 512M, 10G, 1.5T (binary units)
+func parseSize(s string) (size int64, err error) {
+	s = strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "B"), "I")
+	mult := int64(1)
+	if i := strings.IndexAny(s, "KMGT"); i == len(s)-1 && i > 0 {
+		mult = int64(1) << (10 * uint(strings.IndexByte("KMGT", s[i])+1))
+		s = s[:i]
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f <= 0 {
+		return 0, errors.New("invalid size " + s)
+	}
+	return int64(f * float64(mult)), nil
+}
+
+// Longest mount point containing the path
+func mountPoint(path string) (mount string) {
+	raw, _ := ioutil.ReadFile("/proc/mounts")
+	for _, line := range strings.Split(string(raw), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 2 {
+			continue
+		}
+		if (path == f[1] || strings.HasPrefix(path, strings.TrimSuffix(f[1], "/")+"/")) &&
+			len(f[1]) > len(mount) {
+			mount = f[1]
+		}
+	}
+	return
+}
+
+// Stable project ID of the application
+func xfsProject(name string) uint32 {
+	return 1<<20 | crc32.ChecksumIEEE([]byte(name))&0xfffff
+}
+
+func applyQuota(name string, quota string) (err error) {
+	size, err := parseSize(quota)
+	if err != nil {
+		return
+	}
+
+	path := appvmHomesDir + name
+	switch fsType(path) {
+	case "btrfs":
+		_, err = run("btrfs", "qgroup", "limit", fmt.Sprint(size), path)
+	case "zfs":
+		var dataset string
+		dataset, err = zfsDataset(path)
+		if err == nil {
+			_, err = run("zfs", "set", fmt.Sprintf("quota=%d", size), dataset)
+		}
+	case "xfs":
+		id := xfsProject(name)
+		_, err = run("xfs_quota", "-x",
+			"-c", fmt.Sprintf("project -s -p %s %d", path, id),
+			"-c", fmt.Sprintf("limit -p bhard=%d %d", size, id),
+			mountPoint(path))
+	default:
+		err = errors.New("quota needs btrfs, ZFS or XFS")
+	}
+	return
+}
+
+// "1.2 GiB of 10G" for applications with quota
+func quotaUsage(name string, app appConfig) string {
+	if app.Quota == "" {
+		return ""
+	}
+	return humanSize(pathSize(appvmHomesDir+name)) + " of " + app.Quota
+}
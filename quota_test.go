@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in    string
+		want  int64
+		valid bool
+	}{
+		{"512M", 512 << 20, true},
+		{"10G", 10 << 30, true},
+		{"1.5T", 3 << 39, true},
+		{"10KB", 10 << 10, true},
+		{"10KiB", 10 << 10, true},
+		{"2g", 2 << 30, true},
+		{"4096", 4096, true},
+		{"0", 0, false},
+		{"-1G", 0, false},
+		{"G", 0, false},
+		{"", 0, false},
+		{"10X", 0, false},
+		{"1G2", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, err := parseSize(tt.in)
+		if tt.valid && (err != nil || got != tt.want) {
+			t.Errorf("parseSize(%q) = %d, %v, want %d", tt.in, got, err,
+				tt.want)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("parseSize(%q) = %d, want error", tt.in, got)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Metadata of the application is <name>.json next to <name>.nix in
+// the same layer (repos: downloaded with the expression). Policy holds
+// config.json settings used while the application has no entry in
+// config.json; the first change of settings starts from them. Policy
+// may only set how the guest runs (policyKeys): nothing that runs on
+// the host or gives host files and devices to the guest. Metadata of
+// repos is pinned like the expression.
+//
+//	{ "description": "Web browser", "category": "Network",
+//	  "icon": "chromium.png", "homepage": "https://www.chromium.org",
+//	  "policy": { "memory": 2048 } }
+
+type appMeta struct {
+	Description string `json:"description,omitempty"`
+	// freedesktop.org main category, e.g. Network, Office, Graphics
+	Category string `json:"category,omitempty"`
+	// Icon name of the theme or file relative to the expression
+	Icon     string          `json:"icon,omitempty"`
+	Homepage string          `json:"homepage,omitempty"`
+	Policy   json.RawMessage `json:"policy,omitempty"`
+}
+
+var policyKeys = map[string]bool{
+	"memory": true, "vcpus": true, "profile": true, "clipboard": true,
+	"viewer": true, "displays": true, "balloon": true, "hardening": true,
+	"protected": true, "no_share_pages": true, "on_viewer_exit": true,
+}
+
+func checkPolicy(raw json.RawMessage) (err error) {
+	var settings map[string]json.RawMessage
+	err = json.Unmarshal(raw, &settings)
+	if err != nil {
+		return
+	}
+	var denied []string
+	for key := range settings {
+		if !policyKeys[key] {
+			denied = append(denied, key)
+		}
+	}
+	if len(denied) != 0 {
+		sort.Strings(denied)
+		err = errors.New(strings.Join(denied, ", ") +
+			" can not be set by policy")
+	}
+	return
+}
+
+func metaPath(e appExpr) string {
+	return strings.TrimSuffix(e.Path, ".nix") + ".json"
+}
+
+// As findAppExpr, but without downloads from repos
+func cachedAppExpr(name string) (e appExpr, ok bool) {
+	config, _ := loadConfig()
+	if expr := config.Apps[name].Expr; expr != "" {
+		name = expr
+	}
+
+	for _, layer := range configLayers() {
+		e = appExpr{Name: name, Layer: layer,
+			Path: filepath.Join(layer.Dir, name+".nix")}
+		if layer.URL != "" {
+			e.URL = layer.URL + "/" + name + ".nix"
+		}
+		if fileExists(e.Path) {
+			return e, true
+		}
+	}
+	return
+}
+
+// Metadata of the expression used for the application, if any
+func loadMeta(name string) (m appMeta, ok bool) {
+	e, found := cachedAppExpr(name)
+	if !found {
+		return
+	}
+	if e.URL != "" && fileExists(metaPath(e)) {
+		err := checkPinned(e.Layer.URL, metaURL(e), metaPath(e))
+		if err != nil {
+			log.Println(err)
+			return
+		}
+	}
+	raw, err := ioutil.ReadFile(metaPath(e))
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(raw, &m)
+	if err != nil {
+		log.Printf("%s: %v", metaPath(e), err)
+		return
+	}
+
+	if m.Icon != "" && strings.ContainsRune(m.Icon, '.') &&
+		!filepath.IsAbs(m.Icon) {
+		m.Icon = filepath.Join(filepath.Dir(e.Path), m.Icon)
+	}
+	return m, true
+}
+
+func metaURL(e appExpr) string {
+	return strings.TrimSuffix(e.URL, ".nix") + ".json"
+}
+
+// Not found is not an error, metadata is optional
+func fetchMeta(e appExpr) {
+	err := fetchPinned(e.Layer.URL, metaURL(e), metaPath(e))
+	if err != nil && !isNotFound(err) {
+		log.Println(err)
+	}
+}
+
+func defaultAppConfig(name string) (app appConfig) {
+	m, ok := loadMeta(name)
+	if !ok || len(m.Policy) == 0 {
+		return
+	}
+	err := checkPolicy(m.Policy)
+	if err == nil {
+		err = json.Unmarshal(m.Policy, &app)
+	}
+	if err != nil {
+		log.Printf("policy of %s: %v", name, err)
+		app = appConfig{}
+	}
+	return
+}
+
+func metaCategory(m appMeta) string {
+	if m.Category == "" {
+		return "Other"
+	}
+	return m.Category
+}
+
+// All applications with expressions, by category
+func catalog(category, query string) (err error) {
+	byCategory := make(map[string][]string)
+	metas := make(map[string]appMeta)
+	for _, name := range exprNames() {
+		m, _ := loadMeta(name)
+		if category != "" && !strings.EqualFold(metaCategory(m), category) {
+			continue
+		}
+		if query != "" && !metaMatches(name, m, query) {
+			continue
+		}
+		metas[name] = m
+		c := metaCategory(m)
+		byCategory[c] = append(byCategory[c], name)
+	}
+
+	var categories []string
+	for c := range byCategory {
+		categories = append(categories, c)
+	}
+	sort.Strings(categories)
+
+	for _, c := range categories {
+		fmt.Println(c + ":")
+		names := byCategory[c]
+		sort.Strings(names)
+		for _, name := range names {
+			m := metas[name]
+			fmt.Printf("\t%-16s %s\n", name, m.Description)
+			if m.Homepage != "" {
+				fmt.Printf("\t%-16s %s\n", "", m.Homepage)
+			}
+		}
+	}
+	return
+}
+
+func metaMatches(name string, m appMeta, query string) bool {
+	query = strings.ToLower(query)
+	for _, s := range []string{name, m.Description, m.Category} {
+		if strings.Contains(strings.ToLower(s), query) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// appvm rename moves everything that belongs to the application: data,
+// snapshots, logs, state files, config.json entry, own expression and
+// desktop handler. Expression from other layers is copied to
+// ~/.config/appvm/nix under the new name.
+
+const renameStopTimeout = time.Minute
+
+// Files and directories of the application in ~/appvm, paths of
+// different names are in the same order
+func appStatePaths(name string) []string {
+	return []string{
+		appvmHomesDir + name,
+		snapshotsDir(name),
+		buildLogDir(name),
+		appimageDir(name),
+		overlayPath(name),
+		systemLink(name),
+		gcRootPath(name),
+		generationsDir(name),
+		statsPath(name),
+		startArgsPath(name),
+		stoppedMarkPath(name),
+		exitStatusPath(name),
+		startLogPath(name),
+		healthPath(name),
+	}
+}
+
+func appExists(name string) bool {
+	config, err := loadConfig()
+	if err == nil {
+		if _, ok := config.Apps[name]; ok {
+			return true
+		}
+	}
+	if _, ok := findAppExpr(name); ok {
+		return true
+	}
+	return isDirExists(appvmHomesDir + name)
+}
+
+func waitStopped(l *libvirt.Libvirt, name string, timeout time.Duration) error {
+	for start := time.Now(); time.Since(start) < timeout; {
+		if !isRunning(l, name) {
+			return nil
+		}
+		time.Sleep(time.Second)
+	}
+	return withCategory("timeout",
+		errors.New(name+" is not stopped in "+timeout.String()))
+}
+
+// Undo reverts the rename if a later step fails
+func renameExpr(from, to string) (undo func(), err error) {
+	undo = func() {}
+	e, ok := findAppExpr(from)
+	if !ok {
+		return
+	}
+
+	err = os.MkdirAll(configDir+"nix", 0700)
+	if err != nil {
+		return
+	}
+
+	dst := configDir + "nix/" + to + ".nix"
+	if e.Layer.Name == "user" {
+		err = os.Rename(e.Path, dst)
+		undo = func() { os.Rename(dst, e.Path) }
+		return
+	}
+	err = copyFile(e.Path, dst)
+	undo = func() { os.Remove(dst) }
+	return
+}
+
+func renameConfig(from, to string) (undo func(), err error) {
+	undo = func() {}
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+	app, ok := config.Apps[from]
+	if !ok {
+		return
+	}
+
+	delete(config.Apps, from)
+	config.setApp(to, app)
+	err = saveConfig(config)
+	if err != nil {
+		return
+	}
+	undo = func() {
+		config, err := loadConfig()
+		if err != nil {
+			log.Println("Can't restore config of", from, err)
+			return
+		}
+		delete(config.Apps, to)
+		config.setApp(from, app)
+		saveConfig(config)
+	}
+	return
+}
+
+// Moved paths are moved back on error
+func renameState(from, to string) (err error) {
+	oldPaths, newPaths := appStatePaths(from), appStatePaths(to)
+	var moved []int
+	for i, path := range oldPaths {
+		if _, e := os.Lstat(path); e != nil {
+			continue
+		}
+		err = os.Rename(path, newPaths[i])
+		if err != nil {
+			for j := len(moved) - 1; j >= 0; j-- {
+				os.Rename(newPaths[moved[j]], oldPaths[moved[j]])
+			}
+			return
+		}
+		moved = append(moved, i)
+	}
+	return
+}
+
+func renameHandler(from, to string) (err error) {
+	raw, err := ioutil.ReadFile(handlerDesktopFile(from))
+	if err != nil {
+		return nil // no handler
+	}
+
+	var mimes []string
+	for _, line := range strings.Split(string(raw), "\n") {
+		if strings.HasPrefix(line, "MimeType=") {
+			mimes = strings.Split(strings.Trim(line[9:], ";"), ";")
+		}
+	}
+
+	err = handlerUnregister(from)
+	if err != nil {
+		return
+	}
+	return handlerRegister(to, mimes)
+}
+
+func renameStartArgs(from, to string) {
+	raw, err := ioutil.ReadFile(startArgsPath(to))
+	if err != nil {
+		return
+	}
+
+	var args []string
+	if json.Unmarshal(raw, &args) != nil {
+		return
+	}
+	for i := range args {
+		if args[i] == from {
+			args[i] = to
+		}
+	}
+	raw, _ = json.Marshal(args)
+	ioutil.WriteFile(startArgsPath(to), raw, 0600)
+}
+
+func rename(l *libvirt.Libvirt, from, to string, restart bool) (err error) {
+	if !appExists(from) {
+		return errors.New("no application " + from)
+	}
+	if appExists(to) {
+		return errors.New(to + " already exists")
+	}
+
+	running := isRunning(l, from)
+	if running {
+		if !restart {
+			return errors.New(from + " is running, stop it or use --restart")
+		}
+		stop(l, from)
+		err = waitStopped(l, from, renameStopTimeout)
+		if err != nil {
+			return
+		}
+	}
+
+	// Expression and config first, data is moved last as the step
+	// most likely to fail on a busy file
+	undoExpr, err := renameExpr(from, to)
+	if err != nil {
+		undoExpr()
+		return
+	}
+	undoConfig, err := renameConfig(from, to)
+	if err != nil {
+		undoExpr()
+		return
+	}
+	err = renameState(from, to)
+	if err != nil {
+		undoConfig()
+		undoExpr()
+		return
+	}
+	renameStartArgs(from, to)
+	reregisterGCRoot(to)
+
+	err = renameHandler(from, to)
+	if err != nil {
+		log.Println("Can't move desktop handler:", err)
+	}
+
+	log.Println("Renamed", from, "to", to)
+
+	if running {
+		self, err := os.Executable()
+		if err != nil {
+			self = os.Args[0]
+		}
+		command := exec.Command(self, "start", to)
+		command.Stdout = os.Stdout
+		command.Stderr = os.Stderr
+		return command.Run()
+	}
+	return
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// vCPUs and memory of apps without explicit settings are sized from
+// the host: min(4, ncpu/2) vCPUs and quarter of MemTotal (2-8 GiB),
+// half of it is available at start and the rest is left to the
+// balloon. Up to the host CPU count vCPUs can be hotplugged and
+// memory is ballooned up to the maximum by appvm set.
+
+const (
+	vcpusMax      = 4
+	memoryFloor   = 2048 // MiB
+	memoryCeil    = 8192 // MiB
+	memoryBootMin = 1024 // MiB
+	memorySetMin  = 256  // MiB
+)
+
+type vmResources struct {
+	VCPUs int
+	// Hotplug limit
+	VCPUsMax int
+	// MiB
+	Memory        uint64
+	CurrentMemory uint64
+}
+
+func (r vmResources) String() string {
+	return fmt.Sprintf("%d vCPUs, %d MiB (%d MiB at start)",
+		r.VCPUs, r.Memory, r.CurrentMemory)
+}
+
+// MemTotal from /proc/meminfo in MiB, 0 if unknown
+func hostMemTotal() (mib uint64) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kib, _ := strconv.ParseUint(fields[1], 10, 64)
+			return kib / 1024
+		}
+	}
+	return
+}
+
+func appResources(app appConfig) (r vmResources) {
+	r.VCPUs = app.VCPUs
+	if r.VCPUs == 0 {
+		r.VCPUs = runtime.NumCPU() / 2
+		if r.VCPUs > vcpusMax {
+			r.VCPUs = vcpusMax
+		}
+		if r.VCPUs < 1 {
+			r.VCPUs = 1
+		}
+	}
+
+	r.VCPUsMax = runtime.NumCPU()
+	if r.VCPUsMax < r.VCPUs {
+		r.VCPUsMax = r.VCPUs
+	}
+
+	r.Memory = app.Memory
+	if r.Memory == 0 {
+		r.Memory = hostMemTotal() / 4
+		if r.Memory < memoryFloor {
+			r.Memory = memoryFloor
+		}
+		if r.Memory > memoryCeil {
+			r.Memory = memoryCeil
+		}
+	}
+
+	r.CurrentMemory = r.Memory / 2
+	if r.CurrentMemory < memoryBootMin {
+		r.CurrentMemory = memoryBootMin
+	}
+	if r.CurrentMemory > r.Memory {
+		r.CurrentMemory = r.Memory
+	}
+
+	// Guests of image VMs may have no balloon driver
+	if app.Type == "image" {
+		r.CurrentMemory = r.Memory
+	}
+	return
+}
+
+// Saves memory (e.g. 6G) and vCPUs of the application for the next
+// start and applies them to the running VM as far as its maximums allow
+func setResources(l *libvirt.Libvirt, name, memory string, vcpus int) (err error) {
+	if memory == "" && vcpus == 0 {
+		return withCategory("usage",
+			errors.New("nothing to set, use --memory or --vcpus"))
+	}
+
+	var mib uint64
+	if memory != "" {
+		size, err := parseSize(memory)
+		if err != nil {
+			return withCategory("usage", err)
+		}
+		mib = uint64(size >> 20)
+		if mib < memorySetMin {
+			return withCategory("usage", fmt.Errorf("memory must be "+
+				"at least %d MiB", memorySetMin))
+		}
+	}
+	if vcpus < 0 || vcpus > runtime.NumCPU() {
+		return withCategory("usage", fmt.Errorf("vcpus must be "+
+			"from 1 to %d (host CPUs)", runtime.NumCPU()))
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+	app := config.app(name)
+	if mib != 0 {
+		app.Memory = mib
+	}
+	if vcpus != 0 {
+		app.VCPUs = vcpus
+	}
+	config.setApp(name, app)
+	err = saveConfig(config)
+	if err != nil {
+		return
+	}
+	fmt.Println("Saved for next start:", appResources(app))
+
+	dom, err := lookupOwned(l, "appvm_"+name)
+	if err != nil {
+		if libvirt.IsNotFound(err) {
+			return nil
+		}
+		return
+	}
+
+	if vcpus != 0 {
+		max, err := l.DomainGetVcpusFlags(dom,
+			uint32(libvirt.DomainVCPULive|libvirt.DomainVCPUMaximum))
+		if err != nil {
+			return err
+		}
+		if vcpus > int(max) {
+			log.Printf("%s is started with at most %d vCPUs, "+
+				"%d vCPUs are applied on next start", name, max, vcpus)
+		} else {
+			err = l.DomainSetVcpusFlags(dom, uint32(vcpus),
+				uint32(libvirt.DomainVCPULive))
+			if err != nil {
+				return fmt.Errorf("vCPU hotplug: %v", err)
+			}
+			fmt.Println("vCPUs:", vcpus)
+		}
+	}
+
+	if mib != 0 {
+		max, err := l.DomainGetMaxMemory(dom)
+		if err != nil {
+			return err
+		}
+		kib := mib * 1024
+		if kib > max {
+			log.Printf("%s is started with at most %d MiB, "+
+				"%d MiB are applied on next start", name, max/1024, mib)
+			kib = max
+		}
+		err = l.DomainSetMemoryFlags(dom, kib, uint32(libvirt.DomainMemLive))
+		if err != nil {
+			return fmt.Errorf("balloon: %v", err)
+		}
+		fmt.Println("Memory:", kib/1024, "MiB")
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// Restart policy of application VMs, applied by appvm daemon:
+// "never" (default), "on-failure" or "always". VMs stopped with
+// appvm stop are never restarted.
+
+const (
+	restartBackoffMin   = time.Second
+	restartBackoffMax   = 5 * time.Minute
+	restartBackoffReset = 10 * time.Minute
+)
+
+// Last exit of the application VM
+type exitStatus struct {
+	Time     int64  `json:"time"`
+	Reason   string `json:"reason"`
+	Failure  bool   `json:"failure"`
+	Restarts int    `json:"restarts"`
+}
+
+func startArgsPath(id string) string {
+	return appvmHomesDir + "." + id + ".start"
+}
+
+func stoppedMarkPath(id string) string {
+	return appvmHomesDir + "." + id + ".stopped"
+}
+
+func exitStatusPath(id string) string {
+	return appvmHomesDir + "." + id + ".exit"
+}
+
+// Arguments of appvm start are saved to restart VM in the same way
+func saveStartArgs(id string, args []string) {
+	raw, _ := json.Marshal(args)
+	ioutil.WriteFile(startArgsPath(id), raw, 0600)
+	os.Remove(stoppedMarkPath(id))
+}
+
+func loadExitStatus(id string) (s exitStatus, err error) {
+	raw, err := ioutil.ReadFile(exitStatusPath(id))
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(raw, &s)
+	return
+}
+
+func saveExitStatus(id string, s exitStatus) {
+	raw, _ := json.Marshal(s)
+	ioutil.WriteFile(exitStatusPath(id), raw, 0600)
+}
+
+func stopReason(detail int32) (reason string, failure bool) {
+	switch libvirt.DomainEventStoppedDetailType(detail) {
+	case libvirt.DomainEventStoppedShutdown:
+		return "shutdown", false
+	case libvirt.DomainEventStoppedDestroyed:
+		return "destroyed", false
+	case libvirt.DomainEventStoppedCrashed:
+		return "crashed", true
+	case libvirt.DomainEventStoppedFailed:
+		return "emulator failed", true
+	}
+	return fmt.Sprintf("stopped (%d)", detail), false
+}
+
+func restartBackoff(restarts int) (d time.Duration) {
+	d = restartBackoffMin
+	for i := 0; i < restarts && d < restartBackoffMax; i++ {
+		d *= 2
+	}
+	if d > restartBackoffMax {
+		d = restartBackoffMax
+	}
+	return
+}
+
+func restartApp(id string, delay time.Duration) {
+	raw, err := ioutil.ReadFile(startArgsPath(id))
+	if err != nil {
+		log.Println("Can't restart", id, err)
+		return
+	}
+
+	var args []string
+	err = json.Unmarshal(raw, &args)
+	if err != nil {
+		log.Println("Can't restart", id, err)
+		return
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		self = os.Args[0]
+	}
+
+	log.Println("Restart", id, "in", delay)
+	time.Sleep(delay)
+
+	if fileExists(stoppedMarkPath(id)) {
+		return
+	}
+
+	out, err := exec.Command(self, args...).CombinedOutput()
+	if err != nil {
+		log.Println("Can't restart", id, err, string(out))
+	}
+}
+
+func handleStop(e libvirt.DomainEventLifecycleMsg) {
+	if !strings.HasPrefix(e.Dom.Name, "appvm_") {
+		return
+	}
+	id := e.Dom.Name[6:]
+
+	reason, failure := stopReason(e.Detail)
+	if takeUnhealthy(id) {
+		reason, failure = "unhealthy", true
+	}
+	prev, _ := loadExitStatus(id)
+
+	status := exitStatus{
+		Time:    time.Now().Unix(),
+		Reason:  reason,
+		Failure: failure,
+	}
+	if failure && time.Since(time.Unix(prev.Time, 0)) < restartBackoffReset {
+		status.Restarts = prev.Restarts + 1
+	}
+	saveExitStatus(id, status)
+
+	if failure {
+		log.Println(id, reason)
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	app := config.app(appNameFromDomain(e.Dom.Name))
+
+	postStopHook(app, e.Dom.Name, reason)
+
+	if fileExists(stoppedMarkPath(id)) || strings.HasPrefix(id, "tmp_") {
+		return
+	}
+
+	switch app.Restart {
+	case "always":
+	case "on-failure":
+		if !failure {
+			return
+		}
+	default:
+		return
+	}
+
+	go restartApp(id, restartBackoff(status.Restarts))
+}
+
+func watchLifecycle(l *libvirt.Libvirt) {
+	events, err := l.LifecycleEvents(context.Background())
+	if err != nil {
+		log.Println("Can't subscribe to libvirt events:", err)
+		return
+	}
+
+	for e := range events {
+		// Events of domains of all users are delivered
+		if !strings.HasPrefix(e.Dom.Name, "appvm_") ||
+			!eventOwned(l, e.Dom) {
+
+			continue
+		}
+		publishLifecycleEvent(e)
+		if libvirt.DomainEventType(e.Event) == libvirt.DomainEventStopped {
+			handleStop(e)
+		}
+	}
+}
+
+func status(l *libvirt.Libvirt, name string) {
+	if isRunning(l, name) {
+		fmt.Println(name, "is running")
+		config, err := loadConfig()
+		if err == nil {
+			if h := healthStatus(name, config.app(name)); h != "" {
+				fmt.Println("Health:", h)
+			}
+		}
+	} else {
+		fmt.Println(name, "is stopped")
+	}
+
+	s, err := loadExitStatus(name)
+	if err != nil {
+		return
+	}
+
+	fmt.Println("Last exit:", s.Reason, "at",
+		time.Unix(s.Time, 0).Format(time.RFC1123))
+	if s.Restarts != 0 {
+		fmt.Println("Restarts after failure:", s.Restarts)
+	}
+}
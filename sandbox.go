@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// Confinement of qemu on the host. Seccomp filter is applied by libvirt
+// for all domains (seccomp_sandbox in qemu.conf), so it can only be
+// required: VM is destroyed if qemu runs without it. User and MAC
+// labels are set per domain by <seclabel>.
+
+type sandboxConfig struct {
+	// Destroy VM if qemu has no seccomp filter
+	RequireSeccomp bool `json:"require_seccomp,omitempty"`
+	// qemu user and group for qemu:///system, e.g. "+107:+107"
+	User string `json:"user,omitempty"`
+	// "apparmor" or "selinux"
+	MAC string `json:"mac,omitempty"`
+	// Static MAC label, dynamic one if empty
+	Label string `json:"label,omitempty"`
+}
+
+func checkSandbox(s sandboxConfig) (err error) {
+	switch s.MAC {
+	case "", "apparmor", "selinux":
+	default:
+		return errors.New("mac must be apparmor or selinux, not " + s.MAC)
+	}
+	if s.Label != "" && s.MAC == "" {
+		return errors.New("label needs mac")
+	}
+	return
+}
+
+// SELinux label is static per application unless it is set, the label
+// of the data directory is made for it (see mac.go)
+func sandboxXML(name string, s sandboxConfig) (xml string) {
+	if s.User != "" {
+		xml += "\n  <seclabel type='static' model='dac' relabel='yes'>" +
+			"<label>" + xmlEscape(s.User) + "</label></seclabel>"
+	}
+	if s.Label == "" && (s.MAC == "selinux" ||
+		s.MAC == "" && selinuxEnabled()) {
+
+		xml += "\n  <seclabel type='static' model='selinux' " +
+			"relabel='yes'><label>" + selinuxProcessLabel(name) +
+			"</label></seclabel>"
+	} else if s.MAC != "" && s.Label != "" {
+		xml += "\n  <seclabel type='static' model='" + s.MAC +
+			"' relabel='yes'><label>" + xmlEscape(s.Label) +
+			"</label></seclabel>"
+	} else if s.MAC != "" {
+		xml += "\n  <seclabel type='dynamic' model='" + s.MAC +
+			"' relabel='yes'/>"
+	}
+	return
+}
+
+// qemu is started with -name guest=<domain>,...
+func qemuPid(vmName string) (pid int, err error) {
+	procs, _ := filepath.Glob("/proc/[0-9]*/cmdline")
+	for _, p := range procs {
+		raw, err := ioutil.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		args := strings.Split(string(raw), "\x00")
+		for i, arg := range args {
+			if arg == "-name" && i+1 < len(args) &&
+				strings.HasPrefix(args[i+1], "guest="+vmName+",") {
+				return strconv.Atoi(filepath.Base(filepath.Dir(p)))
+			}
+		}
+	}
+	err = errors.New("no qemu process of " + vmName)
+	return
+}
+
+// Fields of /proc/<pid>/status
+func procStatus(pid int) (fields map[string]string, err error) {
+	raw, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return
+	}
+	fields = make(map[string]string)
+	for _, line := range strings.Split(string(raw), "\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = strings.TrimSpace(kv[1])
+		}
+	}
+	return
+}
+
+var seccompModes = map[string]string{"0": "disabled", "1": "strict",
+	"2": "filter"}
+
+func verifySandbox(l *libvirt.Libvirt, vmName string, s sandboxConfig) (
+	err error) {
+
+	if !s.RequireSeccomp {
+		return
+	}
+
+	pid, err := qemuPid(vmName)
+	if err == nil {
+		var fields map[string]string
+		fields, err = procStatus(pid)
+		if err == nil && fields["Seccomp"] != "2" {
+			err = errors.New("qemu of " + vmName +
+				" runs without seccomp filter")
+		}
+	}
+	if err != nil {
+		if dom, lerr := lookupOwned(l, vmName); lerr == nil {
+			l.DomainDestroy(dom)
+		}
+	}
+	return
+}
+
+var seclabelRe = regexp.MustCompile(`<seclabel type='(\w+)' model='(\w+)'[^>]*>` +
+	`(?:\s*<label>([^<]*)</label>)?`)
+
+// Effective confinement and data usage of the running VM
+func info(l *libvirt.Libvirt, name string) (err error) {
+	dom, err := runningDomain(l, name)
+	if err != nil {
+		return
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+	if q := quotaUsage(name, config.app(name)); q != "" {
+		fmt.Println("Data:     ", q)
+	}
+	v := config.app(name).Viewer
+	fmt.Printf("Window:    class %s, title %q\n", viewerClass(name, v),
+		viewerTitle(name, v))
+
+	xml, err := l.DomainGetXMLDesc(dom, 0)
+	if err != nil {
+		return
+	}
+	for _, m := range seclabelRe.FindAllStringSubmatch(xml, -1) {
+		label := m[3]
+		if label == "" {
+			label = "-"
+		}
+		fmt.Printf("%-10s %s (%s)\n", m[2]+":", label, m[1])
+	}
+
+	pid, err := qemuPid(dom.Name)
+	if err != nil {
+		// qemu of qemu:///system may be not visible, e.g. remote URI
+		fmt.Println("Process:   not visible")
+		return nil
+	}
+	fields, err := procStatus(pid)
+	if err != nil {
+		return
+	}
+	uid := strings.Fields(fields["Uid"])
+	attr, _ := ioutil.ReadFile(fmt.Sprintf("/proc/%d/attr/current", pid))
+
+	fmt.Println("Process:  ", pid)
+	if len(uid) != 0 {
+		fmt.Println("UID:      ", uid[0])
+	}
+	fmt.Println("Seccomp:  ", seccompModes[fields["Seccomp"]])
+	fmt.Println("NoNewPrivs:", fields["NoNewPrivs"] == "1")
+	if s := strings.TrimRight(string(attr), "\x00\n"); s != "" {
+		fmt.Println("MAC:      ", s)
+	}
+	fmt.Println("CapEff:   ", fields["CapEff"])
+	return
+}
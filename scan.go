@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+func moveFile(from, to string) (err error) {
+	err = os.Rename(from, to)
+	if err == nil {
+		return
+	}
+
+	err = copyFile(from, to)
+	if err != nil {
+		return
+	}
+	return os.Remove(from)
+}
+
+func scanFile(path, name string) (err error) {
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+
+	scan := config.Scan
+	if len(scan.Command) == 0 {
+		return
+	}
+
+	args := append(scan.Command[1:], path)
+	out, err := exec.Command(scan.Command[0], args...).CombinedOutput()
+	if err == nil {
+		return
+	}
+	log.Print(string(out))
+
+	if scan.Quarantine {
+		os.MkdirAll(quarantineDir, 0700)
+		moveFile(path, quarantineDir+"rejected-"+name)
+		err = errors.New(name + " is rejected by scanner, moved to " +
+			quarantineDir)
+	} else {
+		os.Remove(path)
+		err = errors.New(name + " is rejected by scanner, removed")
+	}
+	return
+}
+
+// Every file crossing the VM boundary should be written with
+// importFile, so it is scanned before it appears at the destination.
+func importFile(data []byte, to string) (err error) {
+	tmp, err := ioutil.TempFile(appvmHomesDir, ".import-")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return
+	}
+
+	err = scanFile(tmp.Name(), filepath.Base(to))
+	if err != nil {
+		return
+	}
+
+	return moveFile(tmp.Name(), to)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Host scheduling of background VMs, applied by libvirt through
+// cgroups: niceness is converted to CPU weight (1.25x per nice level,
+// as in CFS), ionice class/priority to block I/O weight, batch sets
+// SCHED_BATCH for vCPU and emulator threads.
+
+type schedConfig struct {
+	// -20..19, 0 by default
+	Nice int `json:"nice,omitempty"`
+	// "best-effort" (default) or "idle"
+	IOClass string `json:"ionice_class,omitempty"`
+	// 0 (highest) .. 7 for best-effort, 4 by default
+	IOPriority *int `json:"ionice_priority,omitempty"`
+	// SCHED_BATCH
+	Batch bool `json:"batch,omitempty"`
+}
+
+func checkSched(s schedConfig) (err error) {
+	if s.Nice < -20 || s.Nice > 19 {
+		return fmt.Errorf("nice %d is out of range -20..19", s.Nice)
+	}
+	switch s.IOClass {
+	case "", "best-effort", "idle":
+	default:
+		return errors.New("unknown ionice class " + s.IOClass)
+	}
+	if s.IOPriority != nil && (*s.IOPriority < 0 || *s.IOPriority > 7) {
+		return fmt.Errorf("ionice priority %d is out of range 0..7",
+			*s.IOPriority)
+	}
+	return
+}
+
+// Default cgroup CPU weight is 1024
+func cpuShares(nice int) uint64 {
+	shares := 1024 * math.Pow(1.25, float64(-nice))
+	return uint64(math.Max(2, math.Round(shares)))
+}
+
+// Block I/O weight is 10..1000, priority 4 maps to the cgroup v1
+// default 500
+func blkioWeight(s schedConfig) uint64 {
+	if s.IOClass == "idle" {
+		return 10
+	}
+	if s.IOPriority == nil {
+		return 0
+	}
+	return uint64(1000 - 125*(*s.IOPriority))
+}
+
+func schedXML(s schedConfig, vcpus int) (xml string) {
+	cputune := ""
+	if s.Nice != 0 {
+		cputune += fmt.Sprintf("<shares>%d</shares>", cpuShares(s.Nice))
+	}
+	if s.Batch {
+		cputune += fmt.Sprintf("<vcpusched vcpus='0-%d' scheduler='batch'/>"+
+			"<emulatorsched scheduler='batch'/>", vcpus-1)
+	}
+	if cputune != "" {
+		xml += "<cputune>" + cputune + "</cputune>"
+	}
+
+	if w := blkioWeight(s); w != 0 {
+		xml += fmt.Sprintf("<blkiotune><weight>%d</weight></blkiotune>", w)
+	}
+	return
+}
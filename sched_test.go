@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestCPUShares(t *testing.T) {
+	tests := []struct {
+		nice int
+		want uint64
+	}{
+		{0, 1024},
+		{1, 819},
+		{-1, 1280},
+		{10, 110},
+		{-10, 9537},
+		{19, 15},
+		{-19, 71054},
+		{-20, 88818},
+	}
+
+	for _, tt := range tests {
+		if got := cpuShares(tt.nice); got != tt.want {
+			t.Errorf("cpuShares(%d) = %d, want %d", tt.nice, got, tt.want)
+		}
+	}
+}
+
+func TestBlkioWeight(t *testing.T) {
+	prio := func(p int) *int { return &p }
+
+	tests := []struct {
+		s    schedConfig
+		want uint64
+	}{
+		{schedConfig{}, 0},
+		{schedConfig{IOPriority: prio(0)}, 1000},
+		{schedConfig{IOPriority: prio(4)}, 500},
+		{schedConfig{IOPriority: prio(7)}, 125},
+		{schedConfig{IOClass: "best-effort", IOPriority: prio(2)}, 750},
+		{schedConfig{IOClass: "idle"}, 10},
+		{schedConfig{IOClass: "idle", IOPriority: prio(0)}, 10},
+	}
+
+	for _, tt := range tests {
+		if got := blkioWeight(tt.s); got != tt.want {
+			t.Errorf("blkioWeight(%+v) = %d, want %d", tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// Periodic jobs of applications are run by appvm daemon one after
+// another. A job is a shell command like hooks, with the appvm binary
+// in $APPVM. Runs missed while the daemon was not running are done
+// once when it starts. The first run of a new job is one period after
+// the daemon has seen it.
+
+const scheduleTick = time.Minute
+
+type scheduledJob struct {
+	Name string `json:"name"`
+	// "hourly", "daily", "weekly" or duration, e.g. "6h"
+	Every string `json:"every"`
+	// Local time HH:MM for daily and weekly jobs
+	At string `json:"at,omitempty"`
+	// Shell command, see jobCommand
+	Run string `json:"run"`
+}
+
+type jobState struct {
+	// Unix time of the last run, or of the first time seen
+	Last   int64  `json:"last"`
+	Ran    bool   `json:"ran,omitempty"`
+	Status string `json:"status,omitempty"` // ok or failed
+	Output string `json:"output,omitempty"`
+}
+
+func schedulePath() string {
+	return appvmHomesDir + ".schedule.json"
+}
+
+// Keys are <application>/<job>
+func loadSchedule() (states map[string]jobState) {
+	states = make(map[string]jobState)
+	raw, err := ioutil.ReadFile(schedulePath())
+	if err == nil {
+		json.Unmarshal(raw, &states)
+	}
+	return
+}
+
+func saveSchedule(states map[string]jobState) {
+	raw, _ := json.MarshalIndent(states, "", "  ")
+	ioutil.WriteFile(schedulePath(), raw, 0600)
+}
+
+func jobPeriod(job scheduledJob) (period time.Duration, err error) {
+	switch job.Every {
+	case "hourly":
+		period = time.Hour
+	case "daily":
+		period = 24 * time.Hour
+	case "weekly":
+		period = 7 * 24 * time.Hour
+	default:
+		period, err = time.ParseDuration(job.Every)
+		if err != nil {
+			return 0, fmt.Errorf("every must be hourly, daily, weekly "+
+				"or duration, not %q", job.Every)
+		}
+		if period < scheduleTick {
+			return 0, fmt.Errorf("every %s is less than %s",
+				job.Every, scheduleTick)
+		}
+	}
+	return
+}
+
+func nextRun(job scheduledJob, last time.Time) (next time.Time, err error) {
+	if job.Name == "" || job.Run == "" {
+		err = errors.New("name and run are required")
+		return
+	}
+
+	period, err := jobPeriod(job)
+	if err != nil {
+		return
+	}
+
+	if job.At == "" {
+		return last.Add(period), nil
+	}
+
+	if job.Every != "daily" && job.Every != "weekly" {
+		err = errors.New("at is only for daily and weekly jobs")
+		return
+	}
+	at, err := time.Parse("15:04", job.At)
+	if err != nil {
+		err = fmt.Errorf("at must be HH:MM, not %q", job.At)
+		return
+	}
+
+	last = last.Local()
+	next = time.Date(last.Year(), last.Month(), last.Day(),
+		at.Hour(), at.Minute(), 0, 0, time.Local)
+	if !next.After(last) {
+		next = next.AddDate(0, 0, int(period/(24*time.Hour)))
+	}
+	return
+}
+
+// Environment:
+//
+//	APPVM      appvm binary
+//	APPVM_NAME application name
+//	APPVM_DIR  shared directory
+//	APPVM_JOB  job name
+func jobCommand(name string, job scheduledJob) (command *exec.Cmd, err error) {
+	self, err := os.Executable()
+	if err != nil {
+		return
+	}
+
+	command = exec.Command("/bin/sh", "-c", job.Run)
+	command.Env = append(os.Environ(),
+		"APPVM="+self,
+		"APPVM_NAME="+name,
+		"APPVM_DIR="+appvmHomesDir+name,
+		"APPVM_JOB="+job.Name)
+	return
+}
+
+func runJob(name string, job scheduledJob) (state jobState) {
+	state = jobState{Last: time.Now().Unix(), Ran: true, Status: "ok"}
+
+	command, err := jobCommand(name, job)
+	if err != nil {
+		state.Status, state.Output = "failed", err.Error()
+		return
+	}
+
+	output, err := command.CombinedOutput()
+	state.Output = strings.TrimSpace(string(output))
+	if len(state.Output) > 1024 {
+		state.Output = state.Output[len(state.Output)-1024:]
+	}
+	if err != nil {
+		state.Status = "failed"
+		log.Printf("schedule %s/%s: %v", name, job.Name, err)
+	}
+	return
+}
+
+func watchSchedule() {
+	for ; ; time.Sleep(scheduleTick) {
+		config, err := loadConfig()
+		if err != nil {
+			continue
+		}
+
+		states := loadSchedule()
+		for name, app := range config.Apps {
+			for _, job := range app.Schedule {
+				key := name + "/" + job.Name
+				state, ok := states[key]
+				if !ok {
+					states[key] = jobState{Last: time.Now().Unix()}
+					saveSchedule(states)
+					continue
+				}
+
+				next, err := nextRun(job, time.Unix(state.Last, 0))
+				if err != nil || time.Now().Before(next) {
+					continue
+				}
+
+				log.Printf("schedule: running %s", key)
+				states[key] = runJob(name, job)
+				saveSchedule(states)
+			}
+		}
+	}
+}
+
+func checkSchedule(config appvmConfig) {
+	for name, app := range config.Apps {
+		for _, job := range app.Schedule {
+			_, err := nextRun(job, time.Now())
+			if err != nil {
+				log.Printf("schedule %s/%s: %v", name, job.Name, err)
+			}
+		}
+	}
+}
+
+func listSchedule() (err error) {
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+	states := loadSchedule()
+
+	var names []string
+	for name := range config.Apps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Application", "Job", "Every", "Last run",
+		"Next run", "Status"})
+	for _, name := range names {
+		for _, job := range config.Apps[name].Schedule {
+			state, ok := states[name+"/"+job.Name]
+			if !ok {
+				state.Last = time.Now().Unix()
+			}
+
+			every := job.Every
+			if job.At != "" {
+				every += " at " + job.At
+			}
+
+			last := "never"
+			if state.Ran {
+				last = time.Unix(state.Last, 0).Format("2006-01-02 15:04")
+			}
+
+			next := ""
+			t, err := nextRun(job, time.Unix(state.Last, 0))
+			if err != nil {
+				next = "invalid: " + err.Error()
+			} else if ok {
+				next = t.Format("2006-01-02 15:04")
+			} else {
+				next = "not seen by daemon"
+			}
+
+			table.Append([]string{name, job.Name, every, last, next,
+				state.Status})
+		}
+	}
+	table.Render()
+	return
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// appvm screenshot saves the primary display of a running VM by libvirt.
+// It is refused for protected applications, meant for password managers
+// and the like. Their viewer windows are also hidden from host screen
+// capture where the compositor allows: Hyprland noscreenshare rule from
+// appvm wm-rules. X11, sway and i3 can not do that.
+
+var screenshotExts = map[string]string{
+	"image/x-portable-pixmap": ".ppm",
+	"image/png":               ".png",
+}
+
+func checkScreenshot(name string, app appConfig) error {
+	if app.Protected {
+		return withCategory("denied", errors.New(name+
+			" is protected, screenshots are disabled"))
+	}
+	return nil
+}
+
+func screenshot(l *libvirt.Libvirt, name, output string) (err error) {
+	dom, err := runningDomain(l, name)
+	if err != nil {
+		return
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+	err = checkScreenshot(name, config.app(name))
+	if err != nil {
+		return
+	}
+
+	var image bytes.Buffer
+	mime, err := l.DomainScreenshot(dom, &image, 0, 0)
+	if err != nil {
+		return
+	}
+
+	if output == "" {
+		ext := ".ppm"
+		if len(mime) != 0 && screenshotExts[mime[0]] != "" {
+			ext = screenshotExts[mime[0]]
+		}
+		output = name + time.Now().Format("-20060102-150405") + ext
+	}
+
+	err = ioutil.WriteFile(output, image.Bytes(), 0600)
+	if err != nil {
+		return
+	}
+	fmt.Println("Saved", output)
+	return
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// Secrets are resolved on the host by appvm daemon after boot and
+// written through the guest agent to /run/appvm/secrets/<name> (tmpfs,
+// readable by user only), so they are gone on stop and never written
+// to the shared directory. References:
+//
+//	pass:<entry>, gopass:<entry>, systemd-creds:<file>, file:<path>
+
+const (
+	secretsTick     = 5 * time.Second
+	guestSecretsDir = "/run/appvm/secrets"
+)
+
+var secretNameRe = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+func parseSecretRef(ref string) (kind, arg string) {
+	kind, arg = "file", ref
+	if i := strings.Index(ref, ":"); i > 0 {
+		kind, arg = ref[:i], ref[i+1:]
+	}
+	if kind == "file" && strings.HasPrefix(arg, "~/") {
+		arg = os.Getenv("HOME") + arg[1:]
+	}
+	return
+}
+
+func resolveSecret(ref string) (value []byte, err error) {
+	kind, arg := parseSecretRef(ref)
+	switch kind {
+	case "pass":
+		return exec.Command("pass", "show", arg).Output()
+	case "gopass":
+		return exec.Command("gopass", "show", "-o", arg).Output()
+	case "systemd-creds":
+		return exec.Command("systemd-creds", "decrypt", arg, "-").Output()
+	case "file":
+		return ioutil.ReadFile(arg)
+	}
+	return nil, errors.New("unknown secret source " + kind)
+}
+
+// Password managers are not asked before the boot
+func checkSecrets(secrets map[string]string) (err error) {
+	for name, ref := range secrets {
+		if !secretNameRe.MatchString(name) {
+			return fmt.Errorf("invalid secret name %q", name)
+		}
+		switch kind, arg := parseSecretRef(ref); kind {
+		case "file", "systemd-creds":
+			_, err = os.Stat(arg)
+		case "pass", "gopass":
+			_, err = exec.LookPath(kind)
+		default:
+			err = errors.New("unknown secret source " + kind)
+		}
+		if err != nil {
+			return fmt.Errorf("secret %s: %v", name, err)
+		}
+	}
+	return
+}
+
+func applySecrets(l *libvirt.Libvirt, dom libvirt.Domain,
+	secrets map[string]string) (err error) {
+
+	for name, ref := range secrets {
+		value, err := resolveSecret(ref)
+		if err != nil {
+			return fmt.Errorf("secret %s: %v", name, err)
+		}
+
+		path := guestSecretsDir + "/" + name
+		err = guestRoot(l, dom, value, "umask 077 && "+
+			"mkdir -p "+guestSecretsDir+" && "+
+			"chown user "+guestSecretsDir+" && "+
+			"cat > "+path+".tmp && chown user "+path+".tmp && "+
+			"mv "+path+".tmp "+path)
+		if err != nil {
+			return err
+		}
+	}
+	return
+}
+
+func watchSecrets(l *libvirt.Libvirt) {
+	applied := make(map[string]bool)
+
+	for ; ; time.Sleep(secretsTick) {
+		domains, err := l.Domains()
+		if err != nil {
+			continue
+		}
+
+		config, err := loadConfig()
+		if err != nil {
+			continue
+		}
+
+		running := make(map[string]bool)
+		for _, d := range domains {
+			if !strings.HasPrefix(d.Name, "appvm_") || !isOwned(l, d) {
+				continue
+			}
+			running[d.Name] = true
+
+			secrets := config.app(appNameFromDomain(d.Name)).Secrets
+			if applied[d.Name] || len(secrets) == 0 {
+				continue
+			}
+
+			// Guest agent is not available until boot
+			if !guestAgentReady(l, d) {
+				continue
+			}
+			err = applySecrets(l, d, secrets)
+			if err != nil {
+				log.Println(d.Name, err)
+			} else {
+				log.Println("Secrets injected into", d.Name)
+			}
+			// Not retried, password managers may ask
+			applied[d.Name] = true
+		}
+
+		for name := range applied {
+			if !running[name] {
+				delete(applied, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// Guest sends "<destination vm> <absolute path>" lines, see appvm-send
+// in base.nix.
+const guestSendChannel = "org.appvm.send"
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// Asks on the terminal if there is one, otherwise with a dialog window.
+func confirm(question string) bool {
+	if isTerminal(os.Stdin) {
+		fmt.Print(question + " [y/N] ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		return answer == "y" || answer == "yes"
+	}
+
+	return exec.Command("zenity", "--question", "--title", "appvm",
+		"--text", question).Run() == nil
+}
+
+func readFromVM(l *libvirt.Libvirt, name, path string) (data []byte, err error) {
+	if hostPath, ok := guestPathToHost("appvm_"+name, path); ok {
+		return ioutil.ReadFile(hostPath)
+	}
+
+	dom, err := lookupOwned(l, "appvm_"+name)
+	if err != nil {
+		if libvirt.IsNotFound(err) {
+			err = errors.New(name + " is not running and " + path +
+				" is not in the shared directory")
+		}
+		return
+	}
+
+	return guestFileRead(l, dom, path)
+}
+
+// Files are placed to ~/Incoming/<source vm>/ of the destination VM.
+func send(l *libvirt.Libvirt, src, path, dst string, yes bool) (err error) {
+	if src == dst {
+		err = errors.New("source and destination are the same")
+		return
+	}
+
+	if dst == "" || strings.Contains(dst, "/") || strings.HasPrefix(dst, ".") {
+		err = errors.New("invalid destination " + dst)
+		return
+	}
+
+	if !filepath.IsAbs(path) {
+		path = "/home/user/" + path
+	}
+
+	data, err := readFromVM(l, src, path)
+	if err != nil {
+		return
+	}
+
+	question := fmt.Sprintf("Copy %s:%s (%d bytes) to %s?",
+		src, path, len(data), dst)
+	if !yes && !confirm(question) {
+		err = errors.New("cancelled by user")
+		return
+	}
+
+	// Both may be symlinks made by the destination VM, checked before
+	// anything is created in them
+	var dir string
+	for _, rel := range []string{"Incoming", "Incoming/" + src} {
+		os.Mkdir(appvmHomesDir+dst+"/"+rel, 0700)
+		var ok bool
+		dir, ok = resolveInHome(dst, rel)
+		if !ok {
+			err = errors.New(dst + ":/home/user/" + rel +
+				" is not a directory in the VM home")
+			return
+		}
+	}
+
+	to := dir + "/" + filepath.Base(path)
+	err = importFile(data, to)
+	if err != nil {
+		return
+	}
+
+	log.Println("Saved to", dst+":/home/user/Incoming/"+src+"/"+
+		filepath.Base(path))
+	return
+}
+
+func guestSend(l *libvirt.Libvirt, vmName, line string) {
+	fields := strings.SplitN(line, " ", 2)
+	if len(fields) != 2 {
+		log.Println("Invalid send request from", vmName)
+		return
+	}
+
+	err := send(l, strings.TrimPrefix(vmName, "appvm_"),
+		fields[1], fields[0], false)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func parseVMPath(s string) (name, path string, err error) {
+	fields := strings.SplitN(s, ":", 2)
+	if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+		err = errors.New("expected <vm>:<path>, got " + s)
+		return
+	}
+	err = validateName(fields[0])
+	if err != nil {
+		return
+	}
+	return fields[0], fields[1], nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/user"
+
+	"github.com/digitalocean/go-libvirt"
+	"golang.org/x/sys/unix"
+)
+
+// appvm init checks the host (nix, KVM, libvirt access), fixes what it
+// can with confirmation and builds a test VM. Directories and
+// config.json are created on every run of appvm anyway, init reports
+// them. Adding to the libvirt group is done by pkexec, so polkit asks
+// for the password.
+
+const libvirtGroup = "libvirt"
+
+func xdgConfigDir() string {
+	legacy := os.Getenv("HOME") + "/.config/appvm/"
+	xdg := os.Getenv("XDG_CONFIG_HOME")
+	if xdg == "" || isDirExists(legacy) {
+		return legacy
+	}
+	return xdg + "/appvm/"
+}
+
+func setupCheck(what string, err error) bool {
+	if err != nil {
+		fmt.Printf("[FAIL] %s: %v\n", what, err)
+		return false
+	}
+	fmt.Printf("[ OK ] %s\n", what)
+	return true
+}
+
+func checkKVM() (err error) {
+	if !fileExists("/dev/kvm") {
+		return fmt.Errorf("no /dev/kvm, enable virtualization in " +
+			"firmware and load kvm_intel or kvm_amd")
+	}
+	err = unix.Access("/dev/kvm", unix.R_OK|unix.W_OK)
+	if err != nil {
+		err = fmt.Errorf("/dev/kvm: %v", err)
+	}
+	return
+}
+
+func checkLibvirt(uri string) (err error) {
+	c, err := libvirtDial(uri)
+	if err != nil {
+		return
+	}
+	l := libvirt.New(c)
+	err = l.Connect()
+	if err != nil {
+		return
+	}
+	return l.Disconnect()
+}
+
+// False if user is in the group already or there is no such group
+func canJoinGroup(name string) bool {
+	u, err := user.Current()
+	if err != nil {
+		return false
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return false
+	}
+	ids, _ := u.GroupIds()
+	for _, id := range ids {
+		if id == g.Gid {
+			return false
+		}
+	}
+	return true
+}
+
+func addToGroup(name string) (err error) {
+	u, err := user.Current()
+	if err != nil {
+		return
+	}
+	out, err := exec.Command("pkexec", "usermod", "-aG", name,
+		u.Username).CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("pkexec usermod: %v: %s", err, out)
+	}
+	return
+}
+
+func setup(uri string, yes, build bool, testApp string) (err error) {
+	err = validateName(testApp)
+	if err != nil {
+		return
+	}
+
+	ask := func(question string) bool {
+		return yes || confirm(question)
+	}
+
+	fmt.Println("Config:", configPath())
+	fmt.Println("Data:  ", appvmHomesDir)
+
+	nixOK := setupCheck("nix", func() error {
+		_, err := exec.LookPath(nixBin("nix-build"))
+		if err != nil {
+			return fmt.Errorf("nix-build is not found, " +
+				"install nix or run appvm bootstrap-nix")
+		}
+		return nil
+	}())
+
+	kvmOK := setupCheck("KVM", checkKVM())
+
+	libvirtOK := setupCheck("libvirt "+uri, checkLibvirt(uri))
+	if !libvirtOK && canJoinGroup(libvirtGroup) &&
+		ask("Add current user to the "+libvirtGroup+" group?") {
+
+		err = addToGroup(libvirtGroup)
+		if err != nil {
+			return
+		}
+		log.Println("Log in again to apply the group membership")
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+	config.Version = schemaVersion()
+	err = saveConfig(config)
+	if err != nil {
+		return
+	}
+
+	if build && nixOK && ask("Build "+testApp+" to test the setup?") {
+		_, _, _, err = generateVM(configDir, testApp, true,
+			config.app(testApp).Arch)
+		if err != nil {
+			return
+		}
+		fmt.Println("Test VM is built")
+	}
+
+	if !nixOK || !kvmOK || !libvirtOK {
+		return errors.New("host is not ready, see failed checks")
+	}
+	fmt.Println("Setup works, start with: appvm start", testApp)
+	return
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/olekukonko/tablewriter"
+)
+
+// Shares of the running VM: 9p filesystems from the live domain XML
+// and their mount points from /proc/mounts of the guest. Shares
+// attached at runtime are mounted to /mnt/<tag> by the guest agent and
+// are gone after restart.
+
+var filesystemRe = regexp.MustCompile(`(?s)<filesystem type='mount'[^>]*>.*?</filesystem>`)
+var filesystemSourceRe = regexp.MustCompile(`<source dir='([^']*)'/>`)
+var filesystemTargetRe = regexp.MustCompile(`<target dir='([^']*)'/>`)
+
+// Tag -> share
+func domainShares(l *libvirt.Libvirt, dom libvirt.Domain) (
+	shares map[string]share, err error) {
+
+	xml, err := l.DomainGetXMLDesc(dom, 0)
+	if err != nil {
+		return
+	}
+
+	shares = make(map[string]share)
+	for _, fs := range filesystemRe.FindAllString(xml, -1) {
+		source := filesystemSourceRe.FindStringSubmatch(fs)
+		target := filesystemTargetRe.FindStringSubmatch(fs)
+		if source == nil || target == nil {
+			continue
+		}
+		shares[target[1]] = share{Source: source[1], Tag: target[1],
+			ReadOnly: strings.Contains(fs, "<readonly/>")}
+	}
+	return
+}
+
+// Tag -> mount point
+func guestMounts(l *libvirt.Libvirt, dom libvirt.Domain) (
+	mounts map[string]string) {
+
+	mounts = make(map[string]string)
+	result, err := guestExec(l, dom, "/run/current-system/sw/bin/cat",
+		"/proc/mounts")
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(result.Stdout, "\n") {
+		f := strings.Fields(line)
+		if len(f) >= 3 && f[2] == "9p" {
+			mounts[f[0]] = f[1]
+		}
+	}
+	return
+}
+
+func lsshares(l *libvirt.Libvirt, name string) (err error) {
+	dom, err := runningDomain(l, name)
+	if err != nil {
+		return
+	}
+
+	shares, err := domainShares(l, dom)
+	if err != nil {
+		return
+	}
+	mounts := guestMounts(l, dom)
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Tag", "Source", "Mode", "Mounted"})
+	for tag, s := range shares {
+		mode := "rw"
+		if s.ReadOnly {
+			mode = "ro"
+		}
+		table.Append([]string{tag, s.Source, mode, mounts[tag]})
+	}
+	table.Render()
+	return
+}
+
+func shareXML(s share) string {
+	readonly := ""
+	if s.ReadOnly {
+		readonly = "<readonly/>"
+	}
+	return fmt.Sprintf(shareTmpl, xmlEscape(s.Source), xmlEscape(s.Tag),
+		readonly)
+}
+
+var shareTagRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,31}$`)
+
+func shareAttach(l *libvirt.Libvirt, name, dir, tag string,
+	readonly bool) (err error) {
+
+	dom, err := runningDomain(l, name)
+	if err != nil {
+		return
+	}
+
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return
+	}
+	if !isDirExists(dir) {
+		return errors.New(dir + " is not a directory")
+	}
+
+	if tag == "" {
+		tag = strings.Map(func(r rune) rune {
+			if shareTagRe.MatchString(string(r)) {
+				return r
+			}
+			return '_'
+		}, filepath.Base(dir))
+	}
+	if !shareTagRe.MatchString(tag) {
+		return errors.New("invalid tag " + tag)
+	}
+
+	shares, err := domainShares(l, dom)
+	if err != nil {
+		return
+	}
+	if _, ok := shares[tag]; ok {
+		return errors.New(tag + " is already attached")
+	}
+
+	s := share{Source: dir, Tag: tag, ReadOnly: readonly}
+	err = l.DomainAttachDeviceFlags(dom, shareXML(s),
+		uint32(libvirt.DomainDeviceModifyLive))
+	if err != nil {
+		return
+	}
+
+	options := "trans=virtio,version=9p2000.L"
+	if readonly {
+		options += ",ro"
+	}
+	err = guestRoot(l, dom, nil, "mkdir -p /mnt/"+tag+" && "+
+		"mount -t 9p -o "+options+" "+tag+" /mnt/"+tag)
+	if err != nil {
+		return
+	}
+	fmt.Println(dir, "is mounted to /mnt/"+tag, "in", name)
+	return
+}
+
+func shareDetach(l *libvirt.Libvirt, name, tag string) (err error) {
+	dom, err := runningDomain(l, name)
+	if err != nil {
+		return
+	}
+
+	shares, err := domainShares(l, dom)
+	if err != nil {
+		return
+	}
+	s, ok := shares[tag]
+	if !ok {
+		return errors.New("no share " + tag)
+	}
+
+	if mount, ok := guestMounts(l, dom)[tag]; ok {
+		err = guestRoot(l, dom, nil, "umount "+mount)
+		if err != nil {
+			return fmt.Errorf("%s is busy in the guest: %v", mount, err)
+		}
+	}
+
+	return l.DomainDetachDeviceFlags(dom, shareXML(s),
+		uint32(libvirt.DomainDeviceModifyLive))
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Snapshots of application data on btrfs (data directory is a
+// subvolume) and ZFS (data directory is a dataset)
+
+const (
+	btrfsMagic = 0x9123683e
+	zfsMagic   = 0x2fc12fc1
+)
+
+func fsType(path string) string {
+	var st syscall.Statfs_t
+	if syscall.Statfs(path, &st) != nil {
+		return ""
+	}
+
+	switch st.Type {
+	case btrfsMagic:
+		return "btrfs"
+	case zfsMagic:
+		return "zfs"
+	case xfsMagic:
+		return "xfs"
+	}
+	return ""
+}
+
+func run(name string, args ...string) (out string, err error) {
+	raw, err := exec.Command(name, args...).CombinedOutput()
+	out = strings.TrimSpace(string(raw))
+	if err != nil {
+		err = fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "),
+			err, out)
+	}
+	return
+}
+
+// Data directory is created as a subvolume on btrfs, otherwise it
+// can't be snapshotted.
+func createDataDir(path string) (err error) {
+	if isDirExists(path) {
+		return
+	}
+
+	if fsType(appvmHomesDir) == "btrfs" {
+		_, err = run("btrfs", "subvolume", "create", path)
+		if err == nil {
+			return os.Chmod(path, 0700)
+		}
+		log.Println(err)
+	}
+
+	return os.MkdirAll(path, 0700)
+}
+
+func snapshotsDir(name string) string {
+	return appvmHomesDir + ".snapshots/" + name + "/"
+}
+
+func zfsDataset(path string) (dataset string, err error) {
+	out, err := run("zfs", "list", "-H", "-o", "name,mountpoint", path)
+	if err != nil {
+		return
+	}
+
+	fields := strings.Fields(out)
+	if len(fields) != 2 || fields[1] != strings.TrimSuffix(path, "/") {
+		err = errors.New(path + " is not a separate ZFS dataset")
+		return
+	}
+	return fields[0], nil
+}
+
+func dataSnapshot(name string) (snapshot string, err error) {
+	path := appvmHomesDir + name
+	snapshot = "appvm-" + time.Now().Format("20060102-150405")
+
+	switch fsType(path) {
+	case "btrfs":
+		err = os.MkdirAll(snapshotsDir(name), 0700)
+		if err != nil {
+			return
+		}
+		_, err = run("btrfs", "subvolume", "snapshot", "-r", path,
+			snapshotsDir(name)+snapshot)
+	case "zfs":
+		var dataset string
+		dataset, err = zfsDataset(path)
+		if err != nil {
+			return
+		}
+		_, err = run("zfs", "snapshot", dataset+"@"+snapshot)
+	default:
+		err = errors.New(path + " is neither on btrfs nor on ZFS")
+	}
+	return
+}
+
+func dataSnapshots(name string) (snapshots []string, err error) {
+	path := appvmHomesDir + name
+
+	switch fsType(path) {
+	case "btrfs":
+		files, _ := ioutil.ReadDir(snapshotsDir(name))
+		for _, f := range files {
+			snapshots = append(snapshots, f.Name())
+		}
+	case "zfs":
+		var dataset, out string
+		dataset, err = zfsDataset(path)
+		if err != nil {
+			return
+		}
+		out, err = run("zfs", "list", "-H", "-t", "snapshot", "-o",
+			"name", "-s", "creation", dataset)
+		if err != nil {
+			return
+		}
+		for _, line := range strings.Split(out, "\n") {
+			if i := strings.Index(line, "@"); i != -1 {
+				snapshots = append(snapshots, line[i+1:])
+			}
+		}
+	default:
+		err = errors.New(path + " is neither on btrfs nor on ZFS")
+	}
+	return
+}
+
+func dataRollback(name, snapshot string) (err error) {
+	path := appvmHomesDir + name
+
+	switch fsType(path) {
+	case "btrfs":
+		snapshotPath := snapshotsDir(name) + snapshot
+		if !isDirExists(snapshotPath) {
+			err = errors.New("no snapshot " + snapshot)
+			return
+		}
+		// Live data is deleted only when the restored copy is in place
+		restored := appvmHomesDir + "." + name + ".rollback"
+		old := appvmHomesDir + "." + name + ".old"
+		_, err = run("btrfs", "subvolume", "snapshot", snapshotPath,
+			restored)
+		if err != nil {
+			return
+		}
+		err = os.Rename(path, old)
+		if err != nil {
+			run("btrfs", "subvolume", "delete", restored)
+			return
+		}
+		err = os.Rename(restored, path)
+		if err != nil {
+			os.Rename(old, path)
+			run("btrfs", "subvolume", "delete", restored)
+			return
+		}
+		_, err = run("btrfs", "subvolume", "delete", old)
+	case "zfs":
+		var dataset string
+		dataset, err = zfsDataset(path)
+		if err != nil {
+			return
+		}
+		_, err = run("zfs", "rollback", "-r", dataset+"@"+snapshot)
+	default:
+		err = errors.New(path + " is neither on btrfs nor on ZFS")
+	}
+	return
+}
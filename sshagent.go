@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+	"golang.org/x/sys/unix"
+)
+
+// Agents of the host for VMs (SSH here, GPG in gpgagent.go). In the
+// guest socat listens on the agent socket and connects to the host
+// (CID 2) over vsock, appvm daemon accepts connections, checks the
+// policy of the VM found by the peer CID and proxies them to the agent
+// socket of the daemon. Private keys never leave the host.
+
+const sshAgentPort = 5001
+
+func sshAgentModule(app appConfig) string {
+	if !app.SSHAgent {
+		return ""
+	}
+	return fmt.Sprintf(sshAgentModuleTmpl, sshAgentPort)
+}
+
+var sshAgentModuleTmpl = `  systemd.user.services.appvm-ssh-agent = {
+    description = "SSH agent of the host over vsock";
+    serviceConfig = {
+      ExecStart = "${pkgs.socat}/bin/socat UNIX-LISTEN:%%t/ssh-agent,fork,unlink-early VSOCK-CONNECT:2:%d";
+      Restart = "always";
+    };
+    wantedBy = [ "default.target" ];
+  };
+  environment.extraInit = ''export SSH_AUTH_SOCK="$XDG_RUNTIME_DIR/ssh-agent"'';
+  programs.ssh.startAgent = lib.mkForce false;
+`
+
+func vsockListen(port uint32) (fd int, err error) {
+	fd, err = unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return
+	}
+
+	err = unix.Bind(fd, &unix.SockaddrVM{CID: unix.VMADDR_CID_ANY, Port: port})
+	if err == nil {
+		err = unix.Listen(fd, 16)
+	}
+	if err != nil {
+		unix.Close(fd)
+	}
+	return
+}
+
+// Application VM with the vsock CID
+func domainByCID(l *libvirt.Libvirt, cid uint32) (dom libvirt.Domain, err error) {
+	domains, err := l.Domains()
+	if err != nil {
+		return
+	}
+	for _, d := range domains {
+		if !strings.HasPrefix(d.Name, "appvm_") || !isOwned(l, d) {
+			continue
+		}
+		if c, err := vsockCID(l, d); err == nil && c == cid {
+			return d, nil
+		}
+	}
+	err = fmt.Errorf("no VM with CID %d", cid)
+	return
+}
+
+// Agent socket of the host forwarded to VMs over vsock
+type forwardedAgent struct {
+	Name string
+	Port uint32
+	// Empty if the agent is not available
+	Socket func() string
+	// Policy of the application, confirm is asked on the host
+	Policy func(name string, app appConfig) (allow, confirm bool)
+	// Confirmation is valid for the period, every connection if zero
+	ConfirmFor time.Duration
+	approved   map[string]time.Time
+}
+
+var sshAgent = forwardedAgent{
+	Name:   "ssh-agent",
+	Port:   sshAgentPort,
+	Socket: func() string { return os.Getenv("SSH_AUTH_SOCK") },
+	Policy: func(name string, app appConfig) (bool, bool) {
+		return app.SSHAgent, false
+	},
+	approved: make(map[string]time.Time),
+}
+
+func (a forwardedAgent) allowed(l *libvirt.Libvirt, cid uint32) bool {
+	dom, err := domainByCID(l, cid)
+	if err != nil {
+		log.Println(a.Name+":", err)
+		return false
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+
+	name := appNameFromDomain(dom.Name)
+	allow, ask := a.Policy(name, config.app(name))
+	if allow && ask && time.Since(a.approved[name]) > a.ConfirmFor {
+		allow = confirm("Allow " + name + " to use " + a.Name + "?")
+		if allow {
+			a.approved[name] = time.Now()
+		}
+	}
+	if !allow {
+		log.Println("Deny", name, "to use", a.Name)
+	}
+	return allow
+}
+
+func proxyAgent(conn *os.File, socket string) {
+	defer conn.Close()
+
+	agent, err := net.Dial("unix", socket)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer agent.Close()
+
+	go io.Copy(agent, conn)
+	io.Copy(conn, agent)
+}
+
+// Policy is checked in the accept loop, so confirmations are asked one
+// by one
+func serveAgent(l *libvirt.Libvirt, a forwardedAgent) {
+	socket := a.Socket()
+	if socket == "" {
+		return
+	}
+
+	fd, err := vsockListen(a.Port)
+	if err != nil {
+		log.Println(a.Name+":", err)
+		return
+	}
+
+	for {
+		nfd, sa, err := unix.Accept(fd)
+		if err != nil {
+			log.Println(a.Name+":", err)
+			return
+		}
+		unix.CloseOnExec(nfd)
+
+		conn := os.NewFile(uintptr(nfd), "vsock")
+		vm, ok := sa.(*unix.SockaddrVM)
+		if !ok {
+			conn.Close()
+			continue
+		}
+		if !a.allowed(l, vm.CID) {
+			conn.Close()
+			continue
+		}
+		go proxyAgent(conn, socket)
+	}
+}
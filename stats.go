@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// Samples are collected by appvm daemon and appended to the per-app
+// file, one JSON object per line.
+
+const (
+	statsInterval = time.Minute
+	statsKeep     = 7 * 24 * 60 // one week of samples
+)
+
+type statsSample struct {
+	Time      int64  `json:"time"`
+	CPUTime   uint64 `json:"cpu_time"` // ns
+	VCPUs     uint16 `json:"vcpus"`
+	Memory    uint64 `json:"memory"` // used, KiB
+	DiskRead  int64  `json:"disk_read"`
+	DiskWrite int64  `json:"disk_write"`
+}
+
+func statsPath(id string) string {
+	return appvmHomesDir + "." + id + ".stats"
+}
+
+func sampleDomain(l *libvirt.Libvirt, d libvirt.Domain) (s statsSample, err error) {
+	_, _, _, vcpus, cpuTime, err := l.DomainGetInfo(d)
+	if err != nil {
+		return
+	}
+
+	s.Time = time.Now().Unix()
+	s.CPUTime = cpuTime
+	s.VCPUs = vcpus
+	s.Memory, _ = memoryUsed(l, d)
+	_, s.DiskRead, _, s.DiskWrite, _, _ = l.DomainBlockStats(d, "vda")
+	return
+}
+
+func loadStats(id string) (samples []statsSample, err error) {
+	f, err := os.Open(statsPath(id))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var s statsSample
+		if json.Unmarshal(scanner.Bytes(), &s) == nil {
+			samples = append(samples, s)
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+func appendStats(id string, s statsSample) (err error) {
+	samples, _ := loadStats(id)
+	samples = append(samples, s)
+	if len(samples) > statsKeep {
+		samples = samples[len(samples)-statsKeep:]
+	}
+
+	var out []byte
+	for _, s := range samples {
+		line, _ := json.Marshal(s)
+		out = append(append(out, line...), '\n')
+	}
+	return ioutil.WriteFile(statsPath(id), out, 0600)
+}
+
+func collectStats(l *libvirt.Libvirt) {
+	domains, err := l.Domains()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, d := range domains {
+		if !strings.HasPrefix(d.Name, "appvm_") || !isOwned(l, d) {
+			continue
+		}
+
+		s, err := sampleDomain(l, d)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		err = appendStats(d.Name[6:], s)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func sparkline(values []float64) string {
+	const bars = "▁▂▃▄▅▆▇█"
+
+	var max float64
+	for _, v := range values {
+		if v > max {
+			max = v
+		}
+	}
+
+	line := ""
+	for _, v := range values {
+		i := 0
+		if max > 0 && v > 0 {
+			i = int(v / max * 7)
+		}
+		line += string([]rune(bars)[i])
+	}
+	return line
+}
+
+// Values per interval between samples
+type statsSeries struct {
+	CPU   []float64 `json:"cpu"`   // percents of all vCPUs
+	Mem   []float64 `json:"mem"`   // MiB
+	Read  []float64 `json:"read"`  // KiB/s
+	Write []float64 `json:"write"` // KiB/s
+}
+
+func statsRates(samples []statsSample) (r statsSeries) {
+	for i := 1; i < len(samples); i++ {
+		prev, cur := samples[i-1], samples[i]
+		dt := float64(cur.Time - prev.Time)
+		if dt <= 0 || cur.CPUTime < prev.CPUTime {
+			continue // VM was restarted
+		}
+
+		cpu := float64(cur.CPUTime-prev.CPUTime) / 1e9 / dt * 100
+		if cur.VCPUs != 0 {
+			cpu /= float64(cur.VCPUs)
+		}
+
+		r.CPU = append(r.CPU, cpu)
+		r.Mem = append(r.Mem, float64(cur.Memory)/1024)
+		r.Read = append(r.Read, float64(cur.DiskRead-prev.DiskRead)/1024/dt)
+		r.Write = append(r.Write, float64(cur.DiskWrite-prev.DiskWrite)/1024/dt)
+	}
+	return
+}
+
+func lastValue(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	return values[len(values)-1]
+}
+
+func tailValues(values []float64, n int) []float64 {
+	if len(values) > n {
+		return values[len(values)-n:]
+	}
+	return values
+}
+
+func stats(name string, width int, asJSON bool) (err error) {
+	samples, err := loadStats(name)
+	if os.IsNotExist(err) {
+		err = fmt.Errorf("no statistics for %s, is appvm daemon running?",
+			name)
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	if asJSON {
+		return json.NewEncoder(os.Stdout).Encode(samples)
+	}
+
+	r := statsRates(samples)
+	fmt.Printf("CPU     %s %6.1f %%\n", sparkline(tailValues(r.CPU, width)), lastValue(r.CPU))
+	fmt.Printf("Memory  %s %6.0f MiB\n", sparkline(tailValues(r.Mem, width)), lastValue(r.Mem))
+	fmt.Printf("Read    %s %6.1f KiB/s\n", sparkline(tailValues(r.Read, width)), lastValue(r.Read))
+	fmt.Printf("Write   %s %6.1f KiB/s\n", sparkline(tailValues(r.Write, width)), lastValue(r.Write))
+	return
+}
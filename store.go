@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Guest store modes ("store" of the application or global default):
+//
+//   - "host" (default): host /nix/store over 9p
+//   - "image": closure of the system packed to an erofs image
+//     (system.build.appvmStore, see vm.nix), the guest sees only it
+//   - "verity": the same with dm-verity hash tree, the guest opens it in
+//     initrd with the root hash from the kernel command line
+//
+// Image is mounted as /nix/.ro-store, image and hash tree are
+// read-only disks. "verity": true is the same as "store": "verity".
+
+func storeMode(app appConfig) string {
+	if app.Store != "" {
+		return app.Store
+	}
+	if app.Verity {
+		return "verity"
+	}
+	if config, err := loadConfig(); err == nil && config.Store != "" {
+		return config.Store
+	}
+	return "host"
+}
+
+func checkStoreMode(app appConfig) (err error) {
+	switch mode := storeMode(app); mode {
+	case "host", "image", "verity":
+		return
+	default:
+		return errors.New("store must be host, image or verity, not " + mode)
+	}
+}
+
+func storeModule(app appConfig) string {
+	switch storeMode(app) {
+	case "image":
+		return fmt.Sprintf(storeImageModuleTmpl, false) +
+			fmt.Sprintf(storeMountTmpl, "/dev/disk/by-id/virtio-appvm-store")
+	case "verity":
+		return fmt.Sprintf(storeImageModuleTmpl, true) + verityModule +
+			fmt.Sprintf(storeMountTmpl, "/dev/mapper/appvm-store")
+	}
+	return ""
+}
+
+var storeImageModuleTmpl = `  system.build.appvmStore = pkgs.runCommand "appvm-store" {
+    nativeBuildInputs = [ pkgs.erofs-utils pkgs.cryptsetup ];
+    closure = pkgs.closureInfo { rootPaths = [ config.system.build.toplevel ]; };
+  } ''
+    mkdir -p $out root
+    xargs -a $closure/store-paths cp -a -t root
+    mkfs.erofs -T0 --all-root $out/store.img root
+    if [ %t = true ]; then
+      veritysetup format --root-hash-file=$out/roothash \
+        $out/store.img $out/store.verity
+    fi
+  '';
+  boot.initrd.availableKernelModules = [ "erofs" ];
+`
+
+var verityModule = `  boot.initrd.availableKernelModules = [ "dm_verity" ];
+  boot.initrd.extraUtilsCommands = ''
+    copy_bin_and_libs ${pkgs.cryptsetup}/bin/veritysetup
+  '';
+  boot.initrd.preLVMCommands = ''
+    roothash=$(sed -n 's/.*appvm\.roothash=\([0-9a-f]*\).*/\1/p' /proc/cmdline)
+    veritysetup open /dev/disk/by-id/virtio-appvm-store appvm-store \
+      /dev/disk/by-id/virtio-appvm-verity "$roothash"
+  '';
+`
+
+var storeMountTmpl = `  virtualisation.fileSystems."/nix/.ro-store" = lib.mkForce {
+    device = "%s";
+    fsType = "erofs";
+    options = [ "ro" ];
+    neededForBoot = true;
+  };
+`
+
+// Store image of the built system, empty for the host store
+func imageStore(system string) string {
+	b, ok := systemBootInfo(system)
+	if !ok || b.Store == "" || !fileExists(b.Store+"/store.img") {
+		return ""
+	}
+	return b.Store
+}
+
+func verityParams(store string) string {
+	if store == "" {
+		return ""
+	}
+	raw, err := ioutil.ReadFile(store + "/roothash")
+	if err != nil {
+		return ""
+	}
+	return " appvm.roothash=" + strings.TrimSpace(string(raw))
+}
+
+var hostStoreDevices = `
+    <filesystem type='mount' accessmode='passthrough'>
+      <source dir='/nix/store'/>
+      <target dir='nix-store'/>
+      <readonly/>
+    </filesystem>
+`
+
+var storeImageDevicesTmpl = `
+    <disk type='file' device='disk'>
+      <driver name='qemu' type='raw'/>
+      <source file='%s/store.img'/>
+      <target dev='vdb' bus='virtio'/>
+      <serial>appvm-store</serial>
+      <readonly/>
+    </disk>
+`
+
+var verityDevicesTmpl = `
+    <disk type='file' device='disk'>
+      <driver name='qemu' type='raw'/>
+      <source file='%s/store.verity'/>
+      <target dev='vdc' bus='virtio'/>
+      <serial>appvm-verity</serial>
+      <readonly/>
+    </disk>
+`
+
+func storeDevices(store string) (xml string) {
+	if store == "" {
+		return hostStoreDevices
+	}
+	xml = fmt.Sprintf(storeImageDevicesTmpl, xmlEscape(store))
+	if fileExists(store + "/store.verity") {
+		xml += fmt.Sprintf(verityDevicesTmpl, xmlEscape(store))
+	}
+	return
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// appvm drop moves data and state files of the application to
+// ~/appvm/.trash/<name>.<unix time>/, they can be restored by appvm
+// undrop during trashKeep and are removed by appvm gc after.
+
+const trashKeep = 7 * 24 * time.Hour
+
+func trashDir() string {
+	return appvmHomesDir + ".trash/"
+}
+
+func trashEntries(name string) (entries []string) {
+	all, _ := filepath.Glob(trashDir() + name + ".*")
+	for _, e := range all {
+		base := filepath.Base(e)
+		if strings.TrimSuffix(base, filepath.Ext(base)) == name {
+			entries = append(entries, e)
+		}
+	}
+	sort.Strings(entries)
+	return
+}
+
+func trashTime(entry string) (t time.Time, ok bool) {
+	ext := filepath.Ext(entry)
+	sec, err := strconv.ParseInt(strings.TrimPrefix(ext, "."), 10, 64)
+	if err != nil {
+		return
+	}
+	return time.Unix(sec, 0), true
+}
+
+func expiredTrash() (expired []string) {
+	entries, _ := filepath.Glob(trashDir() + "*")
+	for _, e := range entries {
+		if t, ok := trashTime(e); ok && time.Since(t) > trashKeep {
+			expired = append(expired, e)
+		}
+	}
+	return
+}
+
+// Removes defined but stopped domain left by other tools
+func undefineLeftover(l *libvirt.Libvirt, name string) (err error) {
+	dom, err := lookupOwned(l, "appvm_"+name)
+	if err != nil {
+		if libvirt.IsNotFound(err) {
+			return nil
+		}
+		return
+	}
+
+	state, _, err := l.DomainGetState(dom, 0)
+	if err != nil {
+		return
+	}
+	if libvirt.DomainState(state) != libvirt.DomainShutoff {
+		return errors.New(name + " is running, stop it first")
+	}
+	return l.DomainUndefine(dom)
+}
+
+func drop(l *libvirt.Libvirt, name string, yes bool) (err error) {
+	err = undefineLeftover(l, name)
+	if err != nil {
+		return
+	}
+
+	var paths []string
+	var size int64
+	for _, path := range appStatePaths(name) {
+		if _, e := os.Lstat(path); e == nil {
+			paths = append(paths, path)
+			size += pathSize(path)
+		}
+	}
+	if len(paths) == 0 {
+		return errors.New("no data for " + name)
+	}
+
+	if !yes && !confirm(fmt.Sprintf("Drop data of %s (%s)?",
+		name, humanSize(size))) {
+		return errors.New("not confirmed, use --yes")
+	}
+
+	entry := fmt.Sprintf("%s%s.%d/", trashDir(), name, time.Now().Unix())
+	for _, path := range paths {
+		dst := entry + strings.TrimPrefix(path, appvmHomesDir)
+		os.MkdirAll(filepath.Dir(strings.TrimSuffix(dst, "/")), 0700)
+		err = os.Rename(path, dst)
+		if err != nil {
+			return
+		}
+	}
+
+	// Generated on start
+	os.Remove(appvmHomesDir + "." + name + ".fake.qcow2")
+	sockets, _ := filepath.Glob(appvmHomesDir + ".appvm_" + name + ".*.sock")
+	for _, s := range sockets {
+		// Not of name.with.dots
+		if vmName, _ := socketVMName(filepath.Base(s)); vmName == "appvm_"+name {
+			os.Remove(s)
+		}
+	}
+
+	log.Printf("Moved to trash, appvm undrop %s restores in %v\n",
+		name, trashKeep)
+
+	for _, e := range expiredTrash() {
+		os.RemoveAll(e)
+	}
+	return
+}
+
+// Restores the last dropped data of the application
+func undrop(name string) (err error) {
+	entries := trashEntries(name)
+	if len(entries) == 0 {
+		return errors.New("nothing to restore for " + name)
+	}
+	entry := entries[len(entries)-1] + "/"
+
+	for _, path := range appStatePaths(name) {
+		src := entry + strings.TrimPrefix(path, appvmHomesDir)
+		if _, e := os.Lstat(src); e != nil {
+			continue
+		}
+		if _, e := os.Lstat(path); e == nil {
+			return errors.New(path + " already exists")
+		}
+	}
+
+	for _, path := range appStatePaths(name) {
+		src := entry + strings.TrimPrefix(path, appvmHomesDir)
+		if _, e := os.Lstat(src); e != nil {
+			continue
+		}
+		os.MkdirAll(filepath.Dir(strings.TrimSuffix(path, "/")), 0700)
+		err = os.Rename(src, path)
+		if err != nil {
+			return
+		}
+	}
+
+	reregisterGCRoot(name)
+	log.Println("Restored", name)
+	return os.RemoveAll(entry)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// Expressions are downloaded only from repos trusted by appvm trust add.
+// Hash of every downloaded expression is pinned on first use and a
+// changed expression is refused until the pin is revoked. Repos from
+// config.json are imported as trusted when trust.json does not exist.
+
+type trustedRepo struct {
+	Added time.Time `json:"added"`
+	Note  string    `json:"note,omitempty"`
+}
+
+type pinnedExpr struct {
+	SHA256 string    `json:"sha256"`
+	Pinned time.Time `json:"pinned"`
+}
+
+type trustStore struct {
+	Repos map[string]trustedRepo `json:"repos"`
+	// Expression URL -> hash
+	Pins map[string]pinnedExpr `json:"pins"`
+}
+
+func trustPath() string {
+	return configDir + "trust.json"
+}
+
+func loadTrust() (t trustStore, err error) {
+	t.Repos = make(map[string]trustedRepo)
+	t.Pins = make(map[string]pinnedExpr)
+
+	raw, err := ioutil.ReadFile(trustPath())
+	if os.IsNotExist(err) {
+		err = nil
+		config, _ := loadConfig()
+		for _, repo := range config.Repos {
+			t.Repos[strings.TrimSuffix(repo, "/")] = trustedRepo{
+				Added: time.Now(), Note: "imported from config.json"}
+		}
+		return
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(raw, &t)
+	return
+}
+
+func saveTrust(t trustStore) (err error) {
+	raw, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return
+	}
+	return ioutil.WriteFile(trustPath(), raw, 0600)
+}
+
+func isTrustedRepo(repo string) bool {
+	t, err := loadTrust()
+	if err != nil {
+		return false
+	}
+	_, ok := t.Repos[repo]
+	return ok
+}
+
+// Downloads expression from the repo and checks its pinned hash
+func fetchExpr(e appExpr) (err error) {
+	return fetchPinned(e.Layer.URL, e.URL, e.Path)
+}
+
+// Downloads file of the repo, pins its hash on first use and refuses
+// a changed one
+func fetchPinned(repo, url, to string) (err error) {
+	if !isTrustedRepo(repo) {
+		return withCategory("denied", errors.New(repo+
+			" is not trusted, see appvm trust add"))
+	}
+
+	tmp := to + ".part"
+	defer os.Remove(tmp)
+	err = download(url, tmp)
+	if err != nil {
+		return
+	}
+
+	sum := fileSHA256(tmp)
+
+	t, err := loadTrust()
+	if err != nil {
+		return
+	}
+	if pin, ok := t.Pins[url]; ok && pin.SHA256 != sum {
+		return fmt.Errorf("%s has changed (sha256:%s, pinned sha256:%s), "+
+			"see appvm trust revoke %s", url, sum, pin.SHA256, url)
+	} else if !ok {
+		t.Pins[url] = pinnedExpr{SHA256: sum, Pinned: time.Now()}
+		err = saveTrust(t)
+		if err != nil {
+			return
+		}
+	}
+	return os.Rename(tmp, to)
+}
+
+// Cached file of the repo is used only while the repo is trusted and
+// the file has the pinned hash
+func checkPinned(repo, url, path string) (err error) {
+	if !isTrustedRepo(repo) {
+		return withCategory("denied", errors.New(repo+
+			" is not trusted, see appvm trust add"))
+	}
+	t, err := loadTrust()
+	if err != nil {
+		return
+	}
+	pin, ok := t.Pins[url]
+	if !ok {
+		return withCategory("denied", errors.New(url+" is not pinned"))
+	}
+	if sum := fileSHA256(path); sum != pin.SHA256 {
+		return withCategory("denied", fmt.Errorf("%s is not the pinned "+
+			"%s (sha256:%s, pinned sha256:%s)", path, url, sum,
+			pin.SHA256))
+	}
+	return
+}
+
+func trustList() (err error) {
+	t, err := loadTrust()
+	if err != nil {
+		return
+	}
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+
+	repos := make(map[string]bool)
+	for repo := range t.Repos {
+		repos[repo] = true
+	}
+	for _, repo := range config.Repos {
+		repos[strings.TrimSuffix(repo, "/")] = true
+	}
+
+	var urls []string
+	for repo := range repos {
+		urls = append(urls, repo)
+	}
+	sort.Strings(urls)
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Repo", "Status", "Pins", "Added", "Note"})
+	for _, repo := range urls {
+		status, added := "untrusted", ""
+		r, trusted := t.Repos[repo]
+		if trusted {
+			status, added = "trusted", r.Added.Format("2006-01-02")
+		}
+		table.Append([]string{repo, status,
+			fmt.Sprint(len(repoPins(t, repo))), added, r.Note})
+	}
+	table.Render()
+	return
+}
+
+func repoPins(t trustStore, repo string) (urls []string) {
+	for url := range t.Pins {
+		if strings.HasPrefix(url, repo+"/") {
+			urls = append(urls, url)
+		}
+	}
+	sort.Strings(urls)
+	return
+}
+
+func trustAdd(repo, note string) (err error) {
+	repo = strings.TrimSuffix(repo, "/")
+	if !strings.HasPrefix(repo, "https://") &&
+		!strings.HasPrefix(repo, "http://") {
+		return errors.New("repo must be http(s):// URL")
+	}
+
+	t, err := loadTrust()
+	if err != nil {
+		return
+	}
+	t.Repos[repo] = trustedRepo{Added: time.Now(), Note: note}
+	err = saveTrust(t)
+	if err != nil {
+		return
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+	for _, r := range config.Repos {
+		if strings.TrimSuffix(r, "/") == repo {
+			return
+		}
+	}
+	config.Repos = append(config.Repos, repo)
+	return saveConfig(config)
+}
+
+// Repo URL revokes trust and all pins of the repo, expression URL only
+// the pin, so the changed expression is accepted on the next download
+func trustRevoke(url string) (err error) {
+	url = strings.TrimSuffix(url, "/")
+
+	t, err := loadTrust()
+	if err != nil {
+		return
+	}
+
+	if _, ok := t.Pins[url]; ok {
+		delete(t.Pins, url)
+		os.Remove(cachedPath(url))
+		return saveTrust(t)
+	}
+
+	if _, ok := t.Repos[url]; !ok {
+		return errors.New(url + " is not trusted")
+	}
+	delete(t.Repos, url)
+	for _, pin := range repoPins(t, url) {
+		delete(t.Pins, pin)
+	}
+	os.RemoveAll(repoCacheDir(url))
+	return saveTrust(t)
+}
+
+func trustInspect(repo string) (err error) {
+	repo = strings.TrimSuffix(repo, "/")
+
+	t, err := loadTrust()
+	if err != nil {
+		return
+	}
+
+	if r, ok := t.Repos[repo]; ok {
+		fmt.Println("Trusted since", r.Added.Format(time.RFC3339), r.Note)
+	} else {
+		fmt.Println("Not trusted")
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Expression", "SHA256", "Pinned"})
+	for _, url := range repoPins(t, repo) {
+		pin := t.Pins[url]
+		table.Append([]string{strings.TrimPrefix(url, repo+"/"),
+			pin.SHA256, pin.Pinned.Format("2006-01-02 15:04")})
+	}
+	table.Render()
+	return
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+	"golang.org/x/sys/unix"
+)
+
+// appvm ui is a terminal UI without dependencies: raw mode by termios,
+// drawing by ANSI escapes. Actions run appvm itself (as the daemon
+// API does), so they behave the same as on the command line and
+// failure of one does not break the UI.
+
+const uiTick = 2 * time.Second
+
+const uiHelp = "↑/↓ select  s start  x stop  a attach  i inspect  " +
+	"l start log  esc close  q quit"
+
+type uiRow struct {
+	Name    string
+	Running bool
+	// Percents of one host CPU since the previous refresh
+	CPU    float64
+	Memory uint64 // KiB
+	Health string
+	Build  *buildInfo
+}
+
+type uiState struct {
+	rows     []uiRow
+	selected int
+	// Output of inspect or log, shown instead of the builds pane
+	details []string
+	title   string
+	status  string
+	// CPU time (ns) of domains at the previous refresh
+	cpuTime map[string]uint64
+	sampled time.Time
+}
+
+func uiRawMode(fd int) (restore func(), err error) {
+	old, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return
+	}
+
+	raw := *old
+	raw.Lflag &^= unix.ICANON | unix.ECHO | unix.ISIG | unix.IEXTEN
+	raw.Iflag &^= unix.IXON | unix.ICRNL
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	err = unix.IoctlSetTermios(fd, unix.TCSETS, &raw)
+	if err != nil {
+		return
+	}
+
+	// Alternate screen, hidden cursor
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	restore = func() {
+		fmt.Print("\x1b[?25h\x1b[?1049l")
+		unix.IoctlSetTermios(fd, unix.TCSETS, old)
+	}
+	return
+}
+
+func uiSize(fd int) (width, height int) {
+	ws, err := unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ)
+	if err != nil || ws.Col == 0 {
+		return 80, 24
+	}
+	return int(ws.Col), int(ws.Row)
+}
+
+func uiKeys(keys chan<- string) {
+	buf := make([]byte, 16)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			close(keys)
+			return
+		}
+		keys <- string(buf[:n])
+	}
+}
+
+func (s *uiState) refresh(l *libvirt.Libvirt) {
+	// appNames exits on broken config.json, terminal would be left
+	// in raw mode
+	config, _ := loadConfig()
+
+	rows := make(map[string]*uiRow)
+	for _, name := range exprNames() {
+		rows[name] = &uiRow{Name: name}
+	}
+	for name, app := range config.Apps {
+		if app.Type == "image" {
+			rows[name] = &uiRow{Name: name}
+		}
+	}
+
+	now := time.Now()
+	cpuTime := make(map[string]uint64)
+	domains, err := l.Domains()
+	if err != nil {
+		s.status = "libvirt: " + err.Error()
+	}
+	for _, d := range domains {
+		if !strings.HasPrefix(d.Name, "appvm_") || !isOwned(l, d) {
+			continue
+		}
+		id := d.Name[6:]
+		r, ok := rows[id]
+		if !ok {
+			r = &uiRow{Name: id}
+			rows[id] = r
+		}
+		r.Running = true
+		r.Health = healthStatus(id, config.app(appNameFromDomain(d.Name)))
+		r.Memory, _ = memoryUsed(l, d)
+
+		_, _, _, _, t, err := l.DomainGetInfo(d)
+		if err != nil {
+			continue
+		}
+		cpuTime[id] = t
+		if prev, ok := s.cpuTime[id]; ok && t >= prev {
+			elapsed := now.Sub(s.sampled).Nanoseconds()
+			r.CPU = float64(t-prev) * 100 / float64(elapsed)
+		}
+	}
+	s.cpuTime, s.sampled = cpuTime, now
+
+	for _, b := range inflightBuilds() {
+		b := b
+		if r, ok := rows[b.Name]; ok {
+			r.Build = &b
+		}
+	}
+
+	s.rows = nil
+	for _, r := range rows {
+		s.rows = append(s.rows, *r)
+	}
+	// Running first
+	sort.Slice(s.rows, func(i, j int) bool {
+		if s.rows[i].Running != s.rows[j].Running {
+			return s.rows[i].Running
+		}
+		return s.rows[i].Name < s.rows[j].Name
+	})
+	if s.selected >= len(s.rows) {
+		s.selected = len(s.rows) - 1
+	}
+	if s.selected < 0 {
+		s.selected = 0
+	}
+}
+
+func uiTail(path string, n int) (lines []string) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	lines = strings.Split(strings.TrimRight(string(raw), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return
+}
+
+func uiCut(s string, width int) string {
+	s = strings.Replace(s, "\t", "    ", -1)
+	r := []rune(s)
+	if len(r) > width {
+		r = r[:width]
+	}
+	return string(r)
+}
+
+func (s *uiState) draw(width, height int) {
+	var b strings.Builder
+	line := func(format string, args ...interface{}) {
+		b.WriteString(uiCut(fmt.Sprintf(format, args...), width) +
+			"\x1b[K\r\n")
+	}
+
+	b.WriteString("\x1b[H")
+	line("\x1b[1m%-30s %-9s %6s %10s  %s\x1b[0m",
+		"APPLICATION VM", "STATE", "CPU", "MEMORY", "HEALTH")
+
+	// Half of the screen for the list, the rest for panes
+	listHeight := height/2 - 1
+	first := 0
+	if s.selected >= listHeight {
+		first = s.selected - listHeight + 1
+	}
+	for i := first; i < len(s.rows) && i < first+listHeight; i++ {
+		r := s.rows[i]
+		state, cpu, memory := "stopped", "", ""
+		if r.Running {
+			state = "running"
+			cpu = fmt.Sprintf("%.0f%%", r.CPU)
+			memory = humanSize(int64(r.Memory) * 1024)
+		}
+		if r.Build != nil {
+			state = "building"
+		}
+		mark := "  "
+		if i == s.selected {
+			mark = "\x1b[7m> "
+		}
+		line("%s%-28s %-9s %6s %10s  %s\x1b[0m", mark, r.Name, state, cpu,
+			memory, r.Health)
+	}
+	for i := len(s.rows) - first; i < listHeight; i++ {
+		line("")
+	}
+
+	paneHeight := height - listHeight - 4
+	var pane []string
+	if s.details != nil {
+		line("\x1b[1m%s\x1b[0m", s.title)
+		pane = s.details
+	} else {
+		line("\x1b[1mBuilds\x1b[0m")
+		for _, r := range s.rows {
+			if r.Build == nil {
+				continue
+			}
+			pane = append(pane, fmt.Sprintf("%s (pid %d, %s)", r.Name,
+				r.Build.Pid, time.Since(time.Unix(r.Build.Started, 0)).
+					Round(time.Second)))
+			for _, l := range uiTail(buildOutputPath(r.Name), 3) {
+				pane = append(pane, "    "+l)
+			}
+		}
+	}
+	if len(pane) > paneHeight {
+		pane = pane[len(pane)-paneHeight:]
+	}
+	for i := 0; i < paneHeight; i++ {
+		if i < len(pane) {
+			line("%s", pane[i])
+		} else {
+			line("")
+		}
+	}
+
+	line("\x1b[7m %s\x1b[0m", s.status)
+	b.WriteString("\x1b[2m" + uiCut(uiHelp, width) + "\x1b[0m\x1b[K")
+	fmt.Print(b.String())
+}
+
+func uiRun(args ...string) *exec.Cmd {
+	self, err := os.Executable()
+	if err != nil {
+		self = os.Args[0]
+	}
+	return exec.Command(self, args...)
+}
+
+// Start and attach are left running in background, output of start is
+// in the start log, see startLogPath
+func (s *uiState) action(key string) {
+	if len(s.rows) == 0 {
+		return
+	}
+	r := s.rows[s.selected]
+
+	switch key {
+	case "s":
+		if r.Running || r.Build != nil {
+			s.status = r.Name + " is already started"
+			return
+		}
+		logFile, err := os.Create(startLogPath(r.Name))
+		if err != nil {
+			s.status = err.Error()
+			return
+		}
+		command := uiRun("start", r.Name, "--quiet")
+		command.Stdout, command.Stderr = logFile, logFile
+		err = command.Start()
+		if err != nil {
+			logFile.Close()
+			s.status = err.Error()
+			return
+		}
+		go func() {
+			command.Wait()
+			logFile.Close()
+		}()
+		s.status = "Starting " + r.Name
+	case "x":
+		out, err := uiRun("stop", r.Name).CombinedOutput()
+		s.status = "Stopping " + r.Name
+		if err != nil {
+			s.status = strings.TrimSpace(string(out))
+		}
+	case "a":
+		command := uiRun("attach", r.Name)
+		err := command.Start()
+		if err != nil {
+			s.status = err.Error()
+			return
+		}
+		go command.Wait()
+		s.status = "Viewer of " + r.Name
+	case "i":
+		out, _ := uiRun("info", r.Name).CombinedOutput()
+		s.title = "Info of " + r.Name
+		s.details = strings.Split(strings.TrimRight(string(out), "\n"), "\n")
+	case "l":
+		s.title = "Start log of " + r.Name
+		s.details = uiTail(startLogPath(r.Name), 100)
+		if s.details == nil {
+			s.details = []string{"No start log"}
+		}
+	}
+}
+
+func ui(l *libvirt.Libvirt) (err error) {
+	fd := int(os.Stdin.Fd())
+	restore, err := uiRawMode(fd)
+	if err != nil {
+		return fmt.Errorf("terminal: %v", err)
+	}
+	defer restore()
+
+	keys := make(chan string)
+	go uiKeys(keys)
+
+	s := uiState{status: "appvm ui"}
+	s.refresh(l)
+
+	tick := time.NewTicker(uiTick)
+	defer tick.Stop()
+	for {
+		s.draw(uiSize(fd))
+
+		select {
+		case <-tick.C:
+			s.refresh(l)
+		case key, ok := <-keys:
+			if !ok {
+				return
+			}
+			switch key {
+			case "q", "\x03":
+				return
+			case "\x1b[A", "k":
+				if s.selected > 0 {
+					s.selected--
+				}
+			case "\x1b[B", "j":
+				if s.selected < len(s.rows)-1 {
+					s.selected++
+				}
+			case "\x1b":
+				s.details = nil
+			default:
+				s.action(key)
+				s.refresh(l)
+			}
+		}
+	}
+}
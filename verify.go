@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// appvm verify rebuilds the application with nix-store --check (the
+// VM derivation or, with --all, every derivation of the build closure)
+// or compares NAR hashes of the runtime closure with a binary cache or
+// store of another machine (e.g. ssh://builder), and writes the
+// attestation document. Closure hash is sha256 of sorted
+// "path narHash" lines, equal closures have equal hashes.
+
+type attestedPath struct {
+	Path    string `json:"path"`
+	NarHash string `json:"narHash"`
+}
+
+type attestation struct {
+	Name        string         `json:"name"`
+	Expression  string         `json:"expression"`
+	ExprSHA256  string         `json:"expression_sha256"`
+	Module      string         `json:"module_sha256"`
+	Derivation  string         `json:"derivation"`
+	Output      string         `json:"output"`
+	Method      string         `json:"method"`
+	Verified    bool           `json:"verified"`
+	Mismatches  []string       `json:"mismatches,omitempty"`
+	ClosureHash string         `json:"closure_sha256"`
+	Closure     []attestedPath `json:"closure"`
+	Host        string         `json:"host"`
+	Time        time.Time      `json:"time"`
+}
+
+func fileSHA256(path string) string {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(raw))
+}
+
+// Output of nix path-info --json is a list in old versions and an
+// object with paths as keys since nix 2.19
+func pathInfo(store string, paths ...string) (hashes map[string]string,
+	err error) {
+
+	args := []string{"path-info", "--json", "--recursive"}
+	if store != "" {
+		args = append(args, "--store", store)
+	}
+	command := exec.Command(nixBin("nix"), append(args, paths...)...)
+	var stderr strings.Builder
+	command.Stderr = &stderr
+	out, err := command.Output()
+	if err != nil {
+		err = fmt.Errorf("nix path-info %s: %v: %s", store, err,
+			strings.TrimSpace(stderr.String()))
+		return
+	}
+
+	hashes = make(map[string]string)
+	var list []attestedPath
+	if json.Unmarshal(out, &list) == nil {
+		for _, p := range list {
+			hashes[p.Path] = p.NarHash
+		}
+		return
+	}
+
+	var object map[string]*attestedPath
+	err = json.Unmarshal(out, &object)
+	for path, p := range object {
+		if p != nil {
+			hashes[path] = p.NarHash
+		}
+	}
+	return
+}
+
+func closureAttestation(hashes map[string]string) (closure []attestedPath,
+	sum string) {
+
+	var paths []string
+	for path := range hashes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	h := sha256.New()
+	for _, path := range paths {
+		closure = append(closure, attestedPath{path, hashes[path]})
+		fmt.Fprintf(h, "%s %s\n", path, hashes[path])
+	}
+	sum = fmt.Sprintf("%x", h.Sum(nil))
+	return
+}
+
+func rebuildCheck(drv string, all bool) (mismatches []string, err error) {
+	drvs := []string{drv}
+	if all {
+		out, err := run(nixBin("nix-store"), "--query", "--requisites", drv)
+		if err != nil {
+			return nil, err
+		}
+		drvs = nil
+		for _, p := range strings.Fields(out) {
+			if strings.HasSuffix(p, ".drv") {
+				drvs = append(drvs, p)
+			}
+		}
+	}
+
+	for _, d := range drvs {
+		log.Println("Rebuild", d)
+		_, err := run(nixBin("nix-store"), "--realise", "--check", d)
+		if err != nil {
+			if strings.Contains(err.Error(), "may not be deterministic") {
+				mismatches = append(mismatches, d)
+				continue
+			}
+			// Not built locally, nothing to compare with
+			if strings.Contains(err.Error(), "is not valid") {
+				continue
+			}
+			return nil, err
+		}
+	}
+	return
+}
+
+func verify(name, store string, all bool, output string) (err error) {
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+
+	drv, err := checkExpr(configDir, name, config.app(name).Arch)
+	if err != nil {
+		return
+	}
+
+	out, err := run(nixBin("nix-store"), "--realise", drv)
+	if err != nil {
+		return
+	}
+
+	hashes, err := pathInfo("", out)
+	if err != nil {
+		return
+	}
+
+	expr := nixConfigPath(configDir, name)
+	a := attestation{
+		Name:       name,
+		Expression: expr,
+		ExprSHA256: fileSHA256(expr),
+		Module:     fileSHA256(appModulePath(name)),
+		Derivation: drv,
+		Output:     out,
+		Time:       time.Now().UTC(),
+	}
+	a.Host, _ = os.Hostname()
+	a.Closure, a.ClosureHash = closureAttestation(hashes)
+
+	if store != "" {
+		a.Method = "store " + store
+		var remote map[string]string
+		remote, err = pathInfo(store, out)
+		if err != nil {
+			return
+		}
+		for _, p := range a.Closure {
+			if remote[p.Path] != p.NarHash {
+				a.Mismatches = append(a.Mismatches, p.Path)
+			}
+		}
+	} else {
+		a.Method = "rebuild"
+		if all {
+			a.Method = "rebuild all"
+		}
+		a.Mismatches, err = rebuildCheck(drv, all)
+		if err != nil {
+			return
+		}
+	}
+	a.Verified = len(a.Mismatches) == 0
+
+	raw, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return
+	}
+	raw = append(raw, '\n')
+	if output == "" {
+		_, err = os.Stdout.Write(raw)
+	} else {
+		err = ioutil.WriteFile(output, raw, 0644)
+	}
+	if err != nil {
+		return
+	}
+
+	if !a.Verified {
+		err = fmt.Errorf("%d paths differ: %s", len(a.Mismatches),
+			strings.Join(a.Mismatches, " "))
+	}
+	return
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// virt-viewer is run by the detached appvm viewer process that waits
+// for it and applies the per-app action when the window is closed:
+// "keep" (default), "pause" or "shutdown". Paused VM is resumed when
+// the viewer is opened again.
+
+func viewerURI() string {
+	uri := libvirtURIEnv()
+	if strings.Contains(uri, "://") {
+		return uri
+	}
+	return "qemu+unix:///system?socket=" + uri
+}
+
+func startViewer(vmName string) {
+	self, err := os.Executable()
+	if err != nil {
+		self = os.Args[0]
+	}
+
+	command := exec.Command(self, "viewer", vmName)
+	command.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = command.Start()
+	if err != nil {
+		log.Println("Can't start viewer:", err)
+		return
+	}
+	command.Process.Release()
+}
+
+// Viewer for already running application
+func attach(l *libvirt.Libvirt, name string) (err error) {
+	dom, err := runningDomain(l, name)
+	if err != nil {
+		return
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+	if graphicsType(config.app(appNameFromDomain(dom.Name))) == "none" {
+		return errors.New("no display, graphics type is none")
+	}
+
+	startViewer(dom.Name)
+	return
+}
+
+func superviseViewer(l *libvirt.Libvirt, vmName string) (err error) {
+	if !strings.HasPrefix(vmName, "appvm_") {
+		return errors.New("not an application VM: " + vmName)
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+	app := config.app(appNameFromDomain(vmName))
+
+	dom, err := lookupOwned(l, vmName)
+	if err != nil {
+		return
+	}
+
+	// Paused on the previous close of the window
+	state, _, err := l.DomainGetState(dom, 0)
+	if err == nil && libvirt.DomainState(state) == libvirt.DomainPaused {
+		l.DomainResume(dom)
+	}
+
+	if app.Viewer.Monitor != 0 {
+		err = setMonitorMapping(l, vmName, app.Viewer.Monitor)
+		if err != nil {
+			log.Println("Can't set monitor:", err)
+		}
+	}
+
+	command, vvFile, err := viewerCommand(l, vmName, app)
+	if err != nil {
+		return
+	}
+	command.Stdout = os.Stdout
+	command.Stderr = os.Stderr
+	command.Run()
+	if vvFile != "" {
+		os.Remove(vvFile) // if the viewer failed before reading it
+	}
+
+	dom, err = lookupOwned(l, vmName)
+	if err != nil {
+		return nil // VM is stopped
+	}
+
+	switch app.OnViewerExit {
+	case "", "keep":
+	case "pause":
+		err = l.DomainSuspend(dom)
+	case "shutdown":
+		stopped := vmName[6:]
+		ioutil.WriteFile(stoppedMarkPath(stopped), nil, 0600)
+		err = l.DomainShutdown(dom)
+	default:
+		err = errors.New("unknown on_viewer_exit " + app.OnViewerExit)
+	}
+	return
+}
+
+func viewerArgs(v viewerConfig) (args []string) {
+	if v.Fullscreen || v.Monitor != 0 {
+		args = append(args, "--full-screen")
+	}
+	if v.Kiosk {
+		args = append(args, "--kiosk", "--kiosk-quit", "on-disconnect")
+	}
+	if v.Zoom != 0 {
+		args = append(args, "--zoom", strconv.Itoa(v.Zoom))
+	}
+	return
+}
+
+func virtViewerSettingsPath() string {
+	return os.Getenv("HOME") + "/.config/virt-viewer/settings"
+}
+
+// Guest display 1 is shown on the host monitor, see "monitor-mapping"
+// in virt-viewer(1). Settings are grouped by domain UUID.
+func setMonitorMapping(l *libvirt.Libvirt, vmName string, monitor int) (err error) {
+	dom, err := lookupOwned(l, vmName)
+	if err != nil {
+		return
+	}
+
+	u := dom.UUID
+	group := fmt.Sprintf("[%x-%x-%x-%x-%x]", u[0:4], u[4:6], u[6:8],
+		u[8:10], u[10:])
+	mapping := fmt.Sprintf("monitor-mapping=1:%d", monitor)
+
+	raw, _ := ioutil.ReadFile(virtViewerSettingsPath())
+
+	var lines []string
+	inGroup, found := false, false
+	for _, line := range strings.Split(string(raw), "\n") {
+		if strings.HasPrefix(line, "[") {
+			if inGroup && !found {
+				lines = append(lines, mapping)
+				found = true
+			}
+			inGroup = line == group
+		}
+		if inGroup && strings.HasPrefix(line, "monitor-mapping=") {
+			line = mapping
+			found = true
+		}
+		lines = append(lines, line)
+	}
+	if !found {
+		if !inGroup {
+			lines = append(lines, group)
+		}
+		lines = append(lines, mapping)
+	}
+
+	content := strings.Trim(strings.Join(lines, "\n"), "\n") + "\n"
+	os.MkdirAll(filepath.Dir(virtViewerSettingsPath()), 0700)
+	return ioutil.WriteFile(virtViewerSettingsPath(), []byte(content), 0600)
+}
+
+// Options given to appvm start are remembered for the next starts
+func saveViewerConfig(name string, v viewerConfig, reset bool) (err error) {
+	if v == (viewerConfig{}) && !reset {
+		return
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+
+	app := config.app(name)
+	app.Viewer = v
+	config.setApp(name, app)
+	return saveConfig(config)
+}
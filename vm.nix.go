@@ -0,0 +1,44 @@
+package main
+
+// Wrapper around NixOS configuration of the application, output
+// contains appvm.json with boot parameters instead of the
+// run-nixos-vm script. Schema version is increased on incompatible
+// changes, see bootSchema. <appvm-app> is the module generated from
+// config.json, see appmodule.go. Other arguments are parameters of the
+// expression, see params.go.
+
+var vmNix = []byte(`
+{ system ? builtins.currentSystem, ... }@args:
+let
+  nixos = import <nixpkgs/nixos/lib/eval-config.nix> {
+    inherit system;
+    modules = [ <nixos-config> <appvm-app> ];
+    specialArgs.params = removeAttrs args [ "system" ];
+  };
+  inherit (nixos) config pkgs;
+  toplevel = config.system.build.toplevel;
+  # the same closure as in nixos/modules/virtualisation/qemu-vm.nix
+  regInfo = pkgs.closureInfo {
+    rootPaths = (config.virtualisation.additionalPaths or [ ]) ++ [ toplevel ];
+  };
+  metadata = builtins.toJSON {
+    schema = 1;
+    inherit toplevel;
+    kernel = "${toplevel}/kernel";
+    initrd = "${toplevel}/initrd";
+    regInfo = "${regInfo}/registration";
+    store = toString (config.system.build.appvmStore or "");
+  };
+in pkgs.runCommand "appvm-vm" {
+  inherit metadata;
+  passAsFile = [ "metadata" ];
+} ''
+  mkdir $out
+  ln -s ${toplevel} $out/system
+  cp $metadataPath $out/appvm.json
+''
+`)
+
+func vmNixPath() string {
+	return configDir + "vm.nix"
+}
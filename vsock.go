@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+
+	"github.com/digitalocean/go-libvirt"
+	"golang.org/x/sys/unix"
+)
+
+// RPC over vsock, served in the guest by appvm-rpc (see base.nix).
+// Does not depend on guest networking and is faster than the guest
+// agent channel. Every message is 4-byte big-endian length followed
+// by JSON, one response for every request.
+
+const (
+	vsockPort     = 5000
+	vsockFrameMax = 256 << 20
+)
+
+// Needs vhost_vsock on the host, CID is assigned by libvirt
+var vsockDevice = `
+    <vsock model='virtio'>
+      <cid auto='yes'/>
+    </vsock>
+`
+
+func vsockDevices(arch string) string {
+	if domainType(arch) != "kvm" || !fileExists("/dev/vhost-vsock") {
+		return ""
+	}
+	return vsockDevice
+}
+
+type rpcRequest struct {
+	Method  string   `json:"method"`
+	Args    []string `json:"args,omitempty"`
+	Path    string   `json:"path,omitempty"`
+	Data    []byte   `json:"data,omitempty"`
+	Message string   `json:"message,omitempty"`
+}
+
+type rpcResponse struct {
+	Error    string `json:"error,omitempty"`
+	Stdout   []byte `json:"stdout,omitempty"`
+	Stderr   []byte `json:"stderr,omitempty"`
+	ExitCode int    `json:"exitcode"`
+	Data     []byte `json:"data,omitempty"`
+}
+
+func writeFrame(w io.Writer, v interface{}) (err error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(raw)))
+	_, err = w.Write(append(header, raw...))
+	return
+}
+
+func readFrame(r io.Reader, v interface{}) (err error) {
+	header := make([]byte, 4)
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return
+	}
+
+	size := binary.BigEndian.Uint32(header)
+	if size > vsockFrameMax {
+		return fmt.Errorf("frame is too large (%d bytes)", size)
+	}
+
+	raw := make([]byte, size)
+	_, err = io.ReadFull(r, raw)
+	if err != nil {
+		return
+	}
+	return json.Unmarshal(raw, v)
+}
+
+var vsockCIDRe = regexp.MustCompile(`<cid auto='yes' address='(\d+)'/>`)
+
+func vsockCID(l *libvirt.Libvirt, dom libvirt.Domain) (cid uint32, err error) {
+	xml, err := l.DomainGetXMLDesc(dom, 0)
+	if err != nil {
+		return
+	}
+
+	m := vsockCIDRe.FindStringSubmatch(xml)
+	if m == nil {
+		err = errors.New("no vsock for " + dom.Name)
+		return
+	}
+
+	n, err := strconv.ParseUint(m[1], 10, 32)
+	cid = uint32(n)
+	return
+}
+
+func vsockDial(cid, port uint32) (f *os.File, err error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return
+	}
+
+	err = unix.Connect(fd, &unix.SockaddrVM{CID: cid, Port: port})
+	if err != nil {
+		unix.Close(fd)
+		return
+	}
+
+	f = os.NewFile(uintptr(fd), "vsock:"+strconv.Itoa(int(cid)))
+	return
+}
+
+func rpcCall(l *libvirt.Libvirt, name string, req rpcRequest) (
+	resp rpcResponse, err error) {
+
+	dom, err := runningDomain(l, name)
+	if err != nil {
+		return
+	}
+
+	cid, err := vsockCID(l, dom)
+	if err != nil {
+		return
+	}
+
+	conn, err := vsockDial(cid, vsockPort)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	err = writeFrame(conn, req)
+	if err != nil {
+		return
+	}
+
+	err = readFrame(conn, &resp)
+	if err != nil {
+		return
+	}
+
+	if resp.Error != "" {
+		err = errors.New(req.Method + ": " + resp.Error)
+	}
+	return
+}
+
+func rpcExec(l *libvirt.Libvirt, name string, args []string) (code int, err error) {
+	resp, err := rpcCall(l, name, rpcRequest{Method: "exec", Args: args})
+	if err != nil {
+		return
+	}
+	os.Stdout.Write(resp.Stdout)
+	os.Stderr.Write(resp.Stderr)
+	code = resp.ExitCode
+	return
+}
+
+func rpcPush(l *libvirt.Libvirt, name, src, dst string) (err error) {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return
+	}
+	_, err = rpcCall(l, name, rpcRequest{Method: "put", Path: dst, Data: data})
+	return
+}
+
+func rpcPull(l *libvirt.Libvirt, name, src, dst string) (err error) {
+	resp, err := rpcCall(l, name, rpcRequest{Method: "get", Path: src})
+	if err != nil {
+		return
+	}
+	// Crosses the VM boundary, so it is scanned
+	return importFile(resp.Data, dst)
+}
+
+func rpcNotify(l *libvirt.Libvirt, name, message string) (err error) {
+	_, err = rpcCall(l, name, rpcRequest{Method: "notify", Message: message})
+	return
+}
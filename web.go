@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// Web dashboard, requests to /api/ are passed to the API of appvm daemon
+// (appvm daemon --listen), so the same token is required. The API is
+// host:port, https://host:port or unix:<path>; the dashboard itself
+// is served on loopback only.
+
+var webUI = []byte(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>appvm</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { padding: 0.3em 1em; text-align: left; }
+tr.running td.state { color: green; }
+pre { background: #eee; padding: 1em; max-height: 20em; overflow: auto; }
+svg { background: #f8f8f8; }
+polyline { fill: none; stroke: #36c; }
+</style>
+</head>
+<body>
+<h1>appvm</h1>
+<p id="error"></p>
+<table>
+<thead><tr><th>Name</th><th>State</th><th></th><th>CPU</th><th>Memory</th></tr></thead>
+<tbody id="vms"></tbody>
+</table>
+<h2 id="logname"></h2>
+<pre id="log"></pre>
+<script>
+var token = localStorage.getItem("appvm-token");
+if (!token) {
+	token = prompt("Token from ~/.config/appvm/api.token");
+	localStorage.setItem("appvm-token", token);
+}
+
+var logged = "";
+
+function call(method, path, body) {
+	return fetch("/api/v1/" + path, {
+		method: method,
+		headers: {"Authorization": "Bearer " + token},
+		body: body
+	}).then(function(r) {
+		if (r.status == 401) {
+			localStorage.removeItem("appvm-token");
+		}
+		if (!r.ok) {
+			throw new Error(path + ": " + r.statusText);
+		}
+		return r;
+	});
+}
+
+function graph(values, max) {
+	var svg = document.createElementNS("http://www.w3.org/2000/svg", "svg");
+	svg.setAttribute("width", 120);
+	svg.setAttribute("height", 24);
+	var line = document.createElementNS("http://www.w3.org/2000/svg", "polyline");
+	var points = [];
+	max = max || Math.max.apply(null, values.concat([1]));
+	for (var i = 0; i < values.length; i++) {
+		points.push(i * 2 + "," + (24 - values[i] / max * 24));
+	}
+	line.setAttribute("points", points.join(" "));
+	svg.appendChild(line);
+	return svg;
+}
+
+function button(title, onclick) {
+	var b = document.createElement("button");
+	b.textContent = title;
+	b.onclick = onclick;
+	return b;
+}
+
+function cell(tr, content, cls) {
+	var td = document.createElement("td");
+	if (typeof content == "string") {
+		td.textContent = content;
+	} else if (content) {
+		td.appendChild(content);
+	}
+	if (cls) {
+		td.className = cls;
+	}
+	tr.appendChild(td);
+	return td;
+}
+
+function render(vms) {
+	var tbody = document.getElementById("vms");
+	tbody.innerHTML = "";
+	vms.forEach(function(vm) {
+		var tr = document.createElement("tr");
+		tr.className = vm.running ? "running" : "";
+		cell(tr, vm.description);
+		cell(tr, vm.running ? "running" : "stopped", "state");
+		cell(tr, vm.running ?
+			button("Stop", function() { call("POST", "vms/" + vm.name + "/stop"); }) :
+			button("Start", function() {
+				logged = vm.name;
+				call("POST", "vms/" + vm.name + "/start").catch(showError);
+			}));
+		var cpu = cell(tr), mem = cell(tr);
+		if (vm.running) {
+			call("GET", "vms/" + vm.name + "/stats").then(function(r) {
+				return r.json();
+			}).then(function(s) {
+				cpu.appendChild(graph(s.cpu || [], 100));
+				mem.appendChild(graph(s.mem || []));
+			}).catch(function() {});
+		}
+		tbody.appendChild(tr);
+	});
+}
+
+function showError(e) {
+	document.getElementById("error").textContent = e.message;
+}
+
+function refresh() {
+	call("GET", "vms").then(function(r) { return r.json(); }).
+		then(render).catch(showError);
+}
+
+function refreshLog() {
+	if (!logged) {
+		return;
+	}
+	document.getElementById("logname").textContent = "Start of " + logged;
+	call("GET", "vms/" + logged + "/log").then(function(r) {
+		return r.text();
+	}).then(function(text) {
+		document.getElementById("log").textContent = text;
+	}).catch(function() {});
+}
+
+// EventSource can not send the Authorization header
+function watchEvents() {
+	call("GET", "events").then(function(r) {
+		var reader = r.body.getReader();
+		function read() {
+			return reader.read().then(function(chunk) {
+				if (chunk.done) {
+					throw new Error("events: closed");
+				}
+				refresh();
+				return read();
+			});
+		}
+		return read();
+	}).catch(function() {
+		setTimeout(watchEvents, 5000);
+	});
+}
+watchEvents();
+
+refresh();
+setInterval(refresh, 60000);
+setInterval(refreshLog, 1000);
+</script>
+</body>
+</html>
+`)
+
+func web(listen, apiAddr string) {
+	ln, err := apiListener(listen, "", "")
+	if err != nil {
+		fatal(err)
+	}
+
+	var transport http.RoundTripper = http.DefaultTransport
+	switch {
+	case strings.HasPrefix(apiAddr, "unix:"):
+		socket := strings.TrimPrefix(apiAddr, "unix:")
+		transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn,
+				error) {
+
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+		apiAddr = "http://appvm"
+	case !strings.Contains(apiAddr, "://"):
+		apiAddr = "http://" + apiAddr
+	}
+
+	target, err := url.Parse(apiAddr)
+	if err != nil {
+		fatal(err)
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = transport
+	proxy.FlushInterval = -1 // events
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", proxy)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(webUI)
+	})
+
+	log.Println("Listen on", ln.Addr())
+	fatal(http.Serve(ln, mux))
+}
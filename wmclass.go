@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Viewer windows get WM_CLASS (and Wayland app_id, which GTK takes
+// from the program name) appvm-<name> and title "<name> (appvm)" by
+// GTK --class/--name and viewer --title, so window managers can match
+// them. vncviewer windows keep their own class.
+
+func viewerClass(name string, v viewerConfig) string {
+	if v.Class != "" {
+		return v.Class
+	}
+	return "appvm-" + name
+}
+
+func viewerTitle(name string, v viewerConfig) string {
+	if v.Title != "" {
+		return v.Title
+	}
+	return name + " (appvm)"
+}
+
+func viewerWindowArgs(name string, v viewerConfig) []string {
+	class := viewerClass(name, v)
+	return []string{"--class=" + class, "--name=" + class,
+		"--title", viewerTitle(name, v)}
+}
+
+// sway matches app_id of native Wayland windows and class of Xwayland
+// ones; i3 only has class. Hyprland matches class (app_id) and hides
+// windows of protected applications from screen capture.
+func wmRule(wm, name string, app appConfig) (rule string, err error) {
+	v := app.Viewer
+	class := viewerClass(name, v)
+	target := "workspace " + v.Workspace
+	if v.Workspace == "" {
+		target = "workspace <N>"
+	}
+
+	switch wm {
+	case "sway":
+		rule = fmt.Sprintf("assign [app_id=\"^%s$\"] %s\n"+
+			"assign [class=\"^%s$\"] %s", class, target, class, target)
+	case "i3":
+		rule = fmt.Sprintf("assign [class=\"^%s$\"] %s", class, target)
+	case "hyprland":
+		rule = fmt.Sprintf("windowrulev2 = %s, class:^(%s)$", target, class)
+	default:
+		err = errors.New("unknown window manager " + wm +
+			", use sway, i3 or hyprland")
+		return
+	}
+
+	if v.Workspace == "" {
+		rule = "# " + strings.ReplaceAll(rule, "\n", "\n# ")
+	}
+
+	if app.Protected {
+		if wm == "hyprland" {
+			rule += fmt.Sprintf("\nwindowrulev2 = noscreenshare, "+
+				"class:^(%s)$", class)
+		} else {
+			rule += "\n# " + name + " is protected, but " + wm +
+				" can not hide windows from screen capture"
+		}
+	}
+	return
+}
+
+// Rules for applications with workspace set, commented examples for the
+// others
+func wmRules(wm string, names []string) (err error) {
+	config, err := loadConfig()
+	if err != nil {
+		return
+	}
+
+	if len(names) == 0 {
+		names = exprNames()
+		for name, app := range config.Apps {
+			if app.Type == "image" {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+	}
+
+	fmt.Printf("# appvm rules for %s, add to the config\n", wm)
+	for _, name := range names {
+		rule, err := wmRule(wm, name, config.app(name))
+		if err != nil {
+			return err
+		}
+		fmt.Println(rule)
+	}
+	return
+}
@@ -1,29 +1,69 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 // You may think that you want to rewrite to proper golang structures.
 // Believe me, you shouldn't.
 
+// Additional directory exported to the guest
+type share struct {
+	Source   string
+	Tag      string
+	ReadOnly bool
+}
+
 func generateXML(vmName string, network networkModel, gui bool,
-	vmNixPath, reginfo, img, sharedDir string) string {
+	vmNixPath, reginfo, img, sharedDir string, shares []share,
+	app appConfig) string {
+
+	arch := app.Arch
 
 	devices := ""
 
 	if gui {
-		devices = guiDevices
+		devices = guiXML(app, guestArch(arch) != "x86_64")
+	}
+
+	devices += vsockDevices(arch)
+
+	for _, s := range shares {
+		devices += shareXML(s)
 	}
 
 	qemuParams := qemuParamsDefault
 
 	if network == networkQemu {
-		qemuParams = qemuParamsWithNetwork
+		qemuParams = fmt.Sprintf(qemuParamsWithNetwork, userNetdev())
+		if guestArch(arch) != "x86_64" {
+			qemuParams = fmt.Sprintf(qemuParamsWithNetworkVirtio,
+				userNetdev())
+		}
 	} else if network == networkLibvirt {
-		devices += netDevices
+		devices += libvirtNetDevices(appNameFromDomain(vmName), app)
 	}
+	devices += gatewayDevices(appNameFromDomain(vmName), app)
+	devices += profileDevices(app)
+
+	osType, features := archXML(arch)
+
+	store := imageStore(vmNixPath)
+	vmNixPath = xmlEscape(vmNixPath)
+	sharedDir = xmlEscape(sharedDir)
 
-	return fmt.Sprintf(xmlTmpl, vmName, vmNixPath, vmNixPath, vmNixPath,
-		reginfo, img, sharedDir, sharedDir, sharedDir, devices, qemuParams)
+	r := appResources(app)
+
+	return fmt.Sprintf(xmlTmpl, domainType(arch), xmlEscape(vmName),
+		ownerMetadata(), r.Memory, r.CurrentMemory, memoryBacking(app),
+		r.VCPUs, r.VCPUsMax, schedXML(app.Sched, r.VCPUsMax)+sandboxXML(strings.TrimPrefix(vmName, "appvm_"), app.Sandbox), osType,
+		vmNixPath, vmNixPath, vmNixPath, features,
+		xmlEscape(strings.TrimSpace(reginfo+" "+app.KernelParams+
+			verityParams(store))),
+		xmlEscape(img), storeDevices(store), sharedDir, sharedDir,
+		shareAccess(app.GuestUser), sharedDir,
+		guestChannelsXML(vmName), devices, qemuParams)
 }
 
 var qemuParamsDefault = `
@@ -37,47 +77,80 @@ var qemuParamsWithNetwork = `
     <qemu:arg value='-device'/>
     <qemu:arg value='e1000,netdev=net0'/>
     <qemu:arg value='-netdev'/>
-    <qemu:arg value='user,id=net0'/>
+    <qemu:arg value='%s'/>
+    <qemu:arg value='-snapshot'/>
+  </qemu:commandline>
+`
+
+var qemuParamsWithNetworkVirtio = `
+  <qemu:commandline>
+    <qemu:arg value='-device'/>
+    <qemu:arg value='virtio-net-pci,netdev=net0'/>
+    <qemu:arg value='-netdev'/>
+    <qemu:arg value='%s'/>
     <qemu:arg value='-snapshot'/>
   </qemu:commandline>
 `
 
 var netDevices = `
     <interface type='network'>
-      <source network='default'/>
+      <source network='%s'/>%s
     </interface>
 `
 
-var guiDevices = `
-    <!-- Graphical console -->
-    <graphics type='spice' autoport='yes'>
-      <listen type='address'/>
-      <image compression='off'/>
-    </graphics>
-    <!-- Guest additionals support -->
-    <channel type='spicevmc'>
-      <target type='virtio' name='com.redhat.spice.0'/>
+var shareTmpl = `
+    <filesystem type='mount' accessmode='mapped'>
+      <source dir='%s'/>
+      <target dir='%s'/>
+      %s
+    </filesystem>
+`
+
+var guestChannelTmpl = `
+    <channel type='unix'>
+      <source mode='bind' path='%s'/>
+      <target type='virtio' name='%s'/>
     </channel>
-    <video>
-      <model type='qxl' ram='524288' vram='524288' vgamem='262144' heads='1' primary='yes'/>
-      <address type='pci' domain='0x0000' bus='0x00' slot='0x02' function='0x0'/>
-    </video>
+`
+
+// Smartcard of the viewer host, see spiceServicesModule
+var smartcardDevices = `
+    <controller type='ccid' index='0'/>
+    <smartcard mode='passthrough' type='spicevmc'/>
+`
+
+// Folder sharing of the viewer (File -> Preferences -> Share folder),
+// served by spice-webdavd in the guest
+var webdavDevices = `
+    <channel type='spiceport'>
+      <source channel='org.spice-space.webdav.0'/>
+      <target type='virtio' name='org.spice-space.webdav.0'/>
+    </channel>
+`
+
+// USB devices (e.g. printers) redirected by the viewer
+var usbRedirDevices = `
+    <controller type='usb' model='qemu-xhci'/>
+    <redirdev bus='usb' type='spicevmc'/>
+    <redirdev bus='usb' type='spicevmc'/>
 `
 
 var xmlTmpl = `
-<domain type='kvm' xmlns:qemu='http://libvirt.org/schemas/domain/qemu/1.0'>
-  <name>%s</name>
-  <memory unit='GiB'>2</memory>
-  <currentMemory unit='GiB'>1</currentMemory>
-  <vcpu>4</vcpu>
+<domain type='%s' xmlns:qemu='http://libvirt.org/schemas/domain/qemu/1.0'>
+  <name>%s</name>%s
+  <memory unit='MiB'>%d</memory>
+  <currentMemory unit='MiB'>%d</currentMemory>
+  %s
+  <vcpu current='%d'>%d</vcpu>
+  %s
   <os>
-    <type arch='x86_64'>hvm</type>
+    %s
     <kernel>%s/kernel</kernel>
     <initrd>%s/initrd</initrd>
     <cmdline>loglevel=4 init=%s/init %s</cmdline>
   </os>
   <features>
-    <acpi></acpi>
+    %s
   </features>
   <clock offset='utc'/>
   <on_poweroff>destroy</on_poweroff>
@@ -91,11 +164,7 @@ var xmlTmpl = `
       <target dev='vda' bus='virtio'/>
     </disk>
     <!-- filesystems -->
-    <filesystem type='mount' accessmode='passthrough'>
-      <source dir='/nix/store'/>
-      <target dir='nix-store'/>
-      <readonly/>
-    </filesystem>
+    %s
     <filesystem type='mount' accessmode='mapped'>
       <source dir='%s'/>
       <target dir='xchg'/> <!-- workaround for nixpkgs/nixos/modules/virtualisation/qemu-vm.nix -->
@@ -104,10 +173,20 @@ var xmlTmpl = `
       <source dir='%s'/>
       <target dir='shared'/> <!-- workaround for nixpkgs/nixos/modules/virtualisation/qemu-vm.nix -->
     </filesystem>
-    <filesystem type='mount' accessmode='mapped'>
+    <filesystem type='mount' accessmode='%s'>
       <source dir='%s'/>
       <target dir='home'/>
     </filesystem>
+    <!-- Free pages are returned to the host -->
+    <memballoon model='virtio' autodeflate='on' freePageReporting='on'>
+      <stats period='5'/>
+    </memballoon>
+    <!-- Guest agent -->
+    <channel type='unix'>
+      <target type='virtio' name='org.qemu.guest_agent.0'/>
+    </channel>
+    <!-- Requests to appvm daemon -->
+    %s
     %s
   </devices>
   %s